@@ -1 +1,188 @@
-package bench
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"metal-db-proxy/internal/proxy"
+)
+
+// options configure a load test run.
+type options struct {
+	// Target is the MySQL server or proxy to load, connected to as User
+	// with Password, selecting Database.
+	Target   string
+	User     string
+	Password string
+	Database string
+	// Connections is the number of concurrent client connections, each
+	// running Query in a loop.
+	Connections int
+	Query       string
+	// QPS is the target rate across all connections; zero runs queries as
+	// fast as the connections allow.
+	QPS      float64
+	Duration time.Duration
+}
+
+// report summarises a run.
+type report struct {
+	Elapsed time.Duration
+	// Latencies of the queries that completed, in ascending order.
+	Latencies []time.Duration
+	// Errors counts queries the server answered with an error, by message.
+	// Connection failures are counted in ConnErrors.
+	Errors     map[string]int
+	ConnErrors int
+}
+
+// run loads the target for opts.Duration, or until ctx is done. Queries go
+// through the proxy's own client-side protocol code, the same the proxy
+// uses to talk to its backends, so the bench exercises those paths too.
+func run(ctx context.Context, opts options) (*report, error) {
+	if opts.Connections <= 0 {
+		return nil, fmt.Errorf("need at least one connection")
+	}
+	backend := proxy.NewBackend(proxy.BackendConfig{
+		Addr:     opts.Target,
+		User:     opts.User,
+		Password: opts.Password,
+		Database: opts.Database,
+	})
+
+	// Connect every client up front so the run measures queries alone.
+	conns := make([]*proxy.BackendConn, opts.Connections)
+	for i := range conns {
+		bc, err := backend.Pool().Get(ctx)
+		if err != nil {
+			for _, bc := range conns[:i] {
+				bc.Close()
+			}
+			return nil, fmt.Errorf("connect %s: %w", opts.Target, err)
+		}
+		conns[i] = bc
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	var tokens <-chan time.Time
+	if opts.QPS > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.QPS))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	var mu sync.Mutex
+	rep := &report{Errors: make(map[string]int)}
+	var wg sync.WaitGroup
+	started := time.Now()
+	for _, bc := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var latencies []time.Duration
+			errs := make(map[string]int)
+			connErrors := 0
+			for {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					break
+				}
+				if bc == nil {
+					var err error
+					if bc, err = backend.Pool().Get(ctx); err != nil {
+						if ctx.Err() == nil {
+							connErrors++
+						}
+						select {
+						case <-time.After(100 * time.Millisecond):
+						case <-ctx.Done():
+						}
+						continue
+					}
+				}
+				begin := time.Now()
+				err := bc.Query(opts.Query)
+				var sqlErr *proxy.SQLError
+				switch {
+				case err == nil:
+					latencies = append(latencies, time.Since(begin))
+				case errors.As(err, &sqlErr):
+					errs[sqlErr.Message]++
+				default:
+					connErrors++
+					bc.Close()
+					bc = nil
+				}
+			}
+			if bc != nil {
+				bc.Close()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			rep.Latencies = append(rep.Latencies, latencies...)
+			for msg, n := range errs {
+				rep.Errors[msg] += n
+			}
+			rep.ConnErrors += connErrors
+		}()
+	}
+	wg.Wait()
+	rep.Elapsed = time.Since(started)
+	slices.Sort(rep.Latencies)
+	return rep, nil
+}
+
+// percentile returns the latency below which fraction p of queries
+// completed.
+func (r *report) percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(r.Latencies)))
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// errorCount returns the number of failed queries.
+func (r *report) errorCount() int {
+	n := r.ConnErrors
+	for _, c := range r.Errors {
+		n += c
+	}
+	return n
+}
+
+// print writes the report to w.
+func (r *report) print(w io.Writer) {
+	secs := r.Elapsed.Seconds()
+	fmt.Fprintf(w, "queries:  %d in %s (%.1f/s)\n", len(r.Latencies), r.Elapsed.Round(time.Millisecond), float64(len(r.Latencies))/secs)
+	fmt.Fprintf(w, "errors:   %d\n", r.errorCount())
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(w, "latency:  min %s  p50 %s  p90 %s  p99 %s  max %s\n",
+			r.Latencies[0], r.percentile(0.50), r.percentile(0.90), r.percentile(0.99), r.Latencies[len(r.Latencies)-1])
+	}
+	if r.ConnErrors > 0 {
+		fmt.Fprintf(w, "  %d connection failures\n", r.ConnErrors)
+	}
+	msgs := make([]string, 0, len(r.Errors))
+	for msg := range r.Errors {
+		msgs = append(msgs, msg)
+	}
+	slices.Sort(msgs)
+	for _, msg := range msgs {
+		fmt.Fprintf(w, "  %d × %s\n", r.Errors[msg], msg)
+	}
+}
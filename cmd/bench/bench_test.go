@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"metal-db-proxy/internal/proxy"
+)
+
+// TestBenchStandaloneProxy runs a short load test against a proxy without
+// backends, which answers queries itself.
+func TestBenchStandaloneProxy(t *testing.T) {
+	srv, err := proxy.NewServer(proxy.Config{})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.Handle(conn)
+		}
+	}()
+
+	rep, err := run(context.Background(), options{
+		Target:      ln.Addr().String(),
+		User:        "root",
+		Password:    "password",
+		Connections: 4,
+		Query:       "SELECT 1",
+		QPS:         200,
+		Duration:    300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if n := rep.errorCount(); n != 0 {
+		t.Fatalf("%d queries failed: %v", n, rep.Errors)
+	}
+	// About 60 queries at 200 per second, allowing for a slow machine.
+	if n := len(rep.Latencies); n < 10 || n > 70 {
+		t.Fatalf("ran %d queries, want about 60", n)
+	}
+	if rep.percentile(0.5) > rep.percentile(0.99) {
+		t.Fatalf("p50 %s above p99 %s", rep.percentile(0.5), rep.percentile(0.99))
+	}
+	var out strings.Builder
+	rep.print(&out)
+	if !strings.Contains(out.String(), "p99") {
+		t.Fatalf("report lacks percentiles:\n%s", out.String())
+	}
+
+	if _, err := run(context.Background(), options{Target: ln.Addr().String(), User: "root", Password: "wrong", Connections: 1, Duration: time.Second}); err == nil {
+		t.Fatalf("run succeeded with a wrong password")
+	}
+}
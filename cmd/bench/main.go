@@ -0,0 +1,39 @@
+// Command bench load tests a MySQL server or the proxy in front of one: it
+// opens concurrent connections, runs a query on each at a target rate and
+// reports latency percentiles and errors.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.Target, "target", "127.0.0.1:3306", "address of the server or proxy to load (host:port)")
+	flag.StringVar(&opts.User, "user", "root", "user to connect as")
+	flag.StringVar(&opts.Password, "password", "", "password of -user")
+	flag.StringVar(&opts.Database, "db", "", "database to select")
+	flag.IntVar(&opts.Connections, "connections", 10, "concurrent connections")
+	flag.StringVar(&opts.Query, "query", "SELECT 1", "query each connection runs")
+	flag.Float64Var(&opts.QPS, "qps", 0, "target queries per second across all connections; 0 runs them as fast as possible")
+	flag.DurationVar(&opts.Duration, "duration", 10*time.Second, "how long to run")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	rep, err := run(ctx, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bench:", err)
+		os.Exit(1)
+	}
+	rep.print(os.Stdout)
+	if rep.errorCount() > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultListenAddr is the client listen address when none is configured.
+const defaultListenAddr = ":3306"
+
+// listenAddrEnv overrides the listen address of the -config file.
+const listenAddrEnv = "METAL_LISTEN_ADDR"
+
+// fileConfig is the YAML file named by -config.
+type fileConfig struct {
+	// Listen is the client listen address: host:port, or unix:PATH for a
+	// Unix socket.
+	Listen string `yaml:"listen"`
+}
+
+// loadFileConfig reads the YAML file at path; an empty path is an empty
+// configuration. Unknown keys are rejected so a misspelt one is not ignored.
+func loadFileConfig(path string) (fileConfig, error) {
+	var fc fileConfig
+	if path == "" {
+		return fc, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fc, fmt.Errorf("read config: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return fc, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return fc, nil
+}
+
+// listenAddr is the client listen address: METAL_LISTEN_ADDR, then the
+// config file's listen, then :3306.
+func (fc fileConfig) listenAddr() string {
+	if addr := os.Getenv(listenAddrEnv); addr != "" {
+		return addr
+	}
+	if fc.Listen != "" {
+		return fc.Listen
+	}
+	return defaultListenAddr
+}
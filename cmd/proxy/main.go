@@ -2,14 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"metal-db-proxy/internal/buildinfo"
 	"metal-db-proxy/internal/proxy"
 )
 
@@ -21,22 +32,452 @@ func init() {
 }
 
 func main() {
-	listener, err := net.Listen("tcp", ":3306")
+	backendAddr := flag.String("backend", "", "upstream MySQL address (host:port); empty answers queries locally")
+	backendUser := flag.String("backend-user", "root", "user for backend connections")
+	backendPassword := flag.String("backend-password", "", "password for backend connections")
+	backendDB := flag.String("backend-db", "", "default database for backend connections")
+	backendKeepAlive := flag.Duration("backend-keepalive", 0, "ping idle pooled backend connections unused this long; keep it below the backend's wait_timeout; 0 disables")
+	backendMaxIdle := flag.Int("backend-max-idle", 4, "idle connections kept in the backend pool")
+	backendCheckIdle := flag.Duration("backend-check-idle", time.Second, "ping an idle pooled backend connection unused this long before handing it out; 0 disables")
+	backendMaxIdleTime := flag.Duration("backend-max-idle-time", 0, "close idle pooled backend connections unused longer than this instead of handing them out; 0 keeps them")
+	backendReadTimeout := flag.Duration("backend-read-timeout", 0, "max wait for each backend response packet; 0 disables")
+	backendWriteTimeout := flag.Duration("backend-write-timeout", 30*time.Second, "max time to write a command to a backend; 0 disables")
+	backendKillGrace := flag.Duration("backend-kill-grace", 5*time.Second, "close a backend connection whose query, killed after its client disconnected, has not ended this long after the KILL; 0 waits indefinitely")
+	backendTLS := flag.Bool("backend-tls", false, "use TLS for connections to the backends, independently of client connections")
+	backendTLSCA := flag.String("backend-tls-ca", "", "PEM file of CAs trusted to sign backend certificates; system roots when empty")
+	backendTLSCert := flag.String("backend-tls-cert", "", "PEM client certificate presented to the backends")
+	backendTLSKey := flag.String("backend-tls-key", "", "PEM key of -backend-tls-cert")
+	backendTLSMinVersion := flag.String("backend-tls-min-version", "1.2", "oldest TLS version accepted from the backends: 1.2 or 1.3")
+	backendTLSCiphers := flag.String("backend-tls-ciphers", "", "comma-separated TLS 1.2 cipher suites accepted from the backends; all secure suites when empty")
+	backendTLSVerify := flag.String("backend-tls-verify", string(proxy.TLSVerifyFull), "backend certificate verification: verify-full, verify-ca or skip-verify")
+	configPath := flag.String("config", "", "YAML file setting the client listen address (listen: host:port or unix:PATH); the METAL_LISTEN_ADDR environment variable overrides it; :3306 when neither is set")
+	adminAddr := flag.String("admin-addr", ":8080", "address for the /healthz, /readyz and /metrics HTTP endpoints; empty disables")
+	handshakeTimeout := flag.Duration("handshake-timeout", 10*time.Second, "disconnect clients that have not authenticated this long after connecting; 0 disables")
+	idleTimeout := flag.Duration("idle-timeout", 0, "disconnect clients that send no command for this long, and report it to them as wait_timeout; 0 disables")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "after a hot restart (SIGUSR2), how long the old process waits for its connections to finish")
+	reusePort := flag.Bool("reuseport", false, "set SO_REUSEPORT so several proxy processes can share the listen port (Linux balances connections between them)")
+	maxPacketMemory := flag.Int64("max-packet-memory", 0, "cap in bytes on client packet buffers across all connections; 0 is unlimited")
+	maxResultBytes := flag.Int64("max-result-bytes", 0, "cut off a response relayed to a client after this many bytes with an error; 0 is unlimited")
+	deadlockRetries := flag.Int("deadlock-retries", 0, "replay a client transaction up to this many times after a deadlock or lock wait timeout; 0 disables")
+	replayBufferBytes := flag.Int64("replay-buffer-bytes", 1<<20, "largest transaction, in bytes of queries, buffered for -deadlock-retries; 0 means no limit")
+	maxTransactionTime := flag.Duration("max-transaction-time", 0, "roll back a client transaction open longer than this at its next statement; 0 is unlimited")
+	keepAliveIdle := flag.Duration("keepalive-idle", 30*time.Second, "idle time before TCP keepalive probes on client connections; 0 disables keepalive")
+	keepAliveInterval := flag.Duration("keepalive-interval", 10*time.Second, "interval between TCP keepalive probes")
+	keepAliveCount := flag.Int("keepalive-count", 6, "unanswered TCP keepalive probes before the connection is dropped")
+	sndBuf := flag.Int("sndbuf", 0, "SO_SNDBUF in bytes for client connections; 0 keeps the OS default")
+	rcvBuf := flag.Int("rcvbuf", 0, "SO_RCVBUF in bytes for client connections; 0 keeps the OS default")
+	backendSndBuf := flag.Int("backend-sndbuf", 0, "SO_SNDBUF in bytes for backend connections; 0 keeps the OS default")
+	backendRcvBuf := flag.Int("backend-rcvbuf", 0, "SO_RCVBUF in bytes for backend connections; 0 keeps the OS default")
+	maxJoins := flag.Int("max-joins", 0, "reject queries with more JOINs than this; 0 disables")
+	maxSubqueryDepth := flag.Int("max-subquery-depth", 0, "reject queries with subqueries nested deeper than this; 0 disables")
+	rejectCartesian := flag.Bool("reject-cartesian", false, "reject SELECTs over several tables without a join condition or WHERE clause")
+	transparentAuth := flag.Bool("transparent-auth", false, "authenticate clients directly against the default backend with their own credentials, giving each client a dedicated backend connection")
+	jitterMax := flag.Duration("reconnect-jitter", 0, "delay the greeting of new clients by up to this much during reconnect herds; 0 disables (max 5s)")
+	jitterWindow := flag.Duration("reconnect-jitter-window", 30*time.Second, "how long after a backend recovers new connections are jittered")
+	jitterRate := flag.Int("reconnect-jitter-rate", 0, "jitter new connections while more than this many arrive per second; 0 disables")
+	shedConns := flag.Int("shed-connections", 0, "reject new clients with error 1040 while more than this many are connected; 0 disables")
+	shedQueries := flag.Int("shed-in-flight", 0, "reject new clients with error 1040 while more than this many commands are executing; 0 disables")
+	connRate := flag.Float64("connection-rate", 0, "new connections accepted per second from all clients; excess ones are closed without a handshake; 0 disables")
+	connBurst := flag.Int("connection-burst", 0, "new connections that may arrive at once under -connection-rate (default one second's worth)")
+	sourceConnRate := flag.Float64("source-connection-rate", 0, "new connections accepted per second from each client address; 0 disables")
+	sourceConnBurst := flag.Int("source-connection-burst", 0, "new connections that may arrive at once from one address under -source-connection-rate (default one second's worth)")
+	queryCacheSize := flag.Int("query-cache-size", 4096, "number of query fingerprints whose classification is cached; 0 disables the cache")
+	resultCacheBytes := flag.Int64("result-cache-bytes", 0, "memory for caching the result sets of plain SELECT queries; 0 disables the cache")
+	resultCacheTTL := flag.Duration("result-cache-ttl", 10*time.Second, "how long a cached result set is served, regardless of writes since")
+	resultCacheCompress := flag.Int("result-cache-compress-above", 16<<10, "store cached result sets larger than this many bytes zstd compressed; 0 never compresses")
+	maxPreparedStatements := flag.Int("max-prepared-statements", 1024, "most statements a client may have prepared at once; 0 means no limit")
+	maxLongData := flag.Int64("max-long-data-bytes", 64<<20, "most parameter data a client may stream to one prepared statement execution; 0 means no limit")
+	stripComments := flag.Bool("strip-comments", false, "remove comments from queries before forwarding them, keeping optimizer hints")
+	compression := flag.Bool("compression", false, "offer the zlib compressed protocol to clients")
+	usersFile := flag.String("users-file", "", "file of user:hash lines, hash being the hex SHA1(SHA1(password)) of mysql_native_password, authenticating clients; empty accepts any user with the password \"password\"")
+	authFailOpen := flag.Bool("auth-fail-open", false, "let clients in without a password check when the authentication provider fails to look them up, rather than deny them; never applies to -admin-user")
+	authPlugin := flag.String("auth-plugin", "mysql_native_password", "authentication method offered to clients: mysql_native_password or caching_sha2_password; mysql_native_password is always accepted")
+	authRSAKey := flag.String("auth-rsa-key", "", "PEM RSA private key clients encrypt their password with for caching_sha2_password over unencrypted connections; generated at startup when empty")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate offered to clients that ask for TLS; empty refuses TLS")
+	tlsKey := flag.String("tls-key", "", "PEM key of -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "oldest TLS version accepted from clients: 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma-separated TLS 1.2 cipher suites accepted from clients; all secure suites when empty")
+	tlsRequired := flag.Bool("tls-required", false, "deny clients that do not switch to TLS; needs -tls-cert")
+	backendCompression := flag.Bool("backend-compression", false, "use the zlib compressed protocol to backends that offer it, independently of -compression")
+	charsetMismatch := flag.String("charset-mismatch", "", "on relayed text columns in a character set other than the client's: pass, warn or transcode (utf8mb4, utf8mb3, latin1 and ascii); all count a metric; empty disables the check")
+	serverVersion := flag.String("server-version", "", "server version advertised to clients (default the proxy's own)")
+	adminUser := flag.String("admin-user", "", "user allowed to run PROXY commands such as PROXY SHOW CONNECTIONS and PROXY KILL; needs -users-file or -transparent-auth so its password is checked")
+	tagVariable := flag.String("tag-variable", "proxy_tag", "proxy variable clients label their connection with, as in SET @@proxy_tag = 'job-42', shown by PROXY SHOW CONNECTIONS and in logs; empty disables")
+	probeVersion := flag.Bool("probe-backend-version", false, "advertise the default backend's server version, suffixed -metal, once it has been reached")
+	allowPipelining := flag.Bool("allow-pipelining", false, "run commands clients send before the previous response is complete instead of rejecting them")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "export a trace span per query over OTLP/HTTP to this host:port; empty disables tracing")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "send OTLP traces over plain HTTP")
+	queryLog := flag.String("query-log", "", "write every client query as JSON Lines to this file; empty disables")
+	queryLogMaxSize := flag.Int64("query-log-max-size", 100, "size in MiB at which the query log is rotated; 0 disables rotation")
+	queryLogMaxBackups := flag.Int("query-log-max-backups", 10, "rotated query log files to keep; 0 keeps all")
+	queryLogMaxAge := flag.Duration("query-log-max-age", 7*24*time.Hour, "remove rotated query log files older than this; 0 disables")
+	sqlScript := flag.String("sql-script", "", "append every statement clients run successfully to this file as a replayable SQL script, or - for stdout; empty disables")
+	var metricTags listFlag
+	flag.Var(&metricTags, "metric-tag", "sqlcommenter tag, such as controller, to count queries by (repeatable)")
+	var pingQueries listFlag
+	flag.Var(&pingQueries, "ping-query", "validation query such as 'SELECT 1' answered by the proxy outside transactions (repeatable)")
+	var standalone standaloneFlag
+	flag.Var(&standalone, "standalone-response", "without -backend, answer queries matching REGEXP with an OK as ROWS,INSERT_ID:REGEXP (repeatable, first match wins)")
+	var schema schemaFlag
+	flag.Var(&schema, "standalone-table", "without -backend, report a table in information_schema as DB.TABLE=COLUMN TYPE[,COLUMN TYPE] (repeatable)")
+	standaloneColumns := flag.String("standalone-select-columns", "", "without -backend, answer SELECT and SHOW statements matching no -standalone-response with an empty result set of these columns, as COLUMN TYPE[,COLUMN TYPE]")
+	standaloneError := flag.String("standalone-select-error", "", "without -backend, answer SELECT and SHOW statements matching no -standalone-response with an error carrying this message")
+	var capOverrides capabilityFlag
+	flag.Var(&capOverrides, "disable-capability", "withhold capabilities such as compress or ssl from clients in a source range, as CIDR=NAME[,NAME]; IPv6 and single addresses are accepted (repeatable)")
+	var listeners listenerFlag
+	flag.Var(&listeners, "listener", "accept clients on another address with their own greeting, as NAME=ADDR[;disable=NAME[,NAME]][;version=VERSION][;tls=require][;auth=PLUGIN], where tls=require needs -tls-cert (repeatable)")
+	var maskColumns, maskExempt listFlag
+	flag.Var(&maskColumns, "mask-column", "mask result columns matching a LIKE pattern, keeping the last KEEP characters, as PATTERN[:KEEP] (repeatable)")
+	flag.Var(&maskExempt, "mask-exempt", "user who sees masked columns unmasked (repeatable)")
+	var columnTypes, columnTypeUsers listFlag
+	flag.Var(&columnTypes, "column-type", "advertise relayed columns of type FROM as type TO, optionally only those matching a LIKE pattern, as [PATTERN:]FROM=TO such as BIGINT=INT (repeatable)")
+	flag.Var(&columnTypeUsers, "column-type-user", "user the -column-type rules apply to; all users when unset (repeatable)")
+	defaultDatabases := userDatabaseFlag{}
+	flag.Var(defaultDatabases, "default-database", "select a database for a user who connects without one, as user=db (repeatable)")
+	sessionVariables := variableFlag{}
+	flag.Var(sessionVariables, "session-variable", "report a system variable as set to clients that track session state, in the OK completing their authentication, as name=value (repeatable)")
+	userResultBytes := userBytesFlag{}
+	flag.Var(userResultBytes, "user-max-result-bytes", "override -max-result-bytes for a user, as user=bytes (repeatable)")
+	userTransactionTime := userDurationFlag{}
+	flag.Var(userTransactionTime, "user-max-transaction-time", "override -max-transaction-time for a user, as user=duration (repeatable)")
+	var allowStatements, denyStatements listFlag
+	flag.Var(&allowStatements, "allow-statement", "permit only statements of this type, such as select, insert, ddl or set (repeatable)")
+	flag.Var(&denyStatements, "deny-statement", "refuse statements of this type (repeatable)")
+	userAllowStatements, userDenyStatements := userListFlag{}, userListFlag{}
+	flag.Var(userAllowStatements, "user-allow-statement", "permit a user only these statement types, in place of -allow-statement and -deny-statement, as user=TYPE[,TYPE]; user= exempts the user from them (repeatable)")
+	flag.Var(userDenyStatements, "user-deny-statement", "refuse a user these statement types, in place of -allow-statement and -deny-statement, as user=TYPE[,TYPE] (repeatable)")
+	routes := routeFlag{}
+	flag.Var(routes, "route", "route a database to another backend as db=host:port (repeatable)")
+	tenantPattern := flag.String("tenant-pattern", "", "regexp whose group named tenant, or first group, extracts a client's tenant from its user name, such as ^([^.]+)\\.")
+	requireTenant := flag.Bool("require-tenant", false, "reject commands from clients whose user name yields no tenant under -tenant-pattern")
+	tenantRoutes := routeFlag{}
+	flag.Var(tenantRoutes, "tenant-route", "route a tenant to another backend as tenant=host:port, ahead of -route (repeatable)")
+	flag.Parse()
+
+	fileCfg, err := loadFileConfig(*configPath)
+	if err != nil {
+		logger.WithError(err).Fatal("invalid configuration")
+	}
+	listenAddr := fileCfg.listenAddr()
+
+	userStatementRules := make(map[string]proxy.StatementRules)
+	for user, types := range userAllowStatements {
+		rules := userStatementRules[user]
+		rules.Allow = statementTypes(types)
+		userStatementRules[user] = rules
+	}
+	for user, types := range userDenyStatements {
+		rules := userStatementRules[user]
+		rules.Deny = statementTypes(types)
+		userStatementRules[user] = rules
+	}
+
+	var standaloneSelect proxy.StandaloneSelect
+	if *standaloneColumns != "" {
+		cols, err := parseSchemaColumns(*standaloneColumns)
+		if err != nil {
+			logger.Fatalf("-standalone-select-columns: %v", err)
+		}
+		standaloneSelect.Columns = cols
+	}
+	if *standaloneError != "" {
+		standaloneSelect.Error = &proxy.SQLError{Code: 1105, SQLState: "HY000", Message: *standaloneError}
+	}
+
+	cfg := proxy.Config{
+		MaxPacketMemory:     *maxPacketMemory,
+		StandaloneResponses: standalone,
+		StandaloneSchema:    schema,
+		StandaloneSelect:    standaloneSelect,
+		TransparentAuth:     *transparentAuth,
+		HandshakeTimeout:    *handshakeTimeout,
+		IdleTimeout:         *idleTimeout,
+		StripComments:       *stripComments,
+		CapabilityOverrides: capOverrides,
+		ListenerProfiles:    listeners.profiles(),
+		DefaultDatabases:    defaultDatabases,
+		QueryCacheSize:      *queryCacheSize,
+		AllowPipelining:     *allowPipelining,
+		Compression:         *compression,
+		LoadShedding: proxy.LoadShedding{
+			MaxConnections:     *shedConns,
+			MaxInFlightQueries: *shedQueries,
+		},
+		ConnectionRateLimit: proxy.ConnectionRateLimit{
+			Rate:           *connRate,
+			Burst:          *connBurst,
+			PerSourceRate:  *sourceConnRate,
+			PerSourceBurst: *sourceConnBurst,
+		},
+		MaxPreparedStatements: *maxPreparedStatements,
+		MaxLongDataBytes:      *maxLongData,
+		MaxResultBytes:        *maxResultBytes,
+		UserMaxResultBytes:    userResultBytes,
+		AdminUser:             *adminUser,
+		ServerVersion:         *serverVersion,
+		ProbeBackendVersion:   *probeVersion,
+		ReconnectJitter: proxy.ReconnectJitter{
+			Max:    *jitterMax,
+			Window: *jitterWindow,
+			Rate:   *jitterRate,
+		},
+		PingQueries:   pingQueries,
+		MetricTags:    metricTags,
+		SocketBuffers: proxy.SocketBuffers{Send: *sndBuf, Receive: *rcvBuf},
+		Complexity: proxy.ComplexityLimits{
+			MaxJoins:         *maxJoins,
+			MaxSubqueryDepth: *maxSubqueryDepth,
+			RejectCartesian:  *rejectCartesian,
+		},
+		KeepAlive: net.KeepAliveConfig{
+			Enable:   *keepAliveIdle > 0,
+			Idle:     *keepAliveIdle,
+			Interval: *keepAliveInterval,
+			Count:    *keepAliveCount,
+		},
+
+		MaxTransactionTime:     *maxTransactionTime,
+		UserMaxTransactionTime: userTransactionTime,
+		StatementRules:         proxy.StatementRules{Allow: statementTypes(allowStatements), Deny: statementTypes(denyStatements)},
+		UserStatementRules:     userStatementRules,
+		SessionVariables:       sessionVariables,
+		DeadlockRetries:        *deadlockRetries,
+		ReplayBufferBytes:      *replayBufferBytes,
+
+		Script: *sqlScript,
+
+		TenantPattern: *tenantPattern,
+		RequireTenant: *requireTenant,
+
+		CharsetMismatch: proxy.CharsetMismatchMode(*charsetMismatch),
+		TagVariable:     *tagVariable,
+	}
+	for _, m := range maskColumns {
+		rule := proxy.MaskingRule{Column: m, Exempt: maskExempt}
+		if pattern, keep, ok := strings.Cut(m, ":"); ok {
+			n, err := strconv.Atoi(keep)
+			if err != nil || n < 0 {
+				logger.Fatalf("-mask-column %q: invalid number of characters to keep", m)
+			}
+			rule.Column, rule.KeepLast = pattern, n
+		}
+		cfg.MaskingRules = append(cfg.MaskingRules, rule)
+	}
+	for _, ct := range columnTypes {
+		rule := proxy.ColumnTypeRule{Users: columnTypeUsers}
+		types := ct
+		if pattern, rest, ok := strings.Cut(ct, ":"); ok {
+			rule.Column, types = pattern, rest
+		}
+		from, to, ok := strings.Cut(types, "=")
+		if !ok || to == "" {
+			logger.Fatalf("-column-type %q: want [PATTERN:]FROM=TO", ct)
+		}
+		rule.From, rule.To = from, to
+		cfg.ColumnTypeRules = append(cfg.ColumnTypeRules, rule)
+	}
+	if *otlpEndpoint != "" {
+		tp, err := newTracerProvider(context.Background(), *otlpEndpoint, *otlpInsecure)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to set up tracing")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			tp.Shutdown(ctx)
+		}()
+		cfg.TracerProvider = tp
+	}
+	if *resultCacheBytes > 0 {
+		cfg.ResultCache = &proxy.ResultCacheConfig{
+			MaxBytes:      *resultCacheBytes,
+			TTL:           *resultCacheTTL,
+			CompressAbove: *resultCacheCompress,
+		}
+	}
+	if *queryLog != "" {
+		cfg.QueryLog = &proxy.QueryLogConfig{
+			Path:       *queryLog,
+			MaxSize:    *queryLogMaxSize << 20,
+			MaxBackups: *queryLogMaxBackups,
+			MaxAge:     *queryLogMaxAge,
+		}
+	}
+	if *backendAddr != "" {
+		backend := proxy.BackendConfig{
+			Addr:              *backendAddr,
+			User:              *backendUser,
+			Password:          *backendPassword,
+			Database:          *backendDB,
+			ReadTimeout:       *backendReadTimeout,
+			WriteTimeout:      *backendWriteTimeout,
+			KillGracePeriod:   *backendKillGrace,
+			MaxIdle:           *backendMaxIdle,
+			KeepAliveInterval: *backendKeepAlive,
+			CheckIdle:         *backendCheckIdle,
+			MaxIdleTime:       *backendMaxIdleTime,
+			Compression:       *backendCompression,
+			SocketBuffers: proxy.SocketBuffers{
+				Send:    *backendSndBuf,
+				Receive: *backendRcvBuf,
+			},
+		}
+		if *backendTLS {
+			backend.TLS = &proxy.BackendTLSConfig{
+				CAFile:     *backendTLSCA,
+				CertFile:   *backendTLSCert,
+				KeyFile:    *backendTLSKey,
+				Verify:     proxy.TLSVerifyMode(*backendTLSVerify),
+				MinVersion: *backendTLSMinVersion,
+			}
+			if *backendTLSCiphers != "" {
+				backend.TLS.CipherSuites = strings.Split(*backendTLSCiphers, ",")
+			}
+		}
+		cfg.Backends = append(cfg.Backends, backend)
+		cfg.DatabaseRoutes = make(map[string]string, len(routes))
+		for db, addr := range routes {
+			if !hasBackend(cfg.Backends, addr) {
+				backend.Name, backend.Addr = addr, addr
+				cfg.Backends = append(cfg.Backends, backend)
+			}
+			cfg.DatabaseRoutes[db] = addr
+		}
+		cfg.TenantRoutes = make(map[string]string, len(tenantRoutes))
+		for tenant, addr := range tenantRoutes {
+			if !hasBackend(cfg.Backends, addr) {
+				backend.Name, backend.Addr = addr, addr
+				cfg.Backends = append(cfg.Backends, backend)
+			}
+			cfg.TenantRoutes[tenant] = addr
+		}
+	} else if len(routes) > 0 || len(tenantRoutes) > 0 {
+		logger.Fatal("-route and -tenant-route require -backend")
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to load -tls-cert")
+		}
+		cfg.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		var ciphers []string
+		if *tlsCiphers != "" {
+			ciphers = strings.Split(*tlsCiphers, ",")
+		}
+		if err := proxy.ApplyTLSPolicy(cfg.TLS, *tlsMinVersion, ciphers); err != nil {
+			logger.WithError(err).Fatal("invalid client TLS policy")
+		}
+	}
+	cfg.RequireTLS = *tlsRequired
+	if *usersFile != "" {
+		users, err := proxy.LoadUserFile(*usersFile)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to load -users-file")
+		}
+		cfg.Auth = users
+	}
+	cfg.AuthFailOpen = *authFailOpen
+	cfg.AuthPlugin = *authPlugin
+	if *authRSAKey != "" {
+		key, err := loadRSAKey(*authRSAKey)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to load -auth-rsa-key")
+		}
+		cfg.AuthRSAKey = key
+	}
+	srv, err := proxy.NewServer(cfg)
+	if err != nil {
+		logger.WithError(err).Fatal("invalid configuration")
+	}
+	defer srv.Close()
+
+	inherited, err := proxy.InheritedListeners()
 	if err != nil {
-		logger.WithError(err).Fatal("failed to start listener")
+		logger.WithError(err).Fatal("failed to use inherited listeners")
+	}
+	// The primary listener is passed first, the -listener ones by name.
+	var listener net.Listener
+	inheritedExtra := make(map[string]net.Listener)
+	for i, l := range inherited {
+		if i == 0 {
+			listener = l.Listener
+		} else {
+			inheritedExtra[l.Name] = l.Listener
+		}
+	}
+	if listener == nil {
+		listener, err = proxy.Listen(context.Background(), listenAddr, proxy.ListenConfig{ReusePort: *reusePort})
+		if err != nil {
+			logger.WithError(err).Fatal("failed to start listener")
+		}
+	} else {
+		logger.Info("using listener inherited from the previous process")
 	}
 	defer listener.Close()
 
-	logger.Info("metal-db-proxy listening on :3306")
+	info := buildinfo.Get()
+	logger.WithFields(logrus.Fields{"version": info.Version, "commit": info.Commit, "addr": listener.Addr().String()}).Info("metal-db-proxy listening")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go acceptConnections(ctx, listener)
+	go srv.Run(ctx)
+	admin := startAdmin(*adminAddr, srv)
+	defer func() {
+		if admin != nil {
+			admin.Close()
+		}
+	}()
+
+	go acceptConnections(ctx, listener, srv, "")
+	handoff := []proxy.NamedListener{{Name: "metal", Listener: listener}}
+	for _, l := range listeners {
+		extra, ok := inheritedExtra[l.profile.Name]
+		delete(inheritedExtra, l.profile.Name)
+		if !ok {
+			extra, err = proxy.Listen(ctx, l.addr, proxy.ListenConfig{ReusePort: *reusePort})
+			if err != nil {
+				logger.WithError(err).WithField("listener", l.profile.Name).Fatal("failed to start listener")
+			}
+		}
+		defer extra.Close()
+		logger.WithFields(logrus.Fields{"listener": l.profile.Name, "addr": l.addr, "inherited": ok}).Info("listening")
+		handoff = append(handoff, proxy.NamedListener{Name: l.profile.Name, Listener: extra})
+		go acceptConnections(ctx, extra, srv, l.profile.Name)
+	}
+	for name, l := range inheritedExtra {
+		logger.WithField("listener", name).Warn("closing inherited listener that is no longer configured")
+		l.Close()
+	}
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	if proxy.RestartSignal != nil {
+		signals = append(signals, proxy.RestartSignal)
+	}
+	signal.Notify(sigChan, signals...)
+	for sig := range sigChan {
+		if sig != proxy.RestartSignal {
+			break
+		}
+		// The new process binds the admin address itself.
+		if admin != nil {
+			admin.Close()
+		}
+		child, err := proxy.Restart(handoff)
+		if err != nil {
+			logger.WithError(err).Error("hot restart failed; continuing to serve")
+			admin = startAdmin(*adminAddr, srv)
+			continue
+		}
+		logger.WithField("pid", child.Pid).Info("listeners handed to the new process; draining connections")
+		cancel()
+		for _, l := range handoff {
+			l.Close()
+		}
+		drain(srv, *drainTimeout)
+		return
+	}
 
 	logger.Info("shutting down gracefully...")
 	cancel()
@@ -52,7 +493,401 @@ func main() {
 	logger.Info("listener closed, shutdown complete")
 }
 
-func acceptConnections(ctx context.Context, listener net.Listener) {
+// startAdmin serves the admin endpoints on addr, or returns nil if addr is
+// empty.
+func startAdmin(addr string, srv *proxy.Server) *http.Server {
+	if addr == "" {
+		return nil
+	}
+	admin := &http.Server{Addr: addr, Handler: srv.AdminHandler()}
+	go func() {
+		if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.WithError(err).Error("admin listener failed")
+		}
+	}()
+	return admin
+}
+
+// drain waits until every client connection has closed or timeout expires.
+func drain(srv *proxy.Server, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for srv.Connections() > 0 {
+		if time.Now().After(deadline) {
+			logger.WithField("connections", srv.Connections()).Warn("drain timeout reached; closing remaining connections")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logger.Info("all connections drained")
+}
+
+// routeFlag collects -route db=host:port and -tenant-route tenant=host:port
+// flags.
+type routeFlag map[string]string
+
+func (r routeFlag) String() string {
+	pairs := make([]string, 0, len(r))
+	for db, addr := range r {
+		pairs = append(pairs, db+"="+addr)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (r routeFlag) Set(v string) error {
+	db, addr, ok := strings.Cut(v, "=")
+	if !ok || db == "" || addr == "" {
+		return fmt.Errorf("expected db=host:port, got %q", v)
+	}
+	r[db] = addr
+	return nil
+}
+
+// userDatabaseFlag collects -default-database user=db flags.
+type userDatabaseFlag map[string]string
+
+func (f userDatabaseFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for user, db := range f {
+		pairs = append(pairs, user+"="+db)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f userDatabaseFlag) Set(v string) error {
+	user, db, ok := strings.Cut(v, "=")
+	if !ok || user == "" || db == "" {
+		return fmt.Errorf("expected user=db, got %q", v)
+	}
+	f[user] = db
+	return nil
+}
+
+// variableFlag collects -session-variable name=value flags.
+type variableFlag map[string]string
+
+func (f variableFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, value := range f {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f variableFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+	f[name] = value
+	return nil
+}
+
+// userBytesFlag collects -user-max-result-bytes user=bytes flags.
+type userBytesFlag map[string]int64
+
+func (f userBytesFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for user, n := range f {
+		pairs = append(pairs, user+"="+strconv.FormatInt(n, 10))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f userBytesFlag) Set(v string) error {
+	user, bytes, ok := strings.Cut(v, "=")
+	if !ok || user == "" {
+		return fmt.Errorf("expected user=bytes, got %q", v)
+	}
+	n, err := strconv.ParseInt(bytes, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("bytes for user %s: expected a non-negative integer, got %q", user, bytes)
+	}
+	f[user] = n
+	return nil
+}
+
+// userDurationFlag collects -user-max-transaction-time user=duration flags.
+type userDurationFlag map[string]time.Duration
+
+func (f userDurationFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for user, d := range f {
+		pairs = append(pairs, user+"="+d.String())
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f userDurationFlag) Set(v string) error {
+	user, dur, ok := strings.Cut(v, "=")
+	if !ok || user == "" {
+		return fmt.Errorf("expected user=duration, got %q", v)
+	}
+	d, err := time.ParseDuration(dur)
+	if err != nil || d < 0 {
+		return fmt.Errorf("duration for user %s: expected a non-negative duration, got %q", user, dur)
+	}
+	f[user] = d
+	return nil
+}
+
+// userListFlag collects user=VALUE[,VALUE] flags; repeating a user adds to
+// its values, and user= records the user with none.
+type userListFlag map[string][]string
+
+func (f userListFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for user, values := range f {
+		pairs = append(pairs, user+"="+strings.Join(values, ","))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (f userListFlag) Set(v string) error {
+	user, values, ok := strings.Cut(v, "=")
+	if !ok || user == "" {
+		return fmt.Errorf("expected user=VALUE[,VALUE], got %q", v)
+	}
+	f[user] = append(f[user], strings.FieldsFunc(values, func(r rune) bool { return r == ',' })...)
+	return nil
+}
+
+// statementTypes converts statement type names, as the query classifier
+// spells them, to proxy.StatementType.
+func statementTypes(names []string) []proxy.StatementType {
+	types := make([]proxy.StatementType, len(names))
+	for i, name := range names {
+		types[i] = proxy.StatementType(strings.ToLower(strings.TrimSpace(name)))
+	}
+	return types
+}
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// standaloneFlag collects -standalone-response ROWS,INSERT_ID:REGEXP flags.
+type standaloneFlag []proxy.StandaloneResponse
+
+func (f *standaloneFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, r := range *f {
+		parts[i] = fmt.Sprintf("%d,%d:%s", r.AffectedRows, r.LastInsertID, r.Match)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *standaloneFlag) Set(v string) error {
+	counts, pattern, ok := strings.Cut(v, ":")
+	rows, id, ok2 := strings.Cut(counts, ",")
+	if !ok || !ok2 {
+		return fmt.Errorf("expected ROWS,INSERT_ID:REGEXP, got %q", v)
+	}
+	r := proxy.StandaloneResponse{}
+	var err error
+	if r.AffectedRows, err = strconv.ParseUint(rows, 10, 64); err != nil {
+		return fmt.Errorf("affected rows: %w", err)
+	}
+	if r.LastInsertID, err = strconv.ParseUint(id, 10, 64); err != nil {
+		return fmt.Errorf("insert id: %w", err)
+	}
+	if r.Match, err = regexp.Compile(pattern); err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// schemaFlag collects -standalone-table DB.TABLE=COLUMN TYPE[,COLUMN TYPE]
+// flags. A type may end in NOT NULL.
+type schemaFlag []proxy.SchemaTable
+
+func (f *schemaFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, t := range *f {
+		cols := make([]string, len(t.Columns))
+		for j, c := range t.Columns {
+			cols[j] = c.Name + " " + c.Type
+			if c.NotNull {
+				cols[j] += " NOT NULL"
+			}
+		}
+		parts[i] = t.Database + "." + t.Name + "=" + strings.Join(cols, ",")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *schemaFlag) Set(v string) error {
+	name, columns, ok := strings.Cut(v, "=")
+	db, table, ok2 := strings.Cut(name, ".")
+	if !ok || !ok2 || db == "" || table == "" || columns == "" {
+		return fmt.Errorf("expected DB.TABLE=COLUMN TYPE[,COLUMN TYPE], got %q", v)
+	}
+	cols, err := parseSchemaColumns(columns)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, proxy.SchemaTable{Database: db, Name: table, Columns: cols})
+	return nil
+}
+
+// parseSchemaColumns parses COLUMN TYPE[,COLUMN TYPE] column lists. A type
+// may end in NOT NULL.
+func parseSchemaColumns(columns string) ([]proxy.SchemaColumn, error) {
+	var cols []proxy.SchemaColumn
+	// Commas inside parentheses belong to types such as decimal(10,2).
+	depth, start := 0, 0
+	for i := 0; i <= len(columns); i++ {
+		if i < len(columns) {
+			switch columns[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if columns[i] != ',' || depth > 0 {
+				continue
+			}
+		}
+		colName, typ, ok := strings.Cut(strings.TrimSpace(columns[start:i]), " ")
+		if !ok {
+			return nil, fmt.Errorf("column %q: expected COLUMN TYPE", columns[start:i])
+		}
+		col := proxy.SchemaColumn{Name: colName, Type: strings.TrimSpace(typ)}
+		if strings.HasSuffix(strings.ToUpper(col.Type), " NOT NULL") {
+			col.Type, col.NotNull = strings.TrimSpace(col.Type[:len(col.Type)-len(" NOT NULL")]), true
+		}
+		cols = append(cols, col)
+		start = i + 1
+	}
+	return cols, nil
+}
+
+// capabilityFlag collects -disable-capability CIDR=NAME[,NAME] flags.
+type capabilityFlag []proxy.CapabilityOverride
+
+func (f *capabilityFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, o := range *f {
+		parts[i] = o.Source.String() + "=" + strings.Join(o.Disable, ",")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *capabilityFlag) Set(v string) error {
+	cidr, names, ok := strings.Cut(v, "=")
+	if !ok || names == "" {
+		return fmt.Errorf("expected CIDR=NAME[,NAME], got %q", v)
+	}
+	source, err := proxy.ParseSource(cidr)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, proxy.CapabilityOverride{Source: source, Disable: strings.Split(names, ",")})
+	return nil
+}
+
+// listenerFlag collects -listener
+// NAME=ADDR[;disable=NAME[,NAME]][;version=V][;tls=require][;auth=PLUGIN]
+// flags.
+type listenerFlag []namedListener
+
+type namedListener struct {
+	addr    string
+	profile proxy.ListenerProfile
+}
+
+func (f *listenerFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, l := range *f {
+		parts[i] = l.profile.Name + "=" + l.addr
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *listenerFlag) Set(v string) error {
+	name, rest, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=ADDR[;disable=NAME[,NAME]][;version=VERSION][;tls=require][;auth=PLUGIN], got %q", v)
+	}
+	opts := strings.Split(rest, ";")
+	l := namedListener{addr: opts[0], profile: proxy.ListenerProfile{Name: name}}
+	if l.addr == "" {
+		return fmt.Errorf("listener %q has no address", name)
+	}
+	if strings.Contains(name, ":") {
+		// Hot restart passes listener names colon-separated.
+		return fmt.Errorf("listener name %q may not contain ':'", name)
+	}
+	for _, opt := range opts[1:] {
+		key, val, _ := strings.Cut(opt, "=")
+		switch key {
+		case "disable":
+			l.profile.DisableCapabilities = append(l.profile.DisableCapabilities, strings.Split(val, ",")...)
+		case "version":
+			l.profile.ServerVersion = val
+		case "tls":
+			if val != "require" {
+				return fmt.Errorf("listener %q: tls must be require, got %q", name, val)
+			}
+			l.profile.RequireTLS = true
+		case "auth":
+			l.profile.AuthPlugin = val
+		default:
+			return fmt.Errorf("unknown listener option %q", key)
+		}
+	}
+	*f = append(*f, l)
+	return nil
+}
+
+func (f listenerFlag) profiles() []proxy.ListenerProfile {
+	var profiles []proxy.ListenerProfile
+	for _, l := range f {
+		profiles = append(profiles, l.profile)
+	}
+	return profiles
+}
+
+// loadRSAKey reads a PEM RSA private key in PKCS #1 or PKCS #8 form.
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+func hasBackend(backends []proxy.BackendConfig, addr string) bool {
+	for _, b := range backends {
+		if b.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptConnections(ctx context.Context, listener net.Listener, srv *proxy.Server, name string) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -67,12 +902,16 @@ func acceptConnections(ctx context.Context, listener net.Listener) {
 				logger.WithError(err).Warn("accept error")
 				continue
 			}
+			if !srv.AllowConnection(conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
 
 			// Handling each MySQL connection in goroutine
 			go func(c net.Conn) {
 				defer c.Close()
 				logger.WithField("remote", c.RemoteAddr()).Info("new MySQL connection")
-				proxy.Handle(c)
+				srv.HandleOn(c, name)
 			}(conn)
 		}
 	}
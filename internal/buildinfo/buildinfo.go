@@ -0,0 +1,40 @@
+// Package buildinfo describes the proxy build that is running. Version and
+// Commit are set at link time:
+//
+//	go build -ldflags "-X metal-db-proxy/internal/buildinfo.Version=v1.2.0 \
+//	    -X metal-db-proxy/internal/buildinfo.Commit=$(git rev-parse --short HEAD)" ./cmd/proxy
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// Info is the build information reported to operators.
+type Info struct {
+	Version   string
+	Commit    string
+	GoVersion string
+}
+
+// Get returns the build information. When Commit was not set at link time
+// the VCS revision recorded by the Go toolchain is used, if any.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, GoVersion: runtime.Version()}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				if s.Key == "vcs.revision" {
+					info.Commit = s.Value
+				}
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,382 @@
+// Package metrics holds the Prometheus collectors exported by the proxy.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "metal"
+
+// Registry is the registry every proxy collector is registered with. It is
+// kept separate from the global default registry so only proxy metrics are
+// exported.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// BackendConnsDiscarded counts pooled backend connections that were
+	// closed instead of being returned to the pool, by reason.
+	BackendConnsDiscarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_conns_discarded_total",
+		Help:      "Backend connections discarded instead of being returned to the pool.",
+	}, []string{"reason"})
+
+	// BackendUp is 1 while a backend passes health checks.
+	BackendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_up",
+		Help:      "Whether the backend passed its most recent health check.",
+	}, []string{"backend"})
+
+	// BackendDraining is 1 while a backend is drained for maintenance.
+	BackendDraining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_draining",
+		Help:      "Whether the backend is being drained and receives no new queries.",
+	}, []string{"backend"})
+
+	// PacketBufferBytes is the memory currently held in client packet
+	// buffers across all connections.
+	PacketBufferBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "packet_buffer_bytes",
+		Help:      "Bytes currently held in client packet buffers.",
+	})
+
+	// PacketBufferRejections counts client packets refused because the
+	// packet buffer budget was exhausted.
+	PacketBufferRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packet_buffer_rejections_total",
+		Help:      "Client packets rejected because the packet buffer budget was exhausted.",
+	})
+
+	// LongRunningQueries counts forwarded queries still awaiting their
+	// backend response after the keepalive idle time.
+	LongRunningQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "long_running_queries_total",
+		Help:      "Forwarded queries that ran longer than the TCP keepalive idle time.",
+	})
+
+	// PingQueriesAnswered counts pool validation queries answered by the
+	// proxy without a backend round trip.
+	PingQueriesAnswered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ping_queries_answered_total",
+		Help:      "Ping queries answered locally instead of being forwarded.",
+	})
+
+	// QueriesCancelled counts backend queries killed because the client
+	// disconnected while they ran.
+	QueriesCancelled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_cancelled_total",
+		Help:      "Backend queries killed after their client disconnected.",
+	})
+
+	// BackendKillTimeouts counts backend connections closed because a query
+	// killed after its client disconnected did not end in time.
+	BackendKillTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_kill_timeouts_total",
+		Help:      "Backend connections closed because a killed query outlived the kill grace period.",
+	})
+
+	// ComplexQueriesRejected counts queries refused by the complexity
+	// limits, by the limit they exceeded.
+	ComplexQueriesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "complex_queries_rejected_total",
+		Help:      "Queries rejected for exceeding a complexity limit.",
+	}, []string{"reason"})
+
+	// StatementsDenied counts queries refused by the statement rules, by
+	// statement type.
+	StatementsDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "statements_denied_total",
+		Help:      "Queries refused by the statement rules.",
+	}, []string{"type"})
+
+	// CompressionBytes counts the bytes of compressed client connections by
+	// direction (received or sent) and stage: on the wire, or the payload
+	// before compression.
+	CompressionBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "compression_bytes_total",
+		Help:      "Bytes of compressed client connections, on the wire and uncompressed.",
+	}, []string{"direction", "stage"})
+
+	// QueriesByType counts client queries by statement type, as classified
+	// by the proxy's query parser. The label takes a fixed set of values.
+	QueriesByType = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "Client queries by statement type.",
+	}, []string{"statement_type"})
+
+	// QueriesByTag counts client queries by the value of configured
+	// sqlcommenter tags.
+	QueriesByTag = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_by_tag_total",
+		Help:      "Client queries by sqlcommenter tag value.",
+	}, []string{"tag", "value"})
+
+	// FramingViolations counts client connections closed for malformed
+	// packet framing, such as out-of-sequence continuation chunks.
+	FramingViolations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packet_framing_violations_total",
+		Help:      "Client connections closed for malformed packet framing.",
+	})
+
+	// ResultLimitExceeded counts responses cut off for exceeding the
+	// client's result byte limit.
+	ResultLimitExceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "result_limit_exceeded_total",
+		Help:      "Responses cut off for exceeding the result byte limit.",
+	})
+
+	// ConnectionsOpened counts client connections accepted.
+	ConnectionsOpened = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_opened_total",
+		Help:      "Client connections accepted.",
+	})
+
+	// ActiveConnections is the number of client connections open.
+	ActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connections_active",
+		Help:      "Client connections currently open.",
+	})
+
+	// Commands counts client commands by command, such as query or
+	// stmt_execute.
+	Commands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commands_total",
+		Help:      "Client commands by command.",
+	}, []string{"command"})
+
+	// CommandDuration is the time taken to handle client commands, from
+	// their arrival to the end of their response, by command.
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Time taken to handle client commands, by command.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+	}, []string{"command"})
+
+	// ConnectionsClosed counts client connections closed, by reason, such
+	// as client_quit, auth_failed or protocol_error.
+	ConnectionsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_closed_total",
+		Help:      "Client connections closed, by reason.",
+	}, []string{"reason"})
+
+	// ConnectionsRateLimited counts new connections closed before the
+	// handshake for arriving too fast, by the limit exceeded: source or
+	// global.
+	ConnectionsRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_rate_limited_total",
+		Help:      "New connections closed for exceeding the connection rate limit.",
+	}, []string{"limit"})
+
+	// BackendTLSConnections counts TLS connections opened to backends by
+	// the protocol version and cipher suite negotiated.
+	BackendTLSConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_tls_connections_total",
+		Help:      "TLS connections opened to backends by negotiated version and cipher suite.",
+	}, []string{"backend", "version", "cipher"})
+
+	// ClientTLSConnections counts clients that switched to TLS by the
+	// protocol version and cipher suite negotiated.
+	ClientTLSConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_tls_connections_total",
+		Help:      "Client connections switched to TLS by negotiated version and cipher suite.",
+	}, []string{"version", "cipher"})
+
+	// ClientTLSHandshakeFailures counts clients whose TLS handshake failed
+	// after their SSLRequest, by reason.
+	ClientTLSHandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_tls_handshake_failures_total",
+		Help:      "Client TLS handshakes that failed, by reason.",
+	}, []string{"reason"})
+
+	// TransactionsAborted counts client transactions rolled back for
+	// exceeding their time budget.
+	TransactionsAborted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transactions_aborted_total",
+		Help:      "Client transactions rolled back for exceeding their time budget.",
+	})
+
+	// DeadlockRetries counts transactions replayed after a deadlock or lock
+	// wait timeout, by result: succeeded or failed.
+	DeadlockRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deadlock_retries_total",
+		Help:      "Transaction replays after a lock conflict, by result.",
+	}, []string{"result"})
+
+	// CharsetMismatches counts relayed columns whose character set differs
+	// from the client's.
+	CharsetMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "charset_mismatches_total",
+		Help:      "Relayed result columns in a character set other than the client's.",
+	})
+
+	// AuthFailures counts failed client authentications by reason: denied
+	// for wrong credentials, provider_error when the AuthProvider could not
+	// be consulted, protocol for pre-4.1 clients, malformed for
+	// unparseable handshake responses, or tls_required for clients that
+	// did not switch to TLS when it is required.
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Failed client authentications by reason.",
+	}, []string{"reason"})
+
+	// AuthSwitches counts clients asked with an AuthSwitchRequest to redo
+	// their auth response with the method the proxy offers, having
+	// computed it with another.
+	AuthSwitches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_switches_total",
+		Help:      "Clients switched to the proxy's authentication method.",
+	})
+
+	// CachingSHA2Auths counts caching_sha2_password authentications by
+	// path: fast for a scramble checked against the cached hash, full for
+	// a password sent over TLS or encrypted with the proxy's RSA key.
+	CachingSHA2Auths = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "caching_sha2_auths_total",
+		Help:      "caching_sha2_password authentications by fast or full path.",
+	}, []string{"path"})
+
+	// ResultRows is the number of rows in result sets relayed from backends.
+	ResultRows = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "result_rows",
+		Help:      "Rows per result set relayed from backends to clients.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+
+	// HandshakeTimeouts counts clients disconnected for not completing the
+	// handshake in time.
+	HandshakeTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handshake_timeouts_total",
+		Help:      "Client connections closed because authentication did not complete in time.",
+	})
+
+	// QueryCacheLookups counts lookups in the query classification cache by
+	// result: hit or miss.
+	QueryCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_cache_lookups_total",
+		Help:      "Lookups of query classifications cached by fingerprint, by result.",
+	}, []string{"result"})
+
+	// ResultCacheLookups counts lookups in the result set cache by result:
+	// hit or miss.
+	ResultCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "result_cache_lookups_total",
+		Help:      "Lookups of cached query result sets, by result.",
+	}, []string{"result"})
+
+	// ResultCacheBytes is the memory held by cached result sets, by
+	// encoding: zstd for entries stored compressed, none for the rest.
+	ResultCacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "result_cache_bytes",
+		Help:      "Bytes held by cached query result sets, by storage encoding.",
+	}, []string{"encoding"})
+
+	// Shedding is 1 while new connections are being rejected for overload.
+	Shedding = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "shedding",
+		Help:      "Whether the proxy is rejecting new connections because it is overloaded.",
+	})
+
+	// ConnectionsShed counts client connections rejected for overload.
+	ConnectionsShed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_shed_total",
+		Help:      "Client connections rejected because the proxy was overloaded.",
+	})
+
+	// ConnectionsDelayed counts client connections whose greeting was
+	// delayed by reconnect jitter.
+	ConnectionsDelayed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_delayed_total",
+		Help:      "Client connections delayed by reconnect jitter.",
+	})
+
+	// PipelinedCommandsRejected counts client commands refused because they
+	// were sent before the response to the previous command was complete.
+	PipelinedCommandsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pipelined_commands_rejected_total",
+		Help:      "Client commands rejected for being sent before the previous response completed.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		BackendConnsDiscarded,
+		BackendUp,
+		BackendDraining,
+		PacketBufferBytes,
+		PacketBufferRejections,
+		LongRunningQueries,
+		PingQueriesAnswered,
+		QueriesCancelled,
+		BackendKillTimeouts,
+		ComplexQueriesRejected,
+		StatementsDenied,
+		PipelinedCommandsRejected,
+		CompressionBytes,
+		QueriesByType,
+		ConnectionsDelayed,
+		QueriesByTag,
+		AuthFailures,
+		ConnectionsOpened,
+		ActiveConnections,
+		Commands,
+		CommandDuration,
+		AuthSwitches,
+		CachingSHA2Auths,
+		ConnectionsClosed,
+		FramingViolations,
+		Shedding,
+		ConnectionsShed,
+		ConnectionsRateLimited,
+		BackendTLSConnections,
+		ClientTLSConnections,
+		ClientTLSHandshakeFailures,
+		TransactionsAborted,
+		DeadlockRetries,
+		CharsetMismatches,
+		ResultRows,
+		ResultLimitExceeded,
+		HandshakeTimeouts,
+		QueryCacheLookups,
+		ResultCacheLookups,
+		ResultCacheBytes,
+	)
+}
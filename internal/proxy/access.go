@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// StatementRules allow or deny queries by the statement type the query
+// classifier gives them, such as select, insert or ddl.
+type StatementRules struct {
+	// Allow, when set, lists the only statement types permitted.
+	Allow []StatementType
+	// Deny lists statement types refused even where Allow lists them.
+	Deny []StatementType
+}
+
+// statementTypes are the statement types rules may name.
+var statementTypes = []StatementType{
+	StmtOther, StmtSelect, StmtInsert, StmtReplace, StmtUpdate, StmtDelete, StmtDDL, StmtSet, StmtUse,
+	StmtShow, StmtExplain, StmtBegin, StmtCommit, StmtRollback, StmtSavepoint, StmtCall,
+}
+
+func (r StatementRules) validate() error {
+	for _, typ := range append(slices.Clip(r.Allow), r.Deny...) {
+		if !slices.Contains(statementTypes, typ) {
+			return fmt.Errorf("unknown statement type %q", typ)
+		}
+	}
+	return nil
+}
+
+// allows reports whether the rules permit statements of type typ.
+func (r StatementRules) allows(typ StatementType) bool {
+	if slices.Contains(r.Deny, typ) {
+		return false
+	}
+	return len(r.Allow) == 0 || slices.Contains(r.Allow, typ)
+}
+
+// checkStatementRules refuses q with MySQL's 1142 error when the client's
+// statement rules, its own or else the global ones, deny its statement
+// type.
+func (c *Connection) checkStatementRules(q *Query) error {
+	user := c.username
+	rules, ok := c.server.cfg.UserStatementRules[user]
+	if !ok {
+		rules = c.server.cfg.StatementRules
+	}
+	if rules.allows(q.Type) {
+		return nil
+	}
+	metrics.StatementsDenied.WithLabelValues(string(q.Type)).Inc()
+	op := strings.ToUpper(string(q.Type))
+	if len(q.Tokens) > 0 {
+		op = strings.ToUpper(q.Tokens[0].Text)
+	}
+	c.logger.WithField("type", q.Type).WithField("fingerprint", q.Normalized()).Warn("statement denied by the statement rules")
+	return &SQLError{Code: 1142, SQLState: "42000",
+		Message: fmt.Sprintf("%s command denied to user '%s'@'%s'", op, escapeUser(user), remoteHost(c.conn.RemoteAddr()))}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestStatementRules(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{fb.config()},
+		StatementRules: StatementRules{Deny: []StatementType{StmtDDL}},
+		UserStatementRules: map[string]StatementRules{
+			"reporting": {Allow: []StatementType{StmtSelect, StmtShow}},
+			"admin":     {},
+		},
+	})
+	clients := map[string]net.Conn{}
+	for _, user := range []string{"app", "reporting", "admin"} {
+		clients[user] = dialProxyAs(t, srv, user)
+	}
+
+	cases := []struct {
+		user, query string
+		denied      string
+	}{
+		{"app", "DELETE FROM orders WHERE id = 1", ""},
+		{"reporting", "DELETE FROM orders WHERE id = 1", "DELETE command denied to user 'reporting'@"},
+		{"reporting", "SELECT * FROM orders", ""},
+		{"app", "DROP TABLE orders", "DROP command denied to user 'app'@"},
+		{"admin", "DROP TABLE orders", ""},
+		{"admin", "UPDATE orders SET total = 0", ""},
+	}
+	for _, c := range cases {
+		client := clients[c.user]
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, c.query...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		pkt := mustReadPacket(t, client)
+		if c.denied == "" {
+			if pkt.Payload[0] != 0x00 {
+				t.Fatalf("%s: %s: expected OK, got %x", c.user, c.query, pkt.Payload)
+			}
+			continue
+		}
+		if pkt.Payload[0] != 0xFF || binary.LittleEndian.Uint16(pkt.Payload[1:]) != 1142 {
+			t.Fatalf("%s: %s: expected error 1142, got %x", c.user, c.query, pkt.Payload)
+		}
+		if sqlErr, _ := ParseErrPacket(pkt.Payload); !strings.HasPrefix(sqlErr.Message, c.denied) {
+			t.Fatalf("%s: %s: got message %q", c.user, c.query, sqlErr.Message)
+		}
+	}
+	if n := fb.queries.Load(); n != 4 {
+		t.Fatalf("backend saw %d queries, want the 4 allowed", n)
+	}
+
+	if _, err := NewServer(Config{UserStatementRules: map[string]StatementRules{"x": {Deny: []StatementType{"drop"}}}}); err == nil {
+		t.Fatalf("expected an unknown statement type to be rejected")
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// remoteIP returns the IP address of a client at addr. IPv4-mapped IPv6
+// addresses, as seen by dual-stack listeners, are unmapped to IPv4 and zones
+// are dropped, so the address compares equal to what an operator configures.
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.AddrPort().Addr()
+	case nil:
+		return netip.Addr{}, false
+	default:
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = ap.Addr()
+	}
+	if !ip.IsValid() {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
+
+// remoteHost is the client's address without its port, or the whole address
+// for clients that have no IP address.
+func remoteHost(addr net.Addr) string {
+	if ip, ok := remoteIP(addr); ok {
+		return ip.String()
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// normalizePrefix masks p and rewrites IPv4-mapped IPv6 prefixes, such as
+// ::ffff:10.0.0.0/104, as the IPv4 prefix they cover, matching remoteIP.
+func normalizePrefix(p netip.Prefix) netip.Prefix {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked()
+}
+
+// ParseSource parses a client source: a CIDR prefix or a single address,
+// either of which may be an IPv6 address in brackets.
+func ParseSource(s string) (netip.Prefix, error) {
+	addr, bits, hasBits := strings.Cut(s, "/")
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if hasBits {
+		return netip.ParsePrefix(addr + "/" + bits)
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
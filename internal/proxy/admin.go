@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// AdminHandler serves the operational HTTP endpoints: /healthz reports that
+// the process is alive, /readyz whether it accepts clients, /metrics the
+// Prometheus metrics and /backends the state of each backend. POST to
+// /backends/{name}/drain drains a backend for maintenance and DELETE puts
+// it back into service.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.Ready() {
+			http.Error(w, "not ready: no healthy backend", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ready\n"))
+	})
+	mux.HandleFunc("GET /backends", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.BackendStatus())
+	})
+	drain := func(draining bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := s.DrainBackend(r.PathValue("name"), draining); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	mux.Handle("POST /backends/{name}/drain", drain(true))
+	mux.Handle("DELETE /backends/{name}/drain", drain(false))
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	return mux
+}
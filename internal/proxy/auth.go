@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+var (
+	// ErrUnknownUser is returned by an AuthProvider for a user it does not
+	// know. The client is denied as for a wrong password.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrAuthUnavailable is returned when the AuthProvider failed and the
+	// proxy fails closed.
+	ErrAuthUnavailable = errors.New("authentication provider unavailable")
+)
+
+// authLookupTimeout bounds a single AuthProvider lookup.
+const authLookupTimeout = 5 * time.Second
+
+// AuthProvider looks up the credentials clients authenticate to the proxy
+// with.
+type AuthProvider interface {
+	// PasswordHash returns the mysql_native_password hash of user's
+	// password, SHA1(SHA1(password)), ErrUnknownUser if there is no such
+	// user, or another error if the lookup itself failed.
+	PasswordHash(ctx context.Context, user string) ([]byte, error)
+}
+
+// StaticAuth accepts every user name with one password.
+type StaticAuth string
+
+func (p StaticAuth) PasswordHash(ctx context.Context, user string) ([]byte, error) {
+	return nativePasswordHash(string(p)), nil
+}
+
+// defaultAuth is used when no AuthProvider is configured.
+const defaultAuth StaticAuth = "password"
+
+// nativePasswordPlugin is the authentication method the proxy verifies
+// clients with.
+const nativePasswordPlugin = "mysql_native_password"
+
+// authExchange numbers the packets of the handshake phase. The greeting,
+// the client's response, any auth switch rounds and the final OK or ERR
+// each take the sequence number after the last, whichever side sends them;
+// a client packet out of sequence fails the handshake.
+type authExchange struct {
+	r io.Reader
+	w io.Writer
+	// seq is the sequence number of the next packet.
+	seq uint8
+	// startTLS, when set, upgrades the connection after an SSLRequest,
+	// replacing r and w. Without it SSLRequests are refused.
+	startTLS func(*authExchange) error
+	// requireTLS denies a client that did not send an SSLRequest.
+	requireTLS bool
+	// ok, when set, builds the OK packet that completes a successful
+	// authentication in place of a plain one.
+	ok func(*HandshakeResponse) []byte
+	// plugin is the authentication method offered in the greeting,
+	// mysql_native_password when empty. Clients may use either it or
+	// mysql_native_password; others are switched to it.
+	plugin string
+	// sha2 and rsa serve caching_sha2_password authentications.
+	sha2 *sha2Cache
+	rsa  *authRSAKey
+	// admin is the proxy admin user, who is never let in without a
+	// password check.
+	admin string
+}
+
+// read reads the client's next packet.
+func (ex *authExchange) read() (*Packet, error) {
+	pkt, err := ReadPacket(ex.r)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Sequence != ex.seq {
+		return nil, fmt.Errorf("%w: packet has sequence %d, want %d", ErrInvalidHandshake, pkt.Sequence, ex.seq)
+	}
+	ex.seq++
+	return pkt, nil
+}
+
+// write sends the server's next packet.
+func (ex *authExchange) write(payload []byte) error {
+	err := WritePacket(ex.w, ex.seq, payload)
+	ex.seq++
+	return err
+}
+
+// authenticate reads the client's handshake response, switching a client
+// that computed its auth response with an unsupported method to the one
+// offered, and answers it with OK or ERR. When auth fails to
+// look the user up, the client is denied unless failOpen is set, in which
+// case it is let in without checking its password; the admin user is
+// denied regardless.
+func authenticate(ex *authExchange, scramble []byte, auth AuthProvider, failOpen bool, logger *logrus.Entry) (*HandshakeResponse, error) {
+	pkt, err := ex.read()
+	if err != nil {
+		if errors.Is(err, ErrInvalidHandshake) {
+			metrics.AuthFailures.WithLabelValues("malformed").Inc()
+		}
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+	secure := isSSLRequest(pkt.Payload)
+	if secure {
+		if ex.startTLS == nil {
+			return nil, rejectSSLRequest(ex.w, ex.seq)
+		}
+		if err := ex.startTLS(ex); err != nil {
+			return nil, err
+		}
+		// The handshake response follows over TLS.
+		if pkt, err = ex.read(); err != nil {
+			if errors.Is(err, ErrInvalidHandshake) {
+				metrics.AuthFailures.WithLabelValues("malformed").Inc()
+			}
+			return nil, fmt.Errorf("read handshake: %w", err)
+		}
+	}
+	resp, authResp, err := parseHandshakeResponse(pkt.Payload)
+	if errors.Is(err, ErrProtocolMismatch) {
+		metrics.AuthFailures.WithLabelValues("protocol").Inc()
+		errPkt := NewErrPacket(1251, "08004", "Client does not support authentication protocol requested by server; consider upgrading MySQL client")
+		if err := ex.write(errPkt); err != nil {
+			return nil, err
+		}
+		return nil, ErrProtocolMismatch
+	}
+	if err != nil {
+		// A malformed response gets no reply: the client is not speaking the
+		// protocol and the connection is closed.
+		metrics.AuthFailures.WithLabelValues("malformed").Inc()
+		return nil, err
+	}
+	if ex.requireTLS && !secure {
+		metrics.AuthFailures.WithLabelValues("tls_required").Inc()
+		errPkt := NewErrPacket(1045, "28000", fmt.Sprintf("Access denied for user '%s': connections to this proxy must use TLS", escapeUser(resp.Username)))
+		if err := ex.write(errPkt); err != nil {
+			return nil, err
+		}
+		return nil, ErrTLSRequired
+	}
+	plugin := ex.plugin
+	if plugin == "" {
+		plugin = nativePasswordPlugin
+	}
+	switch {
+	case resp.AuthPlugin == nativePasswordPlugin, resp.AuthPlugin == "" && resp.Capabilities&capPluginAuth == 0:
+		// mysql_native_password, which clients without plugin support
+		// use, is always accepted.
+		plugin = nativePasswordPlugin
+	case resp.AuthPlugin != "" && resp.AuthPlugin != plugin:
+		// AuthSwitchRequest: the client answers with a response computed
+		// over the same scramble.
+		metrics.AuthSwitches.Inc()
+		logger.WithField("user", resp.Username).WithField("client_plugin", resp.AuthPlugin).WithField("plugin", plugin).
+			Debug("switching client to the offered authentication method")
+		req := append([]byte{0xFE}, plugin...)
+		req = append(append(append(req, 0), scramble...), 0)
+		if err := ex.write(req); err != nil {
+			return nil, err
+		}
+		pkt, err := ex.read()
+		if err != nil {
+			if errors.Is(err, ErrInvalidHandshake) {
+				metrics.AuthFailures.WithLabelValues("malformed").Inc()
+			}
+			return nil, fmt.Errorf("read auth switch response: %w", err)
+		}
+		authResp = pkt.Payload
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authLookupTimeout)
+	hash, err := auth.PasswordHash(ctx, resp.Username)
+	cancel()
+	switch {
+	case errors.Is(err, ErrUnknownUser):
+		return nil, denyAuth(ex, resp.Username)
+	case err != nil:
+		metrics.AuthFailures.WithLabelValues("provider_error").Inc()
+		log := logger.WithError(err).WithField("user", resp.Username)
+		if !failOpen || ex.admin != "" && resp.Username == ex.admin {
+			log.Error("auth provider failed; denying the connection (fail closed)")
+			errPkt := NewErrPacket(1045, "28000", fmt.Sprintf("Access denied for user '%s': authentication is temporarily unavailable", escapeUser(resp.Username)))
+			if err := ex.write(errPkt); err != nil {
+				return nil, err
+			}
+			return nil, ErrAuthUnavailable
+		}
+		log.Warn("auth provider failed; allowing the connection without a password check (fail open)")
+	case plugin == cachingSHA2Plugin:
+		ok, err := ex.cachingSHA2(resp.Username, authResp, hash, scramble, secure)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, denyAuth(ex, resp.Username)
+		}
+	case !verifyMySQLNativePassword(string(authResp), hash, scramble):
+		return nil, denyAuth(ex, resp.Username)
+	}
+	if ex.ok != nil {
+		return resp, ex.write(ex.ok(resp))
+	}
+	return resp, ex.write(NewOKPacket(0, 0, 0))
+}
+
+// denyAuth answers a client that gave a wrong password or unknown user.
+func denyAuth(ex *authExchange, user string) error {
+	metrics.AuthFailures.WithLabelValues("denied").Inc()
+	if err := ex.write(NewErrPacket(1045, "28000", "Access denied for user '"+escapeUser(user)+"'")); err != nil {
+		return err
+	}
+	return ErrAuthFailed
+}
+
+// escapeUser escapes a client-supplied user name for quoting in an error
+// message: backslashes and quotes are backslash-escaped and other
+// non-printable characters written as \xNN.
+func escapeUser(user string) string {
+	var b strings.Builder
+	for i := 0; i < len(user); {
+		r, n := utf8.DecodeRuneInString(user[i:])
+		switch {
+		case r == '\\' || r == '\'':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == utf8.RuneError && n == 1, !unicode.IsPrint(r):
+			for _, c := range []byte(user[i : i+n]) {
+				fmt.Fprintf(&b, "\\x%02x", c)
+			}
+		default:
+			b.WriteString(user[i : i+n])
+		}
+		i += n
+	}
+	return b.String()
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// authFunc adapts a function returning plaintext passwords to AuthProvider.
+type authFunc func(user string) (string, error)
+
+func (f authFunc) PasswordHash(ctx context.Context, user string) ([]byte, error) {
+	password, err := f(user)
+	if err != nil {
+		return nil, err
+	}
+	return nativePasswordHash(password), nil
+}
+
+func connectAs(t *testing.T, srv *Server, user, password string) error {
+	t.Helper()
+	client, server := net.Pipe()
+	go srv.Handle(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := clientHandshake(client, user, password, "")
+	return err
+}
+
+func TestAuthProvider(t *testing.T) {
+	srv := newTestServer(t, Config{Auth: authFunc(func(user string) (string, error) {
+		if user != "app" {
+			return "", ErrUnknownUser
+		}
+		return "s3cret", nil
+	})})
+	denied := metrics.AuthFailures.WithLabelValues("denied")
+	before := testutil.ToFloat64(denied)
+
+	if err := connectAs(t, srv, "app", "s3cret"); err != nil {
+		t.Fatalf("valid credentials rejected: %v", err)
+	}
+	for _, creds := range [][2]string{{"app", "password"}, {"root", "password"}} {
+		var sqlErr *SQLError
+		if err := connectAs(t, srv, creds[0], creds[1]); !errors.As(err, &sqlErr) || sqlErr.Code != 1045 {
+			t.Fatalf("%s/%s: expected access denied, got %v", creds[0], creds[1], err)
+		}
+	}
+	if got := testutil.ToFloat64(denied) - before; got != 2 {
+		t.Fatalf("denied counter rose by %v, want 2", got)
+	}
+}
+
+func TestUserFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users")
+	contents := "# proxy users\n\n" +
+		"app:" + hex.EncodeToString(nativePasswordHash("s3cret")) + "\n" +
+		"report:*" + strings.ToUpper(hex.EncodeToString(nativePasswordHash("r3port"))) + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("write users file: %v", err)
+	}
+	users, err := LoadUserFile(path)
+	if err != nil {
+		t.Fatalf("load users file: %v", err)
+	}
+	srv := newTestServer(t, Config{Auth: users})
+
+	for _, creds := range [][2]string{{"app", "s3cret"}, {"report", "r3port"}} {
+		if err := connectAs(t, srv, creds[0], creds[1]); err != nil {
+			t.Fatalf("%s: valid credentials rejected: %v", creds[0], err)
+		}
+	}
+	var sqlErr *SQLError
+	if err := connectAs(t, srv, "app", "r3port"); !errors.As(err, &sqlErr) || sqlErr.Code != 1045 {
+		t.Fatalf("wrong password: expected access denied, got %v", err)
+	}
+	// The unknown user's name is escaped in the message.
+	err = connectAs(t, srv, "o'neil\\\x01", "s3cret")
+	if !errors.As(err, &sqlErr) || sqlErr.Code != 1045 || sqlErr.SQLState != "28000" {
+		t.Fatalf("unknown user: expected access denied, got %v", err)
+	}
+	if want := `Access denied for user 'o\'neil\\\x01'`; sqlErr.Message != want {
+		t.Fatalf("unknown user: got message %q, want %q", sqlErr.Message, want)
+	}
+
+	for _, bad := range []string{"app\n", "app:s3cret\n", ":" + hex.EncodeToString(nativePasswordHash("x")) + "\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatalf("write users file: %v", err)
+		}
+		if _, err := LoadUserFile(path); err == nil {
+			t.Fatalf("malformed users file %q loaded", bad)
+		}
+	}
+}
+
+func TestAuthProviderErrors(t *testing.T) {
+	failing := authFunc(func(user string) (string, error) {
+		return "", errors.New("ldap: connection refused")
+	})
+	providerErrors := metrics.AuthFailures.WithLabelValues("provider_error")
+
+	t.Run("fail closed", func(t *testing.T) {
+		before := testutil.ToFloat64(providerErrors)
+		srv := newTestServer(t, Config{Auth: failing})
+		var sqlErr *SQLError
+		err := connectAs(t, srv, "app", "anything")
+		if !errors.As(err, &sqlErr) || sqlErr.Code != 1045 || !strings.Contains(sqlErr.Message, "temporarily unavailable") {
+			t.Fatalf("expected the connection to be denied as unavailable, got %v", err)
+		}
+		if got := testutil.ToFloat64(providerErrors) - before; got != 1 {
+			t.Fatalf("provider error counter rose by %v, want 1", got)
+		}
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		before := testutil.ToFloat64(providerErrors)
+		srv := newTestServer(t, Config{Auth: failing, AuthFailOpen: true, AdminUser: "dba"})
+		if err := connectAs(t, srv, "app", "anything"); err != nil {
+			t.Fatalf("expected the connection to be allowed, got %v", err)
+		}
+		// The admin user is never let in unchecked.
+		var sqlErr *SQLError
+		if err := connectAs(t, srv, "dba", "anything"); !errors.As(err, &sqlErr) || sqlErr.Code != 1045 {
+			t.Fatalf("expected the admin user to be denied, got %v", err)
+		}
+		if got := testutil.ToFloat64(providerErrors) - before; got != 2 {
+			t.Fatalf("provider error counter rose by %v, want 2", got)
+		}
+	})
+}
+
+func TestHandshakeFailureResponses(t *testing.T) {
+	srv := newTestServer(t, Config{})
+	validPrefix := func(caps uint32) []byte {
+		p := binary.LittleEndian.AppendUint32(nil, caps)
+		return append(p, make([]byte, 28)...)
+	}
+	cases := []struct {
+		name    string
+		payload []byte
+		code    uint16 // 0 when the connection is closed without an ERR
+		reason  string
+	}{
+		{"pre-4.1 client", []byte{0x85, 0x00, 0x00, 0x00, 0x00, 'a', 'p', 'p', 0}, 1251, "protocol"},
+		{"wrong password", append(append(validPrefix(capProtocol41|capSecureConnection), "app\x00"...), 0), 1045, "denied"},
+		{"truncated response", validPrefix(capProtocol41)[:20], 0, "malformed"},
+		{"unterminated user name", append(validPrefix(capProtocol41), "app"...), 0, "malformed"},
+		{"auth response overruns packet", append(append(validPrefix(capProtocol41), "app\x00"...), 20, 1, 2), 0, "malformed"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			failures := metrics.AuthFailures.WithLabelValues(c.reason)
+			before := testutil.ToFloat64(failures)
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				srv.Handle(server)
+				close(done)
+			}()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := ReadPacket(client); err != nil {
+				t.Fatalf("read greeting: %v", err)
+			}
+			if err := WritePacket(client, 1, c.payload); err != nil {
+				t.Fatalf("write handshake response: %v", err)
+			}
+			pkt, err := ReadPacket(client)
+			if c.code == 0 {
+				if err == nil {
+					t.Fatalf("expected the connection to be closed, got packet %x", pkt.Payload)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("expected ERR %d, got %v", c.code, err)
+				}
+				sqlErr, err := ParseErrPacket(pkt.Payload)
+				if err != nil || sqlErr.Code != c.code {
+					t.Fatalf("got %v, want ERR %d", sqlErr, c.code)
+				}
+			}
+			<-done
+			if got := testutil.ToFloat64(failures) - before; got != 1 {
+				t.Fatalf("%s failures rose by %v, want 1", c.reason, got)
+			}
+		})
+	}
+}
+
+func TestAuthSwitchSequence(t *testing.T) {
+	srv := newTestServer(t, Config{})
+	// start sends a handshake response computed with caching_sha2_password
+	// at sequence seq, returning the connection and the scramble.
+	start := func(seq uint8) (net.Conn, []byte) {
+		t.Helper()
+		client, server := net.Pipe()
+		go srv.Handle(server)
+		t.Cleanup(func() { client.Close() })
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		pkt, err := ReadPacket(client)
+		if err != nil || pkt.Sequence != 0 {
+			t.Fatalf("read greeting: %v, sequence %d", err, pkt.Sequence)
+		}
+		greeting, err := parseServerGreeting(pkt.Payload)
+		if err != nil {
+			t.Fatalf("parse greeting: %v", err)
+		}
+		resp := make([]byte, 32)
+		putHandshakeHeader(resp, capProtocol41|capSecureConnection|capPluginAuth)
+		resp = append(resp, "app\x00"...)
+		resp = append(resp, 32)
+		resp = append(resp, make([]byte, 32)...)
+		resp = append(resp, "caching_sha2_password\x00"...)
+		if err := WritePacket(client, seq, resp); err != nil {
+			t.Fatalf("write handshake response: %v", err)
+		}
+		return client, greeting.Scramble
+	}
+	malformed := metrics.AuthFailures.WithLabelValues("malformed")
+	switches := testutil.ToFloat64(metrics.AuthSwitches)
+
+	// Greeting 0, response 1, auth switch 2, its response 3 and OK 4.
+	client, scramble := start(1)
+	pkt := mustReadPacket(t, client)
+	want := append(append([]byte("\xFEmysql_native_password\x00"), scramble...), 0)
+	if pkt.Sequence != 2 || string(pkt.Payload) != string(want) {
+		t.Fatalf("got packet %d %q, want auth switch request %q at 2", pkt.Sequence, pkt.Payload, want)
+	}
+	if err := WritePacket(client, 3, nativePasswordAuth(scramble, "password")); err != nil {
+		t.Fatalf("write auth switch response: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Sequence != 4 || pkt.Payload[0] != 0x00 {
+		t.Fatalf("got packet %d %x, want OK at 4", pkt.Sequence, pkt.Payload)
+	}
+	if got := testutil.ToFloat64(metrics.AuthSwitches) - switches; got != 1 {
+		t.Fatalf("auth switches rose by %v, want 1", got)
+	}
+
+	// Packets out of sequence close the connection without a reply.
+	before := testutil.ToFloat64(malformed)
+	client, _ = start(2)
+	if pkt, err := ReadPacket(client); err == nil {
+		t.Fatalf("expected the connection to be closed, got packet %x", pkt.Payload)
+	}
+	client, scramble = start(1)
+	mustReadPacket(t, client)
+	if err := WritePacket(client, 2, nativePasswordAuth(scramble, "password")); err != nil {
+		t.Fatalf("write auth switch response: %v", err)
+	}
+	if pkt, err := ReadPacket(client); err == nil {
+		t.Fatalf("expected the connection to be closed, got packet %x", pkt.Payload)
+	}
+	if got := testutil.ToFloat64(malformed) - before; got != 2 {
+		t.Fatalf("malformed failures rose by %v, want 2", got)
+	}
+}
@@ -0,0 +1,887 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// ErrBackendTimeout is returned when a backend does not answer within its
+// configured read or write timeout.
+var ErrBackendTimeout = errors.New("backend timeout")
+
+// ErrBackendLost is returned when a backend closes its connection, possibly
+// partway through a response.
+var ErrBackendLost = errors.New("lost connection to backend")
+
+const defaultDialTimeout = 5 * time.Second
+
+// BackendConfig describes an upstream MySQL server.
+type BackendConfig struct {
+	Name     string
+	Addr     string
+	User     string
+	Password string
+	Database string
+
+	DialTimeout time.Duration
+	// ReadTimeout bounds the wait for each packet of a backend response and
+	// WriteTimeout the write of each command. Zero disables the deadline.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// KillGracePeriod is how long a query killed with KILL QUERY may take
+	// to end before the connection it runs on is closed and discarded.
+	// Zero waits for the backend indefinitely.
+	KillGracePeriod time.Duration
+
+	// MaxIdle is the number of idle connections kept in the pool.
+	MaxIdle int
+	// KeepAliveInterval pings idle pooled connections once they have gone
+	// unused this long, keeping them from being closed by the backend's
+	// wait_timeout, which it should be well below. Zero disables the
+	// pings.
+	KeepAliveInterval time.Duration
+	// CheckIdle pings an idle pooled connection unused this long before
+	// handing it out, discarding it if the ping fails. Zero hands idle
+	// connections out unchecked.
+	CheckIdle time.Duration
+	// MaxIdleTime closes idle pooled connections unused longer than this
+	// instead of handing them out, so a new one is dialed in their place.
+	// Zero keeps them indefinitely.
+	MaxIdleTime time.Duration
+
+	// TLS encrypts connections to the backend when set.
+	TLS *BackendTLSConfig
+	// Compression requests the zlib compressed protocol from the backend
+	// when it offers it. It is independent of client compression: the
+	// proxy decompresses and recompresses at the boundary as needed.
+	Compression bool
+
+	// SocketBuffers sizes the kernel buffers of backend connections.
+	SocketBuffers SocketBuffers
+}
+
+// Backend is an upstream MySQL server together with its connection pool.
+type Backend struct {
+	cfg     BackendConfig
+	pool    *Pool
+	healthy atomic.Bool
+	// failed is set by a failed health check and cleared by the next
+	// successful one, which records the time in recovered (Unix nanoseconds).
+	failed    atomic.Bool
+	recovered atomic.Int64
+	// draining takes the backend out of routing for maintenance.
+	draining atomic.Bool
+	// version is the server version from the backend's latest greeting.
+	version atomic.Value
+
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config
+	tlsErr    error
+
+	sockBufLogged sync.Once
+}
+
+func NewBackend(cfg BackendConfig) *Backend {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Addr
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	b := &Backend{cfg: cfg}
+	b.pool = newPool(b, cfg.MaxIdle)
+	return b
+}
+
+func (b *Backend) Name() string { return b.cfg.Name }
+
+func (b *Backend) Addr() string { return b.cfg.Addr }
+
+func (b *Backend) Pool() *Pool { return b.pool }
+
+// clientTLS returns the TLS configuration for connections to the backend,
+// or nil when they are plaintext.
+func (b *Backend) clientTLS() (*tls.Config, error) {
+	if b.cfg.TLS == nil {
+		return nil, nil
+	}
+	b.tlsOnce.Do(func() {
+		b.tlsConfig, b.tlsErr = b.cfg.TLS.clientConfig(b.cfg.Addr)
+	})
+	return b.tlsConfig, b.tlsErr
+}
+
+// Version returns the server version the backend reported when a
+// connection to it was last opened, or "" if none has been.
+func (b *Backend) Version() string {
+	v, _ := b.version.Load().(string)
+	return v
+}
+
+// Healthy reports whether the most recent health check succeeded. Backends
+// start out unhealthy until they have been checked once.
+func (b *Backend) Healthy() bool { return b.healthy.Load() }
+
+// Draining reports whether the backend is being drained: no new queries are
+// routed to it and its connections are closed as clients release them.
+func (b *Backend) Draining() bool { return b.draining.Load() }
+
+// setDraining starts or stops draining the backend.
+func (b *Backend) setDraining(draining bool) {
+	b.draining.Store(draining)
+	v := 0.0
+	if draining {
+		v = 1
+		b.pool.Close()
+	}
+	metrics.BackendDraining.WithLabelValues(b.cfg.Name).Set(v)
+}
+
+// RecoveredAt returns when the backend last passed a health check after
+// failing one, or the zero time if it never has.
+func (b *Backend) RecoveredAt() time.Time {
+	if ns := b.recovered.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// keepIdleAlive pings the idle pooled connections until ctx is cancelled,
+// checking every half KeepAliveInterval.
+func (b *Backend) keepIdleAlive(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.KeepAliveInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.pool.keepAlive(b.cfg.KeepAliveInterval)
+		}
+	}
+}
+
+// Check pings the backend over a pooled connection and records the result.
+func (b *Backend) Check(ctx context.Context) error {
+	err := b.ping(ctx)
+	b.healthy.Store(err == nil)
+	if err != nil {
+		b.failed.Store(true)
+	} else if b.failed.Swap(false) {
+		b.recovered.Store(time.Now().UnixNano())
+	}
+	up := 0.0
+	if err == nil {
+		up = 1
+	}
+	metrics.BackendUp.WithLabelValues(b.cfg.Name).Set(up)
+	return err
+}
+
+func (b *Backend) ping(ctx context.Context) error {
+	bc, err := b.pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer b.pool.Put(bc)
+	return bc.Ping()
+}
+
+func (b *Backend) dial(ctx context.Context) (*BackendConn, error) {
+	tlsConfig, err := b.clientTLS()
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", b.cfg.Name, err)
+	}
+
+	raw, err := b.dialTCP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	raw.SetDeadline(time.Now().Add(b.cfg.DialTimeout))
+	conn, greeting, err := clientHandshakeTLS(raw, b.cfg.User, b.cfg.Password, b.cfg.Database, tlsConfig, b.cfg.Compression)
+	if err != nil {
+		raw.Close()
+		if errors.Is(err, ErrTLSPolicy) {
+			logrus.WithError(err).WithField("backend", b.cfg.Name).Warn("backend refused the TLS version and cipher policy")
+		}
+		return nil, fmt.Errorf("backend %s handshake: %w", b.cfg.Name, err)
+	}
+	conn.SetDeadline(time.Time{})
+	b.version.Store(greeting.ServerVersion)
+
+	bc := &BackendConn{
+		backend:          b,
+		conn:             conn,
+		threadID:         greeting.ConnectionID,
+		database:         b.cfg.Database,
+		lastUsed:         time.Now(),
+		optionalMetadata: greeting.Capabilities&capOptionalMetadata != 0,
+	}
+	if cc, ok := conn.(*compressedConn); ok {
+		conn = cc.Conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		bc.recordTLS(tc.ConnectionState())
+	}
+	return bc, nil
+}
+
+// dialTCP opens an unauthenticated connection to the backend.
+func (b *Backend) dialTCP(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: b.cfg.DialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", b.cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial backend %s: %w", b.cfg.Name, err)
+	}
+	b.cfg.SocketBuffers.apply(conn, logrus.WithField("backend", b.cfg.Name), &b.sockBufLogged)
+	return conn, nil
+}
+
+// BackendConn is a single authenticated connection to a backend.
+type BackendConn struct {
+	backend  *Backend
+	conn     net.Conn
+	threadID uint32
+	database string
+	lastUsed time.Time
+	// seq is the sequence number the backend's next packet must have.
+	seq uint8
+
+	// optionalMetadata is set when CLIENT_OPTIONAL_RESULTSET_METADATA was
+	// negotiated: the column count of each result set is then followed by a
+	// flag saying whether column definitions are sent.
+	optionalMetadata bool
+	// sessionTrack is set when CLIENT_SESSION_TRACK was negotiated, which
+	// changes the encoding of the info in OK packets.
+	sessionTrack bool
+
+	// dedicated is set on connections authenticated with a client's own
+	// credentials; they serve only that client and are never pooled.
+	dedicated bool
+
+	// dirty is set once a client has run commands on the connection, which
+	// may have left session state behind.
+	dirty bool
+
+	// poisonReason is set once the connection is in an unknown protocol
+	// state; the pool discards poisoned connections instead of reusing them.
+	poisonReason string
+	// abandoned is set when the connection is closed under a statement
+	// that did not end within the kill grace period.
+	abandoned atomic.Bool
+
+	// tlsVersion and tlsCipher name what was negotiated on TLS
+	// connections; they are empty otherwise.
+	tlsVersion string
+	tlsCipher  string
+}
+
+func (bc *BackendConn) Backend() *Backend { return bc.backend }
+
+func (bc *BackendConn) Close() error { return bc.conn.Close() }
+
+func (bc *BackendConn) poison(reason string) {
+	if bc.poisonReason == "" {
+		bc.poisonReason = reason
+	}
+}
+
+func (bc *BackendConn) Poisoned() bool { return bc.poisonReason != "" }
+
+func (bc *BackendConn) writePacket(sequence uint8, payload []byte) error {
+	if t := bc.backend.cfg.WriteTimeout; t > 0 {
+		bc.conn.SetWriteDeadline(time.Now().Add(t))
+	}
+	if cc, ok := bc.conn.(*compressedConn); ok && sequence == 0 {
+		cc.resetSequence()
+	}
+	next, err := WriteLargePacket(bc.conn, sequence, payload)
+	if err != nil {
+		return bc.ioError("write", err)
+	}
+	bc.seq = next
+	return nil
+}
+
+func (bc *BackendConn) readPacket() (*Packet, error) {
+	if t := bc.backend.cfg.ReadTimeout; t > 0 {
+		bc.conn.SetReadDeadline(time.Now().Add(t))
+	}
+	pkt, err := ReadFullMessage(bc.conn)
+	if errors.Is(err, ErrPacketFraming) {
+		bc.poison("desync")
+		return nil, fmt.Errorf("%w: backend %s (thread %d): %v", ErrBackendDesync, bc.backend.cfg.Name, bc.threadID, err)
+	}
+	if err != nil {
+		return nil, bc.ioError("read", err)
+	}
+	// Every chunk but the last of a reassembled payload is full.
+	if first := pkt.Sequence - uint8(pkt.Length/maxPacketChunk); first != bc.seq {
+		bc.poison("desync")
+		return nil, fmt.Errorf("%w: backend %s (thread %d) sent sequence %d, want %d", ErrBackendDesync, bc.backend.cfg.Name, bc.threadID, first, bc.seq)
+	}
+	bc.seq = pkt.Sequence + 1
+	return pkt, nil
+}
+
+// ioError poisons the connection after a failed read or write, classifying
+// deadline expiries as ErrBackendTimeout and closed connections as
+// ErrBackendLost.
+func (bc *BackendConn) ioError(op string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		bc.poison("timeout")
+		return fmt.Errorf("%w: %s on backend %s", ErrBackendTimeout, op, bc.backend.cfg.Name)
+	}
+	if bc.abandoned.Load() {
+		bc.poison("kill_timeout")
+		return fmt.Errorf("backend %s did not end a killed query within %s", bc.backend.cfg.Name, bc.backend.cfg.KillGracePeriod)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		bc.poison("closed")
+		return fmt.Errorf("%w %s: %s: %v", ErrBackendLost, bc.backend.cfg.Name, op, err)
+	}
+	bc.poison("error")
+	return fmt.Errorf("backend %s %s: %w", bc.backend.cfg.Name, op, err)
+}
+
+// Ping sends COM_PING and waits for the OK.
+func (bc *BackendConn) Ping() error {
+	if err := bc.writePacket(0, []byte{COM_PING}); err != nil {
+		return err
+	}
+	pkt, err := bc.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(pkt.Payload) == 0 || pkt.Payload[0] != 0x00 {
+		bc.poison("protocol")
+		return fmt.Errorf("%w: unexpected COM_PING response from backend %s", ErrInvalidPacket, bc.backend.cfg.Name)
+	}
+	return nil
+}
+
+// UseDatabase makes db the connection's current database. An ERR from the
+// backend is returned as a *SQLError and leaves the connection usable.
+func (bc *BackendConn) UseDatabase(db string) error {
+	if err := bc.writePacket(0, append([]byte{COM_INIT_DB}, db...)); err != nil {
+		return err
+	}
+	pkt, err := bc.readPacket()
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(pkt.Payload) > 0 && pkt.Payload[0] == 0x00:
+		bc.database = db
+		return nil
+	case len(pkt.Payload) > 0 && pkt.Payload[0] == 0xFF:
+		return parseErrOrInvalid(pkt.Payload)
+	default:
+		bc.poison("protocol")
+		return fmt.Errorf("%w: unexpected COM_INIT_DB response from backend %s", ErrInvalidPacket, bc.backend.cfg.Name)
+	}
+}
+
+func parseErrOrInvalid(payload []byte) error {
+	sqlErr, err := ParseErrPacket(payload)
+	if err != nil {
+		return err
+	}
+	return sqlErr
+}
+
+// ErrBackendDesync is returned when a backend sends a packet that cannot be
+// part of the response being relayed. The backend connection is poisoned
+// and the client disconnected, since neither is in a known protocol state.
+var ErrBackendDesync = errors.New("backend protocol desync")
+
+// errMetadataRequired is returned for result sets sent without column
+// definitions to a client that cannot receive them, or whose rows the
+// proxy has to rewrite.
+var errMetadataRequired = &SQLError{Code: 1235, SQLState: "42000", Message: "This version of metal-db-proxy doesn't yet support 'resultset_metadata=NONE on this connection'"}
+
+// ExecResult summarizes a backend response that was relayed to the client.
+type ExecResult struct {
+	// Err is set when the backend answered with an ERR packet.
+	Err *SQLError
+	// Status is the server status reported by the final OK or EOF packet
+	// of the last result.
+	Status uint16
+	// Rows is the number of rows in the result set, or the affected rows
+	// reported by an OK packet, summed over a chain of results.
+	Rows uint64
+	// ResultSet is set when the response was a result set rather than an
+	// OK or ERR packet.
+	ResultSet bool
+	// LastInsertID is the id reported by the last OK packet, and Warnings
+	// the warning counts of OK packets summed over a chain of results.
+	LastInsertID uint64
+	Warnings     uint16
+}
+
+// serverStatusInTrans is the server status flag set while a transaction is
+// open.
+const serverStatusInTrans uint16 = 0x0001
+
+// serverMoreResultsExists is the server status flag set on every result of
+// a chain but the last.
+const serverMoreResultsExists uint16 = 0x0008
+
+// InTransaction reports whether the session was inside a transaction when
+// the backend finished the command.
+func (r *ExecResult) InTransaction() bool {
+	return r.Status&serverStatusInTrans != 0
+}
+
+// Execute sends a command to the backend and passes every packet of the
+// response to forward until the response is complete. If the response is
+// cut short the connection is poisoned and must not be reused.
+func (bc *BackendConn) Execute(payload []byte, forward func([]byte) error) (*ExecResult, error) {
+	return bc.execute(payload, forward, nil, bc.capabilities())
+}
+
+// capabilities are the capabilities negotiated on the connection that
+// decide how responses are framed.
+func (bc *BackendConn) capabilities() uint32 {
+	var caps uint32
+	if bc.optionalMetadata {
+		caps |= capOptionalMetadata
+	}
+	if bc.sessionTrack {
+		caps |= capSessionTrack
+	}
+	return caps
+}
+
+// execute is Execute with an optional pipeline applied to every result-set
+// column definition and row before it is forwarded. client are the
+// capabilities the client negotiated: without
+// CLIENT_OPTIONAL_RESULTSET_METADATA the metadata flag is dropped from the
+// column counts forwarded to it, and the info of OK packets is re-encoded
+// when it negotiated CLIENT_SESSION_TRACK and this connection did not.
+func (bc *BackendConn) execute(payload []byte, forward func([]byte) error, p *rowPipeline, client uint32) (*ExecResult, error) {
+	clientMetadata := client&capOptionalMetadata != 0
+	trackInfo := client&capSessionTrack != 0 && !bc.sessionTrack
+	bc.lastUsed = time.Now()
+	bc.dirty = true
+	if err := bc.writePacket(0, payload); err != nil {
+		return nil, err
+	}
+
+	res := &ExecResult{}
+	var columnDefs []ColumnDef
+	expect := expectHeader
+	// metadata is cleared when the backend sends a result set without
+	// column definitions.
+	metadata := true
+	relay := func() (*Packet, error) {
+		pkt, err := bc.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkResponsePacket(expect, pkt.Payload); err != nil {
+			bc.poison("desync")
+			return nil, fmt.Errorf("%w: backend %s (thread %d) sent %s", ErrBackendDesync, bc.backend.cfg.Name, bc.threadID, err)
+		}
+		out := pkt.Payload
+		switch {
+		case pkt.Payload[0] == 0xFF:
+			res.Err, _ = ParseErrPacket(pkt.Payload)
+		case expect == expectHeader && pkt.Payload[0] == localInfileHeader:
+			// Answered by execute rather than relayed.
+			return pkt, nil
+		case expect == expectHeader && pkt.Payload[0] == 0x00:
+			if trackInfo {
+				out = trackedOKInfo(pkt.Payload)
+			}
+		case expect == expectHeader && bc.optionalMetadata && pkt.Payload[0] != 0x00:
+			_, n, err := ReadLengthEncodedInt(pkt.Payload)
+			if err != nil || n >= len(pkt.Payload) {
+				break
+			}
+			metadata = pkt.Payload[n] != 0
+			if !metadata && (p.rewritesRows() || !clientMetadata) {
+				// The rows cannot be rewritten, or the client framed,
+				// without their column definitions.
+				bc.poison("protocol")
+				return nil, errMetadataRequired
+			}
+			if !clientMetadata {
+				out = pkt.Payload[:n]
+			}
+		case p.empty() || isEOFPacket(pkt.Payload):
+		case expect == expectRow && p.rewritesRows():
+			row, err := parseTextRow(pkt.Payload, len(columnDefs))
+			if err != nil {
+				bc.poison("protocol")
+				return nil, fmt.Errorf("backend %s: malformed row: %w", bc.backend.cfg.Name, err)
+			}
+			out = encodeTextRow(p.TransformRow(columnDefs, row))
+		case expect == expectColumnDef:
+			col, err := parseColumnDef(pkt.Payload)
+			if err != nil {
+				bc.poison("protocol")
+				return nil, fmt.Errorf("backend %s: malformed column definition: %w", bc.backend.cfg.Name, err)
+			}
+			if p.TransformColumn(&col) {
+				out = col.packet()
+			}
+			columnDefs = append(columnDefs, col)
+		}
+		if err := forward(out); err != nil {
+			if errors.Is(err, ErrResultTooLarge) {
+				bc.poison("result_limit")
+			} else {
+				bc.poison("client")
+			}
+			return nil, err
+		}
+		return pkt, nil
+	}
+
+	// A multi-statement batch or a stored procedure call answers with a
+	// chain of results, each but the last flagged with
+	// SERVER_MORE_RESULTS_EXISTS; they are all relayed.
+	for {
+		expect, metadata, columnDefs = expectHeader, true, nil
+		first, err := relay()
+		if err != nil {
+			return nil, err
+		}
+		switch first.Payload[0] {
+		case 0x00:
+			ok, err := ParseOKPacket(first.Payload)
+			if err != nil {
+				// checkResponsePacket accepted it, so only the trailing
+				// status and warnings can be missing.
+				ok = &OKPacket{}
+				ok.AffectedRows, _, _ = ReadLengthEncodedInt(first.Payload[1:])
+			}
+			res.Status = ok.Status
+			res.Rows += ok.AffectedRows
+			res.LastInsertID = ok.LastInsertID
+			res.Warnings += ok.Warnings
+		case 0xFF:
+			return res, nil
+		case localInfileHeader:
+			return nil, bc.declineLocalInfile(first.Sequence)
+		default:
+			columns, _, _ := ReadLengthEncodedInt(first.Payload)
+			// Column definitions, unless the backend suppressed them,
+			// followed by their terminating EOF.
+			if !metadata {
+				columns = 0
+			}
+			columnDefs = make([]ColumnDef, 0, columns)
+			expect = expectColumnDef
+			for i := uint64(0); i < columns; i++ {
+				if _, err := relay(); err != nil {
+					return nil, err
+				}
+			}
+			expect = expectColumnsEOF
+			if _, err := relay(); err != nil {
+				return nil, err
+			}
+			expect = expectRow
+			res.ResultSet = true
+			// Rows until the final EOF or an ERR.
+			for {
+				pkt, err := relay()
+				if err != nil {
+					return nil, err
+				}
+				if isEOFPacket(pkt.Payload) {
+					if len(pkt.Payload) >= 5 {
+						res.Status = binary.LittleEndian.Uint16(pkt.Payload[3:])
+					}
+					break
+				}
+				if res.Err != nil {
+					return res, nil
+				}
+				res.Rows++
+			}
+		}
+		if res.Status&serverMoreResultsExists == 0 {
+			return res, nil
+		}
+	}
+}
+
+// KillQuery aborts the statement running on the connection with KILL QUERY
+// sent over a separate connection. It is safe to call while another
+// goroutine is blocked in Execute.
+func (bc *BackendConn) KillQuery() error {
+	b := bc.backend
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.DialTimeout)
+	defer cancel()
+	killer, err := b.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer killer.Close()
+	return killer.Query(fmt.Sprintf("KILL QUERY %d", bc.threadID))
+}
+
+// abandon closes the connection under a killed statement that has not
+// ended, failing the read waiting for its response.
+func (bc *BackendConn) abandon() {
+	bc.abandoned.Store(true)
+	metrics.BackendKillTimeouts.Inc()
+	bc.conn.Close()
+}
+
+// okPacketStatus returns the status flags of an OK packet.
+func okPacketStatus(payload []byte) uint16 {
+	ok, err := ParseOKPacket(payload)
+	if err != nil {
+		return 0
+	}
+	return ok.Status
+}
+
+// Query runs query on the backend for the proxy's own purposes, discarding
+// any result set. A backend ERR is returned as a *SQLError.
+func (bc *BackendConn) Query(query string) error {
+	res, err := bc.Execute(append([]byte{COM_QUERY}, query...), func([]byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	if res.Err != nil {
+		return res.Err
+	}
+	return nil
+}
+
+// Reset clears the session state a client left on the connection with
+// COM_RESET_CONNECTION so it can be handed to another client.
+func (bc *BackendConn) Reset() error {
+	if err := bc.writePacket(0, []byte{COM_RESET_CONNECTION}); err != nil {
+		return err
+	}
+	pkt, err := bc.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(pkt.Payload) == 0 || pkt.Payload[0] != 0x00 {
+		bc.poison("reset")
+		return fmt.Errorf("backend %s refused COM_RESET_CONNECTION", bc.backend.cfg.Name)
+	}
+	bc.dirty = false
+	return nil
+}
+
+func isEOFPacket(payload []byte) bool {
+	return len(payload) > 0 && len(payload) < 9 && payload[0] == 0xFE
+}
+
+// serverGreeting is the subset of the initial handshake packet the proxy
+// needs when acting as a client.
+type serverGreeting struct {
+	ServerVersion string
+	ConnectionID  uint32
+	Capabilities  uint32
+	Scramble      []byte
+	AuthPlugin    string
+}
+
+func parseServerGreeting(payload []byte) (*serverGreeting, error) {
+	if len(payload) == 0 {
+		return nil, ErrInvalidHandshake
+	}
+	if payload[0] == 0xFF {
+		if sqlErr, err := ParseErrPacket(payload); err == nil {
+			return nil, sqlErr
+		}
+		return nil, ErrInvalidHandshake
+	}
+	if payload[0] != 10 {
+		return nil, fmt.Errorf("%w: protocol version %d", ErrInvalidHandshake, payload[0])
+	}
+
+	version, n, err := ReadNullTerminatedString(payload[1:])
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	pos := 1 + n
+	if len(payload) < pos+4+8+1+2 {
+		return nil, ErrInvalidHandshake
+	}
+	g := &serverGreeting{ServerVersion: version}
+	g.ConnectionID = binary.LittleEndian.Uint32(payload[pos:])
+	pos += 4
+	g.Scramble = append(g.Scramble, payload[pos:pos+8]...)
+	pos += 8 + 1
+	g.Capabilities = uint32(binary.LittleEndian.Uint16(payload[pos:]))
+	pos += 2
+
+	if len(payload) < pos+1+2+2+1+10 {
+		return g, nil
+	}
+	pos += 1 + 2 // charset, status flags
+	g.Capabilities |= uint32(binary.LittleEndian.Uint16(payload[pos:])) << 16
+	pos += 2
+	authLen := int(payload[pos])
+	pos += 1 + 10
+
+	if g.Capabilities&capSecureConnection != 0 {
+		part2 := max(13, authLen-8)
+		if len(payload) < pos+part2 {
+			return nil, ErrInvalidHandshake
+		}
+		g.Scramble = append(g.Scramble, bytes.TrimRight(payload[pos:pos+part2], "\x00")...)
+		pos += part2
+	}
+	if g.Capabilities&capPluginAuth != 0 && pos < len(payload) {
+		g.AuthPlugin = string(bytes.TrimRight(payload[pos:], "\x00"))
+	}
+	return g, nil
+}
+
+// clientHandshake authenticates to a MySQL server over conn as user, using
+// mysql_native_password.
+func clientHandshake(conn net.Conn, user, password, database string) (*serverGreeting, error) {
+	_, greeting, err := clientHandshakeTLS(conn, user, password, database, nil, false)
+	return greeting, err
+}
+
+// clientHandshakeTLS is clientHandshake upgrading the connection to TLS
+// first when tlsConfig is set, and negotiating compression when compress is
+// set and the server offers it. It returns the connection to use afterwards.
+func clientHandshakeTLS(conn net.Conn, user, password, database string, tlsConfig *tls.Config, compress bool) (net.Conn, *serverGreeting, error) {
+	pkt, err := ReadPacket(conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read greeting: %w", err)
+	}
+	greeting, err := parseServerGreeting(pkt.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caps := capClientLongPassword | capLongFlag | capProtocol41 | capTransactions | capSecureConnection | capMultiStatements | capMultiResults | capPluginAuth | capOptionalMetadata
+	if database != "" {
+		caps |= capConnectWithDB
+	}
+	if compress {
+		caps |= capCompress
+	}
+	caps &= greeting.Capabilities | capClientLongPassword
+
+	seq := pkt.Sequence + 1
+	if tlsConfig != nil {
+		if greeting.Capabilities&capSSL == 0 {
+			return nil, nil, errors.New("backend does not support TLS")
+		}
+		caps |= capSSL
+		if conn, err = startTLS(conn, caps, seq, tlsConfig); err != nil {
+			return nil, nil, err
+		}
+		seq++
+	}
+
+	auth := nativePasswordAuth(greeting.Scramble, password)
+
+	resp := make([]byte, 32, 64+len(user)+len(database))
+	putHandshakeHeader(resp, caps)
+	resp = append(resp, user...)
+	resp = append(resp, 0)
+	resp = append(resp, byte(len(auth)))
+	resp = append(resp, auth...)
+	if caps&capConnectWithDB != 0 {
+		resp = append(resp, database...)
+		resp = append(resp, 0)
+	}
+	if caps&capPluginAuth != 0 {
+		resp = append(resp, "mysql_native_password"...)
+		resp = append(resp, 0)
+	}
+
+	if err := WritePacket(conn, seq, resp); err != nil {
+		return nil, nil, fmt.Errorf("write handshake response: %w", err)
+	}
+
+	for {
+		pkt, err := ReadPacket(conn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read auth result: %w", err)
+		}
+		if len(pkt.Payload) == 0 {
+			return nil, nil, ErrInvalidPacket
+		}
+		switch pkt.Payload[0] {
+		case 0x00:
+			if caps&capCompress != 0 {
+				cc := newCompressedConn(conn)
+				cc.backend = true
+				return cc, greeting, nil
+			}
+			return conn, greeting, nil
+		case 0xFF:
+			sqlErr, err := ParseErrPacket(pkt.Payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, sqlErr
+		case 0xFE:
+			plugin, n, err := ReadNullTerminatedString(pkt.Payload[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			if plugin != "mysql_native_password" {
+				return nil, nil, fmt.Errorf("unsupported auth plugin %q", plugin)
+			}
+			scramble := bytes.TrimRight(pkt.Payload[1+n:], "\x00")
+			seq = pkt.Sequence + 1
+			if err := WritePacket(conn, seq, nativePasswordAuth(scramble, password)); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("%w: unexpected auth response 0x%02x", ErrInvalidPacket, pkt.Payload[0])
+		}
+	}
+}
+
+// putHandshakeHeader fills the fixed 32-byte prefix shared by the
+// HandshakeResponse41 and SSLRequest packets.
+func putHandshakeHeader(buf []byte, caps uint32) {
+	binary.LittleEndian.PutUint32(buf[0:4], caps)
+	binary.LittleEndian.PutUint32(buf[4:8], 1<<24)
+	buf[8] = byte(CollationUTF8MB3GeneralCI)
+}
+
+// nativePasswordAuth computes the mysql_native_password response
+// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password))).
+func nativePasswordAuth(scramble []byte, password string) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	resp := h.Sum(nil)
+	for i := range resp {
+		resp[i] ^= stage1[i]
+	}
+	return resp
+}
@@ -0,0 +1,625 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// fakeBackend is a minimal MySQL server that accepts the password
+// "password" for any user, answers COM_PING and hands every other command to
+// handler.
+type fakeBackend struct {
+	ln       net.Listener
+	handler  func(conn net.Conn, payload []byte)
+	accepted atomic.Int32
+	queries  atomic.Int32
+	pings    atomic.Int32
+
+	// tls, when set, makes the backend refuse clients that do not switch
+	// to TLS.
+	tls *tls.Config
+	// version, when set, is the server version the backend advertises.
+	version string
+	// compress offers CLIENT_COMPRESS; compressed counts the connections
+	// that negotiated it.
+	compress   atomic.Bool
+	compressed atomic.Int32
+}
+
+func newFakeBackend(t *testing.T, handler func(conn net.Conn, payload []byte)) *fakeBackend {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	fb := &fakeBackend{ln: ln, handler: handler}
+	t.Cleanup(func() { ln.Close() })
+	go fb.serve()
+	return fb
+}
+
+func (fb *fakeBackend) serve() {
+	for {
+		conn, err := fb.ln.Accept()
+		if err != nil {
+			return
+		}
+		fb.accepted.Add(1)
+		go fb.serveConn(conn)
+	}
+}
+
+func (fb *fakeBackend) serveConn(conn net.Conn) {
+	defer conn.Close()
+	version := fb.version
+	if version == "" {
+		version = defaultServerVersion
+	}
+	if fb.tls == nil {
+		caps := uint32(serverCapabilities)
+		if fb.compress.Load() {
+			caps |= capCompress
+		}
+		scramble, err := sendHandshake(conn, uint32(fb.accepted.Load()), version, caps, nativePasswordPlugin)
+		if err != nil {
+			return
+		}
+		resp, err := HandleHandshake(conn, conn, scramble, 0)
+		if err != nil {
+			return
+		}
+		if resp.Capabilities&capCompress != 0 {
+			fb.compressed.Add(1)
+			conn = newCompressedConn(conn)
+		}
+	} else {
+		scramble, err := sendHandshake(conn, uint32(fb.accepted.Load()), version, serverCapabilities|capSSL, nativePasswordPlugin)
+		if err != nil {
+			return
+		}
+		pkt, err := ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(pkt.Payload) != 32 || binary.LittleEndian.Uint32(pkt.Payload)&capSSL == 0 {
+			WritePacket(conn, pkt.Sequence+1, NewErrPacket(3159, "HY000", "Connections using insecure transport are prohibited"))
+			return
+		}
+		tlsConn := tls.Server(conn, fb.tls)
+		if _, err := HandleHandshake(tlsConn, tlsConn, scramble, pkt.Sequence); err != nil {
+			return
+		}
+		conn = tlsConn
+	}
+	for {
+		pkt, err := ReadPacket(conn)
+		if err != nil || len(pkt.Payload) == 0 || pkt.Payload[0] == COM_QUIT {
+			return
+		}
+		switch pkt.Payload[0] {
+		case COM_PING:
+			fb.pings.Add(1)
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			continue
+		case COM_RESET_CONNECTION:
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			continue
+		case COM_QUERY:
+			fb.queries.Add(1)
+		}
+		fb.handler(conn, pkt.Payload)
+	}
+}
+
+func (fb *fakeBackend) config() BackendConfig {
+	return BackendConfig{Addr: fb.ln.Addr().String(), User: "root", Password: "password"}
+}
+
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	srv.checkBackends(context.Background())
+	return srv
+}
+
+// dialProxy connects an authenticated client to srv over an in-memory pipe.
+func dialProxy(t *testing.T, srv *Server) net.Conn {
+	t.Helper()
+	return dialProxyAs(t, srv, "root")
+}
+
+// dialProxyAs is dialProxy authenticating as user.
+func dialProxyAs(t *testing.T, srv *Server, user string) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go srv.Handle(server)
+	t.Cleanup(func() { client.Close() })
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientHandshake(client, user, "password", ""); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	return client
+}
+
+func TestBackendReadTimeoutPoisonsConnection(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		// Start a result set, then stall mid-response.
+		WritePacket(conn, 1, []byte{0x01})
+		io.Copy(io.Discard, conn)
+	})
+	cfg := fb.config()
+	cfg.ReadTimeout = 50 * time.Millisecond
+	srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}})
+
+	discarded := metrics.BackendConnsDiscarded.WithLabelValues("timeout")
+	before := testutil.ToFloat64(discarded)
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT SLEEP(10)"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+
+	pkt, err := ReadPacket(client)
+	if err != nil {
+		t.Fatalf("read column count: %v", err)
+	}
+	if pkt.Sequence != 1 || pkt.Payload[0] != 0x01 {
+		t.Fatalf("unexpected first packet: seq=%d payload=%x", pkt.Sequence, pkt.Payload)
+	}
+
+	pkt, err = ReadPacket(client)
+	if err != nil {
+		t.Fatalf("read error packet: %v", err)
+	}
+	sqlErr, err := ParseErrPacket(pkt.Payload)
+	if err != nil {
+		t.Fatalf("expected ERR packet, got %x", pkt.Payload)
+	}
+	if sqlErr.Code != 3024 || pkt.Sequence != 2 {
+		t.Fatalf("unexpected error: seq=%d %v", pkt.Sequence, sqlErr)
+	}
+
+	if got := testutil.ToFloat64(discarded) - before; got != 1 {
+		t.Fatalf("expected one timeout discard, got %v", got)
+	}
+	if idle := srv.router.Route("").Pool().Idle(); idle != 0 {
+		t.Fatalf("poisoned connection returned to pool: idle=%d", idle)
+	}
+}
+
+func TestIdleConnectionsKeptAlive(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {})
+	cfg := fb.config()
+	cfg.KeepAliveInterval = 20 * time.Millisecond
+	srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}, HealthCheckInterval: time.Hour})
+	pool := srv.router.Route("").Pool()
+
+	// Two idle connections, one left by the initial health check.
+	a, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	b, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	pool.Put(a)
+	pool.Put(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Run(ctx)
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// Each connection is pinged repeatedly on top of the health checks.
+	before := fb.pings.Load()
+	waitFor("keepalive pings", func() bool { return fb.pings.Load()-before >= 6 })
+
+	// A connection the backend has dropped is closed instead of being
+	// handed to a client.
+	discarded := metrics.BackendConnsDiscarded.WithLabelValues("keepalive")
+	dropped := testutil.ToFloat64(discarded)
+	waitFor("an idle connection not being pinged", func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		if len(pool.idle) < 2 {
+			return false
+		}
+		pool.idle[0].conn.Close()
+		return true
+	})
+	waitFor("the dead connection to be discarded", func() bool { return testutil.ToFloat64(discarded)-dropped == 1 })
+	waitFor("one idle connection", func() bool { return pool.Idle() == 1 })
+}
+
+func TestPoolChecksIdleConnections(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {})
+	cfg := fb.config()
+	cfg.CheckIdle = time.Minute
+	cfg.MaxIdleTime = time.Hour
+	srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}, HealthCheckInterval: time.Hour})
+	pool := srv.router.Route("").Pool()
+
+	get := func() *BackendConn {
+		t.Helper()
+		bc, err := pool.Get(context.Background())
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		return bc
+	}
+	bc := get()
+	accepted := fb.accepted.Load()
+
+	// A recently used connection is handed out unchecked.
+	pool.Put(bc)
+	pings := fb.pings.Load()
+	if get() != bc || fb.pings.Load() != pings {
+		t.Fatalf("recently used connection not handed out unchecked")
+	}
+
+	// One unused for CheckIdle is pinged first.
+	bc.lastUsed = time.Now().Add(-2 * time.Minute)
+	pool.Put(bc)
+	if get() != bc || fb.pings.Load() != pings+1 {
+		t.Fatalf("idle connection not pinged before being handed out")
+	}
+
+	// One failing the ping is replaced.
+	failed := metrics.BackendConnsDiscarded.WithLabelValues("health_check")
+	before := testutil.ToFloat64(failed)
+	bc.lastUsed = time.Now().Add(-2 * time.Minute)
+	pool.Put(bc)
+	bc.conn.Close()
+	if got := get(); got == bc {
+		t.Fatalf("connection failing its health check handed out")
+	} else {
+		bc = got
+	}
+	if got := testutil.ToFloat64(failed) - before; got != 1 {
+		t.Fatalf("connections failing their health check discarded: got %v, want 1", got)
+	}
+
+	// One unused past MaxIdleTime is replaced without a ping.
+	expired := metrics.BackendConnsDiscarded.WithLabelValues("max_idle_time")
+	before = testutil.ToFloat64(expired)
+	bc.lastUsed = time.Now().Add(-2 * time.Hour)
+	pool.Put(bc)
+	pings = fb.pings.Load()
+	if got := get(); got == bc || fb.pings.Load() != pings {
+		t.Fatalf("connection past MaxIdleTime handed out or pinged")
+	}
+	if got := testutil.ToFloat64(expired) - before; got != 1 {
+		t.Fatalf("connections past MaxIdleTime discarded: got %v, want 1", got)
+	}
+	if got := fb.accepted.Load() - accepted; got != 2 {
+		t.Fatalf("replacement connections dialed: got %d, want 2", got)
+	}
+}
+
+func TestBackendForwardsQuery(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(3, 7, 0))
+	})
+	cfg := fb.config()
+	srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}})
+
+	client := dialProxy(t, srv)
+	for i := 0; i < 2; i++ {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DELETE FROM t"...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		pkt, err := ReadPacket(client)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if pkt.Payload[0] != 0x00 || pkt.Payload[1] != 3 {
+			t.Fatalf("unexpected response: %x", pkt.Payload)
+		}
+	}
+	if n := fb.accepted.Load(); n != 1 {
+		t.Fatalf("expected pooled connection to be reused, backend saw %d connections", n)
+	}
+}
+
+func TestBackendRelaysMultiStatementResults(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		if string(payload[1:]) != "UPDATE a SET x = 1; UPDATE b SET y = 2" {
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			return
+		}
+		WritePacket(conn, 1, NewOKPacket(2, 0, serverMoreResultsExists))
+		WritePacket(conn, 2, NewOKPacket(3, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "UPDATE a SET x = 1; UPDATE b SET y = 2"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	for i, want := range []struct {
+		rows   byte
+		status uint16
+	}{{2, serverMoreResultsExists}, {3, 0}} {
+		pkt := mustReadPacket(t, client)
+		if pkt.Payload[0] != 0x00 || pkt.Payload[1] != want.rows || okPacketStatus(pkt.Payload) != want.status {
+			t.Fatalf("result %d: got %x", i, pkt.Payload)
+		}
+	}
+
+	// Nothing of the batch is left over to desync the next command.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 || pkt.Payload[1] != 0 {
+		t.Fatalf("next query: got %x", pkt.Payload)
+	}
+}
+
+func TestBackendDesyncClosesConnection(t *testing.T) {
+	responses := map[string][][]byte{
+		"EOF header":         {{0xFE, 0x00, 0x00, 0x02, 0x00}},
+		"garbage header":     {{0xFC, 0xFF}},
+		"column definition":  {{1}, {0x42, 0x42, 0x42}},
+		"missing column EOF": {{1}, ColumnDef{Name: "a"}.packet(), {0x01, 'x'}},
+	}
+	for name, packets := range responses {
+		t.Run(name, func(t *testing.T) {
+			fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+				for i, p := range packets {
+					WritePacket(conn, uint8(i+1), p)
+				}
+			})
+			srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+			discarded := metrics.BackendConnsDiscarded.WithLabelValues("desync")
+			before := testutil.ToFloat64(discarded)
+
+			client := dialProxy(t, srv)
+			if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT a FROM t"...)); err != nil {
+				t.Fatalf("write query: %v", err)
+			}
+			var pkt *Packet
+			for {
+				// Packets before the desync are relayed as usual.
+				pkt = mustReadPacket(t, client)
+				if pkt.Payload[0] == 0xFF {
+					break
+				}
+			}
+			if sqlErr, _ := ParseErrPacket(pkt.Payload); sqlErr == nil || sqlErr.Code != 1835 {
+				t.Fatalf("expected error 1835, got %x", pkt.Payload)
+			}
+			if _, err := ReadPacket(client); err == nil {
+				t.Fatalf("client connection still open after desync")
+			}
+			if got := testutil.ToFloat64(discarded) - before; got != 1 {
+				t.Fatalf("desynced backend connections discarded: got %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestBackendRelaysLargeRow(t *testing.T) {
+	value := bytes.Repeat([]byte{'x'}, maxPacketChunk+100)
+	row := AppendLengthEncodedString(nil, string(value))
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, []byte{1})
+		WritePacket(conn, 2, ColumnDef{Name: "a"}.packet())
+		WritePacket(conn, 3, []byte{0xFE, 0x00, 0x00, 0x02, 0x00})
+		next, _ := WriteLargePacket(conn, 4, row)
+		WritePacket(conn, next, []byte{0xFE, 0x00, 0x00, 0x02, 0x00})
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT a FROM t"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		mustReadPacket(t, client)
+	}
+	pkt, err := ReadFullMessage(client)
+	if err != nil {
+		t.Fatalf("read row: %v", err)
+	}
+	if !bytes.Equal(pkt.Payload, row) || pkt.Sequence != 5 {
+		t.Fatalf("got a %d byte row ending at sequence %d, want %d bytes ending at 5", len(pkt.Payload), pkt.Sequence, len(row))
+	}
+	if pkt := mustReadPacket(t, client); !isEOFPacket(pkt.Payload) || pkt.Sequence != 6 {
+		t.Fatalf("got packet %d %x, want EOF at 6", pkt.Sequence, pkt.Payload)
+	}
+}
+
+func TestBackendClosedMidResult(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		if string(payload[1:]) != "SELECT a FROM t" {
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			return
+		}
+		WritePacket(conn, 1, []byte{1})
+		WritePacket(conn, 2, ColumnDef{Name: "a"}.packet())
+		WritePacket(conn, 3, []byte{0xFE, 0x00, 0x00, 0x02, 0x00})
+		WritePacket(conn, 4, []byte{0x01, 'x'})
+		conn.Close()
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT a FROM t"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	var pkt *Packet
+	for {
+		// The rows read before the backend closed are relayed.
+		pkt = mustReadPacket(t, client)
+		if pkt.Payload[0] == 0xFF {
+			break
+		}
+	}
+	if sqlErr, _ := ParseErrPacket(pkt.Payload); sqlErr == nil || sqlErr.Code != 2013 || sqlErr.SQLState != "HY000" {
+		t.Fatalf("expected error 2013, got %x", pkt.Payload)
+	}
+
+	// The client stays connected and is served by a new backend connection.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("next query: got %x", pkt.Payload)
+	}
+	if got := fb.accepted.Load(); got != 2 {
+		t.Fatalf("backend connections: got %d, want 2", got)
+	}
+}
+
+func TestBackendSequenceChecked(t *testing.T) {
+	// A result set of 300 rows numbers its packets past 255.
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		if string(payload[1:]) == "DO 1" {
+			WritePacket(conn, 2, NewOKPacket(0, 0, 0))
+			return
+		}
+		seq := uint8(1)
+		write := func(p []byte) {
+			WritePacket(conn, seq, p)
+			seq++
+		}
+		write([]byte{1})
+		write(ColumnDef{Name: "a"}.packet())
+		write([]byte{0xFE, 0x00, 0x00, 0x02, 0x00})
+		for i := 0; i < 300; i++ {
+			write([]byte{0x01, 'x'})
+		}
+		write([]byte{0xFE, 0x00, 0x00, 0x02, 0x00})
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT a FROM t"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	for i := 1; i <= 304; i++ {
+		if pkt := mustReadPacket(t, client); pkt.Sequence != uint8(i) {
+			t.Fatalf("packet %d has sequence %d", i, pkt.Sequence)
+		}
+	}
+
+	// A packet out of sequence desyncs the connection.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	pkt := mustReadPacket(t, client)
+	if sqlErr, _ := ParseErrPacket(pkt.Payload); sqlErr == nil || sqlErr.Code != 1835 {
+		t.Fatalf("expected error 1835, got %x", pkt.Payload)
+	}
+}
+
+func TestLocalInfileDeclined(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		if string(payload[1:]) != "LOAD DATA LOCAL INFILE 'rows.csv' INTO TABLE t" {
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			return
+		}
+		WritePacket(conn, 1, append([]byte{localInfileHeader}, "rows.csv"...))
+		if pkt, err := ReadPacket(conn); err != nil || len(pkt.Payload) != 0 || pkt.Sequence != 2 {
+			return
+		}
+		WritePacket(conn, 3, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "LOAD DATA LOCAL INFILE 'rows.csv' INTO TABLE t"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if sqlErr, err := ParseErrPacket(mustReadPacket(t, client).Payload); err != nil || sqlErr.Code != 1148 {
+		t.Fatalf("expected error 1148, got %v %v", sqlErr, err)
+	}
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("next query: got %x", pkt.Payload)
+	}
+	if n := fb.accepted.Load(); n != 1 {
+		t.Fatalf("backend connection replaced after LOCAL INFILE: %d connections", n)
+	}
+}
+
+// writeTestResultSet writes rs from a fake backend as the response to a
+// command.
+func writeTestResultSet(conn net.Conn, rs *ResultSet) {
+	for i, p := range rs.Packets() {
+		WritePacket(conn, uint8(i+1), p)
+	}
+}
+
+// readTestResultSet reads a text result set from the proxy and returns its
+// column names and rows.
+func readTestResultSet(t *testing.T, conn net.Conn) ([]string, [][]string) {
+	t.Helper()
+	first := mustReadPacket(t, conn)
+	if first.Payload[0] == 0xFF || first.Payload[0] == 0x00 {
+		t.Fatalf("expected a result set, got %x", first.Payload)
+	}
+	count, _, err := ReadLengthEncodedInt(first.Payload)
+	if err != nil {
+		t.Fatalf("column count: %v", err)
+	}
+	var names []string
+	for i := uint64(0); i < count; i++ {
+		col, err := parseColumnDef(mustReadPacket(t, conn).Payload)
+		if err != nil {
+			t.Fatalf("column definition: %v", err)
+		}
+		names = append(names, col.Name)
+	}
+	if pkt := mustReadPacket(t, conn); !isEOFPacket(pkt.Payload) {
+		t.Fatalf("expected EOF after column definitions, got %x", pkt.Payload)
+	}
+	var rows [][]string
+	for {
+		pkt := mustReadPacket(t, conn)
+		if isEOFPacket(pkt.Payload) {
+			return names, rows
+		}
+		values, err := parseTextRow(pkt.Payload, int(count))
+		if err != nil {
+			t.Fatalf("row: %v", err)
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			if v == nil {
+				row[i] = "NULL"
+			} else {
+				row[i] = string(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// TLSVerifyMode selects how a backend's certificate is verified.
+type TLSVerifyMode string
+
+const (
+	// TLSVerifyFull verifies the certificate chain and that the certificate
+	// matches the backend host name. It is the default.
+	TLSVerifyFull TLSVerifyMode = "verify-full"
+	// TLSVerifyCA verifies the certificate chain but not the host name.
+	TLSVerifyCA TLSVerifyMode = "verify-ca"
+	// TLSSkipVerify encrypts the connection without verifying the backend.
+	TLSSkipVerify TLSVerifyMode = "skip-verify"
+)
+
+// BackendTLSConfig enables TLS on connections from the proxy to a backend.
+// It is independent of how clients connect to the proxy.
+type BackendTLSConfig struct {
+	// CAFile is a PEM bundle of the CAs trusted to sign the backend
+	// certificate. The system roots are used when empty.
+	CAFile string
+	// CertFile and KeyFile are an optional client certificate presented to
+	// the backend.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name verified against the certificate;
+	// it defaults to the host of the backend address.
+	ServerName string
+	Verify     TLSVerifyMode
+	// MinVersion is the oldest TLS version accepted, "1.2" (the default) or
+	// "1.3".
+	MinVersion string
+	// CipherSuites, when set, are the only cipher suites accepted, by their
+	// standard names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3
+	// suites cannot be restricted and are always accepted.
+	CipherSuites []string
+}
+
+// ErrTLSPolicy is returned when a backend cannot negotiate a TLS version
+// or cipher suite allowed by BackendTLSConfig.
+var ErrTLSPolicy = errors.New("backend TLS handshake rejected by TLS version or cipher policy")
+
+// tlsVersions are the values of BackendTLSConfig.MinVersion and of the
+// minVersion of ApplyTLSPolicy.
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuites looks up suites by name among those Go considers secure.
+func cipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		found := false
+		for _, cs := range tls.CipherSuites() {
+			if cs.Name == name {
+				ids = append(ids, cs.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+	}
+	return ids, nil
+}
+
+// ApplyTLSPolicy restricts cfg to TLS versions from minVersion on and to
+// cipherNames, named as in BackendTLSConfig. It is how the same policy is
+// applied to the Config.TLS offered to clients.
+func ApplyTLSPolicy(cfg *tls.Config, minVersion string, cipherNames []string) error {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return fmt.Errorf("unsupported minimum TLS version %q: must be 1.2 or 1.3", minVersion)
+	}
+	suites, err := cipherSuites(cipherNames)
+	if err != nil {
+		return err
+	}
+	cfg.MinVersion, cfg.CipherSuites = version, suites
+	return nil
+}
+
+// clientConfig builds the tls.Config used to dial the backend at addr.
+func (c *BackendTLSConfig) clientConfig(addr string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: c.ServerName}
+	if err := ApplyTLSPolicy(cfg, c.MinVersion, c.CipherSuites); err != nil {
+		return nil, err
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg.ServerName = host
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read backend CA: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load backend client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch c.Verify {
+	case "", TLSVerifyFull:
+	case TLSVerifyCA:
+		// Verify the chain ourselves, skipping only the host name check.
+		roots := cfg.RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("backend presented no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	case TLSSkipVerify:
+		cfg.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("unknown TLS verify mode %q", c.Verify)
+	}
+	return cfg, nil
+}
+
+// startTLS asks the backend to switch to TLS with an SSLRequest packet and
+// performs the TLS handshake, returning the encrypted connection.
+func startTLS(conn net.Conn, caps uint32, seq uint8, cfg *tls.Config) (net.Conn, error) {
+	req := make([]byte, 32)
+	putHandshakeHeader(req, caps)
+	if err := WritePacket(conn, seq, req); err != nil {
+		return nil, fmt.Errorf("write SSL request: %w", err)
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		if tlsPolicyFailure(err) {
+			return nil, fmt.Errorf("%w: %v", ErrTLSPolicy, err)
+		}
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// tlsPolicyFailure reports whether a handshake failed because no allowed
+// version or cipher suite was common to both ends. crypto/tls does not
+// export its alerts, so this goes by their descriptions.
+func tlsPolicyFailure(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{"protocol version not supported", "unsupported protocol version", "handshake failure", "no cipher suite supported"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTLS logs and counts the TLS version and cipher suite negotiated with
+// the backend, so connections still on weak ones can be found. Both are
+// named from fixed sets, bounding the metric's labels.
+func (bc *BackendConn) recordTLS(cs tls.ConnectionState) {
+	bc.tlsVersion = tls.VersionName(cs.Version)
+	bc.tlsCipher = tls.CipherSuiteName(cs.CipherSuite)
+	metrics.BackendTLSConnections.WithLabelValues(bc.backend.cfg.Name, bc.tlsVersion, bc.tlsCipher).Inc()
+	logrus.WithFields(logrus.Fields{
+		"backend":     bc.backend.cfg.Name,
+		"thread_id":   bc.threadID,
+		"tls_version": bc.tlsVersion,
+		"tls_cipher":  bc.tlsCipher,
+	}).Info("backend TLS connection established")
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// newTLSFakeBackend starts a fakeBackend that only accepts TLS clients and
+// returns it with the path of the PEM file holding its CA. configure
+// adjusts the backend's TLS configuration.
+func newTLSFakeBackend(t *testing.T, handler func(conn net.Conn, payload []byte), configure ...func(*tls.Config)) (*fakeBackend, string) {
+	t.Helper()
+	cert, caPEM := newTestCertificate(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	fb := &fakeBackend{ln: ln, handler: handler, tls: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	for _, f := range configure {
+		f(fb.tls)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go fb.serve()
+	return fb, caFile
+}
+
+// newTestCertificate issues a certificate for 127.0.0.1 from a throwaway CA
+// and returns it with the CA certificate in PEM form.
+func newTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "metal test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "backend"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+}
+
+func TestBackendTLS(t *testing.T) {
+	fb, caFile := newTLSFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+
+	cfg := fb.config()
+	cfg.TLS = &BackendTLSConfig{CAFile: caFile}
+	srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}})
+	if !srv.Ready() {
+		t.Fatalf("TLS backend failed its health check")
+	}
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected OK over the TLS backend, got %x", pkt.Payload)
+	}
+	if fb.queries.Load() != 1 {
+		t.Fatalf("backend saw %d queries, want 1", fb.queries.Load())
+	}
+
+	bc, err := srv.router.Route("").pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get backend connection: %v", err)
+	}
+	defer srv.router.Route("").pool.Put(bc)
+	if bc.tlsVersion != "TLS 1.3" || bc.tlsCipher == "" {
+		t.Fatalf("negotiated TLS recorded as %q %q, want TLS 1.3 and a cipher suite", bc.tlsVersion, bc.tlsCipher)
+	}
+	counted := metrics.BackendTLSConnections.WithLabelValues(bc.backend.Name(), bc.tlsVersion, bc.tlsCipher)
+	if testutil.ToFloat64(counted) == 0 {
+		t.Fatalf("TLS connection not counted")
+	}
+}
+
+func TestBackendTLSVerification(t *testing.T) {
+	fb, caFile := newTLSFakeBackend(t, func(conn net.Conn, payload []byte) {})
+	_, otherCA := newTestCertificate(t)
+	otherFile := filepath.Join(t.TempDir(), "other.pem")
+	if err := os.WriteFile(otherFile, otherCA, 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		tls  *BackendTLSConfig
+		ok   bool
+	}{
+		{"plaintext", nil, false},
+		{"untrusted CA", &BackendTLSConfig{CAFile: otherFile}, false},
+		{"wrong host name", &BackendTLSConfig{CAFile: caFile, ServerName: "db.example.com"}, false},
+		{"verify-ca ignores host name", &BackendTLSConfig{CAFile: caFile, ServerName: "db.example.com", Verify: TLSVerifyCA}, true},
+		{"skip-verify", &BackendTLSConfig{Verify: TLSSkipVerify}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := fb.config()
+			cfg.TLS = c.tls
+			srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}})
+			if srv.Ready() != c.ok {
+				t.Fatalf("Ready() = %v, want %v", srv.Ready(), c.ok)
+			}
+		})
+	}
+}
+
+func TestBackendTLSPolicy(t *testing.T) {
+	cases := []struct {
+		name string
+		// backend is the newest TLS version the backend speaks.
+		backend    uint16
+		minVersion string
+		ciphers    []string
+		ok         bool
+	}{
+		{"defaults", tls.VersionTLS12, "", nil, true},
+		{"TLS 1.0 backend", tls.VersionTLS10, "1.2", nil, false},
+		{"minimum above the backend's", tls.VersionTLS12, "1.3", nil, false},
+		{"allowed cipher", tls.VersionTLS12, "1.2", []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}, true},
+		{"cipher outside the allowlist", tls.VersionTLS12, "1.2", []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fb, caFile := newTLSFakeBackend(t, func(conn net.Conn, payload []byte) {}, func(cfg *tls.Config) {
+				cfg.MinVersion, cfg.MaxVersion = tls.VersionTLS10, c.backend
+				cfg.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}
+			})
+			cfg := fb.config()
+			cfg.TLS = &BackendTLSConfig{CAFile: caFile, MinVersion: c.minVersion, CipherSuites: c.ciphers}
+			srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}})
+			bc, err := srv.router.Route("").dial(context.Background())
+			if c.ok {
+				if err != nil {
+					t.Fatalf("dial: %v", err)
+				}
+				bc.Close()
+				return
+			}
+			if !errors.Is(err, ErrTLSPolicy) {
+				t.Fatalf("expected the handshake to be rejected by TLS policy, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBackendTLSConfigErrors(t *testing.T) {
+	cfg := BackendConfig{Addr: "127.0.0.1:1", TLS: &BackendTLSConfig{Verify: "sometimes"}}
+	if _, err := NewServer(Config{Backends: []BackendConfig{cfg}}); err == nil {
+		t.Fatalf("expected an error for an unknown verify mode")
+	}
+	cfg.TLS = &BackendTLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}
+	if _, err := NewServer(Config{Backends: []BackendConfig{cfg}}); err == nil {
+		t.Fatalf("expected an error for a missing CA file")
+	}
+	cfg.TLS = &BackendTLSConfig{MinVersion: "1.0"}
+	if _, err := NewServer(Config{Backends: []BackendConfig{cfg}}); err == nil {
+		t.Fatalf("expected an error for a minimum version below TLS 1.2")
+	}
+	cfg.TLS = &BackendTLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}
+	if _, err := NewServer(Config{Backends: []BackendConfig{cfg}}); err == nil {
+		t.Fatalf("expected an error for an insecure cipher suite")
+	}
+}
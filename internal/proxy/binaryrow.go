@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Further column types understood by the binary row encoder.
+const (
+	TypeDecimal    byte = 0x00
+	TypeTiny       byte = 0x01
+	TypeShort      byte = 0x02
+	TypeLong       byte = 0x03
+	TypeFloat      byte = 0x04
+	TypeDouble     byte = 0x05
+	TypeInt24      byte = 0x09
+	TypeYear       byte = 0x0D
+	TypeVarchar    byte = 0x0F
+	TypeBit        byte = 0x10
+	TypeJSON       byte = 0xF5
+	TypeNewDecimal byte = 0xF6
+	TypeEnum       byte = 0xF7
+	TypeSet        byte = 0xF8
+	TypeTinyBlob   byte = 0xF9
+	TypeMediumBlob byte = 0xFA
+	TypeLongBlob   byte = 0xFB
+	TypeBlob       byte = 0xFC
+	TypeString     byte = 0xFE
+	TypeGeometry   byte = 0xFF
+)
+
+// FlagUnsigned marks an unsigned numeric column.
+const FlagUnsigned uint16 = 0x0020
+
+// NewBinaryRowPacket encodes a row of the binary protocol used in
+// COM_STMT_EXECUTE responses: a 0x00 header, the NULL bitmap and each
+// non-NULL value in the encoding of its column type. Values may be nil,
+// signed or unsigned integers, floats, strings or byte slices.
+func NewBinaryRowPacket(columns []ColumnDef, values []any) ([]byte, error) {
+	if len(values) != len(columns) {
+		return nil, fmt.Errorf("binary row: %d values for %d columns", len(values), len(columns))
+	}
+	// The bitmap of a binary row starts at bit 2.
+	bitmap := make([]byte, (len(columns)+7+2)/8)
+	p := append([]byte{0x00}, bitmap...)
+	for i, v := range values {
+		if v == nil {
+			p[1+(i+2)/8] |= 1 << ((i + 2) % 8)
+			continue
+		}
+		var err error
+		if p, err = appendBinaryValue(p, columns[i].Type, v); err != nil {
+			return nil, fmt.Errorf("binary row: column %q: %w", columns[i].Name, err)
+		}
+	}
+	return p, nil
+}
+
+func appendBinaryValue(p []byte, typ byte, v any) ([]byte, error) {
+	switch typ {
+	case TypeTiny, TypeShort, TypeYear, TypeLong, TypeInt24, TypeLongLong:
+		n, err := binaryInt(v)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case TypeTiny:
+			return append(p, byte(n)), nil
+		case TypeShort, TypeYear:
+			return binary.LittleEndian.AppendUint16(p, uint16(n)), nil
+		case TypeLong, TypeInt24:
+			return binary.LittleEndian.AppendUint32(p, uint32(n)), nil
+		default:
+			return binary.LittleEndian.AppendUint64(p, n), nil
+		}
+	case TypeFloat, TypeDouble:
+		f, err := binaryFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if typ == TypeFloat {
+			return binary.LittleEndian.AppendUint32(p, math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(p, math.Float64bits(f)), nil
+	case TypeDecimal, TypeNewDecimal, TypeVarchar, TypeVarString, TypeString, TypeBit,
+		TypeJSON, TypeEnum, TypeSet, TypeTinyBlob, TypeMediumBlob, TypeLongBlob, TypeBlob, TypeGeometry:
+		switch v := v.(type) {
+		case string:
+			return AppendLengthEncodedString(p, v), nil
+		case []byte:
+			return AppendLengthEncodedString(p, string(v)), nil
+		default:
+			return AppendLengthEncodedString(p, fmt.Sprint(v)), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported column type 0x%02x", typ)
+}
+
+// binaryInt returns the two's complement bits of an integer value.
+func binaryInt(v any) (uint64, error) {
+	switch v := v.(type) {
+	case int:
+		return uint64(v), nil
+	case int8:
+		return uint64(v), nil
+	case int16:
+		return uint64(v), nil
+	case int32:
+		return uint64(v), nil
+	case int64:
+		return uint64(v), nil
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%T is not an integer", v)
+}
+
+func binaryFloat(v any) (float64, error) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	n, err := binaryInt(v)
+	if err != nil {
+		return 0, fmt.Errorf("%T is not a number", v)
+	}
+	return float64(int64(n)), nil
+}
+
+// BinaryPackets encodes the result set as a COM_STMT_EXECUTE response. The
+// text values are converted according to each column's type.
+func (rs *ResultSet) BinaryPackets() ([][]byte, error) {
+	return rs.BinaryPacketsFor(0)
+}
+
+// BinaryPacketsFor is BinaryPackets framed for a client that negotiated
+// caps, as PacketsFor is.
+func (rs *ResultSet) BinaryPacketsFor(caps uint32) ([][]byte, error) {
+	packets := rs.headerPackets(caps)
+	for _, row := range rs.Rows {
+		values := make([]any, len(row))
+		for i, s := range row {
+			v, err := binaryValueOf(rs.Columns[i], s)
+			if err != nil {
+				return nil, fmt.Errorf("column %q: %w", rs.Columns[i].Name, err)
+			}
+			values[i] = v
+		}
+		p, err := NewBinaryRowPacket(rs.Columns, values)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+	return append(packets, resultSetEnd(caps)), nil
+}
+
+// binaryValueOf parses the text form of a value into the Go value the
+// binary encoding of col expects.
+func binaryValueOf(col ColumnDef, s string) (any, error) {
+	switch col.Type {
+	case TypeTiny, TypeShort, TypeYear, TypeLong, TypeInt24, TypeLongLong:
+		if col.Flags&FlagUnsigned != 0 {
+			return strconv.ParseUint(s, 10, 64)
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case TypeFloat, TypeDouble:
+		return strconv.ParseFloat(s, 64)
+	}
+	return s, nil
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestNewBinaryRowPacket(t *testing.T) {
+	columns := []ColumnDef{
+		{Name: "id", Type: TypeLongLong},
+		{Name: "name", Type: TypeVarString},
+		{Name: "age", Type: TypeTiny},
+		{Name: "note", Type: TypeVarString},
+		{Name: "score", Type: TypeLong},
+	}
+	p, err := NewBinaryRowPacket(columns, []any{int64(-2), "bob", 42, nil, uint32(7)})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	want := []byte{0x00, 1 << 5} // header, NULL bitmap with column 3 (bit 3+2) set
+	want = binary.LittleEndian.AppendUint64(want, uint64(0xFFFFFFFFFFFFFFFE))
+	want = append(want, 3, 'b', 'o', 'b')
+	want = append(want, 42)
+	want = binary.LittleEndian.AppendUint32(want, 7)
+	if !bytes.Equal(p, want) {
+		t.Fatalf("got  %x\nwant %x", p, want)
+	}
+
+	if _, err := NewBinaryRowPacket(columns[:1], []any{"x"}); err == nil {
+		t.Fatalf("expected an error encoding a string as BIGINT")
+	}
+}
+
+func TestBinaryRowNullBitmapSpansBytes(t *testing.T) {
+	columns := make([]ColumnDef, 7)
+	values := make([]any, 7)
+	for i := range columns {
+		columns[i] = ColumnDef{Type: TypeTiny}
+	}
+	p, err := NewBinaryRowPacket(columns, values)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	// Seven NULLs occupy bits 2..8: two bitmap bytes and no values.
+	if want := []byte{0x00, 0xFC, 0x01}; !bytes.Equal(p, want) {
+		t.Fatalf("got %x, want %x", p, want)
+	}
+}
+
+func TestPreparedPingAnsweredInBinaryProtocol(t *testing.T) {
+	srv := newTestServer(t, Config{PingQueries: []string{"SELECT 1"}})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_STMT_PREPARE}, "SELECT 1"...)); err != nil {
+		t.Fatalf("write prepare: %v", err)
+	}
+	ok := mustReadPacket(t, client).Payload
+	// The test client negotiates CLIENT_OPTIONAL_RESULTSET_METADATA, so the
+	// metadata flag follows the warning count.
+	if ok[0] != 0x00 || len(ok) != 13 || ok[12] != resultsetMetadataFull {
+		t.Fatalf("expected COM_STMT_PREPARE_OK, got %x", ok)
+	}
+	id := binary.LittleEndian.Uint32(ok[1:])
+	if cols := binary.LittleEndian.Uint16(ok[5:]); cols != 1 {
+		t.Fatalf("prepared statement has %d columns, want 1", cols)
+	}
+	mustReadPacket(t, client) // column definition
+	mustReadPacket(t, client) // EOF
+
+	exec := []byte{COM_STMT_EXECUTE}
+	exec = binary.LittleEndian.AppendUint32(exec, id)
+	exec = append(exec, 0, 1, 0, 0, 0)
+	if err := WritePacket(client, 0, exec); err != nil {
+		t.Fatalf("write execute: %v", err)
+	}
+	if count := mustReadPacket(t, client).Payload; !bytes.Equal(count, []byte{1, resultsetMetadataFull}) {
+		t.Fatalf("column count = %x", count)
+	}
+	col, err := parseColumnDef(mustReadPacket(t, client).Payload)
+	if err != nil || col.Type != TypeLongLong {
+		t.Fatalf("column definition = %+v, %v", col, err)
+	}
+	mustReadPacket(t, client) // EOF
+	row := mustReadPacket(t, client).Payload
+	if want := []byte{0x00, 0x00, 1, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(row, want) {
+		t.Fatalf("binary row = %x, want %x", row, want)
+	}
+	if !isEOFPacket(mustReadPacket(t, client).Payload) {
+		t.Fatalf("expected EOF after the row")
+	}
+
+	// Closing has no response; executing afterwards fails.
+	if err := WritePacket(client, 0, append([]byte{COM_STMT_CLOSE}, exec[1:5]...)); err != nil {
+		t.Fatalf("write close: %v", err)
+	}
+	if err := WritePacket(client, 0, exec); err != nil {
+		t.Fatalf("write execute: %v", err)
+	}
+	if sqlErr, err := ParseErrPacket(mustReadPacket(t, client).Payload); err != nil || sqlErr.Code != 1243 {
+		t.Fatalf("execute after close: %v, %v", sqlErr, err)
+	}
+}
+
+func TestPreparedStatementLimit(t *testing.T) {
+	srv := newTestServer(t, Config{PingQueries: []string{"SELECT 1"}, MaxPreparedStatements: 2})
+	client := dialProxy(t, srv)
+
+	prepare := func() []byte {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_STMT_PREPARE}, "SELECT 1"...)); err != nil {
+			t.Fatalf("write prepare: %v", err)
+		}
+		p := mustReadPacket(t, client).Payload
+		if p[0] == 0x00 {
+			mustReadPacket(t, client) // column definition
+			mustReadPacket(t, client) // EOF
+		}
+		return p
+	}
+	first := prepare()
+	if p := prepare(); p[0] != 0x00 {
+		t.Fatalf("second prepare failed: %x", p)
+	}
+	sqlErr, err := ParseErrPacket(prepare())
+	if err != nil || sqlErr.Code != 1461 {
+		t.Fatalf("prepare beyond the limit: %v, %v", sqlErr, err)
+	}
+
+	// Closing a statement makes room for another.
+	if err := WritePacket(client, 0, append([]byte{COM_STMT_CLOSE}, first[1:5]...)); err != nil {
+		t.Fatalf("write close: %v", err)
+	}
+	if p := prepare(); p[0] != 0x00 {
+		t.Fatalf("prepare after close failed: %x", p)
+	}
+}
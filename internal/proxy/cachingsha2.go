@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// cachingSHA2Plugin is the authentication method MySQL 8.0 clients default
+// to.
+const cachingSHA2Plugin = "caching_sha2_password"
+
+// AuthMoreData packets of caching_sha2_password, and the client's request
+// for the server's public key.
+var (
+	fastAuthSuccess = []byte{0x01, 0x03}
+	fullAuthNeeded  = []byte{0x01, 0x04}
+)
+
+const requestPublicKey = 0x02
+
+// verifyCachingSHA2Password checks a client's caching_sha2_password fast
+// auth response, SHA256(password) XOR SHA256(digest + scramble), against
+// digest, the cached SHA256(SHA256(password)).
+func verifyCachingSHA2Password(clientResp string, digest, scramble []byte) bool {
+	resp := []byte(clientResp)
+	if len(resp) != sha256.Size || len(digest) != sha256.Size {
+		return false
+	}
+	h := sha256.New()
+	h.Write(digest)
+	h.Write(scramble)
+	mask := h.Sum(nil)
+
+	stage1 := make([]byte, sha256.Size)
+	for i := range stage1 {
+		stage1[i] = resp[i] ^ mask[i]
+	}
+	candidate := sha256.Sum256(stage1)
+	return subtle.ConstantTimeCompare(candidate[:], digest) == 1
+}
+
+// sha2Cache holds the SHA256(SHA256(password)) of users who completed a
+// full caching_sha2_password authentication, so later connections can use
+// the fast path. Entries are keyed to the password hash the AuthProvider
+// gave, so a changed password needs a full authentication again.
+type sha2Cache struct {
+	mu      sync.Mutex
+	entries map[string]sha2Entry
+}
+
+type sha2Entry struct {
+	hash   []byte
+	digest []byte
+}
+
+// digest returns the cached digest of user if it was cached for hash.
+func (c *sha2Cache) digest(user string, hash []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[user]
+	if !ok || subtle.ConstantTimeCompare(e.hash, hash) != 1 {
+		return nil
+	}
+	return e.digest
+}
+
+func (c *sha2Cache) put(user string, hash []byte, password string) {
+	stage1 := sha256.Sum256([]byte(password))
+	digest := sha256.Sum256(stage1[:])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]sha2Entry{}
+	}
+	c.entries[user] = sha2Entry{hash: hash, digest: digest[:]}
+}
+
+// authRSAKey is the key clients encrypt their password with for a full
+// caching_sha2_password authentication over an unencrypted connection.
+type authRSAKey struct {
+	key *rsa.PrivateKey
+	// pem is the public key sent to clients that ask for it.
+	pem []byte
+}
+
+// authRSAKeyFor returns the RSA key of cfg, generating one if it or one of
+// its listener profiles uses caching_sha2_password without configuring a
+// key. It validates AuthPlugin.
+func authRSAKeyFor(cfg Config) (*authRSAKey, error) {
+	sha2 := false
+	switch cfg.AuthPlugin {
+	case "", nativePasswordPlugin:
+	case cachingSHA2Plugin:
+		sha2 = true
+	default:
+		return nil, fmt.Errorf("unsupported auth plugin %q", cfg.AuthPlugin)
+	}
+	for _, p := range cfg.ListenerProfiles {
+		sha2 = sha2 || p.AuthPlugin == cachingSHA2Plugin
+	}
+	if !sha2 {
+		return nil, nil
+	}
+	key := cfg.AuthRSAKey
+	if key == nil {
+		var err error
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return nil, fmt.Errorf("generate auth RSA key: %w", err)
+		}
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshal auth RSA public key: %w", err)
+	}
+	return &authRSAKey{key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})}, nil
+}
+
+// cachingSHA2 completes a caching_sha2_password authentication of user
+// whose password has the mysql_native_password hash. authResp is the
+// client's fast auth response. If it does not match the cached digest the
+// client is asked for its password: in the clear over TLS, otherwise
+// encrypted with the proxy's RSA public key, which it may first request.
+// The password is checked against hash and its digest cached.
+func (ex *authExchange) cachingSHA2(user string, authResp, hash, scramble []byte, secure bool) (bool, error) {
+	if len(authResp) == 0 {
+		// An empty password.
+		return subtle.ConstantTimeCompare(hash, nativePasswordHash("")) == 1, nil
+	}
+	if digest := ex.sha2.digest(user, hash); digest != nil && verifyCachingSHA2Password(string(authResp), digest, scramble) {
+		metrics.CachingSHA2Auths.WithLabelValues("fast").Inc()
+		return true, ex.write(fastAuthSuccess)
+	}
+	if err := ex.write(fullAuthNeeded); err != nil {
+		return false, err
+	}
+	pkt, err := ex.read()
+	if err != nil {
+		return false, fmt.Errorf("read password: %w", err)
+	}
+	password := pkt.Payload
+	if !secure {
+		if len(password) == 1 && password[0] == requestPublicKey {
+			if err := ex.write(append([]byte{0x01}, ex.rsa.pem...)); err != nil {
+				return false, err
+			}
+			if pkt, err = ex.read(); err != nil {
+				return false, fmt.Errorf("read encrypted password: %w", err)
+			}
+		}
+		password, err = rsa.DecryptOAEP(sha1.New(), nil, ex.rsa.key, pkt.Payload, nil)
+		if err != nil {
+			return false, nil
+		}
+		// The password was XORed with the scramble before encryption.
+		for i := range password {
+			password[i] ^= scramble[i%len(scramble)]
+		}
+	}
+	plain := strings.TrimSuffix(string(password), "\x00")
+	if subtle.ConstantTimeCompare(nativePasswordHash(plain), hash) != 1 {
+		return false, nil
+	}
+	metrics.CachingSHA2Auths.WithLabelValues("full").Inc()
+	ex.sha2.put(user, hash, plain)
+	return true, nil
+}
+
+// authPlugin is the authentication method offered to clients.
+func (s *Server) authPlugin() string {
+	if s.cfg.AuthPlugin == "" {
+		return nativePasswordPlugin
+	}
+	return s.cfg.AuthPlugin
+}
+
+// authPlugin is the authentication method offered to the client: its
+// listener's, or the server's.
+func (c *Connection) authPlugin() string {
+	if c.profile.authPlugin != "" {
+		return c.profile.authPlugin
+	}
+	return c.server.authPlugin()
+}
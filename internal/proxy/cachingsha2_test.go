@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cachingSHA2Auth computes the caching_sha2_password fast auth response
+// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble).
+func cachingSHA2Auth(scramble []byte, password string) []byte {
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	mask := sha256.Sum256(append(stage2[:], scramble...))
+	for i := range mask {
+		mask[i] ^= stage1[i]
+	}
+	return mask[:]
+}
+
+// sha2Handshake authenticates to srv with caching_sha2_password, over TLS
+// when tlsConfig is set, and returns the packet ending the handshake and
+// whether the fast or full path was taken.
+func sha2Handshake(t *testing.T, srv *Server, user, password string, tlsConfig *tls.Config) ([]byte, string) {
+	t.Helper()
+	client, server := net.Pipe()
+	go srv.Handle(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	pkt := mustReadPacket(t, client)
+	greeting, err := parseServerGreeting(pkt.Payload)
+	if err != nil {
+		t.Fatalf("parse greeting: %v", err)
+	}
+	if greeting.AuthPlugin != cachingSHA2Plugin {
+		t.Fatalf("greeting offers %q", greeting.AuthPlugin)
+	}
+
+	var conn net.Conn = client
+	caps := capProtocol41 | capSecureConnection | capPluginAuth
+	seq := uint8(1)
+	if tlsConfig != nil {
+		caps |= capSSL
+		if conn, err = startTLS(client, caps, seq, tlsConfig); err != nil {
+			t.Fatalf("start TLS: %v", err)
+		}
+		seq++
+	}
+	auth := cachingSHA2Auth(greeting.Scramble, password)
+	resp := make([]byte, 32)
+	putHandshakeHeader(resp, caps)
+	resp = append(resp, user+"\x00"...)
+	resp = append(append(resp, byte(len(auth))), auth...)
+	resp = append(resp, cachingSHA2Plugin+"\x00"...)
+	if err := WritePacket(conn, seq, resp); err != nil {
+		t.Fatalf("write handshake response: %v", err)
+	}
+
+	write := func(seq uint8, payload []byte) {
+		t.Helper()
+		if err := WritePacket(conn, seq, payload); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	pkt = mustReadPacket(t, conn)
+	switch {
+	case bytes.Equal(pkt.Payload, fastAuthSuccess):
+		return mustReadPacket(t, conn).Payload, "fast"
+	case !bytes.Equal(pkt.Payload, fullAuthNeeded):
+		return pkt.Payload, ""
+	case tlsConfig != nil:
+		write(pkt.Sequence+1, []byte(password+"\x00"))
+		return mustReadPacket(t, conn).Payload, "full"
+	}
+	write(pkt.Sequence+1, []byte{requestPublicKey})
+	pkt = mustReadPacket(t, conn)
+	block, _ := pem.Decode(pkt.Payload[1:])
+	if pkt.Payload[0] != 0x01 || block == nil {
+		t.Fatalf("expected the public key, got %q", pkt.Payload)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse public key: %v", err)
+	}
+	plain := []byte(password + "\x00")
+	for i := range plain {
+		plain[i] ^= greeting.Scramble[i%len(greeting.Scramble)]
+	}
+	enc, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub.(*rsa.PublicKey), plain, nil)
+	if err != nil {
+		t.Fatalf("encrypt password: %v", err)
+	}
+	write(pkt.Sequence+1, enc)
+	return mustReadPacket(t, conn).Payload, "full"
+}
+
+func TestCachingSHA2Password(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	cert, caPEM := newTestCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	var mu sync.Mutex
+	passwords := map[string]string{"app": "s3cret", "report": "r3port"}
+	srv := newTestServer(t, Config{
+		AuthPlugin: cachingSHA2Plugin,
+		AuthRSAKey: key,
+		TLS:        &tls.Config{Certificates: []tls.Certificate{cert}},
+		Auth: authFunc(func(user string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			password, ok := passwords[user]
+			if !ok {
+				return "", ErrUnknownUser
+			}
+			return password, nil
+		}),
+	})
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	for _, c := range []struct {
+		name, user, password string
+		tls                  bool
+		path                 string
+		ok                   bool
+	}{
+		{"first connection", "app", "s3cret", false, "full", true},
+		{"cached", "app", "s3cret", false, "fast", true},
+		{"wrong password", "app", "nope", false, "full", false},
+		{"unknown user", "root", "s3cret", false, "", false},
+		{"over TLS", "report", "r3port", true, "full", true},
+		{"cached over TLS", "report", "r3port", false, "fast", true},
+	} {
+		var cfg *tls.Config
+		if c.tls {
+			cfg = tlsConfig
+		}
+		end, path := sha2Handshake(t, srv, c.user, c.password, cfg)
+		if path != c.path || (end[0] == 0x00) != c.ok {
+			t.Fatalf("%s: took the %q path and ended with %x", c.name, path, end)
+		}
+		if !c.ok {
+			if sqlErr, err := ParseErrPacket(end); err != nil || sqlErr.Code != 1045 {
+				t.Fatalf("%s: expected access denied, got %x", c.name, end)
+			}
+		}
+	}
+
+	// A changed password is not checked against the cached one.
+	mu.Lock()
+	passwords["app"] = "n3w"
+	mu.Unlock()
+	if end, path := sha2Handshake(t, srv, "app", "s3cret", nil); path != "full" || end[0] != 0xFF {
+		t.Fatalf("old password: took the %q path and ended with %x", path, end)
+	}
+	if end, path := sha2Handshake(t, srv, "app", "n3w", nil); path != "full" || end[0] != 0x00 {
+		t.Fatalf("new password: took the %q path and ended with %x", path, end)
+	}
+
+	// A client using another method is switched to caching_sha2_password.
+	client, server := net.Pipe()
+	go srv.Handle(server)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	greeting, err := parseServerGreeting(mustReadPacket(t, client).Payload)
+	if err != nil {
+		t.Fatalf("parse greeting: %v", err)
+	}
+	resp := make([]byte, 32)
+	putHandshakeHeader(resp, capProtocol41|capSecureConnection|capPluginAuth)
+	resp = append(resp, "report\x00\x00sha256_password\x00"...)
+	if err := WritePacket(client, 1, resp); err != nil {
+		t.Fatalf("write handshake response: %v", err)
+	}
+	want := append(append([]byte("\xFEcaching_sha2_password\x00"), greeting.Scramble...), 0)
+	if pkt := mustReadPacket(t, client); !bytes.Equal(pkt.Payload, want) {
+		t.Fatalf("got %q, want auth switch request %q", pkt.Payload, want)
+	}
+	if err := WritePacket(client, 3, cachingSHA2Auth(greeting.Scramble, "r3port")); err != nil {
+		t.Fatalf("write auth switch response: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); !bytes.Equal(pkt.Payload, fastAuthSuccess) {
+		t.Fatalf("got %x, want fast auth success", pkt.Payload)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Sequence != 5 || pkt.Payload[0] != 0x00 {
+		t.Fatalf("got packet %d %x, want OK at 5", pkt.Sequence, pkt.Payload)
+	}
+
+	// mysql_native_password still works.
+	if err := connectAs(t, srv, "report", "r3port"); err != nil {
+		t.Fatalf("mysql_native_password client rejected: %v", err)
+	}
+	if _, err := NewServer(Config{AuthPlugin: "sha256_password"}); err == nil {
+		t.Fatalf("unsupported auth plugin accepted")
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// capabilityNames name the capability flags for logs and configuration,
+// after MySQL's CLIENT_* constants.
+var capabilityNames = map[uint32]string{
+	capClientLongPassword: "long_password",
+	capFoundRows:          "found_rows",
+	capLongFlag:           "long_flag",
+	capConnectWithDB:      "connect_with_db",
+	capCompress:           "compress",
+	capProtocol41:         "protocol_41",
+	capSSL:                "ssl",
+	capTransactions:       "transactions",
+	capSecureConnection:   "secure_connection",
+	capMultiStatements:    "multi_statements",
+	capMultiResults:       "multi_results",
+	capPluginAuth:         "plugin_auth",
+	capSessionTrack:       "session_track",
+	capDeprecateEOF:       "deprecate_eof",
+	capOptionalMetadata:   "optional_resultset_metadata",
+	capQueryAttributes:    "query_attributes",
+}
+
+// capabilityString lists the named flags set in caps, lowest bit first,
+// separated by "|". Unnamed flags are shown in hex.
+func capabilityString(caps uint32) string {
+	var names []string
+	for caps != 0 {
+		bit := uint32(1) << bits.TrailingZeros32(caps)
+		caps &^= bit
+		if name, ok := capabilityNames[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("0x%x", bit))
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// CapabilityOverride withholds capabilities from clients connecting from
+// Source, to work around clients that misbehave when they negotiate them.
+type CapabilityOverride struct {
+	Source netip.Prefix
+	// Disable names the capabilities to withhold, such as "compress".
+	Disable []string
+}
+
+type capabilityOverride struct {
+	source netip.Prefix
+	mask   uint32
+}
+
+func compileCapabilityOverrides(overrides []CapabilityOverride) ([]capabilityOverride, error) {
+	compiled := make([]capabilityOverride, 0, len(overrides))
+	for _, o := range overrides {
+		if !o.Source.IsValid() {
+			return nil, fmt.Errorf("capability override for %v: invalid source", o.Source)
+		}
+		mask, err := capabilityMask(o.Disable)
+		if err != nil {
+			return nil, fmt.Errorf("capability override for %s: %w", o.Source, err)
+		}
+		compiled = append(compiled, capabilityOverride{source: normalizePrefix(o.Source), mask: mask})
+	}
+	return compiled, nil
+}
+
+// capabilityMask returns the flags of the named capabilities.
+func capabilityMask(names []string) (uint32, error) {
+	var mask uint32
+	for _, name := range names {
+		found := false
+		for bit, n := range capabilityNames {
+			if n == strings.ToLower(name) {
+				mask |= bit
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+	}
+	return mask, nil
+}
+
+// withheldCapabilities returns the capabilities withheld from a client at
+// remote.
+func (s *Server) withheldCapabilities(remote net.Addr) uint32 {
+	if len(s.capOverrides) == 0 {
+		return 0
+	}
+	ip, ok := remoteIP(remote)
+	if !ok {
+		return 0
+	}
+	var mask uint32
+	for _, o := range s.capOverrides {
+		if o.source.Contains(ip) {
+			mask |= o.mask
+		}
+	}
+	return mask
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCapabilityString(t *testing.T) {
+	if got := capabilityString(capCompress | capProtocol41 | 0x40000000); got != "compress|protocol_41|0x40000000" {
+		t.Fatalf("capabilityString = %q", got)
+	}
+}
+
+func TestCapabilityOverrideReducesAdvertisement(t *testing.T) {
+	srv := newTestServer(t, Config{
+		Compression: true,
+		CapabilityOverrides: []CapabilityOverride{{
+			Source:  netip.MustParsePrefix("127.0.0.0/8"),
+			Disable: []string{"compress", "multi_statements"},
+		}},
+	})
+	greeting := func(client, server net.Conn) uint32 {
+		t.Helper()
+		defer client.Close()
+		go srv.Handle(server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		g, err := parseServerGreeting(mustReadPacket(t, client).Payload)
+		if err != nil {
+			t.Fatalf("parse greeting: %v", err)
+		}
+		return g.Capabilities
+	}
+
+	// Clients from elsewhere get every capability.
+	caps := greeting(net.Pipe())
+	if caps&capCompress == 0 || caps&capMultiStatements == 0 {
+		t.Fatalf("capabilities %s lack compress or multi_statements", capabilityString(caps))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	caps = greeting(client, server)
+	if caps&(capCompress|capMultiStatements) != 0 {
+		t.Fatalf("overridden source was offered %s", capabilityString(caps))
+	}
+	if caps&capProtocol41 == 0 {
+		t.Fatalf("override withheld more than configured: %s", capabilityString(caps))
+	}
+}
+
+func TestCapabilityOverrideUnknownName(t *testing.T) {
+	_, err := NewServer(Config{CapabilityOverrides: []CapabilityOverride{{
+		Source:  netip.MustParsePrefix("10.0.0.0/8"),
+		Disable: []string{"teleport"},
+	}}})
+	if err == nil {
+		t.Fatalf("expected an error for an unknown capability")
+	}
+}
+
+func TestCapabilityOverrideIPv6Sources(t *testing.T) {
+	srv := newTestServer(t, Config{CapabilityOverrides: []CapabilityOverride{
+		{Source: netip.MustParsePrefix("2001:db8::/32"), Disable: []string{"compress"}},
+		{Source: netip.MustParsePrefix("10.0.0.0/8"), Disable: []string{"ssl"}},
+		{Source: netip.MustParsePrefix("::ffff:192.168.0.0/112"), Disable: []string{"multi_statements"}},
+	}})
+	cases := []struct {
+		addr string
+		want uint32
+	}{
+		{"[2001:db8::1]:3306", capCompress},
+		{"[2001:db8:ffff::1%eth0]:3306", capCompress},
+		{"[2001:db9::1]:3306", 0},
+		{"10.1.2.3:3306", capSSL},
+		// Dual-stack listeners see IPv4 clients as IPv4-mapped addresses.
+		{"[::ffff:10.1.2.3]:3306", capSSL},
+		{"192.168.4.5:3306", capMultiStatements},
+		{"[::ffff:192.168.4.5]:3306", capMultiStatements},
+		{"[::1]:3306", 0},
+	}
+	for _, c := range cases {
+		addr, err := net.ResolveTCPAddr("tcp", c.addr)
+		if err != nil {
+			t.Fatalf("resolve %s: %v", c.addr, err)
+		}
+		if got := srv.withheldCapabilities(addr); got != c.want {
+			t.Errorf("%s: withheld %s, want %s", c.addr, capabilityString(got), capabilityString(c.want))
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.0/8":          "10.0.0.0/8",
+		"10.1.2.3":            "10.1.2.3/32",
+		"2001:db8::/32":       "2001:db8::/32",
+		"[2001:db8::]/32":     "2001:db8::/32",
+		"[2001:db8::1]":       "2001:db8::1/128",
+		"::ffff:10.0.0.0/104": "::ffff:10.0.0.0/104",
+	}
+	for in, want := range cases {
+		p, err := ParseSource(in)
+		if err != nil || p.String() != want {
+			t.Errorf("ParseSource(%q) = %v, %v, want %s", in, p, err, want)
+		}
+	}
+	if _, err := ParseSource("2001:db8::1]:3306"); err == nil {
+		t.Errorf("expected an error for an address with a port")
+	}
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// CharsetMismatchMode selects what happens to a relayed text column whose
+// character set differs from the one the client negotiated, in its
+// handshake or with SET NAMES. The empty mode does not look for them.
+type CharsetMismatchMode string
+
+const (
+	// CharsetMismatchPass relays the column as the backend sent it, only
+	// counting the mismatch.
+	CharsetMismatchPass CharsetMismatchMode = "pass"
+	// CharsetMismatchWarn also logs a warning naming the column.
+	CharsetMismatchWarn CharsetMismatchMode = "warn"
+	// CharsetMismatchTranscode converts the column's values to the client's
+	// character set, when both are among those the proxy can convert:
+	// utf8mb4, utf8mb3, latin1 and ascii. Prepared statement results, and
+	// other character sets, are relayed with a warning. Characters the
+	// client's character set lacks become '?', as they do in MySQL.
+	CharsetMismatchTranscode CharsetMismatchMode = "transcode"
+)
+
+func (m CharsetMismatchMode) validate() error {
+	switch m {
+	case "", CharsetMismatchPass, CharsetMismatchWarn, CharsetMismatchTranscode:
+		return nil
+	}
+	return fmt.Errorf("unknown charset mismatch mode %q", m)
+}
+
+// cp1252 maps the bytes 0x80-0x9F of MySQL's latin1, which is Windows-1252
+// rather than ISO 8859-1, to the characters they stand for. Bytes unassigned
+// in Windows-1252 map to the C1 control characters, as in MySQL.
+var cp1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// transcodable are the character sets the proxy converts between.
+var transcodable = map[string]bool{"utf8mb4": true, "utf8mb3": true, "latin1": true, "ascii": true}
+
+// charsetCompatible reports whether text in charset from reads the same in
+// charset to: they are the same, or from is a subset of to.
+func charsetCompatible(from, to string) bool {
+	switch {
+	case from == to, from == "binary":
+		return true
+	case from == "ascii":
+		return transcodable[to]
+	case from == "utf8mb3":
+		return to == "utf8mb4"
+	}
+	return false
+}
+
+// transcode converts s from one of the transcodable character sets to
+// another.
+func transcode(s []byte, from, to string) []byte {
+	out := make([]byte, 0, len(s))
+	for len(s) > 0 {
+		var r rune
+		switch from {
+		case "latin1":
+			r = rune(s[0])
+			if r >= 0x80 && r < 0xA0 {
+				r = cp1252[r-0x80]
+			}
+			s = s[1:]
+		default:
+			var n int
+			r, n = utf8.DecodeRune(s)
+			s = s[n:]
+		}
+		switch to {
+		case "utf8mb4":
+			out = utf8.AppendRune(out, r)
+		case "utf8mb3":
+			if r > 0xFFFF {
+				r = '?'
+			}
+			out = utf8.AppendRune(out, r)
+		case "latin1":
+			out = append(out, latin1Byte(r))
+		default:
+			if r >= 0x80 {
+				r = '?'
+			}
+			out = append(out, byte(r))
+		}
+	}
+	return out
+}
+
+// latin1Byte encodes r in MySQL's latin1, or as '?' if it has no encoding.
+func latin1Byte(r rune) byte {
+	if r < 0x80 || r >= 0xA0 && r <= 0xFF {
+		return byte(r)
+	}
+	for i, c := range cp1252 {
+		if c == r {
+			return byte(0x80 + i)
+		}
+	}
+	return '?'
+}
+
+// charsetChecker returns the transformer comparing the character set of
+// the columns relayed to the client with its own, under the server's
+// CharsetMismatch mode, or nil if there is none. transcode reports whether
+// the rows of the response are converted by transcodeRow, so the column can
+// be advertised in the client's character set.
+func (c *Connection) charsetChecker(transcode bool) RowTransformer {
+	mode := c.server.cfg.CharsetMismatch
+	if mode == "" || c.charset == "" {
+		return nil
+	}
+	client := c.charset
+	return columnRewriter(func(col *ColumnDef) bool {
+		coll, ok := CollationByID(col.Charset)
+		if !ok || charsetCompatible(coll.Charset, client) {
+			return false
+		}
+		metrics.CharsetMismatches.Inc()
+		convert := mode == CharsetMismatchTranscode && transcode && transcodable[coll.Charset] && transcodable[client]
+		if mode == CharsetMismatchWarn || mode == CharsetMismatchTranscode && !convert {
+			c.logger.WithField("column", col.Name).WithField("charset", coll.Charset).WithField("client_charset", client).
+				Warn("backend column character set differs from the client's")
+		}
+		if !convert {
+			return false
+		}
+		def, _ := DefaultCollation(client)
+		col.Charset = def.ID
+		col.transcodeFrom = coll.Charset
+		return true
+	})
+}
+
+// transcodeRow converts the values of the columns charsetChecker marked to
+// the client's character set.
+func (c *Connection) transcodeRow(columns []ColumnDef, row [][]byte) [][]byte {
+	for i, col := range columns {
+		if col.transcodeFrom != "" && i < len(row) && row[i] != nil {
+			row[i] = transcode(row[i], col.transcodeFrom, c.charset)
+		}
+	}
+	return row
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestCharsetMismatchTranscode(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		if string(payload[1:]) != "SELECT name, city FROM t" {
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			return
+		}
+		writeTestResultSet(conn, &ResultSet{
+			Columns: []ColumnDef{{Name: "name", Charset: 8}, {Name: "city"}},
+			Rows:    [][]string{{"caf\xe9 \x80", "Z\xc3\xbcrich \xf0\x9f\x8f\x94"}},
+		})
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, CharsetMismatch: CharsetMismatchTranscode})
+	client := dialProxy(t, srv)
+
+	query := func() ([]uint16, []string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT name, city FROM t"...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		mustReadPacket(t, client) // column count
+		var charsets []uint16
+		for range 2 {
+			col, err := parseColumnDef(mustReadPacket(t, client).Payload)
+			if err != nil {
+				t.Fatalf("column definition: %v", err)
+			}
+			charsets = append(charsets, col.Charset)
+		}
+		mustReadPacket(t, client) // EOF
+		row, err := parseTextRow(mustReadPacket(t, client).Payload, 2)
+		if err != nil {
+			t.Fatalf("row: %v", err)
+		}
+		mustReadPacket(t, client) // EOF
+		return charsets, []string{string(row[0]), string(row[1])}
+	}
+
+	before := testutil.ToFloat64(metrics.CharsetMismatches)
+	// The client negotiated collation 33, utf8mb3: the latin1 column is
+	// converted.
+	charsets, row := query()
+	if want := []uint16{CollationUTF8MB3GeneralCI, CharsetUTF8MB4}; !reflect.DeepEqual(charsets, want) {
+		t.Fatalf("column charsets %v, want %v", charsets, want)
+	}
+	if want := []string{"café €", "Zürich 🏔"}; !reflect.DeepEqual(row, want) {
+		t.Fatalf("row %q, want %q", row, want)
+	}
+
+	// After SET NAMES latin1 the utf8 column is, with '?' for the
+	// character latin1 lacks.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SET NAMES latin1"...)); err != nil {
+		t.Fatalf("write SET NAMES: %v", err)
+	}
+	mustReadPacket(t, client)
+	charsets, row = query()
+	if want := []uint16{8, 8}; !reflect.DeepEqual(charsets, want) {
+		t.Fatalf("column charsets %v, want %v", charsets, want)
+	}
+	if want := []string{"caf\xe9 \x80", "Z\xfcrich ?"}; !reflect.DeepEqual(row, want) {
+		t.Fatalf("row %q, want %q", row, want)
+	}
+	if got := testutil.ToFloat64(metrics.CharsetMismatches) - before; got != 2 {
+		t.Fatalf("counted %v mismatches, want 2", got)
+	}
+}
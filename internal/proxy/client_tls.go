@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// ErrTLSHandshake is returned when a client asked to switch to TLS and the
+// TLS handshake then failed.
+var ErrTLSHandshake = errors.New("client TLS handshake failed")
+
+// tlsConfig is the TLS configuration offered to the client: its
+// listener's, or the server's.
+func (c *Connection) tlsConfig() *tls.Config {
+	if c.profile.tls != nil {
+		return c.profile.tls
+	}
+	return c.server.cfg.TLS
+}
+
+// startTLS upgrades the client connection to TLS after its SSLRequest. The
+// handshake is run explicitly so that a failure is attributed to TLS: it is
+// logged with its reason, counted and fails the handshake with
+// ErrTLSHandshake. Authentication continues over the upgraded connection.
+func (c *Connection) startTLS(ex *authExchange) error {
+	tc := tls.Server(c.conn, c.tlsConfig())
+	if err := tc.Handshake(); err != nil {
+		reason := tlsFailureReason(err)
+		metrics.ClientTLSHandshakeFailures.WithLabelValues(reason).Inc()
+		c.logger.WithError(err).WithField("reason", reason).Warn("client TLS handshake failed")
+		if reason == "timeout" {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrTLSHandshake, err)
+	}
+	c.mu.Lock()
+	c.conn = tc
+	c.mu.Unlock()
+	ex.r, ex.w = tc, tc
+	// Like recordTLS for backends, so clients still on weak versions or
+	// ciphers can be found.
+	cs := tc.ConnectionState()
+	version, cipher := tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite)
+	metrics.ClientTLSConnections.WithLabelValues(version, cipher).Inc()
+	c.logger.WithField("tls_version", version).WithField("tls_cipher", cipher).Info("client TLS connection established")
+	return nil
+}
+
+// tlsFailureReason classifies a failed server-side TLS handshake: not_tls
+// for a client that sent something else, alert for one that rejected the
+// proxy's certificate or parameters, bad_certificate for a client
+// certificate that failed verification, timeout, disconnected, or
+// negotiation for no common protocol version or cipher suite and other
+// failures.
+func tlsFailureReason(err error) string {
+	var (
+		header     tls.RecordHeaderError
+		opErr      *net.OpError
+		verify     *tls.CertificateVerificationError
+		unknownCA  x509.UnknownAuthorityError
+		invalidErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &header):
+		return "not_tls"
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		// crypto/tls reports an alert from the peer this way.
+		return "alert"
+	case errors.As(err, &verify), errors.As(err, &unknownCA), errors.As(err, &invalidErr):
+		return "bad_certificate"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrClosedPipe), errors.Is(err, net.ErrClosed), errors.Is(err, syscall.ECONNRESET):
+		return "disconnected"
+	}
+	return "negotiation"
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestClientTLS(t *testing.T) {
+	cert, caPEM := newTestCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	srv := newTestServer(t, Config{TLS: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}})
+
+	// established counts TLS 1.3 clients under any of the suites Go may
+	// prefer on this CPU.
+	established := func() float64 {
+		n := 0.0
+		for _, cs := range []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384, tls.TLS_CHACHA20_POLY1305_SHA256} {
+			n += testutil.ToFloat64(metrics.ClientTLSConnections.WithLabelValues("TLS 1.3", tls.CipherSuiteName(cs)))
+		}
+		return n
+	}
+	before := established()
+	connect := tlsTestDialer(t, srv)
+	if conn, err := connect(&tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}); err != nil || conn.CloseReason() != CloseClientDisconnect {
+		t.Fatalf("TLS client: %v, closed as %q", err, conn.CloseReason())
+	}
+	if got := established() - before; got != 1 {
+		t.Fatalf("TLS 1.3 client connections rose by %v, want 1", got)
+	}
+
+	for _, c := range []struct {
+		name   string
+		cfg    *tls.Config
+		reason string
+	}{
+		{"old protocol version", &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", MaxVersion: tls.VersionTLS12}, "negotiation"},
+		{"untrusted certificate", &tls.Config{ServerName: "127.0.0.1"}, "alert"},
+	} {
+		failures := metrics.ClientTLSHandshakeFailures.WithLabelValues(c.reason)
+		before := testutil.ToFloat64(failures)
+		conn, err := connect(c.cfg)
+		if err == nil {
+			t.Fatalf("%s: handshake succeeded", c.name)
+		}
+		if got := conn.CloseReason(); got != CloseTLSHandshakeFailed {
+			t.Fatalf("%s: closed as %q", c.name, got)
+		}
+		if got := testutil.ToFloat64(failures) - before; got != 1 {
+			t.Fatalf("%s: %s failures rose by %v, want 1", c.name, c.reason, got)
+		}
+	}
+}
+
+func TestApplyTLSPolicy(t *testing.T) {
+	cfg := &tls.Config{}
+	if err := ApplyTLSPolicy(cfg, "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}); err != nil {
+		t.Fatalf("policy: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("got min version %x, suites %x", cfg.MinVersion, cfg.CipherSuites)
+	}
+	if err := ApplyTLSPolicy(cfg, "1.1", nil); err == nil {
+		t.Fatalf("TLS 1.1 accepted as a minimum version")
+	}
+	if err := ApplyTLSPolicy(cfg, "", []string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Fatalf("insecure cipher suite accepted")
+	}
+}
+
+func TestClientTLSRequired(t *testing.T) {
+	if _, err := NewServer(Config{RequireTLS: true}); err == nil {
+		t.Fatalf("RequireTLS accepted without TLS")
+	}
+	cert, caPEM := newTestCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	srv := newTestServer(t, Config{TLS: &tls.Config{Certificates: []tls.Certificate{cert}}, RequireTLS: true})
+
+	connect := tlsTestDialer(t, srv)
+	if conn, err := connect(&tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}); err != nil || conn.CloseReason() != CloseClientDisconnect {
+		t.Fatalf("TLS client: %v, closed as %q", err, conn.CloseReason())
+	}
+
+	denied := metrics.AuthFailures.WithLabelValues("tls_required")
+	before := testutil.ToFloat64(denied)
+	conn, err := connect(nil)
+	var sqlErr *SQLError
+	if !errors.As(err, &sqlErr) || sqlErr.Code != 1045 || sqlErr.SQLState != "28000" {
+		t.Fatalf("plaintext client: got %v, want error 1045", err)
+	}
+	if got := conn.CloseReason(); got != CloseAuthFailed {
+		t.Fatalf("plaintext client closed as %q", got)
+	}
+	if got := testutil.ToFloat64(denied) - before; got != 1 {
+		t.Fatalf("tls_required auth failures rose by %v, want 1", got)
+	}
+}
+
+// tlsTestDialer returns a function that runs the handshake with srv using
+// the client TLS configuration cfg, plaintext when nil, and returns the
+// connection once the proxy is done with it. A TCP connection buffers the
+// proxy's flight while the client rejects it.
+func tlsTestDialer(t *testing.T, srv *Server) func(cfg *tls.Config) (*Connection, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return func(cfg *tls.Config) (*Connection, error) {
+		t.Helper()
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer client.Close()
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		conn := NewConnection(srv, server)
+		done := make(chan struct{})
+		go func() {
+			conn.Handle()
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = clientHandshakeTLS(client, "app", "password", "", cfg, false)
+		client.Close()
+		<-done
+		return conn, err
+	}
+}
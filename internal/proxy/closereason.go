@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+)
+
+// CloseReason is why a client connection ended. It is logged and counted
+// when the connection closes.
+type CloseReason string
+
+const (
+	// CloseClientQuit is a client that sent COM_QUIT.
+	CloseClientQuit CloseReason = "client_quit"
+	// CloseClientDisconnect is a client that closed the connection without
+	// COM_QUIT.
+	CloseClientDisconnect CloseReason = "client_disconnect"
+	// CloseNetworkError is a failed read or write on the client connection.
+	CloseNetworkError CloseReason = "network_error"
+	// CloseProtocolError is a client that broke the protocol, from a
+	// malformed handshake to malformed packet framing.
+	CloseProtocolError CloseReason = "protocol_error"
+	// CloseAuthFailed is a client denied at authentication.
+	CloseAuthFailed CloseReason = "auth_failed"
+	// CloseHandshakeTimeout is a client too slow to authenticate.
+	CloseHandshakeTimeout CloseReason = "handshake_timeout"
+	// CloseIdleTimeout is a client idle for longer than Config.IdleTimeout.
+	CloseIdleTimeout CloseReason = "idle_timeout"
+	// CloseTLSHandshakeFailed is a client whose TLS handshake failed after
+	// its SSLRequest.
+	CloseTLSHandshakeFailed CloseReason = "tls_handshake_failed"
+	// CloseNotReady and CloseOverloaded are clients turned away before the
+	// handshake.
+	CloseNotReady   CloseReason = "not_ready"
+	CloseOverloaded CloseReason = "overloaded"
+	// CloseKilled is a client disconnected by PROXY KILL.
+	CloseKilled CloseReason = "killed"
+	// CloseBackendError is a client disconnected because its backend broke
+	// the protocol mid-response.
+	CloseBackendError CloseReason = "backend_error"
+	// ClosePanic is a connection that ended in a panic.
+	ClosePanic CloseReason = "panic"
+)
+
+// setCloseReason records why the connection is closing. The first reason
+// recorded wins: a connection killed by an admin fails its next read, which
+// must not be reported as a network error.
+func (c *Connection) setCloseReason(reason CloseReason) {
+	c.mu.Lock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+	c.mu.Unlock()
+}
+
+// CloseReason returns why the connection closed, or "" while it is open.
+func (c *Connection) CloseReason() CloseReason {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeReason
+}
+
+// ioCloseReason classifies a failed read from the client.
+func ioCloseReason(err error) CloseReason {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return CloseClientDisconnect
+	}
+	return CloseNetworkError
+}
+
+// kill disconnects the client. A query it is running on a backend is killed
+// as when the client goes away itself.
+func (c *Connection) kill() error {
+	c.setCloseReason(CloseKilled)
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.Close()
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestCloseReasons(t *testing.T) {
+	passwords := authFunc(func(string) (string, error) { return "password", nil })
+	srv := newTestServer(t, Config{Auth: passwords, AdminUser: "dba"})
+	cases := []struct {
+		name   string
+		reason CloseReason
+		// end drives the client until the proxy closes conn.
+		end func(t *testing.T, client net.Conn, conn *Connection)
+	}{
+		{"quit", CloseClientQuit, func(t *testing.T, client net.Conn, conn *Connection) {
+			clientHandshake(client, "app", "password", "")
+			WritePacket(client, 0, []byte{COM_QUIT})
+		}},
+		{"disconnect", CloseClientDisconnect, func(t *testing.T, client net.Conn, conn *Connection) {
+			clientHandshake(client, "app", "password", "")
+			client.Close()
+		}},
+		{"auth failure", CloseAuthFailed, func(t *testing.T, client net.Conn, conn *Connection) {
+			clientHandshake(client, "app", "wrong", "")
+		}},
+		{"bad framing", CloseProtocolError, func(t *testing.T, client net.Conn, conn *Connection) {
+			clientHandshake(client, "app", "password", "")
+			WritePacket(client, 3, []byte{COM_QUERY, 'D', 'O', ' ', '1'})
+		}},
+		{"killed", CloseKilled, func(t *testing.T, client net.Conn, conn *Connection) {
+			clientHandshake(client, "app", "password", "")
+			admin := dialProxyAs(t, srv, "dba")
+			id := strconv.FormatUint(uint64(conn.id), 10)
+			WritePacket(admin, 0, append([]byte{COM_QUERY}, "PROXY KILL "+id...))
+			mustReadPacket(t, admin)
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			closed := metrics.ConnectionsClosed.WithLabelValues(string(c.reason))
+			before := testutil.ToFloat64(closed)
+			client, server := net.Pipe()
+			defer client.Close()
+			conn := NewConnection(srv, server)
+			done := make(chan struct{})
+			go func() {
+				conn.Handle()
+				close(done)
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			c.end(t, client, conn)
+			// Drain whatever the proxy still writes until it hangs up.
+			go func() {
+				for {
+					if _, err := ReadPacket(client); err != nil {
+						return
+					}
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("connection did not close")
+			}
+			if got := conn.CloseReason(); got != c.reason {
+				t.Fatalf("close reason %q, want %q", got, c.reason)
+			}
+			if got := testutil.ToFloat64(closed) - before; got != 1 {
+				t.Fatalf("%s closes rose by %v, want 1", c.reason, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Collation ids the proxy refers to directly.
+const (
+	CollationUTF8MB3GeneralCI uint16 = 33
+	CollationUTF8MB4GeneralCI uint16 = 45
+	CollationBinary           uint16 = 63
+	CollationUTF8MB4_0900AICI uint16 = 255
+)
+
+// Collation is a MySQL collation together with its character set.
+type Collation struct {
+	ID      uint16
+	Name    string
+	Charset string
+	// Default is set on the collation a character set uses when none is
+	// named.
+	Default bool
+}
+
+// collations lists the collations known to the proxy: the default
+// collation of every MySQL character set plus commonly used alternatives.
+var collations = []Collation{
+	{1, "big5_chinese_ci", "big5", true},
+	{3, "dec8_swedish_ci", "dec8", true},
+	{4, "cp850_general_ci", "cp850", true},
+	{5, "latin1_german1_ci", "latin1", false},
+	{6, "hp8_english_ci", "hp8", true},
+	{7, "koi8r_general_ci", "koi8r", true},
+	{8, "latin1_swedish_ci", "latin1", true},
+	{9, "latin2_general_ci", "latin2", true},
+	{10, "swe7_swedish_ci", "swe7", true},
+	{11, "ascii_general_ci", "ascii", true},
+	{12, "ujis_japanese_ci", "ujis", true},
+	{13, "sjis_japanese_ci", "sjis", true},
+	{15, "latin1_danish_ci", "latin1", false},
+	{16, "hebrew_general_ci", "hebrew", true},
+	{18, "tis620_thai_ci", "tis620", true},
+	{19, "euckr_korean_ci", "euckr", true},
+	{22, "koi8u_general_ci", "koi8u", true},
+	{24, "gb2312_chinese_ci", "gb2312", true},
+	{25, "greek_general_ci", "greek", true},
+	{26, "cp1250_general_ci", "cp1250", true},
+	{28, "gbk_chinese_ci", "gbk", true},
+	{30, "latin5_turkish_ci", "latin5", true},
+	{31, "latin1_german2_ci", "latin1", false},
+	{32, "armscii8_general_ci", "armscii8", true},
+	{33, "utf8mb3_general_ci", "utf8mb3", true},
+	{35, "ucs2_general_ci", "ucs2", true},
+	{36, "cp866_general_ci", "cp866", true},
+	{37, "keybcs2_general_ci", "keybcs2", true},
+	{38, "macce_general_ci", "macce", true},
+	{39, "macroman_general_ci", "macroman", true},
+	{40, "cp852_general_ci", "cp852", true},
+	{41, "latin7_general_ci", "latin7", true},
+	{45, "utf8mb4_general_ci", "utf8mb4", false},
+	{46, "utf8mb4_bin", "utf8mb4", false},
+	{47, "latin1_bin", "latin1", false},
+	{48, "latin1_general_ci", "latin1", false},
+	{49, "latin1_general_cs", "latin1", false},
+	{50, "cp1251_bin", "cp1251", false},
+	{51, "cp1251_general_ci", "cp1251", true},
+	{54, "utf16_general_ci", "utf16", true},
+	{55, "utf16_bin", "utf16", false},
+	{56, "utf16le_general_ci", "utf16le", true},
+	{57, "cp1256_general_ci", "cp1256", true},
+	{59, "cp1257_general_ci", "cp1257", true},
+	{60, "utf32_general_ci", "utf32", true},
+	{61, "utf32_bin", "utf32", false},
+	{63, "binary", "binary", true},
+	{65, "ascii_bin", "ascii", false},
+	{66, "cp1250_bin", "cp1250", false},
+	{70, "greek_bin", "greek", false},
+	{71, "hebrew_bin", "hebrew", false},
+	{77, "latin2_bin", "latin2", false},
+	{83, "utf8mb3_bin", "utf8mb3", false},
+	{84, "big5_bin", "big5", false},
+	{85, "euckr_bin", "euckr", false},
+	{86, "gb2312_bin", "gb2312", false},
+	{87, "gbk_bin", "gbk", false},
+	{88, "sjis_bin", "sjis", false},
+	{90, "ucs2_bin", "ucs2", false},
+	{92, "geostd8_general_ci", "geostd8", true},
+	{94, "latin1_spanish_ci", "latin1", false},
+	{95, "cp932_japanese_ci", "cp932", true},
+	{96, "cp932_bin", "cp932", false},
+	{97, "eucjpms_japanese_ci", "eucjpms", true},
+	{98, "eucjpms_bin", "eucjpms", false},
+	{101, "utf16_unicode_ci", "utf16", false},
+	{128, "ucs2_unicode_ci", "ucs2", false},
+	{160, "utf32_unicode_ci", "utf32", false},
+	{192, "utf8mb3_unicode_ci", "utf8mb3", false},
+	{224, "utf8mb4_unicode_ci", "utf8mb4", false},
+	{246, "utf8mb4_unicode_520_ci", "utf8mb4", false},
+	{248, "gb18030_chinese_ci", "gb18030", true},
+	{249, "gb18030_bin", "gb18030", false},
+	{255, "utf8mb4_0900_ai_ci", "utf8mb4", true},
+	{278, "utf8mb4_0900_as_cs", "utf8mb4", false},
+	{305, "utf8mb4_0900_as_ci", "utf8mb4", false},
+	{309, "utf8mb4_0900_bin", "utf8mb4", false},
+}
+
+var (
+	collationsByID      = make(map[uint16]Collation, len(collations))
+	collationsByName    = make(map[string]Collation, len(collations))
+	defaultCollationFor = make(map[string]Collation)
+)
+
+func init() {
+	for _, c := range collations {
+		collationsByID[c.ID] = c
+		collationsByName[c.Name] = c
+		if c.Default {
+			defaultCollationFor[c.Charset] = c
+		}
+	}
+}
+
+// CollationByID looks up a collation by the id used in handshakes and column
+// definitions.
+func CollationByID(id uint16) (Collation, bool) {
+	c, ok := collationsByID[id]
+	return c, ok
+}
+
+// CollationByName looks up a collation by name, ignoring case. The utf8_
+// prefix is accepted as the older name of utf8mb3_ collations.
+func CollationByName(name string) (Collation, bool) {
+	name = strings.ToLower(name)
+	if rest, ok := strings.CutPrefix(name, "utf8_"); ok {
+		name = "utf8mb3_" + rest
+	}
+	c, ok := collationsByName[name]
+	return c, ok
+}
+
+// DefaultCollation returns the default collation of a character set. utf8
+// is accepted as an alias of utf8mb3.
+func DefaultCollation(charset string) (Collation, bool) {
+	charset = strings.ToLower(charset)
+	if charset == "utf8" {
+		charset = "utf8mb3"
+	}
+	c, ok := defaultCollationFor[charset]
+	return c, ok
+}
+
+// setNamesCollation validates the character set and collation named by a
+// SET NAMES or SET CHARACTER SET statement, returning the error MySQL would,
+// and returns the collation it selects: the one it names, or else the
+// default of its character set. Statements of any other shape are left to
+// the backend, and with SET NAMES DEFAULT give the zero Collation.
+func setNamesCollation(toks []Token) (Collation, error) {
+	if len(toks) < 3 || !toks[0].IsWord("SET") {
+		return Collation{}, nil
+	}
+	rest := toks[1:]
+	switch {
+	case rest[0].IsWord("NAMES"), rest[0].IsWord("CHARSET"):
+		rest = rest[1:]
+	case len(rest) > 2 && rest[0].IsWord("CHARACTER") && rest[1].IsWord("SET"):
+		rest = rest[2:]
+	default:
+		return Collation{}, nil
+	}
+	if len(rest) == 0 || rest[0].IsWord("DEFAULT") {
+		return Collation{}, nil
+	}
+
+	charset := rest[0].Value
+	def, ok := DefaultCollation(charset)
+	if !ok {
+		return Collation{}, &SQLError{Code: 1115, SQLState: "42000", Message: fmt.Sprintf("Unknown character set: '%s'", charset)}
+	}
+	if len(rest) == 3 && rest[1].IsWord("COLLATE") {
+		name := rest[2].Value
+		coll, ok := CollationByName(name)
+		if !ok {
+			return Collation{}, &SQLError{Code: 1273, SQLState: "HY000", Message: fmt.Sprintf("Unknown collation: '%s'", name)}
+		}
+		if coll.Charset != def.Charset {
+			return Collation{}, &SQLError{Code: 1253, SQLState: "42000", Message: fmt.Sprintf("COLLATION '%s' is not valid for CHARACTER SET '%s'", name, charset)}
+		}
+		return coll, nil
+	}
+	return def, nil
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCollationLookup(t *testing.T) {
+	cases := []struct {
+		id      uint16
+		name    string
+		charset string
+	}{
+		{8, "latin1_swedish_ci", "latin1"},
+		{33, "utf8mb3_general_ci", "utf8mb3"},
+		{45, "utf8mb4_general_ci", "utf8mb4"},
+		{63, "binary", "binary"},
+		{224, "utf8mb4_unicode_ci", "utf8mb4"},
+		{255, "utf8mb4_0900_ai_ci", "utf8mb4"},
+	}
+	for _, c := range cases {
+		byID, ok := CollationByID(c.id)
+		if !ok || byID.Name != c.name || byID.Charset != c.charset {
+			t.Errorf("CollationByID(%d) = %+v, %v", c.id, byID, ok)
+		}
+		byName, ok := CollationByName(c.name)
+		if !ok || byName.ID != c.id {
+			t.Errorf("CollationByName(%q) = %+v, %v", c.name, byName, ok)
+		}
+	}
+
+	if c, ok := CollationByName("UTF8_General_CI"); !ok || c.ID != 33 {
+		t.Errorf("utf8_general_ci alias = %+v, %v", c, ok)
+	}
+	if c, ok := DefaultCollation("utf8mb4"); !ok || c.ID != CollationUTF8MB4_0900AICI {
+		t.Errorf("DefaultCollation(utf8mb4) = %+v, %v", c, ok)
+	}
+	if _, ok := CollationByID(0); ok {
+		t.Errorf("collation 0 should be unknown")
+	}
+}
+
+func TestSetNamesCollation(t *testing.T) {
+	cases := []struct {
+		query string
+		code  uint16
+	}{
+		{"SET NAMES utf8mb4", 0},
+		{"SET NAMES 'utf8' COLLATE 'utf8_unicode_ci'", 0},
+		{"SET NAMES DEFAULT", 0},
+		{"SET CHARACTER SET latin1", 0},
+		{"SET NAMES klingon", 1115},
+		{"SET NAMES utf8mb4 COLLATE utf8mb4_nonsense_ci", 1273},
+		{"SET NAMES latin1 COLLATE utf8mb4_bin", 1253},
+		{"SET @x = 'klingon'", 0},
+	}
+	for _, c := range cases {
+		_, err := setNamesCollation(ParseQuery(c.query).Tokens)
+		var sqlErr *SQLError
+		switch {
+		case c.code == 0 && err != nil:
+			t.Errorf("%q: unexpected error %v", c.query, err)
+		case c.code != 0 && (!errors.As(err, &sqlErr) || sqlErr.Code != c.code):
+			t.Errorf("%q: got %v, want error %d", c.query, err, c.code)
+		}
+	}
+}
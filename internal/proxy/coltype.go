@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ColumnTypeRule changes the type advertised for relayed result columns,
+// for clients that cannot handle the type a backend reports, such as a
+// legacy client shown BIGINT columns as INT or JSON columns as TEXT.
+// Text-protocol values are the same for all types, so rows are relayed
+// unchanged; a BIGINT value too large for INT still reaches the client.
+type ColumnTypeRule struct {
+	// Column is a SQL LIKE pattern matched case-insensitively against the
+	// column's alias and its name in the table. Empty matches every column.
+	Column string
+	// From restricts the rule to columns of this type, such as BIGINT.
+	// Empty matches any type.
+	From string
+	// To is the type advertised instead.
+	To string
+	// Users limits the rule to these users; empty applies it to everyone.
+	Users []string
+}
+
+// columnTypes are the type names ColumnTypeRule understands.
+var columnTypes = map[string]byte{
+	"TINYINT":   TypeTiny,
+	"SMALLINT":  TypeShort,
+	"MEDIUMINT": TypeInt24,
+	"INT":       TypeLong,
+	"BIGINT":    TypeLongLong,
+	"FLOAT":     TypeFloat,
+	"DOUBLE":    TypeDouble,
+	"DECIMAL":   TypeNewDecimal,
+	"YEAR":      TypeYear,
+	"BIT":       TypeBit,
+	"CHAR":      TypeString,
+	"VARCHAR":   TypeVarString,
+	"TEXT":      TypeBlob,
+	"BLOB":      TypeBlob,
+	"JSON":      TypeJSON,
+	"ENUM":      TypeEnum,
+	"SET":       TypeSet,
+	"GEOMETRY":  TypeGeometry,
+}
+
+// textTypes are the targets whose columns must carry a character set:
+// MySQL tells TEXT from BLOB, and CHAR from BINARY, only by the binary
+// collation. Columns retyped to others are given the binary one.
+var textTypes = map[string]bool{"CHAR": true, "VARCHAR": true, "TEXT": true, "ENUM": true, "SET": true}
+
+type columnTypeRule struct {
+	column  *regexp.Regexp
+	from    byte
+	anyType bool
+	to      byte
+	text    bool
+	users   map[string]bool
+}
+
+func compileColumnTypeRules(rules []ColumnTypeRule) ([]columnTypeRule, error) {
+	compiled := make([]columnTypeRule, len(rules))
+	for i, r := range rules {
+		to, ok := columnTypes[strings.ToUpper(r.To)]
+		if !ok {
+			return nil, fmt.Errorf("column type rule %d: unknown type %q", i+1, r.To)
+		}
+		c := columnTypeRule{to: to, text: textTypes[strings.ToUpper(r.To)], anyType: r.From == ""}
+		if !c.anyType {
+			if c.from, ok = columnTypes[strings.ToUpper(r.From)]; !ok {
+				return nil, fmt.Errorf("column type rule %d: unknown type %q", i+1, r.From)
+			}
+		}
+		if r.Column != "" {
+			c.column = likePattern(r.Column)
+		}
+		if len(r.Users) > 0 {
+			c.users = make(map[string]bool, len(r.Users))
+			for _, u := range r.Users {
+				c.users[u] = true
+			}
+		}
+		compiled[i] = c
+	}
+	return compiled, nil
+}
+
+// typeRewriter returns the transformer applying the column type rules to
+// result sets relayed to user, or nil if none apply to them.
+func (s *Server) typeRewriter(user string) RowTransformer {
+	var rules []columnTypeRule
+	for _, r := range s.columnTypes {
+		if r.users == nil || r.users[user] {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return columnRewriter(func(col *ColumnDef) bool {
+		for _, r := range rules {
+			if !r.anyType && col.Type != r.from {
+				continue
+			}
+			if r.column != nil && !r.column.MatchString(col.Name) && !r.column.MatchString(col.OrgName) {
+				continue
+			}
+			col.Type = r.to
+			switch {
+			case !r.text:
+				col.Charset = CharsetBinary
+			case col.Charset == CharsetBinary:
+				col.Charset = CharsetUTF8MB4
+			}
+			return true
+		}
+		return false
+	})
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestColumnTypeRules(t *testing.T) {
+	events := &ResultSet{
+		Columns: []ColumnDef{
+			{Name: "id", Type: TypeLongLong, Charset: CharsetBinary, Length: 20},
+			{Name: "payload", Type: TypeJSON, Charset: CharsetBinary},
+			{Name: "total", Type: TypeLongLong, Charset: CharsetBinary, Length: 20},
+		},
+		Rows: [][]string{{"1", `{"a": 1}`, "42"}},
+	}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeTestResultSet(conn, events)
+	})
+	srv := newTestServer(t, Config{
+		Backends: []BackendConfig{fb.config()},
+		ColumnTypeRules: []ColumnTypeRule{
+			{Column: "id", From: "BIGINT", To: "INT", Users: []string{"legacy"}},
+			{From: "json", To: "text", Users: []string{"legacy"}},
+		},
+	})
+
+	query := func(user string) ([]ColumnDef, []byte) {
+		t.Helper()
+		client := dialProxyAs(t, srv, user)
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT * FROM events"...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		mustReadPacket(t, client) // column count
+		var cols []ColumnDef
+		for range events.Columns {
+			col, err := parseColumnDef(mustReadPacket(t, client).Payload)
+			if err != nil {
+				t.Fatalf("parse column definition: %v", err)
+			}
+			cols = append(cols, col)
+		}
+		mustReadPacket(t, client) // EOF
+		row := mustReadPacket(t, client).Payload
+		mustReadPacket(t, client) // EOF
+		return cols, row
+	}
+
+	cols, row := query("legacy")
+	types := []byte{cols[0].Type, cols[1].Type, cols[2].Type}
+	if want := []byte{TypeLong, TypeBlob, TypeLongLong}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("legacy client got column types %x, want %x", types, want)
+	}
+	if cols[1].Charset != CharsetUTF8MB4 {
+		t.Fatalf("JSON column retyped as TEXT kept charset %d", cols[1].Charset)
+	}
+	cols, raw := query("app")
+	if string(row) != string(raw) {
+		t.Fatalf("retyped row %q differs from the backend's %q", row, raw)
+	}
+	if cols[0].Type != TypeLongLong || cols[1].Type != TypeJSON {
+		t.Fatalf("rules applied to a user they do not name: %+v", cols)
+	}
+
+	if _, err := NewServer(Config{ColumnTypeRules: []ColumnTypeRule{{From: "BIGINT", To: "HUGEINT"}}}); err == nil {
+		t.Fatalf("expected an error for an unknown column type")
+	}
+}
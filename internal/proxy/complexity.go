@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ComplexityLimits rejects pathological queries before they reach a
+// backend. Zero values disable the corresponding check.
+type ComplexityLimits struct {
+	// MaxJoins is the largest number of JOINs allowed in a statement.
+	MaxJoins int
+	// MaxSubqueryDepth is the deepest nesting of subqueries allowed.
+	MaxSubqueryDepth int
+	// RejectCartesian rejects a SELECT that reads several tables, or joins
+	// them without a condition, and has no WHERE clause.
+	RejectCartesian bool
+}
+
+func (l ComplexityLimits) enabled() bool {
+	return l.MaxJoins > 0 || l.MaxSubqueryDepth > 0 || l.RejectCartesian
+}
+
+// queryComplexity is what the heuristics measure in a statement.
+type queryComplexity struct {
+	joins         int
+	subqueryDepth int
+	cartesian     bool
+}
+
+// selectScope tracks one SELECT, either the statement itself or a
+// parenthesised subquery, while scanning its tokens.
+type selectScope struct {
+	depth       int // parenthesis depth the scope's clauses are at
+	nesting     int // number of enclosing subqueries, counting this one
+	isSelect    bool
+	inFrom      bool
+	tables      int
+	pendingJoin bool // a JOIN not yet followed by ON or USING
+	unjoined    int  // JOINs without a condition
+	hasWhere    bool
+}
+
+func (s *selectScope) endJoin() {
+	if s.pendingJoin {
+		s.unjoined++
+		s.pendingJoin = false
+	}
+}
+
+func (s *selectScope) cartesian() bool {
+	s.endJoin()
+	return s.isSelect && !s.hasWhere && (s.tables > 1 || s.unjoined > 0)
+}
+
+// fromClauseEnd are the words that end a FROM clause.
+var fromClauseEnd = map[string]bool{
+	"WHERE": true, "GROUP": true, "HAVING": true, "ORDER": true, "LIMIT": true,
+	"UNION": true, "EXCEPT": true, "INTERSECT": true, "WINDOW": true, "FOR": true,
+	"LOCK": true, "INTO": true, "SET": true,
+}
+
+func measureComplexity(q *Query) queryComplexity {
+	var c queryComplexity
+	scopes := []*selectScope{{}}
+	depth := 0
+	toks := q.Tokens
+
+	for i, tok := range toks {
+		scope := scopes[len(scopes)-1]
+		switch {
+		case tok.IsPunct("("):
+			depth++
+			if i+1 < len(toks) && (toks[i+1].IsWord("SELECT") || toks[i+1].IsWord("WITH")) {
+				// A parenthesised SELECT is a subquery unless it is a
+				// whole statement or UNION branch.
+				nesting := scope.nesting
+				if i > 0 && !isSetOperator(toks[i-1]) {
+					nesting++
+				}
+				scopes = append(scopes, &selectScope{depth: depth, nesting: nesting})
+				c.subqueryDepth = max(c.subqueryDepth, nesting)
+			}
+		case tok.IsPunct(")"):
+			if len(scopes) > 1 && scope.depth == depth {
+				c.cartesian = c.cartesian || scope.cartesian()
+				scopes = scopes[:len(scopes)-1]
+			}
+			depth--
+		case depth != scope.depth:
+			// Inside an expression or derived table list of this scope.
+		case tok.Kind != TokenWord:
+			if scope.inFrom && tok.IsPunct(",") {
+				scope.tables++
+			}
+		default:
+			switch word := strings.ToUpper(tok.Text); {
+			case word == "JOIN" || word == "STRAIGHT_JOIN":
+				c.joins++
+				scope.endJoin()
+				natural := i > 0 && toks[i-1].IsWord("NATURAL")
+				scope.pendingJoin = !natural
+			case word == "ON" || word == "USING":
+				scope.pendingJoin = false
+			case word == "FROM":
+				scope.inFrom = true
+				scope.tables = 1
+			case word == "WHERE":
+				scope.endJoin()
+				scope.inFrom = false
+				scope.hasWhere = true
+			case word == "SELECT":
+				if scope.isSelect {
+					// A UNION branch starts a fresh SELECT at this level.
+					c.cartesian = c.cartesian || scope.cartesian()
+					*scope = selectScope{depth: scope.depth, nesting: scope.nesting}
+				}
+				scope.isSelect = true
+			case fromClauseEnd[word]:
+				scope.endJoin()
+				scope.inFrom = false
+			}
+		}
+	}
+	for _, s := range scopes {
+		c.cartesian = c.cartesian || s.cartesian()
+	}
+	return c
+}
+
+func isSetOperator(tok Token) bool {
+	return tok.IsWord("UNION") || tok.IsWord("EXCEPT") || tok.IsWord("INTERSECT") ||
+		tok.IsWord("ALL") || tok.IsWord("DISTINCT")
+}
+
+// check returns the error sent to the client when q exceeds the limits.
+func (l ComplexityLimits) check(q *Query) (reason string, err error) {
+	c := measureComplexity(q)
+	switch {
+	case l.MaxJoins > 0 && c.joins > l.MaxJoins:
+		return "joins", complexityError(fmt.Sprintf("%d joins exceed the limit of %d", c.joins, l.MaxJoins))
+	case l.MaxSubqueryDepth > 0 && c.subqueryDepth > l.MaxSubqueryDepth:
+		return "subquery_depth", complexityError(fmt.Sprintf("subqueries nested %d deep exceed the limit of %d", c.subqueryDepth, l.MaxSubqueryDepth))
+	case l.RejectCartesian && c.cartesian:
+		return "cartesian", complexityError("it reads several tables without a join condition or WHERE clause (cartesian product)")
+	}
+	return "", nil
+}
+
+func complexityError(reason string) *SQLError {
+	return &SQLError{Code: 1104, SQLState: "42000", Message: "Query rejected by metal-db-proxy: " + reason}
+}
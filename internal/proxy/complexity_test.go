@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMeasureComplexity(t *testing.T) {
+	cases := []struct {
+		sql       string
+		joins     int
+		depth     int
+		cartesian bool
+	}{
+		{"SELECT * FROM a JOIN b ON a.id = b.id LEFT JOIN c USING (id)", 2, 0, false},
+		{"SELECT * FROM a, b", 0, 0, true},
+		{"SELECT * FROM a, b WHERE a.id = b.id", 0, 0, false},
+		{"SELECT * FROM a CROSS JOIN b", 1, 0, true},
+		{"SELECT * FROM a NATURAL JOIN b", 1, 0, false},
+		{"SELECT * FROM a WHERE id IN (SELECT id FROM b WHERE x IN (SELECT x FROM c))", 0, 2, false},
+		{"SELECT (SELECT COUNT(*) FROM a, b) FROM c", 0, 1, true},
+		{"SELECT 'JOIN JOIN, FROM a, b' FROM t", 0, 0, false},
+		{"SELECT EXTRACT(YEAR FROM d) FROM t", 0, 0, false},
+		{"(SELECT * FROM a) UNION (SELECT * FROM b)", 0, 0, false},
+		{"SELECT * FROM a WHERE x = 1 UNION SELECT * FROM b, c", 0, 0, true},
+		{"INSERT INTO t SELECT * FROM a, b", 0, 0, true},
+		{"DELETE FROM t", 0, 0, false},
+	}
+	for _, c := range cases {
+		got := measureComplexity(ParseQuery(c.sql))
+		if got.joins != c.joins || got.subqueryDepth != c.depth || got.cartesian != c.cartesian {
+			t.Errorf("%q: got joins=%d depth=%d cartesian=%v, want %d %d %v",
+				c.sql, got.joins, got.subqueryDepth, got.cartesian, c.joins, c.depth, c.cartesian)
+		}
+	}
+}
+
+func TestComplexQueryRejected(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{
+		Backends:   []BackendConfig{fb.config()},
+		Complexity: ComplexityLimits{MaxJoins: 1, MaxSubqueryDepth: 1, RejectCartesian: true},
+	})
+	client := dialProxy(t, srv)
+
+	cases := []struct {
+		sql      string
+		rejected bool
+	}{
+		{"SELECT * FROM a JOIN b ON a.id = b.id JOIN c ON c.id = b.id", true},
+		{"SELECT * FROM a WHERE id IN (SELECT id FROM b WHERE x IN (SELECT x FROM c))", true},
+		{"SELECT * FROM orders, customers", true},
+		{"SELECT * FROM a JOIN b ON a.id = b.id WHERE a.id IN (SELECT id FROM c)", false},
+	}
+	for _, c := range cases {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, c.sql...)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		pkt := mustReadPacket(t, client)
+		sqlErr, err := ParseErrPacket(pkt.Payload)
+		if rejected := err == nil; rejected != c.rejected {
+			t.Fatalf("%q: rejected=%v, want %v", c.sql, rejected, c.rejected)
+		}
+		if c.rejected && sqlErr.Code != 1104 {
+			t.Fatalf("%q: unexpected error %v", c.sql, sqlErr)
+		}
+	}
+	if n := fb.queries.Load(); n != 1 {
+		t.Fatalf("backend saw %d queries, want only the permitted one", n)
+	}
+}
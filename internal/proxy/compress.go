@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+const (
+	// compressedHeaderSize is the size of a compressed protocol frame
+	// header: compressed length, sequence and uncompressed length.
+	compressedHeaderSize = 7
+	// minCompressLength is the payload size below which frames are sent
+	// uncompressed, as the MySQL server does.
+	minCompressLength = 50
+	// maxFramePayload is the largest payload a frame can carry.
+	maxFramePayload = 0xFFFFFF
+)
+
+// CompressionStats counts the bytes of a compressed client connection before
+// and after compression in each direction.
+type CompressionStats struct {
+	// ReceivedWire and ReceivedPayload are the bytes received from the
+	// client as sent and after decompression.
+	ReceivedWire    uint64
+	ReceivedPayload uint64
+	// SentPayload and SentWire are the bytes sent to the client before and
+	// after compression.
+	SentPayload uint64
+	SentWire    uint64
+}
+
+// Ratio is the number of payload bytes per byte on the wire across both
+// directions, or 0 before any traffic.
+func (s CompressionStats) Ratio() float64 {
+	wire := s.ReceivedWire + s.SentWire
+	if wire == 0 {
+		return 0
+	}
+	return float64(s.ReceivedPayload+s.SentPayload) / float64(wire)
+}
+
+// compressedConn speaks the zlib compressed protocol over a connection
+// after CLIENT_COMPRESS has been negotiated. Reads return the decompressed
+// packet stream and every Write is sent as one or more frames.
+//
+// One goroutine may read while another writes. A read interrupted by a
+// deadline keeps the part of the frame already received.
+type compressedConn struct {
+	net.Conn
+
+	// seq is the frame sequence number, restarted by each frame the peer
+	// sends.
+	seq atomic.Uint32
+	// frame holds the frame being read; in the decompressed bytes not yet
+	// returned by Read.
+	frame []byte
+	in    []byte
+	zw    *zlib.Writer
+	wbuf  bytes.Buffer
+
+	receivedWire, receivedPayload atomic.Uint64
+	sentPayload, sentWire         atomic.Uint64
+
+	// backend is set on connections to backends, whose bytes are left out
+	// of the client compression metrics.
+	backend bool
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	c := &compressedConn{Conn: conn}
+	c.zw = zlib.NewWriter(&c.wbuf)
+	return c
+}
+
+// resetSequence restarts the frame sequence, as a client does before each
+// command it sends.
+func (c *compressedConn) resetSequence() { c.seq.Store(0) }
+
+// Stats returns the connection's byte counters.
+func (c *compressedConn) Stats() CompressionStats {
+	return CompressionStats{
+		ReceivedWire:    c.receivedWire.Load(),
+		ReceivedPayload: c.receivedPayload.Load(),
+		SentPayload:     c.sentPayload.Load(),
+		SentWire:        c.sentWire.Load(),
+	}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	for len(c.in) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *compressedConn) readFrame() error {
+	need := compressedHeaderSize
+	for {
+		if len(c.frame) >= compressedHeaderSize {
+			need = compressedHeaderSize + int(uint24(c.frame))
+		}
+		if len(c.frame) == need {
+			break
+		}
+		if cap(c.frame) < need {
+			c.frame = append(make([]byte, 0, need), c.frame...)
+		}
+		n, err := c.Conn.Read(c.frame[len(c.frame):need])
+		c.frame = c.frame[:len(c.frame)+n]
+		if err != nil {
+			if err == io.EOF && len(c.frame) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	body := c.frame[compressedHeaderSize:]
+	c.seq.Store(uint32(c.frame[3]) + 1)
+	if size := uint24(c.frame[4:]); size == 0 {
+		c.in = append([]byte(nil), body...)
+	} else {
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("decompress frame: %w", err)
+		}
+		c.in = make([]byte, size)
+		if _, err := io.ReadFull(zr, c.in); err != nil {
+			return fmt.Errorf("decompress frame: %w", err)
+		}
+	}
+	c.count(&c.receivedWire, &c.receivedPayload, "received", len(c.frame), len(c.in))
+	c.frame = c.frame[:0]
+	return nil
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxFramePayload)]
+		if err := c.writeFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame sends payload in one frame, compressed unless it is short or
+// does not shrink.
+func (c *compressedConn) writeFrame(payload []byte) error {
+	body, size := payload, 0
+	if len(payload) >= minCompressLength {
+		c.wbuf.Reset()
+		c.zw.Reset(&c.wbuf)
+		c.zw.Write(payload)
+		if err := c.zw.Close(); err != nil {
+			return err
+		}
+		if c.wbuf.Len() < len(payload) {
+			body, size = c.wbuf.Bytes(), len(payload)
+		}
+	}
+	frame := make([]byte, compressedHeaderSize, compressedHeaderSize+len(body))
+	putUint24(frame, uint32(len(body)))
+	frame[3] = byte(c.seq.Add(1) - 1)
+	putUint24(frame[4:], uint32(size))
+	frame = append(frame, body...)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return err
+	}
+	c.count(&c.sentWire, &c.sentPayload, "sent", len(frame), len(payload))
+	return nil
+}
+
+func (c *compressedConn) count(wire, payload *atomic.Uint64, direction string, wireBytes, payloadBytes int) {
+	wire.Add(uint64(wireBytes))
+	payload.Add(uint64(payloadBytes))
+	if c.backend {
+		return
+	}
+	metrics.CompressionBytes.WithLabelValues(direction, "wire").Add(float64(wireBytes))
+	metrics.CompressionBytes.WithLabelValues(direction, "payload").Add(float64(payloadBytes))
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialCompressed authenticates a client that negotiates CLIENT_COMPRESS and
+// returns its side of the compressed connection with the connection id.
+func dialCompressed(t *testing.T, srv *Server) (*compressedConn, uint32) {
+	t.Helper()
+	client, server := net.Pipe()
+	go srv.Handle(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pkt := mustReadPacket(t, client)
+	greeting, err := parseServerGreeting(pkt.Payload)
+	if err != nil {
+		t.Fatalf("parse greeting: %v", err)
+	}
+	if greeting.Capabilities&capCompress == 0 {
+		t.Fatalf("greeting does not advertise CLIENT_COMPRESS")
+	}
+	auth := nativePasswordAuth(greeting.Scramble, "password")
+	resp := make([]byte, 32)
+	putHandshakeHeader(resp, capProtocol41|capSecureConnection|capCompress)
+	resp = append(append(resp, "root\x00"...), byte(len(auth)))
+	resp = append(resp, auth...)
+	if err := WritePacket(client, pkt.Sequence+1, resp); err != nil {
+		t.Fatalf("write handshake response: %v", err)
+	}
+	if ok := mustReadPacket(t, client); ok.Payload[0] != 0x00 {
+		t.Fatalf("expected OK, got %x", ok.Payload)
+	}
+	return newCompressedConn(client), greeting.ConnectionID
+}
+
+func TestCompressedConnRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sender, receiver := newCompressedConn(a), newCompressedConn(b)
+
+	large := []byte(strings.Repeat("metal-db-proxy ", 100))
+	small := []byte("short")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sender.Write(large)
+		sender.Write(small)
+	}()
+	got := make([]byte, len(large)+len(small))
+	for n := 0; n < len(got); {
+		m, err := receiver.Read(got[n:])
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		n += m
+	}
+	if !bytes.Equal(got, append(large, small...)) {
+		t.Fatalf("payload corrupted in transit")
+	}
+	<-done
+
+	sent, received := sender.Stats(), receiver.Stats()
+	if sent.SentPayload != uint64(len(got)) || received.ReceivedPayload != uint64(len(got)) {
+		t.Fatalf("payload counters: sent %d, received %d, want %d", sent.SentPayload, received.ReceivedPayload, len(got))
+	}
+	if sent.SentWire != received.ReceivedWire || sent.SentWire >= sent.SentPayload {
+		t.Fatalf("wire counters: sent %d, received %d; want equal and below %d", sent.SentWire, received.ReceivedWire, sent.SentPayload)
+	}
+	if sent.Ratio() <= 1 {
+		t.Fatalf("ratio %.2f, want compression", sent.Ratio())
+	}
+}
+
+func TestCompressedClientStats(t *testing.T) {
+	rs := &ResultSet{
+		Columns: []ColumnDef{{Name: "body"}},
+		Rows:    [][]string{{strings.Repeat("a", 4096)}},
+	}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeTestResultSet(conn, rs)
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, Compression: true})
+	client, id := dialCompressed(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT body FROM docs"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if _, rows := readTestResultSet(t, client); !reflect.DeepEqual(rows, rs.Rows) {
+		t.Fatalf("rows corrupted over the compressed connection")
+	}
+
+	conn, ok := srv.conns.get(id)
+	if !ok {
+		t.Fatalf("connection %d not registered", id)
+	}
+	stats := conn.Stats().Compression
+	if stats == nil {
+		t.Fatalf("no compression stats for a compressed client")
+	}
+	if stats.ReceivedPayload == 0 || stats.SentPayload < 4096 || stats.SentWire >= stats.SentPayload {
+		t.Fatalf("unexpected stats %+v", *stats)
+	}
+}
+
+func TestCompressionBridging(t *testing.T) {
+	rs := &ResultSet{
+		Columns: []ColumnDef{{Name: "body"}},
+		Rows:    [][]string{{strings.Repeat("b", 4096)}},
+	}
+	query := "SELECT body FROM docs WHERE title = '" + strings.Repeat("t", 200) + "'"
+	for _, tc := range []struct {
+		name            string
+		client, backend bool
+	}{
+		{"compressed client, plain backend", true, false},
+		{"plain client, compressed backend", false, true},
+		{"both compressed", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var received []string
+			var mu sync.Mutex
+			fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+				mu.Lock()
+				received = append(received, string(payload[1:]))
+				mu.Unlock()
+				writeTestResultSet(conn, rs)
+			})
+			fb.compress.Store(tc.backend)
+			cfg := fb.config()
+			cfg.Compression = tc.backend
+			srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}, Compression: true})
+
+			var client net.Conn
+			if tc.client {
+				client, _ = dialCompressed(t, srv)
+			} else {
+				client = dialProxy(t, srv)
+			}
+			for range 2 {
+				if err := WritePacket(client, 0, append([]byte{COM_QUERY}, query...)); err != nil {
+					t.Fatalf("write query: %v", err)
+				}
+				if _, rows := readTestResultSet(t, client); !reflect.DeepEqual(rows, rs.Rows) {
+					t.Fatalf("rows corrupted between client and backend")
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) != 2 || received[0] != query || received[1] != query {
+				t.Fatalf("backend received %d queries, want the query twice intact", len(received))
+			}
+			want := int32(0)
+			if tc.backend {
+				want = 1
+			}
+			if got := fb.compressed.Load(); got != want {
+				t.Fatalf("%d backend connections compressed, want %d", got, want)
+			}
+		})
+	}
+}
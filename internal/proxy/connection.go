@@ -1,65 +1,304 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"metal-db-proxy/internal/metrics"
 )
 
 const (
 	COM_QUIT    = 0x01
 	COM_INIT_DB = 0x02
 	COM_QUERY   = 0x03
+	COM_PING    = 0x0E
+
+	COM_RESET_CONNECTION = 0x1F
 )
 
+// commandNames name commands in metrics. Others are counted as "other",
+// keeping the label's values bounded.
+var commandNames = map[byte]string{
+	COM_QUIT:                "quit",
+	COM_INIT_DB:             "init_db",
+	COM_QUERY:               "query",
+	COM_PING:                "ping",
+	COM_RESET_CONNECTION:    "reset_connection",
+	COM_STMT_PREPARE:        "stmt_prepare",
+	COM_STMT_EXECUTE:        "stmt_execute",
+	COM_STMT_SEND_LONG_DATA: "stmt_send_long_data",
+	COM_STMT_CLOSE:          "stmt_close",
+	COM_STMT_RESET:          "stmt_reset",
+}
+
+func commandName(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return "other"
+}
+
+// errClientQuit ends the command loop after COM_QUIT.
+var errClientQuit = errors.New("client quit")
+
+// connectionIDs hands out the thread ids advertised in the handshake. They only
+// need to be unique, not unpredictable.
+var connectionIDs atomic.Uint32
+
+func nextConnectionID() uint32 {
+	return connectionIDs.Add(1)
+}
+
 type Connection struct {
+	id        uint32
+	server    *Server
 	conn      net.Conn
 	logger    *logrus.Entry
 	sequence  uint8 // server-side sequence counter
-	username  string
 	connected time.Time
+
+	// mu guards the fields other goroutines read through Info. They are
+	// only written by the connection's own goroutine, which reads them
+	// without locking.
+	mu       sync.Mutex
+	username string
+	database string
+	// tenant is derived from username at authentication.
+	tenant string
+	// tag is the label set with the Config.TagVariable proxy variable.
+	tag string
+
+	// backend is the backend connection held for this client, if any.
+	backend *BackendConn
+	session *sessionState
+	// inTransaction is set while the backend reports an open transaction,
+	// which began with the statement started at txStarted.
+	inTransaction bool
+	txStarted     time.Time
+	// txStatements are the text queries of the open transaction, totalling
+	// txBuffered bytes, kept to replay it after a lock conflict.
+	// txUnreplayable is set once it ran a command that was not kept.
+	txStatements   []string
+	txBuffered     int64
+	txUnreplayable bool
+	// txWrites are the tables written in the open transaction, whose cached
+	// results are dropped again when it ends; txWroteAll is set when a
+	// statement of it named no tables.
+	txWrites   []string
+	txWroteAll bool
+	// stmts are the client's prepared statements by id.
+	stmts      map[uint32]*PreparedStatement
+	lastStmtID uint32
+	// compressed is the compression layer when the client negotiated it.
+	compressed *compressedConn
+	// reader buffers client commands after the handshake.
+	reader *bufio.Reader
+	// mask rewrites the rows relayed to this client under the server's
+	// masking rules; nil when none apply to the user.
+	mask RowTransformer
+	// retype changes the column types relayed to this client under the
+	// server's column type rules; nil when none apply to the user.
+	retype RowTransformer
+	// charset is the character set the client negotiated in its handshake
+	// or last selected with SET NAMES; empty when it is not known.
+	charset string
+	// result describes the last response relayed from a backend or
+	// answered locally, for the query log.
+	result *ExecResult
+	// route records the backend the query being executed was sent to and
+	// why, for the query log.
+	route queryRoute
+	// hinted is the backend named by the hint of the query being executed.
+	hinted *Backend
+	// capture, when set, copies the response relayed for the command being
+	// executed, for the result cache.
+	capture *resultCapture
+	// beforeReply, when set, runs once just before the response to the
+	// command being executed is relayed.
+	beforeReply func()
+	// offered are the capability flags advertised to the client, and
+	// capabilities those it negotiated.
+	offered      uint32
+	capabilities uint32
+	// pipelined is set when the client sent more data together with a
+	// command, before any response to it could have been written.
+	pipelined bool
+	// closeReason is why the connection ended; guarded by mu.
+	closeReason CloseReason
+	// profile shapes the greeting for the listener the client connected
+	// to.
+	profile listenerProfile
 }
 
-func NewConnection(c net.Conn) *Connection {
+func NewConnection(s *Server, c net.Conn) *Connection {
+	id := nextConnectionID()
 	return &Connection{
+		id:        id,
+		server:    s,
 		conn:      c,
-		logger:    logrus.WithField("remote", c.RemoteAddr().String()),
+		logger:    logrus.WithFields(logrus.Fields{"remote": c.RemoteAddr().String(), "conn_id": id}),
 		sequence:  0,
 		connected: time.Now(),
+		session:   newSessionState(s.cfg.MaxSessionVariables),
 	}
 }
 
 func (c *Connection) Handle() {
+	c.server.conns.add(c)
+	metrics.ConnectionsOpened.Inc()
+	metrics.ActiveConnections.Inc()
+	// Deferred first so they run last, even if the cleanup below panics.
+	defer c.server.conns.remove(c)
+	defer metrics.ActiveConnections.Dec()
 	defer func() {
 		if r := recover(); r != nil {
+			c.setCloseReason(ClosePanic)
 			c.logger.Errorf("panic in connection: %v", r)
 		}
+		c.releaseBackend()
 		c.conn.Close()
-		c.logger.Info("connection closed")
+		// Paths that record no reason failed to write to the client.
+		c.setCloseReason(CloseNetworkError)
+		reason := c.CloseReason()
+		metrics.ConnectionsClosed.WithLabelValues(string(reason)).Inc()
+		c.logger.WithField("reason", reason).Info("connection closed")
 	}()
 
 	c.logger.Info("new connection")
 
-	scramble, err := SendHandshake(c.conn)
-	if err != nil {
-		c.logger.WithError(err).Error("failed to send handshake")
+	if !c.server.Ready() {
+		c.logger.Warn("rejecting connection: no backend is ready")
+		c.setCloseReason(CloseNotReady)
+		// ER_SERVER_SHUTDOWN, which clients treat as the server being
+		// unavailable and retry, as they do while a backend drains.
+		WritePacket(c.conn, 0, NewErrPacket(1053, "08S01", "metal-db-proxy is starting: no backend is available yet"))
 		return
 	}
-	c.sequence = 1
+	if reason := c.server.overloaded(); reason != "" {
+		c.logger.WithField("load", reason).Warn("rejecting connection: proxy overloaded")
+		metrics.ConnectionsShed.Inc()
+		c.setCloseReason(CloseOverloaded)
+		WritePacket(c.conn, 0, NewErrPacket(1040, "08004", "Too many connections"))
+		return
+	}
+
+	if d := c.server.reconnectDelay(); d > 0 {
+		metrics.ConnectionsDelayed.Inc()
+		c.logger.WithField("delay", d).Debug("delaying greeting to spread reconnects")
+		time.Sleep(d)
+	}
 
-	if err := HandleHandshake(c.conn, c.conn, scramble, c.sequence); err != nil {
-		c.logger.WithError(err).Error("handshake/auth failed")
+	if t := c.server.cfg.HandshakeTimeout; t > 0 {
+		c.conn.SetDeadline(c.connected.Add(t))
+	}
+	hs, err := c.handshake()
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			metrics.HandshakeTimeouts.Inc()
+			c.setCloseReason(CloseHandshakeTimeout)
+			c.logger.WithField("timeout", c.server.cfg.HandshakeTimeout).Warn("handshake timed out")
+			return
+		}
+		switch {
+		case errors.Is(err, ErrInvalidHandshake):
+			c.setCloseReason(CloseProtocolError)
+			c.logger.WithError(err).Warn("malformed handshake response; closing connection")
+		case errors.Is(err, ErrTLSUnavailable):
+			c.setCloseReason(CloseProtocolError)
+			c.logger.WithError(err).Error("handshake/auth failed")
+		case errors.Is(err, ErrTLSHandshake):
+			// Logged with its reason by startTLS.
+			c.setCloseReason(CloseTLSHandshakeFailed)
+		case errors.Is(err, ErrProtocolMismatch):
+			c.setCloseReason(CloseProtocolError)
+			c.logger.Warn("client only supports the pre-4.1 protocol; closing connection")
+		case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrAuthUnavailable), errors.Is(err, ErrTLSRequired):
+			c.setCloseReason(CloseAuthFailed)
+			c.logger.WithError(err).Error("handshake/auth failed")
+		default:
+			c.setCloseReason(ioCloseReason(err))
+			c.logger.WithError(err).Error("handshake/auth failed")
+		}
 		return
 	}
-	c.logger.Info("client authenticated")
+	c.conn.SetDeadline(time.Time{})
+	c.mu.Lock()
+	c.username = hs.Username
+	c.database = hs.Database
+	c.tenant = c.server.tenantOf(hs.Username)
+	c.mu.Unlock()
+	c.capabilities = hs.Capabilities
+	if !c.server.cfg.TransparentAuth {
+		c.capabilities &= c.offered
+	}
+	c.mask = c.server.maskRewriter(hs.Username)
+	c.retype = c.server.typeRewriter(hs.Username)
+	if coll, ok := CollationByID(hs.Collation); ok {
+		c.charset = coll.Charset
+	}
+	if db := c.server.cfg.DefaultDatabases[hs.Username]; hs.Database == "" && db != "" {
+		if _, err := c.useDatabase(db); err != nil {
+			c.logger.WithError(err).WithField("database", db).Warn("failed to select the user's default database")
+		}
+	}
+	if c.capabilities&capCompress != 0 && c.server.capabilities()&capCompress != 0 {
+		c.mu.Lock()
+		c.compressed = newCompressedConn(c.conn)
+		c.conn = c.compressed
+		c.mu.Unlock()
+	}
+	compression := "none"
+	if c.compressed != nil {
+		compression = "zlib"
+	}
+	c.logger.WithFields(logrus.Fields{
+		"capabilities": capabilityString(c.capabilities),
+		"compression":  compression,
+	}).Info("client authenticated")
 
+	c.reader = bufio.NewReader(c.conn)
 	for {
-		pkt, err := ReadPacket(c.conn)
+		if t := c.server.cfg.IdleTimeout; t > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(t))
+		}
+		pkt, err := readCommandPacket(c.reader, c.server.packetMemory)
+		if c.server.cfg.IdleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.setCloseReason(CloseIdleTimeout)
+			c.logger.WithField("after", c.server.cfg.IdleTimeout).Info("closing idle client connection")
+			c.sequence = 0
+			c.writePacket(errIdleTimeout.Packet())
+			return
+		}
+		if errors.Is(err, ErrPacketFraming) {
+			metrics.FramingViolations.Inc()
+			c.setCloseReason(CloseProtocolError)
+			c.logger.WithError(err).Warn("security: possible packet smuggling; closing connection")
+			return
+		}
+		if errors.Is(err, ErrPacketMemoryExhausted) {
+			c.logger.WithField("bytes", pkt.Length).Warn("rejecting packet: packet buffer memory exhausted")
+			c.sequence = pkt.Sequence + 1
+			if werr := c.writePacket(errorPacket(err)); werr != nil {
+				c.logger.WithError(werr).Warn("failed to write error packet")
+				return
+			}
+			continue
+		}
 		if err != nil {
+			c.setCloseReason(ioCloseReason(err))
 			if errors.Is(err, io.EOF) {
 				c.logger.Info("client disconnected (EOF)")
 				return
@@ -72,13 +311,42 @@ func (c *Connection) Handle() {
 			continue
 		}
 
+		c.sequence = pkt.Sequence + 1
+		if expectsResponse(pkt.Payload[0]) {
+			if c.pipelined && !c.server.cfg.AllowPipelining {
+				err := c.rejectPipelined(pkt.Payload[0])
+				c.server.packetMemory.Release(int64(len(pkt.Payload)))
+				if err != nil {
+					c.logger.WithError(err).Warn("failed to write error packet")
+					return
+				}
+				continue
+			}
+			c.pipelined = c.reader.Buffered() > 0
+		}
 		start := time.Now()
+		c.server.inFlight.Add(1)
 		resp, err := c.handleCommand(pkt.Payload)
-		_ = start // placeholder until metrics are wired
+		c.server.inFlight.Add(-1)
+		c.server.packetMemory.Release(int64(len(pkt.Payload)))
+		cmd := commandName(pkt.Payload[0])
+		metrics.Commands.WithLabelValues(cmd).Inc()
+		metrics.CommandDuration.WithLabelValues(cmd).Observe(time.Since(start).Seconds())
 
 		if err != nil {
-			errPkt := NewErrPacket(1064, "42000", err.Error())
-			if werr := WritePacket(c.conn, pkt.Sequence+1, errPkt); werr != nil {
+			if errors.Is(err, errClientQuit) {
+				c.setCloseReason(CloseClientQuit)
+				return
+			}
+			if errors.Is(err, ErrBackendDesync) {
+				// Part of the response may have been relayed already, so
+				// the client cannot be trusted to be in step either.
+				c.setCloseReason(CloseBackendError)
+				c.logger.WithError(err).WithField("cmd", pkt.Payload[0]).Error("backend protocol desync; closing connection")
+				c.writePacket(errorPacket(err))
+				return
+			}
+			if werr := c.writePacket(errorPacket(err)); werr != nil {
 				c.logger.WithError(werr).Warn("failed to write error packet")
 				return
 			}
@@ -89,42 +357,628 @@ func (c *Connection) Handle() {
 			continue
 		}
 
-		if err := WritePacket(c.conn, pkt.Sequence+1, resp); err != nil {
+		if err := c.writePacket(resp); err != nil {
 			c.logger.WithError(err).Warn("failed to write response packet")
 			return
 		}
 	}
 }
 
+// handshake authenticates the client, against the default backend in
+// transparent mode and against the proxy otherwise.
+func (c *Connection) handshake() (*HandshakeResponse, error) {
+	if c.server.cfg.TransparentAuth && c.server.router != nil {
+		return c.transparentHandshake()
+	}
+
+	caps := c.server.capabilities()
+	if c.profile.tls != nil {
+		caps |= capSSL
+	}
+	c.offered = caps &^ c.server.withheldCapabilities(c.conn.RemoteAddr()) &^ c.profile.withheld
+	version := c.profile.version
+	if version == "" {
+		version = c.server.serverVersion()
+	}
+	scramble, err := sendHandshake(c.conn, c.id, version, c.offered, c.authPlugin())
+	if err != nil {
+		return nil, fmt.Errorf("send handshake: %w", err)
+	}
+	auth := c.server.cfg.Auth
+	if auth == nil {
+		auth = defaultAuth
+	}
+	// The greeting went out with sequence number 0.
+	ex := &authExchange{r: c.conn, w: c.conn, seq: 1, plugin: c.authPlugin(), sha2: &c.server.sha2Cache, rsa: c.server.authRSA, admin: c.server.cfg.AdminUser}
+	if c.tlsConfig() != nil {
+		ex.startTLS = c.startTLS
+		ex.requireTLS = c.server.cfg.RequireTLS || c.profile.requireTLS
+	}
+	if len(c.server.cfg.SessionVariables) > 0 {
+		ex.ok = c.sessionStateOK
+	}
+	return authenticate(ex, scramble, auth, c.server.cfg.AuthFailOpen, c.logger)
+}
+
+// Info returns a snapshot of the connection. It is safe to call from any
+// goroutine.
+func (c *Connection) Info() ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConnectionInfo{
+		ID:        c.id,
+		User:      c.username,
+		Database:  c.database,
+		Remote:    c.conn.RemoteAddr().String(),
+		Connected: c.connected,
+		Tag:       c.tag,
+	}
+}
+
+// ConnectionStats are the traffic counters of a client connection.
+type ConnectionStats struct {
+	// Compression is nil unless the client negotiated compression.
+	Compression *CompressionStats
+}
+
+// Stats returns the connection's traffic counters.
+func (c *Connection) Stats() ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stats ConnectionStats
+	if c.compressed != nil {
+		cs := c.compressed.Stats()
+		stats.Compression = &cs
+	}
+	return stats
+}
+
 func (c *Connection) handleCommand(payload []byte) ([]byte, error) {
 	cmd := payload[0]
 	data := payload[1:]
 
+	if cmd != COM_QUIT && cmd != COM_STMT_CLOSE {
+		if err := c.checkTenant(); err != nil {
+			return nil, err
+		}
+	}
+
 	switch cmd {
 	case COM_QUIT:
 		c.logger.Info("COM_QUIT received")
-		return nil, io.EOF
+		return nil, errClientQuit
+
+	case COM_PING:
+		// Answered by the proxy itself: drivers and pools ping to keep the
+		// client connection alive, which needs no backend.
+		return NewOKPacket(0, 0, 0), nil
 
 	case COM_INIT_DB:
 		dbName := string(data)
 		c.logger.WithField("db", dbName).Info("COM_INIT_DB received")
-		return NewOKPacket(0, 0, 0), nil
+		return c.useDatabase(dbName)
 
 	case COM_QUERY:
 		query := string(data)
 		c.logger.WithField("query", query).Debug("COM_QUERY received")
-		return c.executeQuery(query)
+		start := time.Now()
+		resp, err := c.runQuery(query)
+		c.auditQuery(query, start, err)
+		return resp, err
+
+	case COM_STMT_PREPARE:
+		return nil, c.prepare(string(data))
+
+	case COM_STMT_EXECUTE:
+		return nil, c.executeStatement(data)
+
+	case COM_STMT_SEND_LONG_DATA:
+		c.sendLongData(data)
+		return nil, nil
+
+	case COM_STMT_CLOSE:
+		c.closeStatement(data)
+		return nil, nil
+
+	case COM_STMT_RESET:
+		return c.resetStatement(data)
 
 	default:
 		c.logger.WithField("cmd", cmd).Warn("unsupported command")
 		return nil, fmt.Errorf("unsupported command: %d", cmd)
 	}
 }
-func (c *Connection) executeQuery(query string) ([]byte, error) {
-	_ = query
+
+// writePacket sends a response packet to the client using the connection's
+// sequence counter, split over several packets if it is large.
+func (c *Connection) writePacket(payload []byte) error {
+	var err error
+	c.sequence, err = WriteLargePacket(c.conn, c.sequence, payload)
+	return err
+}
+
+// errorPacket converts a command error into the ERR packet sent to the client.
+func errorPacket(err error) []byte {
+	var sqlErr *SQLError
+	switch {
+	case errors.As(err, &sqlErr):
+		return sqlErr.Packet()
+	case errors.Is(err, ErrPacketMemoryExhausted):
+		return NewErrPacket(1040, "08004", "Too many connections: proxy packet buffer memory exhausted")
+	case errors.Is(err, ErrBackendDesync):
+		return NewErrPacket(1835, "HY000", "Malformed communication packet from backend; the connection is closed")
+	case errors.Is(err, ErrResultTooLarge):
+		return NewErrPacket(1105, "HY000", "Result set exceeds the proxy's limit: "+err.Error())
+	case errors.Is(err, ErrBackendLost):
+		return NewErrPacket(2013, "HY000", "Lost connection to MySQL server during query: "+err.Error())
+	case errors.Is(err, ErrBackendDraining):
+		return NewErrPacket(1053, "08S01", "Server shutdown in progress: "+err.Error())
+	case errors.Is(err, ErrBackendTimeout):
+		return NewErrPacket(3024, "HY000", "Query execution was interrupted: "+err.Error())
+	default:
+		return NewErrPacket(1064, "42000", err.Error())
+	}
+}
+
+// writeResultSet sends a locally built result set to the client.
+func (c *Connection) writeResultSet(rs *ResultSet) error {
+	c.result = &ExecResult{Rows: uint64(len(rs.Rows))}
+	for _, p := range c.withMetadataFlag(rs.PacketsFor(c.capabilities)) {
+		if err := c.writePacket(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runQuery executes a COM_QUERY, recording it in the query log, the SQL
+// script, as a trace span and by sqlcommenter tag when those are
+// configured.
+func (c *Connection) runQuery(query string) ([]byte, error) {
+	q, class := c.server.parseQuery(c.rewriteQuery(query))
+	if c.server.queryLog == nil && c.server.script == nil && c.server.tracer == nil && c.server.tags == nil {
+		return c.executeQuery(q, class)
+	}
+	c.server.tags.count(q.Tags())
+	start := time.Now()
+	database := c.database
+	span := c.startSpan(q)
+	c.result, c.route = nil, queryRoute{}
+	resp, err := c.executeQuery(q, class)
+	qerr := c.queryError(err)
+	c.endSpan(span, qerr)
+	c.logQuery(q, start, qerr)
+	if qerr == nil && !isProxyCommand(q) {
+		c.recordScript(database, q, nil)
+	}
+	return resp, err
+}
+
+// auditQuery logs the fingerprint of a COM_QUERY that started at start,
+// never the query itself, with its user and duration at info level.
+func (c *Connection) auditQuery(query string, start time.Time, err error) {
+	if !c.logger.Logger.IsLevelEnabled(logrus.InfoLevel) {
+		return
+	}
+	entry := c.logger.WithFields(logrus.Fields{
+		"user":        c.username,
+		"fingerprint": Fingerprint(query),
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Info("query")
+}
+
+// queryError is the error a query ended with: err, or the error the backend
+// answered with.
+func (c *Connection) queryError(err error) error {
+	if err == nil && c.result != nil && c.result.Err != nil {
+		return c.result.Err
+	}
+	return err
+}
+
+// errMultiStatements is returned for a batch of statements from a client
+// that did not negotiate CLIENT_MULTI_STATEMENTS, as MySQL itself does.
+var errMultiStatements = &SQLError{Code: 1064, SQLState: "42000", Message: "You have an error in your SQL syntax; multiple statements require CLIENT_MULTI_STATEMENTS"}
+
+// errEmptyQuery answers a query with no statement in it, only whitespace,
+// comments or semicolons, as MySQL does.
+var errEmptyQuery = &SQLError{Code: 1065, SQLState: "42000", Message: "Query was empty"}
+
+// errIdleTimeout is sent to clients disconnected for idling, as MySQL 8.0
+// does.
+var errIdleTimeout = &SQLError{Code: 4031, SQLState: "HY000", Message: "The client was disconnected by the server because of inactivity. See wait_timeout and interactive_timeout for configuring this behavior."}
+
+func (c *Connection) executeQuery(q *Query, class *queryClass) ([]byte, error) {
+	query := q.SQL
+	metrics.QueriesByType.WithLabelValues(string(q.Type)).Inc()
+
+	if len(q.Tokens) == 0 {
+		return nil, errEmptyQuery
+	}
+	if err := c.checkTransactionBudget(); err != nil {
+		return nil, err
+	}
+	if c.capabilities&capMultiStatements == 0 && q.MultiStatement() {
+		// Backend connections accept batches, so clients that did not ask
+		// for them are held to the single statement they negotiated.
+		return nil, errMultiStatements
+	}
+	if isProxyCommand(q) {
+		return c.proxyCommand(q)
+	}
+	if err := c.checkStatementRules(q); err != nil {
+		return nil, err
+	}
+	if tag, ok := c.server.tagAssignment(q); ok {
+		c.setTag(tag)
+		return NewOKPacket(0, 0, 0), nil
+	}
+	if db, ok := parseUseStatement(query); ok {
+		return c.useDatabase(db)
+	}
+	if rs := c.server.interceptStatus(q); rs != nil {
+		return nil, c.writeResultSet(rs)
+	}
+	if rs := c.interceptIdentity(q); rs != nil {
+		return nil, c.writeResultSet(rs)
+	}
+
+	if c.isPing(q) {
+		metrics.PingQueriesAnswered.Inc()
+		return nil, c.writeResultSet(pingResult)
+	}
+
+	router := c.server.router
+	if router == nil {
+		if rs := c.interceptInformationSchema(q); rs != nil {
+			return nil, c.writeResultSet(rs)
+		}
+		return c.standaloneAnswer(q)
+	}
+
+	if router.RoutesByDatabase() && isShowDatabases(query) {
+		return nil, c.writeResultSet(showDatabasesResult(router.Databases()))
+	}
+
+	if err := c.checkComplexity(query, class); err != nil {
+		return nil, err
+	}
+
+	c.hinted = c.hintedBackend(q)
+	defer func() { c.hinted = nil }()
+	if c.server.cfg.StripComments {
+		// Hints and tags have been read from the comments by now.
+		query = q.WithoutComments()
+	}
+
+	payload := append([]byte{COM_QUERY}, query...)
+	if rewrite := explainRewriter(c.server.cfg.ExplainRewrites); rewrite != nil && isExplain(query) {
+		_, err := c.forwardRewrite(payload, c.mask, rewrite)
+		return nil, err
+	}
+
+	if pattern, ok := showStatusPattern(q.Tokens); ok {
+		return nil, c.forwardStatus(payload, pattern)
+	}
+
+	key, isSet := sessionSetKey(query)
+	if !isSet {
+		_, err := c.forwardCached(q, payload)
+		return nil, err
+	}
+
+	var names Collation
+	if key == "names" {
+		var err error
+		if names, err = setNamesCollation(ParseQuery(query).Tokens); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.session.check(key); err != nil {
+		return nil, err
+	}
+	res, err := c.forward(payload)
+	if err == nil && res.Err == nil {
+		c.session.record(key, query)
+		if names.Charset != "" {
+			c.charset = names.Charset
+		}
+	}
+	return nil, err
+}
+
+func showDatabasesResult(dbs []string) *ResultSet {
+	rs := &ResultSet{Columns: []ColumnDef{{Name: "Database"}}}
+	for _, db := range dbs {
+		rs.Rows = append(rs.Rows, []string{db})
+	}
+	return rs
+}
+
+// useDatabase switches the connection's current database. With backends
+// configured the switch is validated by the backend that serves db.
+func (c *Connection) useDatabase(db string) ([]byte, error) {
+	if c.server.router != nil {
+		b, reason, err := c.server.router.routeFor(c.tenant, db)
+		if err != nil && !c.pinned() {
+			return nil, err
+		}
+		bc, err := c.backendFor(b)
+		if err != nil {
+			return nil, err
+		}
+		c.recordRoute(bc, b, reason)
+		err = bc.UseDatabase(db)
+		c.dropPoisonedBackend(err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	c.database = db
+	c.mu.Unlock()
 	return NewOKPacket(0, 0, 0), nil
 }
 
+// backendFor returns the held backend connection if it belongs to b, or if
+// the client is inside a transaction, which must finish on the connection it
+// started on. Otherwise the held connection is released and a connection to
+// b is borrowed, with the client's session variables replayed on it.
+func (c *Connection) backendFor(b *Backend) (*BackendConn, error) {
+	if c.backend != nil && c.backend.Backend() == b || c.pinned() {
+		return c.backend, nil
+	}
+	if c.server.cfg.TransparentAuth {
+		// The client's credentials are not known to the proxy, so a lost
+		// dedicated connection cannot be replaced.
+		return nil, &SQLError{Code: 2013, SQLState: "HY000", Message: "Lost connection to backend; reconnect to authenticate again"}
+	}
+	c.releaseBackend()
+
+	bc, err := b.Pool().Get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if c.session.len() > 0 {
+		if err := c.session.replay(bc); err != nil {
+			b.Pool().Put(bc)
+			return nil, err
+		}
+		c.logger.WithField("backend", b.Name()).WithField("variables", c.session.len()).Debug("replayed session variables")
+	}
+	c.backend = bc
+	return bc, nil
+}
+
+// pinned reports whether the client must stay on its held backend
+// connection, whichever backend its queries route to: the connection is
+// dedicated to it, or a transaction is open on it.
+func (c *Connection) pinned() bool {
+	return c.backend != nil && (c.backend.dedicated || c.inTransaction)
+}
+
+// checkComplexity rejects a query that exceeds the complexity limits.
+func (c *Connection) checkComplexity(query string, class *queryClass) error {
+	if class.complexityErr != nil {
+		metrics.ComplexQueriesRejected.WithLabelValues(class.complexityReason).Inc()
+		c.logger.WithField("reason", class.complexityReason).WithField("fingerprint", Fingerprint(query)).Warn("rejected complex query")
+	}
+	return class.complexityErr
+}
+
+// acquireBackend returns a connection to the backend the current query
+// hints, or else the one serving the current database, switching it to that
+// database if needed.
+func (c *Connection) acquireBackend() (*BackendConn, error) {
+	b, reason := c.hinted, "hint"
+	if b == nil {
+		var err error
+		if b, reason, err = c.server.router.routeFor(c.tenant, c.database); err != nil && !c.pinned() {
+			return nil, err
+		}
+	}
+	bc, err := c.acquire(b)
+	if err == nil {
+		c.recordRoute(bc, b, reason)
+	}
+	return bc, err
+}
+
+// queryRoute is the backend a query was sent to and why it was chosen.
+type queryRoute struct {
+	backend string
+	reason  string
+}
+
+// recordRoute records that the query is running on bc, chosen as b for
+// reason. A client in a transaction stays on the backend it began it on.
+func (c *Connection) recordRoute(bc *BackendConn, b *Backend, reason string) {
+	if bc.Backend() != b {
+		reason = "transaction"
+		if bc.dedicated {
+			reason = "dedicated"
+		}
+	}
+	c.route = queryRoute{backend: bc.Backend().Name(), reason: reason}
+}
+
+// acquire returns a connection to b switched to the current database.
+func (c *Connection) acquire(b *Backend) (*BackendConn, error) {
+	bc, err := c.backendFor(b)
+	if err != nil {
+		return nil, err
+	}
+	if c.database != "" && bc.database != c.database {
+		err := bc.UseDatabase(c.database)
+		c.dropPoisonedBackend(err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+// releaseBackend returns the held backend connection to its pool. The
+// pool resets it, so statements prepared on it are prepared again when next
+// executed.
+func (c *Connection) releaseBackend() {
+	if c.backend == nil {
+		return
+	}
+	if c.backend.dedicated {
+		c.backend.Close()
+	} else {
+		c.backend.Backend().Pool().Put(c.backend)
+	}
+	c.backend = nil
+	c.endTransaction()
+	c.unbindStatements()
+}
+
+// dropPoisonedBackend releases the held connection if the last operation left
+// it unusable, so the next command gets a fresh one.
+func (c *Connection) dropPoisonedBackend(err error) {
+	if c.backend == nil || !c.backend.Poisoned() {
+		return
+	}
+	c.logger.WithError(err).WithField("backend", c.backend.Backend().Name()).Warn("discarding backend connection")
+	c.releaseBackend()
+}
+
+// forward relays a command to the backend and streams the response back to
+// the client, masking text-protocol rows as configured.
+func (c *Connection) forward(payload []byte) (*ExecResult, error) {
+	return c.forwardRewrite(payload, c.mask)
+}
+
+// forwardRewrite is forward with transformers applied in order to every
+// relayed result set, rather than the client's masking alone.
+func (c *Connection) forwardRewrite(payload []byte, transformers ...RowTransformer) (*ExecResult, error) {
+	bc, err := c.acquireBackend()
+	if err != nil {
+		return nil, err
+	}
+	return c.relay(bc, payload, transformers...)
+}
+
+// relay runs a command on bc and streams the response back to the client,
+// through the client's column retyping, then transformers and then the
+// charset checks.
+func (c *Connection) relay(bc *BackendConn, payload []byte, transformers ...RowTransformer) (*ExecResult, error) {
+	if ka := c.server.cfg.KeepAlive; ka.Enable && ka.Idle > 0 {
+		timer := time.AfterFunc(ka.Idle, func() {
+			metrics.LongRunningQueries.Inc()
+			c.logger.WithField("backend", bc.Backend().Name()).WithField("after", ka.Idle).
+				Info("query still running on backend; TCP keepalive is holding the client connection open")
+		})
+		defer timer.Stop()
+	}
+	// abandon closes bc if the killed query outlives the grace period. It
+	// is set by the watch, which has ended once stop returns.
+	var abandon *time.Timer
+	stop := c.watchClient(func() {
+		c.logger.WithField("backend", bc.Backend().Name()).Info("client disconnected during query; killing it on the backend")
+		metrics.QueriesCancelled.Inc()
+		if err := bc.KillQuery(); err != nil {
+			c.logger.WithError(err).Warn("failed to kill query")
+		}
+		if grace := bc.backend.cfg.KillGracePeriod; grace > 0 {
+			abandon = time.AfterFunc(grace, func() {
+				c.logger.WithField("backend", bc.Backend().Name()).WithField("after", grace).
+					Warn("killed query has not ended; closing its backend connection")
+				bc.abandon()
+			})
+		}
+	})
+	started := time.Now()
+	write := c.writePacket
+	if c.capture != nil {
+		write = c.capture.wrap(write)
+	}
+	if before := c.replyInvalidation(); before != nil {
+		next := write
+		write = func(p []byte) error {
+			if before != nil {
+				before()
+				before = nil
+			}
+			return next(p)
+		}
+	}
+	forward := limitForward(write, c.resultLimit())
+	var held []byte
+	fwd := forward
+	if c.canReplay(payload) {
+		fwd = holdLockConflict(forward, &held)
+	}
+	p := newRowPipeline(append([]RowTransformer{c.retype}, transformers...)...)
+	// Only text protocol rows can be transcoded.
+	text := payload[0] == COM_QUERY
+	if check := c.charsetChecker(text); check != nil {
+		p.then(check)
+		if text && c.server.cfg.CharsetMismatch == CharsetMismatchTranscode {
+			p.then(rowRewriter(c.transcodeRow))
+		}
+	}
+	res, err := bc.execute(payload, fwd, p, c.capabilities)
+	if err == nil && held != nil {
+		res, err = c.retryLockConflict(bc, payload, forward, p, held)
+	}
+	stop()
+	if abandon != nil && !abandon.Stop() {
+		// Closed as the query ended, too late to tell from its result.
+		bc.poison("kill_timeout")
+	}
+	c.result = res
+	if res != nil && res.Err == nil {
+		if res.InTransaction() && !c.inTransaction {
+			c.txStarted = started
+		}
+		c.bufferStatement(payload, res.InTransaction())
+		if c.inTransaction && !res.InTransaction() {
+			c.endTransactionWrites()
+		}
+		c.inTransaction = res.InTransaction()
+		if res.ResultSet {
+			metrics.ResultRows.Observe(float64(res.Rows))
+		}
+	}
+	c.dropPoisonedBackend(err)
+	return res, err
+}
+
+// watchClient calls onDisconnect if the client goes away while a command
+// runs on a backend. MySQL clients wait silently for the response, so a read
+// that fails means the connection was closed. The returned stop function ends
+// the watch and must be called before the client is read again.
+func (c *Connection) watchClient(onDisconnect func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.reader.ReadByte()
+		if err == nil {
+			// The next command; leave it for the command loop. It may have
+			// been sent once the response was complete, so it is not
+			// treated as pipelined.
+			c.reader.UnreadByte()
+			return
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			onDisconnect()
+		}
+	}()
+	return func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
 func Handle(conn net.Conn) {
-	NewConnection(conn).Handle()
+	srv, _ := NewServer(Config{})
+	srv.Handle(conn)
 }
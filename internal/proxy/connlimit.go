@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// ConnectionRateLimit bounds how fast new connections are accepted, from
+// all clients and from each source address, to absorb connection floods
+// before they cost a handshake. Each limit is a token bucket refilled at
+// Rate connections per second holding up to Burst. The zero value disables
+// it.
+type ConnectionRateLimit struct {
+	// Rate is the connections per second accepted from all clients. Zero
+	// disables the limit.
+	Rate float64
+	// Burst is how many connections may arrive at once; zero means one
+	// second's worth of Rate.
+	Burst int
+	// PerSourceRate and PerSourceBurst limit each client IP address alike.
+	PerSourceRate  float64
+	PerSourceBurst int
+}
+
+func (l ConnectionRateLimit) validate() error {
+	if l.Rate < 0 || l.PerSourceRate < 0 || l.Burst < 0 || l.PerSourceBurst < 0 {
+		return fmt.Errorf("connection rate limits must not be negative")
+	}
+	return nil
+}
+
+// burst is the capacity of a bucket refilled at rate when burst is unset.
+func burst(rate float64, burst int) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+// tokenBucket is a bucket of connections allowed; new buckets start full.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time since it was last used and takes a
+// token if there is one.
+func (b *tokenBucket) take(now time.Time, rate, capacity float64) bool {
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connLimiter enforces a ConnectionRateLimit.
+type connLimiter struct {
+	cfg ConnectionRateLimit
+
+	mu      sync.Mutex
+	global  tokenBucket
+	sources map[netip.Addr]*tokenBucket
+	swept   time.Time
+}
+
+// sweepInterval is how often buckets of sources that have gone quiet are
+// dropped, bounding the memory a flood from many addresses can hold.
+const sweepInterval = time.Minute
+
+func newConnLimiter(cfg ConnectionRateLimit) *connLimiter {
+	if cfg.Rate <= 0 && cfg.PerSourceRate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &connLimiter{
+		cfg:     cfg,
+		global:  tokenBucket{tokens: burst(cfg.Rate, cfg.Burst), last: now},
+		sources: make(map[netip.Addr]*tokenBucket),
+		swept:   now,
+	}
+}
+
+// allow takes a token for a connection from addr, returning which limit
+// refused it, or "" if it may proceed. A connection refused by the global
+// limit does not use up its source's token.
+func (l *connLimiter) allow(addr net.Addr, now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var source *tokenBucket
+	if ip, ok := remoteIP(addr); ok && l.cfg.PerSourceRate > 0 {
+		capacity := burst(l.cfg.PerSourceRate, l.cfg.PerSourceBurst)
+		if now.Sub(l.swept) >= sweepInterval {
+			for src, b := range l.sources {
+				if b.tokens+now.Sub(b.last).Seconds()*l.cfg.PerSourceRate >= capacity {
+					delete(l.sources, src)
+				}
+			}
+			l.swept = now
+		}
+		b, ok := l.sources[ip]
+		if !ok {
+			b = &tokenBucket{tokens: capacity, last: now}
+			l.sources[ip] = b
+		}
+		if !b.take(now, l.cfg.PerSourceRate, capacity) {
+			return "source"
+		}
+		source = b
+	}
+	if l.cfg.Rate > 0 && !l.global.take(now, l.cfg.Rate, burst(l.cfg.Rate, l.cfg.Burst)) {
+		if source != nil {
+			source.tokens++
+		}
+		return "global"
+	}
+	return ""
+}
+
+// AllowConnection reports whether a connection just accepted from addr is
+// within Config.ConnectionRateLimit. The caller closes refused connections
+// without a handshake.
+func (s *Server) AllowConnection(addr net.Addr) bool {
+	if s.connLimiter == nil {
+		return true
+	}
+	limit := s.connLimiter.allow(addr, time.Now())
+	if limit == "" {
+		return true
+	}
+	metrics.ConnectionsRateLimited.WithLabelValues(limit).Inc()
+	logrus.WithField("remote", addr.String()).WithField("limit", limit).Debug("connection rate limit exceeded; closing connection")
+	return false
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestConnectionRateLimit(t *testing.T) {
+	srv := newTestServer(t, Config{ConnectionRateLimit: ConnectionRateLimit{
+		Rate: 1, Burst: 5,
+		PerSourceRate: 1, PerSourceBurst: 3,
+	}})
+	source := metrics.ConnectionsRateLimited.WithLabelValues("source")
+	global := metrics.ConnectionsRateLimited.WithLabelValues("global")
+	beforeSource, beforeGlobal := testutil.ToFloat64(source), testutil.ToFloat64(global)
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	// A burst from one address is cut off at its own limit, IPv4-mapped
+	// addresses counting as the IPv4 address.
+	for i, ip := range []string{"10.0.0.1", "10.0.0.1", "::ffff:10.0.0.1", "10.0.0.1", "10.0.0.1"} {
+		if got, want := srv.AllowConnection(addr(ip)), i < 3; got != want {
+			t.Fatalf("connection %d from %s allowed = %v, want %v", i+1, ip, got, want)
+		}
+	}
+	// Other addresses use up the rest of the global burst.
+	for i, ip := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if got, want := srv.AllowConnection(addr(ip)), i < 2; got != want {
+			t.Fatalf("connection from %s allowed = %v, want %v", ip, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(source) - beforeSource; got != 2 {
+		t.Fatalf("source rejections rose by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(global) - beforeGlobal; got != 1 {
+		t.Fatalf("global rejections rose by %v, want 1", got)
+	}
+
+	if !newTestServer(t, Config{}).AllowConnection(addr("10.0.0.1")) {
+		t.Fatalf("connections are rate limited by default")
+	}
+}
+
+func TestConnectionRateLimitRefill(t *testing.T) {
+	l := newConnLimiter(ConnectionRateLimit{PerSourceRate: 2})
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if limit := l.allow(addr, now); limit != "" {
+			t.Fatalf("connection %d refused by the %s limit", i+1, limit)
+		}
+	}
+	if l.allow(addr, now) != "source" {
+		t.Fatalf("connection beyond the burst allowed")
+	}
+	if limit := l.allow(addr, now.Add(500*time.Millisecond)); limit != "" {
+		t.Fatalf("connection after the bucket refilled refused by the %s limit", limit)
+	}
+
+	// Buckets of quiet sources are dropped.
+	l.allow(&net.TCPAddr{IP: net.ParseIP("10.0.0.2")}, now.Add(2*sweepInterval))
+	if len(l.sources) != 1 {
+		t.Fatalf("%d source buckets kept after the sweep, want 1", len(l.sources))
+	}
+}
+
+func TestConnectionRateLimitGlobalKeepsSourceToken(t *testing.T) {
+	l := newConnLimiter(ConnectionRateLimit{Rate: 1, Burst: 1, PerSourceRate: 0.1, PerSourceBurst: 1})
+	now := time.Now()
+	if limit := l.allow(&net.TCPAddr{IP: net.ParseIP("10.0.0.2")}, now); limit != "" {
+		t.Fatalf("first connection refused by the %s limit", limit)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	if limit := l.allow(addr, now); limit != "global" {
+		t.Fatalf("connection beyond the global burst refused by %q, want global", limit)
+	}
+	// The source's only token was not spent on the refused connection.
+	if limit := l.allow(addr, now.Add(time.Second)); limit != "" {
+		t.Fatalf("connection after the global bucket refilled refused by the %s limit", limit)
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// isLockConflict reports whether a backend error code is a deadlock or a
+// lock wait timeout, after which the transaction may succeed if run again.
+func isLockConflict(code uint16) bool { return code == 1213 || code == 1205 }
+
+// canReplay reports whether the transaction the command payload runs in may
+// be replayed after a lock conflict: retries are enabled, the command is a
+// text query and every statement of the transaction so far was buffered.
+func (c *Connection) canReplay(payload []byte) bool {
+	return c.server.cfg.DeadlockRetries > 0 && payload[0] == COM_QUERY && !c.txUnreplayable
+}
+
+// bufferStatement records a command that completed on the backend, leaving
+// the session inTransaction, for replay after a lock conflict. The buffer
+// is dropped once the transaction ends.
+func (c *Connection) bufferStatement(payload []byte, inTransaction bool) {
+	if !inTransaction {
+		c.endTransaction()
+		return
+	}
+	if c.txUnreplayable {
+		return
+	}
+	limit := c.server.cfg.ReplayBufferBytes
+	if payload[0] != COM_QUERY || limit > 0 && c.txBuffered+int64(len(payload)) > limit {
+		c.txStatements, c.txBuffered, c.txUnreplayable = nil, 0, true
+		return
+	}
+	c.txStatements = append(c.txStatements, string(payload[1:]))
+	c.txBuffered += int64(len(payload))
+}
+
+// holdLockConflict wraps forward to hold back, in held, an ERR answering a
+// command outright with a lock conflict, so the command can be retried
+// without the client seeing it.
+func holdLockConflict(forward func([]byte) error, held *[]byte) func([]byte) error {
+	first := true
+	return func(p []byte) error {
+		if first && len(p) >= 3 && p[0] == 0xFF && isLockConflict(binary.LittleEndian.Uint16(p[1:])) {
+			*held = append([]byte(nil), p...)
+			first = false
+			return nil
+		}
+		first = false
+		return forward(p)
+	}
+}
+
+// retryLockConflict runs the command payload again after the backend
+// answered it with the lock conflict held: the transaction is rolled back,
+// its buffered statements replayed and the command sent again, up to
+// Config.DeadlockRetries times. If every attempt fails the last error is
+// sent to the client, whose transaction has then been rolled back.
+func (c *Connection) retryLockConflict(bc *BackendConn, payload []byte, forward func([]byte) error, p *rowPipeline, held []byte) (*ExecResult, error) {
+	for attempt := 1; attempt <= c.server.cfg.DeadlockRetries; attempt++ {
+		log := c.logger.WithField("backend", bc.Backend().Name()).WithField("code", binary.LittleEndian.Uint16(held[1:])).WithField("attempt", attempt)
+		log.Info("retrying transaction after lock conflict")
+		if err := bc.Query("ROLLBACK"); err != nil {
+			return nil, err
+		}
+		if err := c.replayStatements(bc); err != nil {
+			var sqlErr *SQLError
+			if !errors.As(err, &sqlErr) {
+				return nil, err
+			}
+			metrics.DeadlockRetries.WithLabelValues("failed").Inc()
+			held = NewErrPacket(sqlErr.Code, sqlErr.SQLState, sqlErr.Message)
+			if !isLockConflict(sqlErr.Code) {
+				log.WithError(sqlErr).Warn("transaction replay failed")
+				break
+			}
+			continue
+		}
+		held = nil
+		res, err := bc.execute(payload, holdLockConflict(forward, &held), p, c.capabilities)
+		if err != nil {
+			return nil, err
+		}
+		if held == nil {
+			metrics.DeadlockRetries.WithLabelValues("succeeded").Inc()
+			return res, nil
+		}
+		metrics.DeadlockRetries.WithLabelValues("failed").Inc()
+	}
+	// The client retries the transaction itself, from the start.
+	bc.Query("ROLLBACK")
+	c.endTransaction()
+	sqlErr, _ := ParseErrPacket(held)
+	return &ExecResult{Err: sqlErr}, forward(held)
+}
+
+// replayStatements runs the buffered statements of the transaction again.
+// A statement the backend rejects fails it with a *SQLError.
+func (c *Connection) replayStatements(bc *BackendConn) error {
+	for _, stmt := range c.txStatements {
+		if err := bc.Query(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endTransaction forgets the client's transaction once it is over.
+func (c *Connection) endTransaction() {
+	c.inTransaction = false
+	c.txStatements, c.txBuffered, c.txUnreplayable = nil, 0, false
+}
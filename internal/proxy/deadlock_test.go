@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDeadlockRetry(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	deadlocks := map[string]int{"UPDATE b SET x = 1": 1, "UPDATE c SET x = 1": 100}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		query := string(payload[1:])
+		mu.Lock()
+		received = append(received, query)
+		fail := deadlocks[query] > 0
+		if fail {
+			deadlocks[query]--
+		}
+		mu.Unlock()
+		switch {
+		case fail:
+			WritePacket(conn, 1, NewErrPacket(1213, "40001", "Deadlock found when trying to get lock; try restarting transaction"))
+		case query == "COMMIT" || query == "ROLLBACK":
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+		default:
+			WritePacket(conn, 1, NewOKPacket(1, 0, serverStatusInTrans))
+		}
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, DeadlockRetries: 2})
+	client := dialProxy(t, srv)
+
+	query := func(q string) byte {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %s: %v", q, err)
+		}
+		return mustReadPacket(t, client).Payload[0]
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(received, want) {
+			t.Fatalf("backend received %q, want %q", received, want)
+		}
+		received = nil
+	}
+
+	// The deadlock is hidden by replaying the transaction.
+	for _, q := range []string{"BEGIN", "UPDATE a SET x = 1", "UPDATE b SET x = 1", "COMMIT"} {
+		if h := query(q); h != 0x00 {
+			t.Fatalf("%s: expected OK, got %x", q, h)
+		}
+	}
+	expect("BEGIN", "UPDATE a SET x = 1", "UPDATE b SET x = 1",
+		"ROLLBACK", "BEGIN", "UPDATE a SET x = 1", "UPDATE b SET x = 1", "COMMIT")
+
+	// One that persists reaches the client once the retries run out.
+	query("BEGIN")
+	if h := query("UPDATE c SET x = 1"); h != 0xFF {
+		t.Fatalf("expected the deadlock error, got %x", h)
+	}
+	expect("BEGIN", "UPDATE c SET x = 1",
+		"ROLLBACK", "BEGIN", "UPDATE c SET x = 1",
+		"ROLLBACK", "BEGIN", "UPDATE c SET x = 1",
+		"ROLLBACK")
+}
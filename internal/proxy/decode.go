@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DecodedResultSet is a text-protocol result set read off the wire.
+type DecodedResultSet struct {
+	// Columns are the column definitions; empty when the server suppressed
+	// them with resultset_metadata=NONE.
+	Columns []ColumnDef
+	// Rows hold the values as sent, with nil for NULL.
+	Rows [][]sql.RawBytes
+	// Status is the server status of the terminating EOF or OK packet.
+	Status uint16
+}
+
+// DecodeResultSet reads a complete text-protocol result set from r: the
+// column count, column definitions, rows and the terminating packet. caps
+// are the capabilities negotiated on the connection, which select EOF or
+// CLIENT_DEPRECATE_EOF framing and whether the column count carries a
+// metadata flag. An ERR packet, before or among the rows, is returned as a
+// *SQLError.
+func DecodeResultSet(r io.Reader, caps uint32) (*DecodedResultSet, error) {
+	pkt, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt.Payload) == 0 {
+		return nil, ErrInvalidPacket
+	}
+	switch pkt.Payload[0] {
+	case 0xFF:
+		return nil, decodeErr(pkt.Payload)
+	case 0x00, 0xFE, localInfileHeader:
+		return nil, fmt.Errorf("%w: expected a result set, got packet type 0x%02x", ErrInvalidPacket, pkt.Payload[0])
+	}
+	columns, n, err := ReadLengthEncodedInt(pkt.Payload)
+	if err != nil || columns == 0 || columns > maxColumns {
+		return nil, fmt.Errorf("%w: bad column count", ErrInvalidPacket)
+	}
+	metadata := true
+	if caps&capOptionalMetadata != 0 && n < len(pkt.Payload) {
+		metadata = pkt.Payload[n] != 0
+	}
+	deprecateEOF := caps&capDeprecateEOF != 0
+
+	rs := &DecodedResultSet{}
+	if metadata {
+		rs.Columns = make([]ColumnDef, 0, columns)
+		for i := uint64(0); i < columns; i++ {
+			pkt, err := ReadPacket(r)
+			if err != nil {
+				return nil, err
+			}
+			col, err := parseColumnDef(pkt.Payload)
+			if err != nil {
+				return nil, err
+			}
+			rs.Columns = append(rs.Columns, col)
+		}
+	}
+	if !deprecateEOF {
+		pkt, err := ReadPacket(r)
+		if err != nil {
+			return nil, err
+		}
+		if !isEOFPacket(pkt.Payload) {
+			return nil, fmt.Errorf("%w: expected EOF after column definitions", ErrInvalidPacket)
+		}
+	}
+
+	for {
+		pkt, err := ReadPacket(r)
+		if err != nil {
+			return nil, err
+		}
+		p := pkt.Payload
+		switch {
+		case len(p) > 0 && p[0] == 0xFF:
+			return nil, decodeErr(p)
+		case isEOFPacket(p) && !deprecateEOF:
+			if len(p) >= 5 {
+				rs.Status = binary.LittleEndian.Uint16(p[3:])
+			}
+			return rs, nil
+		case deprecateEOF && len(p) > 0 && p[0] == 0xFE && len(p) < 0xFFFFFF:
+			// An OK packet with the EOF header; a row this short cannot
+			// start with an 8-byte length.
+			rs.Status = okPacketStatus(p)
+			return rs, nil
+		}
+		values, err := parseTextRow(p, int(columns))
+		if err != nil {
+			return nil, err
+		}
+		row := make([]sql.RawBytes, len(values))
+		for i, v := range values {
+			row[i] = v
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+}
+
+func decodeErr(payload []byte) error {
+	sqlErr, err := ParseErrPacket(payload)
+	if err != nil {
+		return err
+	}
+	return sqlErr
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// resultSetStream encodes a two-column result set with a NULL and an empty
+// value, framed with EOF packets or, with deprecateEOF, a final OK.
+func resultSetStream(deprecateEOF bool, trailer []byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	seq := uint8(1)
+	write := func(p []byte) {
+		WritePacket(&buf, seq, p)
+		seq++
+	}
+	write([]byte{2})
+	write(ColumnDef{Name: "id", Type: TypeLongLong}.packet())
+	write(ColumnDef{Name: "name"}.packet())
+	if !deprecateEOF {
+		write(NewEOFPacket(0))
+	}
+	write(encodeTextRow([][]byte{[]byte("1"), []byte("alice")}))
+	write(encodeTextRow([][]byte{[]byte("2"), nil}))
+	write(encodeTextRow([][]byte{[]byte("3"), {}}))
+	write(trailer)
+	return &buf
+}
+
+func TestDecodeResultSet(t *testing.T) {
+	eof := NewEOFPacket(serverStatusInTrans)
+	ok := NewOKPacket(0, 0, serverStatusInTrans)
+	ok[0] = 0xFE
+	for _, tc := range []struct {
+		name   string
+		caps   uint32
+		stream *bytes.Buffer
+	}{
+		{"EOF", capProtocol41, resultSetStream(false, eof)},
+		{"DEPRECATE_EOF", capProtocol41 | capDeprecateEOF, resultSetStream(true, ok)},
+	} {
+		rs, err := DecodeResultSet(tc.stream, tc.caps)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tc.name, err)
+		}
+		if len(rs.Columns) != 2 || rs.Columns[0].Name != "id" || rs.Columns[0].Type != TypeLongLong || rs.Columns[1].Name != "name" {
+			t.Fatalf("%s: columns = %+v", tc.name, rs.Columns)
+		}
+		want := [][]sql.RawBytes{{sql.RawBytes("1"), sql.RawBytes("alice")}, {sql.RawBytes("2"), nil}, {sql.RawBytes("3"), sql.RawBytes{}}}
+		if !reflect.DeepEqual(rs.Rows, want) {
+			t.Fatalf("%s: rows = %q", tc.name, rs.Rows)
+		}
+		if rs.Rows[1][1] != nil || rs.Rows[2][1] == nil {
+			t.Fatalf("%s: NULL and empty values not told apart", tc.name)
+		}
+		if rs.Status != serverStatusInTrans {
+			t.Fatalf("%s: status = %#x", tc.name, rs.Status)
+		}
+		if tc.stream.Len() != 0 {
+			t.Fatalf("%s: %d bytes left unread", tc.name, tc.stream.Len())
+		}
+	}
+}
+
+func TestDecodeResultSetError(t *testing.T) {
+	stream := resultSetStream(false, NewErrPacket(1317, "70100", "Query execution was interrupted"))
+	_, err := DecodeResultSet(stream, capProtocol41)
+	var sqlErr *SQLError
+	if !errors.As(err, &sqlErr) || sqlErr.Code != 1317 {
+		t.Fatalf("expected error 1317, got %v", err)
+	}
+
+	var ok bytes.Buffer
+	WritePacket(&ok, 1, NewOKPacket(1, 0, 0))
+	if _, err := DecodeResultSet(&ok, capProtocol41); !errors.Is(err, ErrInvalidPacket) {
+		t.Fatalf("decoding an OK packet: got %v", err)
+	}
+}
+
+func TestResultSetFraming(t *testing.T) {
+	rs := &ResultSet{
+		Columns: []ColumnDef{{Name: "id", Type: TypeLongLong}, {Name: "name"}},
+		Rows:    [][]string{{"1", "alice"}, {"2", "bob"}},
+	}
+	for _, tc := range []struct {
+		name string
+		caps uint32
+	}{
+		{"EOF", capProtocol41},
+		{"DEPRECATE_EOF", capProtocol41 | capDeprecateEOF},
+	} {
+		deprecateEOF := tc.caps&capDeprecateEOF != 0
+		binaryPackets, err := rs.BinaryPacketsFor(tc.caps)
+		if err != nil {
+			t.Fatalf("%s: binary packets: %v", tc.name, err)
+		}
+		for protocol, packets := range map[string][][]byte{"text": rs.PacketsFor(tc.caps), "binary": binaryPackets} {
+			// Column count, two definitions, then the EOF or, without one,
+			// the first row.
+			if got := isEOFPacket(packets[3]); got == deprecateEOF {
+				t.Fatalf("%s %s: packet after the column definitions %x", tc.name, protocol, packets[3])
+			}
+			end := packets[len(packets)-1]
+			// An EOF is 5 bytes; an OK with the EOF header at least 7.
+			switch {
+			case !deprecateEOF && (!isEOFPacket(end) || len(end) != 5):
+				t.Fatalf("%s %s: rows end with %x, want EOF", tc.name, protocol, end)
+			case deprecateEOF && (end[0] != 0xFE || len(end) < 7):
+				t.Fatalf("%s %s: rows end with %x, want an OK with the EOF header", tc.name, protocol, end)
+			}
+			if want := 3 + len(rs.Rows) + 1; deprecateEOF && len(packets) != want || !deprecateEOF && len(packets) != want+1 {
+				t.Fatalf("%s %s: %d packets", tc.name, protocol, len(packets))
+			}
+		}
+
+		var stream bytes.Buffer
+		for i, p := range rs.PacketsFor(tc.caps) {
+			WritePacket(&stream, uint8(i+1), p)
+		}
+		decoded, err := DecodeResultSet(&stream, tc.caps)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tc.name, err)
+		}
+		if len(decoded.Rows) != 2 || string(decoded.Rows[1][1]) != "bob" || stream.Len() != 0 {
+			t.Fatalf("%s: decoded %q with %d bytes left", tc.name, decoded.Rows, stream.Len())
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ExplainRewrite rewrites the values of one column in EXPLAIN results, for
+// example to hide backend table or partition names from tenants.
+type ExplainRewrite struct {
+	// Column is the EXPLAIN output column, matched case-insensitively.
+	Column string
+	// Match selects the part of the value to replace; nil replaces the
+	// whole value.
+	Match *regexp.Regexp
+	// Replace is the replacement text. With Match set it may refer to
+	// capture groups as in regexp.ReplaceAllString.
+	Replace string
+}
+
+// explainRewriter returns a transformer applying rules, or nil if there are
+// none.
+func explainRewriter(rules []ExplainRewrite) RowTransformer {
+	if len(rules) == 0 {
+		return nil
+	}
+	return rowRewriter(func(columns []ColumnDef, row [][]byte) [][]byte {
+		for i, col := range columns {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			for _, rule := range rules {
+				if !strings.EqualFold(rule.Column, col.Name) {
+					continue
+				}
+				if rule.Match == nil {
+					row[i] = []byte(rule.Replace)
+				} else {
+					row[i] = rule.Match.ReplaceAll(row[i], []byte(rule.Replace))
+				}
+			}
+		}
+		return row
+	})
+}
+
+// isExplain reports whether query is an EXPLAIN statement.
+func isExplain(query string) bool {
+	q := ParseQuery(query)
+	return q.Type == StmtExplain && len(q.Tokens) > 1
+}
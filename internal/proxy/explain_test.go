@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestExplainRewritesColumn(t *testing.T) {
+	explain := &ResultSet{
+		Columns: []ColumnDef{{Name: "id"}, {Name: "table"}, {Name: "partitions"}, {Name: "Extra"}},
+		Rows: [][]string{
+			{"1", "orders", "tenant_42_p2024", "Using where"},
+		},
+	}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeTestResultSet(conn, explain)
+	})
+	srv := newTestServer(t, Config{
+		Backends: []BackendConfig{fb.config()},
+		ExplainRewrites: []ExplainRewrite{
+			{Column: "PARTITIONS", Match: regexp.MustCompile(`tenant_\d+_`), Replace: "tenant_*_"},
+			{Column: "table", Replace: "<redacted>"},
+		},
+	})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "EXPLAIN SELECT * FROM orders"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	_, rows := readTestResultSet(t, client)
+	want := [][]string{{"1", "<redacted>", "tenant_*_p2024", "Using where"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got rows %q, want %q", rows, want)
+	}
+
+	// Other queries are relayed untouched.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT * FROM plan"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if _, rows := readTestResultSet(t, client); !reflect.DeepEqual(rows, [][]string{explain.Rows[0]}) {
+		t.Fatalf("non-EXPLAIN rows were rewritten: %q", rows)
+	}
+}
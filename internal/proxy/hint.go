@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// backendHint returns the backend named by a `/*+ backend=NAME */` hint
+// comment in q, or "".
+func backendHint(q *Query) string {
+	for _, c := range q.Comments {
+		body, ok := strings.CutPrefix(c.Value, "+")
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Fields(body) {
+			key, value, ok := strings.Cut(field, "=")
+			if ok && strings.EqualFold(key, "backend") && value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// hintedBackend returns the backend a query's hint asks for, or nil when it
+// has none or the named backend cannot serve it, in which case the query
+// is routed as usual. Hints are ignored for clients of a tenant routed to a
+// backend of its own, which must not reach other tenants' data.
+func (c *Connection) hintedBackend(q *Query) *Backend {
+	name := backendHint(q)
+	if name == "" {
+		return nil
+	}
+	b, ok := c.server.router.Named(name)
+	switch {
+	case c.server.router.tenantRouted(c.tenant):
+		c.logger.WithField("backend", name).Warn("query from a routed tenant hints a backend; routing it to the tenant's backend")
+		return nil
+	case !ok:
+		c.logger.WithField("backend", name).Warn("query hints an unknown backend; routing it as usual")
+		return nil
+	case !b.Healthy():
+		c.logger.WithField("backend", name).Warn("query hints an unhealthy backend; routing it as usual")
+		return nil
+	case b.Draining():
+		c.logger.WithField("backend", name).Warn("query hints a draining backend; routing it as usual")
+		return nil
+	}
+	return b
+}
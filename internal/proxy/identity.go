@@ -0,0 +1,58 @@
+package proxy
+
+import "strings"
+
+// identityFunctions are the functions returning the client's account that
+// the proxy answers itself.
+var identityFunctions = map[string]bool{
+	"USER":         true,
+	"CURRENT_USER": true,
+	"SESSION_USER": true,
+	"SYSTEM_USER":  true,
+}
+
+// interceptIdentity answers a SELECT of only USER(), CURRENT_USER() and
+// their synonyms with the account the client authenticated as at the
+// proxy, as user@host. It returns nil for other queries.
+func (c *Connection) interceptIdentity(q *Query) *ResultSet {
+	toks := q.Tokens
+	if q.Type != StmtSelect || len(toks) < 2 || !toks[0].IsWord("SELECT") {
+		return nil
+	}
+	account := c.account()
+	rs := &ResultSet{Rows: [][]string{nil}}
+	for i := 1; i < len(toks); i++ {
+		tok := toks[i]
+		if tok.Kind != TokenWord || !identityFunctions[strings.ToUpper(tok.Text)] {
+			return nil
+		}
+		name := tok.Text
+		if i+2 < len(toks) && toks[i+1].IsPunct("(") && toks[i+2].IsPunct(")") {
+			name += "()"
+			i += 2
+		} else if !tok.IsWord("CURRENT_USER") {
+			return nil
+		}
+		if i+2 < len(toks) && toks[i+1].IsWord("AS") {
+			name = toks[i+2].Value
+			i += 2
+		}
+		rs.Columns = append(rs.Columns, ColumnDef{Name: name})
+		rs.Rows[0] = append(rs.Rows[0], account)
+		if i+1 < len(toks) {
+			if !toks[i+1].IsPunct(",") {
+				return nil
+			}
+			i++
+		}
+	}
+	return rs
+}
+
+// account is the client's user name and host in MySQL's user@host form.
+func (c *Connection) account() string {
+	c.mu.Lock()
+	user := c.username
+	c.mu.Unlock()
+	return user + "@" + remoteHost(c.conn.RemoteAddr())
+}
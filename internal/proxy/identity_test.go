@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectUserAnsweredByProxy(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			srv.Handle(conn)
+		}
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientHandshake(client, "app", "password", ""); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+
+	cases := []struct {
+		query string
+		names []string
+	}{
+		{"SELECT USER()", []string{"USER()"}},
+		{"select current_user()", []string{"current_user()"}},
+		{"SELECT CURRENT_USER", []string{"CURRENT_USER"}},
+		{"SELECT USER() AS u, CURRENT_USER()", []string{"u", "CURRENT_USER()"}},
+	}
+	for _, tc := range cases {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, tc.query...)); err != nil {
+			t.Fatalf("write %q: %v", tc.query, err)
+		}
+		names, rows := readTestResultSet(t, client)
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Fatalf("%q: columns = %q, want %q", tc.query, names, tc.names)
+		}
+		for _, v := range rows[0] {
+			if v != "app@127.0.0.1" {
+				t.Fatalf("%q: got %q, want app@127.0.0.1", tc.query, v)
+			}
+		}
+	}
+	if n := fb.queries.Load(); n != 0 {
+		t.Fatalf("identity queries reached the backend %d times", n)
+	}
+
+	// Anything else selected alongside goes to the backend.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT USER(), NOW()"...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	mustReadPacket(t, client)
+	if n := fb.queries.Load(); n != 1 {
+		t.Fatalf("backend saw %d queries, want 1", n)
+	}
+}
+
+func TestSelectCurrentUserStandalone(t *testing.T) {
+	srv := newTestServer(t, Config{})
+	client := dialProxyAs(t, srv, "reporting")
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT CURRENT_USER()"...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_, rows := readTestResultSet(t, client)
+	if !reflect.DeepEqual(rows, [][]string{{"reporting@pipe"}}) {
+		t.Fatalf("rows = %q", rows)
+	}
+}
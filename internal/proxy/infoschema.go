@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SchemaTable is a table reported by the proxy's own information_schema
+// when it runs without a backend, for clients that introspect schemas on
+// connect.
+type SchemaTable struct {
+	Database string
+	Name     string
+	Columns  []SchemaColumn
+}
+
+// SchemaColumn is a column of a SchemaTable.
+type SchemaColumn struct {
+	Name string
+	// Type is the column type as MySQL reports it, such as int or
+	// varchar(255).
+	Type    string
+	NotNull bool
+}
+
+// infoSchemaView is an information_schema table the proxy answers itself.
+type infoSchemaView struct {
+	columns []string
+	// numeric marks the columns holding integers.
+	numeric map[string]bool
+	rows    func(tables []SchemaTable) [][]string
+}
+
+var infoSchemaViews = map[string]infoSchemaView{
+	"TABLES": {
+		columns: []string{"TABLE_CATALOG", "TABLE_SCHEMA", "TABLE_NAME", "TABLE_TYPE", "ENGINE", "TABLE_ROWS", "TABLE_COMMENT"},
+		numeric: map[string]bool{"TABLE_ROWS": true},
+		rows: func(tables []SchemaTable) [][]string {
+			rows := make([][]string, 0, len(tables))
+			for _, t := range tables {
+				rows = append(rows, []string{"def", t.Database, t.Name, "BASE TABLE", "InnoDB", "0", ""})
+			}
+			return rows
+		},
+	},
+	"COLUMNS": {
+		columns: []string{"TABLE_CATALOG", "TABLE_SCHEMA", "TABLE_NAME", "COLUMN_NAME", "ORDINAL_POSITION", "IS_NULLABLE", "DATA_TYPE", "COLUMN_TYPE", "COLUMN_KEY", "COLUMN_COMMENT"},
+		numeric: map[string]bool{"ORDINAL_POSITION": true},
+		rows: func(tables []SchemaTable) [][]string {
+			var rows [][]string
+			for _, t := range tables {
+				for i, col := range t.Columns {
+					nullable := "YES"
+					if col.NotNull {
+						nullable = "NO"
+					}
+					typ := strings.ToLower(col.Type)
+					dataType, _, _ := strings.Cut(typ, "(")
+					rows = append(rows, []string{"def", t.Database, t.Name, col.Name, strconv.Itoa(i + 1), nullable, strings.TrimSpace(dataType), typ, "", ""})
+				}
+			}
+			return rows
+		},
+	},
+}
+
+// infoSchemaQuery is a SELECT from an information_schema view of the form
+//
+//	SELECT * | col [[AS] name], ... FROM information_schema.view [[AS] alias]
+//	[WHERE col = value | col IN (value, ...) [AND ...]]
+//	[ORDER BY col [ASC | DESC], ...]
+//
+// where a value is a literal or DATABASE().
+type infoSchemaQuery struct {
+	view    infoSchemaView
+	table   string
+	alias   string
+	fields  []infoSchemaField
+	filters []infoSchemaFilter
+	order   []infoSchemaOrder
+}
+
+type infoSchemaField struct {
+	column int
+	name   string
+}
+
+type infoSchemaFilter struct {
+	column int
+	values []string
+}
+
+type infoSchemaOrder struct {
+	column int
+	desc   bool
+}
+
+// interceptInformationSchema answers a query of the information_schema
+// TABLES or COLUMNS views from Config.StandaloneSchema. It returns nil for
+// other queries and for shapes it does not understand.
+func (c *Connection) interceptInformationSchema(q *Query) *ResultSet {
+	if q.Type != StmtSelect {
+		return nil
+	}
+	iq, ok := parseInfoSchemaQuery(q.Tokens, c.database)
+	if !ok {
+		return nil
+	}
+	return iq.run(c.server.cfg.StandaloneSchema)
+}
+
+func parseInfoSchemaQuery(toks []Token, database string) (*infoSchemaQuery, bool) {
+	if len(toks) < 6 || !toks[0].IsWord("SELECT") {
+		return nil, false
+	}
+	// The view determines the columns, so find FROM first.
+	from := -1
+	for i, tok := range toks {
+		if tok.IsWord("FROM") {
+			from = i
+			break
+		}
+	}
+	if from < 0 || from+3 >= len(toks) || !toks[from+1].IsWord("information_schema") || !toks[from+2].IsPunct(".") {
+		return nil, false
+	}
+	table := strings.ToUpper(identifier(toks[from+3]))
+	view, ok := infoSchemaViews[table]
+	if !ok {
+		return nil, false
+	}
+	iq := &infoSchemaQuery{view: view, table: table}
+	i := from + 4
+	if i < len(toks) && toks[i].IsWord("AS") {
+		i++
+	}
+	if i < len(toks) && (toks[i].Kind == TokenQuotedName || (toks[i].Kind == TokenWord && !tableListEnd[strings.ToUpper(toks[i].Text)])) {
+		iq.alias = toks[i].Value
+		i++
+	}
+
+	if !iq.parseFields(toks[1:from]) {
+		return nil, false
+	}
+	if i < len(toks) && toks[i].IsWord("WHERE") {
+		if i, ok = iq.parseFilters(toks, i+1, database); !ok {
+			return nil, false
+		}
+	}
+	if i+1 < len(toks) && toks[i].IsWord("ORDER") && toks[i+1].IsWord("BY") {
+		if i, ok = iq.parseOrder(toks, i+2); !ok {
+			return nil, false
+		}
+	}
+	return iq, i == len(toks)
+}
+
+func (iq *infoSchemaQuery) parseFields(toks []Token) bool {
+	if len(toks) == 1 && toks[0].IsPunct("*") {
+		for col, name := range iq.view.columns {
+			iq.fields = append(iq.fields, infoSchemaField{column: col, name: name})
+		}
+		return true
+	}
+	for i := 0; i < len(toks); {
+		col, n := iq.column(toks[i:])
+		if n == 0 {
+			return false
+		}
+		field := infoSchemaField{column: col, name: identifier(toks[i+n-1])}
+		i += n
+		if i < len(toks) && toks[i].IsWord("AS") {
+			i++
+		}
+		if i < len(toks) && (toks[i].Kind == TokenWord || toks[i].Kind == TokenQuotedName || toks[i].Kind == TokenString) {
+			field.name = toks[i].Value
+			i++
+		}
+		iq.fields = append(iq.fields, field)
+		if i < len(toks) {
+			if !toks[i].IsPunct(",") || i+1 == len(toks) {
+				return false
+			}
+			i++
+		}
+	}
+	return len(iq.fields) > 0
+}
+
+func (iq *infoSchemaQuery) parseFilters(toks []Token, i int, database string) (int, bool) {
+	for {
+		col, n := iq.column(toks[i:])
+		if n == 0 {
+			return 0, false
+		}
+		i += n
+		f := infoSchemaFilter{column: col}
+		switch {
+		case i < len(toks) && toks[i].IsPunct("="):
+			v, n := filterValue(toks[i+1:], database)
+			if n == 0 {
+				return 0, false
+			}
+			f.values = []string{v}
+			i += 1 + n
+		case i+1 < len(toks) && toks[i].IsWord("IN") && toks[i+1].IsPunct("("):
+			i += 2
+			for {
+				v, n := filterValue(toks[i:], database)
+				if n == 0 {
+					return 0, false
+				}
+				f.values = append(f.values, v)
+				i += n
+				if i < len(toks) && toks[i].IsPunct(",") {
+					i++
+					continue
+				}
+				if i < len(toks) && toks[i].IsPunct(")") {
+					i++
+					break
+				}
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+		iq.filters = append(iq.filters, f)
+		if i < len(toks) && toks[i].IsWord("AND") {
+			i++
+			continue
+		}
+		return i, true
+	}
+}
+
+func (iq *infoSchemaQuery) parseOrder(toks []Token, i int) (int, bool) {
+	for {
+		col, n := iq.column(toks[i:])
+		if n == 0 {
+			return 0, false
+		}
+		i += n
+		o := infoSchemaOrder{column: col}
+		if i < len(toks) && (toks[i].IsWord("ASC") || toks[i].IsWord("DESC")) {
+			o.desc = toks[i].IsWord("DESC")
+			i++
+		}
+		iq.order = append(iq.order, o)
+		if i < len(toks) && toks[i].IsPunct(",") {
+			i++
+			continue
+		}
+		return i, true
+	}
+}
+
+// column resolves a possibly qualified column reference at the start of
+// toks to the index of a view column, returning the tokens it spans.
+func (iq *infoSchemaQuery) column(toks []Token) (int, int) {
+	n := 1
+	if len(toks) >= 3 && toks[1].IsPunct(".") {
+		qualifier := identifier(toks[0])
+		if !strings.EqualFold(qualifier, iq.table) && !strings.EqualFold(qualifier, iq.alias) {
+			return 0, 0
+		}
+		toks, n = toks[2:], 3
+	}
+	if len(toks) == 0 || (toks[0].Kind != TokenWord && toks[0].Kind != TokenQuotedName) {
+		return 0, 0
+	}
+	name := identifier(toks[0])
+	for i, col := range iq.view.columns {
+		if strings.EqualFold(col, name) {
+			return i, n
+		}
+	}
+	return 0, 0
+}
+
+// filterValue reads a literal or DATABASE() at the start of toks.
+func filterValue(toks []Token, database string) (string, int) {
+	switch {
+	case len(toks) > 0 && toks[0].isLiteral():
+		return toks[0].Value, 1
+	case len(toks) > 2 && (toks[0].IsWord("DATABASE") || toks[0].IsWord("SCHEMA")) && toks[1].IsPunct("(") && toks[2].IsPunct(")"):
+		return database, 3
+	}
+	return "", 0
+}
+
+func identifier(tok Token) string {
+	if tok.Kind == TokenQuotedName {
+		return tok.Value
+	}
+	return tok.Text
+}
+
+func (iq *infoSchemaQuery) run(tables []SchemaTable) *ResultSet {
+	var rows [][]string
+	for _, row := range iq.view.rows(tables) {
+		if iq.matches(row) {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(a, b int) bool {
+		for _, o := range iq.order {
+			c := iq.compare(o.column, rows[a][o.column], rows[b][o.column])
+			if c != 0 {
+				return (c < 0) != o.desc
+			}
+		}
+		return false
+	})
+
+	rs := &ResultSet{Rows: make([][]string, 0, len(rows))}
+	for _, f := range iq.fields {
+		orgName := iq.view.columns[f.column]
+		col := ColumnDef{Schema: "information_schema", Table: iq.table, OrgTable: iq.table, Name: f.name, OrgName: orgName}
+		if iq.view.numeric[orgName] {
+			col.Type, col.Charset, col.Length = TypeLongLong, CharsetBinary, 21
+		}
+		rs.Columns = append(rs.Columns, col)
+	}
+	for _, row := range rows {
+		out := make([]string, len(iq.fields))
+		for i, f := range iq.fields {
+			out[i] = row[f.column]
+		}
+		rs.Rows = append(rs.Rows, out)
+	}
+	return rs
+}
+
+// matches reports whether row passes every filter. Names are compared
+// ignoring case.
+func (iq *infoSchemaQuery) matches(row []string) bool {
+	for _, f := range iq.filters {
+		ok := false
+		for _, v := range f.values {
+			if strings.EqualFold(row[f.column], v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (iq *infoSchemaQuery) compare(column int, a, b string) int {
+	if iq.view.numeric[iq.view.columns[column]] {
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		return x - y
+	}
+	return strings.Compare(a, b)
+}
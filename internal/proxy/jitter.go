@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// maxReconnectJitter bounds ReconnectJitter.Max so a misconfiguration cannot
+// stall clients past their connect timeouts.
+const maxReconnectJitter = 5 * time.Second
+
+// ReconnectJitter delays the greeting to new clients by a random amount up
+// to Max while reconnects are likely to arrive as a herd: for Window after a
+// backend recovers from a failed health check, and while more than Rate
+// connections arrive per second. Spreading the reconnects gives a recovering
+// backend room to warm up. The zero value disables it.
+type ReconnectJitter struct {
+	Max time.Duration
+	// Window is how long after a backend recovers new connections are
+	// delayed. Zero disables the trigger.
+	Window time.Duration
+	// Rate is the connections per second above which new connections are
+	// delayed. Zero disables the trigger.
+	Rate int
+}
+
+func (j ReconnectJitter) validate() error {
+	if j.Max < 0 || j.Max > maxReconnectJitter {
+		return fmt.Errorf("reconnect jitter %v out of range: must be between 0 and %v", j.Max, maxReconnectJitter)
+	}
+	if j.Window < 0 || j.Rate < 0 {
+		return fmt.Errorf("reconnect jitter window and rate must not be negative")
+	}
+	return nil
+}
+
+// connRate counts connections in the current second.
+type connRate struct {
+	mu     sync.Mutex
+	second int64
+	count  int
+}
+
+// add records a connection and returns the count for the current second.
+func (r *connRate) add(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := now.Unix(); s != r.second {
+		r.second, r.count = s, 0
+	}
+	r.count++
+	return r.count
+}
+
+// reconnectDelay records a new connection and returns how long to delay its
+// greeting.
+func (s *Server) reconnectDelay() time.Duration {
+	j := s.cfg.ReconnectJitter
+	if j.Max <= 0 {
+		return 0
+	}
+	now := time.Now()
+	herd := j.Rate > 0 && s.connRate.add(now) > j.Rate
+	if !herd && j.Window > 0 && s.router != nil {
+		for _, b := range s.router.Backends() {
+			if now.Sub(b.RecoveredAt()) < j.Window {
+				herd = true
+				break
+			}
+		}
+	}
+	if !herd {
+		return 0
+	}
+	return rand.N(j.Max + 1)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectJitterBounded(t *testing.T) {
+	const max = 20 * time.Millisecond
+	srv := newTestServer(t, Config{ReconnectJitter: ReconnectJitter{Max: max, Rate: 1}})
+
+	delayed := 0
+	for i := 0; i < 500; i++ {
+		d := srv.reconnectDelay()
+		if d < 0 || d > max {
+			t.Fatalf("delay %v outside [0, %v]", d, max)
+		}
+		if d > 0 {
+			delayed++
+		}
+	}
+	if delayed == 0 {
+		t.Fatalf("no connection was delayed above the rate threshold")
+	}
+
+	if d := newTestServer(t, Config{}).reconnectDelay(); d != 0 {
+		t.Fatalf("jitter is off by default, got %v", d)
+	}
+}
+
+func TestReconnectJitterAfterRecovery(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {})
+	srv := newTestServer(t, Config{
+		Backends:        []BackendConfig{fb.config()},
+		ReconnectJitter: ReconnectJitter{Max: time.Second, Window: time.Minute},
+	})
+	for i := 0; i < 100; i++ {
+		if d := srv.reconnectDelay(); d != 0 {
+			t.Fatalf("delayed by %v without an incident", d)
+		}
+	}
+
+	// A failed check followed by a successful one opens the window.
+	b := srv.router.Backends()[0]
+	b.failed.Store(true)
+	srv.checkBackends(context.Background())
+	if b.RecoveredAt().IsZero() {
+		t.Fatalf("recovery not recorded")
+	}
+	delayed := false
+	for i := 0; i < 100; i++ {
+		d := srv.reconnectDelay()
+		if d > time.Second {
+			t.Fatalf("delay %v above the bound", d)
+		}
+		delayed = delayed || d > 0
+	}
+	if !delayed {
+		t.Fatalf("no connection was delayed after the backend recovered")
+	}
+}
+
+func TestReconnectJitterValidation(t *testing.T) {
+	for _, j := range []ReconnectJitter{{Max: time.Minute}, {Max: -time.Second}, {Max: time.Second, Rate: -1}} {
+		if _, err := NewServer(Config{ReconnectJitter: j}); err == nil {
+			t.Fatalf("expected %+v to be rejected", j)
+		}
+	}
+}
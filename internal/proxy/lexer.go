@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// TokenKind classifies a lexical token of a SQL statement.
+type TokenKind int
+
+const (
+	TokenWord        TokenKind = iota // keyword or bare identifier
+	TokenQuotedName                   // `backquoted` identifier
+	TokenString                       // 'single' or "double" quoted string
+	TokenNumber                       // numeric, hex or bit literal
+	TokenVariable                     // @user or @@system variable
+	TokenPlaceholder                  // ? parameter marker
+	TokenComment                      // -- , # or /* */ comment
+	TokenPunct                        // operator or punctuation
+)
+
+// Token is one lexical element of a SQL statement.
+type Token struct {
+	Kind TokenKind
+	// Text is the token exactly as it appears in the query.
+	Text string
+	// Value is the unquoted content of quoted names and strings, and the
+	// body of comments; otherwise it equals Text.
+	Value string
+	// Pos is the byte offset of the token in the query.
+	Pos int
+}
+
+// IsWord reports whether the token is the bare word w, ignoring case.
+func (t Token) IsWord(w string) bool {
+	return t.Kind == TokenWord && strings.EqualFold(t.Text, w)
+}
+
+// IsPunct reports whether the token is the punctuation p.
+func (t Token) IsPunct(p string) bool {
+	return t.Kind == TokenPunct && t.Text == p
+}
+
+// isLiteral reports whether the token is a string or numeric literal.
+func (t Token) isLiteral() bool {
+	return t.Kind == TokenString || t.Kind == TokenNumber
+}
+
+// Tokenize splits a SQL statement into tokens, skipping whitespace. String
+// literals, quoted identifiers and comments are recognised so that keywords
+// inside them are never mistaken for statement keywords. The body of a
+// MySQL executable comment (/*! ... */) is tokenized as SQL because the
+// server executes it.
+func Tokenize(query string) []Token {
+	var tokens []Token
+	l := lexer{src: query}
+	for {
+		tok, ok := l.next()
+		if !ok {
+			return tokens
+		}
+		if tok.Kind == TokenComment && strings.HasPrefix(tok.Text, "/*!") {
+			body := tok.Value[1:]
+			offset := tok.Pos + 3
+			// Strip the optional server version, e.g. /*!50100 ... */.
+			i := 0
+			for i < len(body) && isDigit(body[i]) {
+				i++
+			}
+			for _, inner := range Tokenize(body[i:]) {
+				inner.Pos += offset + i
+				tokens = append(tokens, inner)
+			}
+			continue
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (Token, bool) {
+	for l.pos < len(l.src) && isSpace(l.src[l.pos]) {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return Token{}, false
+	}
+
+	start := l.pos
+	ch := l.src[l.pos]
+	tok := func(kind TokenKind) Token {
+		text := l.src[start:l.pos]
+		return Token{Kind: kind, Text: text, Value: text, Pos: start}
+	}
+
+	switch {
+	case ch == '#' || (ch == '-' && strings.HasPrefix(l.src[l.pos:], "--") &&
+		(l.pos+2 == len(l.src) || isSpace(l.src[l.pos+2]))):
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			l.pos = len(l.src)
+		} else {
+			l.pos += end
+		}
+		t := tok(TokenComment)
+		t.Value = strings.TrimSpace(strings.TrimLeft(t.Text, "#-"))
+		return t, true
+
+	case ch == '/' && strings.HasPrefix(l.src[l.pos:], "/*"):
+		end := strings.Index(l.src[l.pos+2:], "*/")
+		if end < 0 {
+			l.pos = len(l.src)
+		} else {
+			l.pos += 2 + end + 2
+		}
+		t := tok(TokenComment)
+		t.Value = strings.TrimSuffix(t.Text[2:], "*/")
+		return t, true
+
+	case ch == '\'' || ch == '"':
+		t := tok(TokenString)
+		t.Value = l.quoted(ch)
+		t.Text = l.src[start:l.pos]
+		return t, true
+
+	case ch == '`':
+		t := tok(TokenQuotedName)
+		t.Value = l.quoted(ch)
+		t.Text = l.src[start:l.pos]
+		return t, true
+
+	case (ch == 'x' || ch == 'X' || ch == 'b' || ch == 'B') && l.pos+1 < len(l.src) && l.src[l.pos+1] == '\'':
+		l.pos++
+		l.quoted('\'')
+		return tok(TokenNumber), true
+
+	case isDigit(ch) || (ch == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1])):
+		l.number()
+		return tok(TokenNumber), true
+
+	case ch == '@':
+		l.pos++
+		if l.pos < len(l.src) && l.src[l.pos] == '@' {
+			l.pos++
+		}
+		if l.pos < len(l.src) && (l.src[l.pos] == '`' || l.src[l.pos] == '\'' || l.src[l.pos] == '"') {
+			l.quoted(l.src[l.pos])
+		} else {
+			for l.pos < len(l.src) && (isWordChar(l.src[l.pos]) || l.src[l.pos] == '.') {
+				l.pos++
+			}
+		}
+		return tok(TokenVariable), true
+
+	case ch == '?':
+		l.pos++
+		return tok(TokenPlaceholder), true
+
+	case isWordChar(ch):
+		for l.pos < len(l.src) && isWordChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return tok(TokenWord), true
+	}
+
+	for _, op := range []string{"<=>", "<=", ">=", "<>", "!=", ":=", "||", "&&", "<<", ">>", "->>", "->"} {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return tok(TokenPunct), true
+		}
+	}
+	l.pos++
+	return tok(TokenPunct), true
+}
+
+// quoted consumes a quoted string starting at the opening quote and returns
+// its unescaped content. Both backslash escapes and doubled quotes are
+// understood; an unterminated string runs to the end of the input.
+func (l *lexer) quoted(quote byte) string {
+	l.pos++ // opening quote
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		switch {
+		case ch == '\\' && quote != '`' && l.pos+1 < len(l.src):
+			b.WriteByte(l.src[l.pos+1])
+			l.pos += 2
+		case ch == quote && l.pos+1 < len(l.src) && l.src[l.pos+1] == quote:
+			b.WriteByte(quote)
+			l.pos += 2
+		case ch == quote:
+			l.pos++
+			return b.String()
+		default:
+			b.WriteByte(ch)
+			l.pos++
+		}
+	}
+	return b.String()
+}
+
+func (l *lexer) number() {
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0b") {
+		l.pos += 2
+		for l.pos < len(l.src) && isWordChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return
+	}
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		switch {
+		case isDigit(ch) || ch == '.':
+			l.pos++
+		case (ch == 'e' || ch == 'E') && l.pos+1 < len(l.src):
+			l.pos++
+			if l.src[l.pos] == '+' || l.src[l.pos] == '-' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isWordChar(ch byte) bool {
+	return ch == '_' || ch == '$' || isDigit(ch) || (ch|0x20 >= 'a' && ch|0x20 <= 'z') || ch >= 0x80
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	toks := Tokenize("SELECT `a``b`, 'it''s', \"x\\\"y\", 0x1F, 1.5e3, @v, @@session.sql_mode, ? -- tail\n/* c */ # hash")
+	want := []struct {
+		kind  TokenKind
+		value string
+	}{
+		{TokenWord, "SELECT"},
+		{TokenQuotedName, "a`b"},
+		{TokenPunct, ","},
+		{TokenString, "it's"},
+		{TokenPunct, ","},
+		{TokenString, "x\"y"},
+		{TokenPunct, ","},
+		{TokenNumber, "0x1F"},
+		{TokenPunct, ","},
+		{TokenNumber, "1.5e3"},
+		{TokenPunct, ","},
+		{TokenVariable, "@v"},
+		{TokenPunct, ","},
+		{TokenVariable, "@@session.sql_mode"},
+		{TokenPunct, ","},
+		{TokenPlaceholder, "?"},
+		{TokenComment, "tail"},
+		{TokenComment, " c "},
+		{TokenComment, "hash"},
+	}
+	if len(toks) != len(want) {
+		t.Fatalf("got %d tokens %+v, want %d", len(toks), toks, len(want))
+	}
+	for i, w := range want {
+		if toks[i].Kind != w.kind || toks[i].Value != w.value {
+			t.Errorf("token %d = %v %q, want %v %q", i, toks[i].Kind, toks[i].Value, w.kind, w.value)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	cases := []struct {
+		sql    string
+		typ    StatementType
+		tables []string
+	}{
+		{"SELECT 'DELETE FROM users' FROM t1", StmtSelect, []string{"t1"}},
+		{"/* DROP TABLE x */ SELECT * FROM `db`.`t` AS a JOIN u b ON a.id = b.id", StmtSelect, []string{"db.t", "u"}},
+		{"-- UPDATE t\nSELECT 1", StmtSelect, nil},
+		{"select * from a, b c, d where x = 'FROM e'", StmtSelect, []string{"a", "b", "d"}},
+		{"INSERT INTO orders (id) VALUES (1)", StmtInsert, []string{"orders"}},
+		{"UPDATE LOW_PRIORITY accounts SET x = 1", StmtUpdate, []string{"accounts"}},
+		{"DELETE FROM logs WHERE msg = 'it\\'s; DROP TABLE x'", StmtDelete, []string{"logs"}},
+		{"REPLACE INTO kv VALUES ('a', 'b')", StmtReplace, []string{"kv"}},
+		{"CREATE TABLE IF NOT EXISTS t (id INT)", StmtDDL, []string{"t"}},
+		{"TRUNCATE TABLE sessions", StmtDDL, []string{"sessions"}},
+		{"WITH c AS (SELECT * FROM a) DELETE FROM b", StmtDelete, []string{"a", "b"}},
+		{"(SELECT 1) UNION (SELECT 2)", StmtSelect, nil},
+		{"START TRANSACTION READ ONLY", StmtBegin, nil},
+		{"begin;", StmtBegin, nil},
+		{"COMMIT", StmtCommit, nil},
+		{"ROLLBACK", StmtRollback, nil},
+		{"ROLLBACK WORK AND NO CHAIN", StmtRollback, nil},
+		{"SAVEPOINT sp1", StmtSavepoint, nil},
+		{"ROLLBACK TO SAVEPOINT sp1", StmtSavepoint, nil},
+		{"rollback work to sp1", StmtSavepoint, nil},
+		{"RELEASE SAVEPOINT sp1", StmtSavepoint, nil},
+		{"/*!40101 SET NAMES utf8mb4 */", StmtSet, nil},
+		{"USE `shop`", StmtUse, nil},
+		{"EXPLAIN SELECT * FROM t", StmtExplain, []string{"t"}},
+		{"DESCRIBE t", StmtShow, nil},
+		{"'SELECT'", StmtOther, nil},
+		{"", StmtOther, nil},
+	}
+	for _, c := range cases {
+		q := ParseQuery(c.sql)
+		if q.Type != c.typ {
+			t.Errorf("ParseQuery(%q).Type = %q, want %q", c.sql, q.Type, c.typ)
+		}
+		if !reflect.DeepEqual(q.Tables, c.tables) {
+			t.Errorf("ParseQuery(%q).Tables = %q, want %q", c.sql, q.Tables, c.tables)
+		}
+	}
+}
+
+func TestQueryNormalized(t *testing.T) {
+	cases := map[string]string{
+		"SELECT  *\nFROM t WHERE id = 42 AND name = 'bob' /* hint */;": "SELECT * FROM t WHERE id = ? AND name = ?",
+		"select * from t where id in (1, 2,3)":                         "select * from t where id in (?, ?, ?)",
+		"SELECT a.b FROM `x` WHERE c = ? -- trailing":                  "SELECT a.b FROM `x` WHERE c = ?",
+		"INSERT INTO t VALUES (x'FF', -1.5)":                           "INSERT INTO t VALUES (?, - ?)",
+	}
+	for sql, want := range cases {
+		if got := ParseQuery(sql).Normalized(); got != want {
+			t.Errorf("Normalized(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cases := map[string]string{
+		"SELECT *  FROM users\n\tWHERE email = 'a@b.c' AND age > 30;": "SELECT * FROM users WHERE email = ? AND age > ?",
+		"/* app */ UPDATE t SET pw = \"secret\" WHERE id = 0x1F":      "UPDATE t SET pw = ? WHERE id = ?",
+		"SELECT 1": "SELECT ?",
+		"":         "",
+	}
+	for sql, want := range cases {
+		if got := Fingerprint(sql); got != want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
+
+func TestQueryMultiStatement(t *testing.T) {
+	cases := map[string]bool{
+		"SELECT 1;":                                          false,
+		"SELECT ';' FROM t -- ;":                             false,
+		"UPDATE a SET x = 1; DELETE FROM b":                  true,
+		"SELECT 1; SELECT 2;":                                true,
+		"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END": false,
+	}
+	for sql, want := range cases {
+		if got := ParseQuery(sql).MultiStatement(); got != want {
+			t.Errorf("MultiStatement(%q) = %v, want %v", sql, got, want)
+		}
+	}
+}
+
+func TestQueryWithoutComments(t *testing.T) {
+	cases := map[string]string{
+		"SELECT 1": "SELECT 1",
+		"SELECT /* x */ a FROM t -- tail\nWHERE b = '/* no */'": "SELECT   a FROM t  \nWHERE b = '/* no */'",
+		"SELECT/**/1 # hash":                        "SELECT 1  ",
+		"SELECT /*+ BKA(t) */ a FROM t /*app='x'*/": "SELECT /*+ BKA(t) */ a FROM t  ",
+		"/*!40101 SET NAMES utf8mb4 */":             "/*!40101 SET NAMES utf8mb4 */",
+	}
+	for sql, want := range cases {
+		if got := ParseQuery(sql).WithoutComments(); got != want {
+			t.Errorf("WithoutComments(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
+
+func TestQueryInspectionIgnoresLiteralsAndComments(t *testing.T) {
+	if db, ok := parseUseStatement("USE `my db`;"); !ok || db != "my db" {
+		t.Errorf("parseUseStatement = %q, %v", db, ok)
+	}
+	if _, ok := parseUseStatement("SELECT 'USE other'"); ok {
+		t.Errorf("USE inside a string literal was detected")
+	}
+	if !isShowDatabases("show /* all */ schemas") {
+		t.Errorf("SHOW SCHEMAS with a comment was not detected")
+	}
+	if isExplain("SELECT 'EXPLAIN SELECT 1'") {
+		t.Errorf("EXPLAIN inside a string literal was detected")
+	}
+	if _, ok := sessionSetKey("SELECT 'SET @x = 1'"); ok {
+		t.Errorf("SET inside a string literal was detected")
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ListenConfig controls how the client-facing listener socket is created.
+type ListenConfig struct {
+	// ReusePort sets SO_REUSEPORT so several proxy processes can bind the
+	// same address and let the kernel balance accepted connections between
+	// them. See setReusePort for platform support.
+	//
+	// The accept queue length is not configurable from Go's net package; it
+	// follows the kernel limit (net.core.somaxconn on Linux), which should be
+	// raised alongside running several processes.
+	ReusePort bool
+}
+
+// Listen opens a TCP listener on addr, or a Unix socket listener on the
+// path after "unix:" in addr. ReusePort does not apply to Unix sockets.
+func Listen(ctx context.Context, addr string, cfg ListenConfig) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return lc.Listen(ctx, "unix", path)
+	}
+	if cfg.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// ListenerProfile is the greeting and authentication posture of clients
+// accepted on one of several listeners, so the same backends can be offered
+// to different clients under different terms. Connections passed to
+// Server.HandleOn with the profile's Name use it.
+type ListenerProfile struct {
+	Name string
+	// DisableCapabilities names capabilities withheld from the listener's
+	// clients, such as "multi_statements", on top of any withheld by
+	// source address.
+	DisableCapabilities []string
+	// ServerVersion, when set, is advertised instead of the server's.
+	ServerVersion string
+	// TLS, when set, is offered to the listener's clients instead of
+	// Config.TLS.
+	TLS *tls.Config
+	// RequireTLS denies the listener's clients that do not switch to TLS,
+	// as Config.RequireTLS does for all clients.
+	RequireTLS bool
+	// AuthPlugin, when set, is offered instead of Config.AuthPlugin.
+	AuthPlugin string
+}
+
+type listenerProfile struct {
+	withheld   uint32
+	version    string
+	tls        *tls.Config
+	requireTLS bool
+	authPlugin string
+}
+
+// compileListenerProfiles validates the ListenerProfiles of cfg against
+// the rest of it, as NewServer validates the server-wide settings.
+func compileListenerProfiles(cfg Config) (map[string]listenerProfile, error) {
+	compiled := make(map[string]listenerProfile, len(cfg.ListenerProfiles))
+	for _, p := range cfg.ListenerProfiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("listener profile without a name")
+		}
+		if _, dup := compiled[p.Name]; dup {
+			return nil, fmt.Errorf("duplicate listener profile %q", p.Name)
+		}
+		mask, err := capabilityMask(p.DisableCapabilities)
+		if err != nil {
+			return nil, fmt.Errorf("listener profile %s: %w", p.Name, err)
+		}
+		switch p.AuthPlugin {
+		case "", nativePasswordPlugin, cachingSHA2Plugin:
+		default:
+			return nil, fmt.Errorf("listener profile %s: unsupported auth plugin %q", p.Name, p.AuthPlugin)
+		}
+		if p.RequireTLS && ((p.TLS == nil && cfg.TLS == nil) || cfg.TransparentAuth) {
+			return nil, fmt.Errorf("listener profile %s: RequireTLS needs TLS and is not supported with TransparentAuth", p.Name)
+		}
+		compiled[p.Name] = listenerProfile{
+			withheld:   mask,
+			version:    p.ServerVersion,
+			tls:        p.TLS,
+			requireTLS: p.RequireTLS,
+			authPlugin: p.AuthPlugin,
+		}
+	}
+	return compiled, nil
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT load balancing is Linux specific")
+	}
+	ctx := context.Background()
+	first, err := Listen(ctx, "127.0.0.1:0", ListenConfig{ReusePort: true})
+	if err != nil {
+		t.Fatalf("first listen: %v", err)
+	}
+	defer first.Close()
+
+	second, err := Listen(ctx, first.Addr().String(), ListenConfig{ReusePort: true})
+	if err != nil {
+		t.Fatalf("second listen on %s: %v", first.Addr(), err)
+	}
+	second.Close()
+
+	if l, err := Listen(ctx, first.Addr().String(), ListenConfig{}); err == nil {
+		l.Close()
+		t.Fatalf("expected bind without SO_REUSEPORT to fail")
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not supported")
+	}
+	srv := newTestServer(t, Config{})
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	ln, err := Listen(context.Background(), "unix:"+path, ListenConfig{})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			srv.Handle(conn)
+		}
+	}()
+
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := parseServerGreeting(mustReadPacket(t, conn).Payload); err != nil {
+		t.Fatalf("parse greeting: %v", err)
+	}
+}
+
+func TestListenerProfiles(t *testing.T) {
+	srv := newTestServer(t, Config{
+		Compression: true,
+		ListenerProfiles: []ListenerProfile{
+			{Name: "internal"},
+			{Name: "public", DisableCapabilities: []string{"compress", "multi_statements"}, ServerVersion: "8.0.36-public"},
+		},
+	})
+	greeting := func(listener string) *serverGreeting {
+		t.Helper()
+		client, server := net.Pipe()
+		defer client.Close()
+		go srv.HandleOn(server, listener)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		g, err := parseServerGreeting(mustReadPacket(t, client).Payload)
+		if err != nil {
+			t.Fatalf("parse greeting: %v", err)
+		}
+		return g
+	}
+
+	internal, public := greeting("internal"), greeting("public")
+	if internal.Capabilities&(capCompress|capMultiStatements) != capCompress|capMultiStatements {
+		t.Fatalf("internal listener offered %s", capabilityString(internal.Capabilities))
+	}
+	if public.Capabilities&(capCompress|capMultiStatements) != 0 || public.Capabilities&capProtocol41 == 0 {
+		t.Fatalf("public listener offered %s", capabilityString(public.Capabilities))
+	}
+	if internal.ServerVersion != defaultServerVersion || public.ServerVersion != "8.0.36-public" {
+		t.Fatalf("listeners advertised versions %q and %q", internal.ServerVersion, public.ServerVersion)
+	}
+
+	for _, profiles := range [][]ListenerProfile{
+		{{Name: "public"}, {Name: "public"}},
+		{{Name: "public", DisableCapabilities: []string{"teleport"}}},
+		{{Name: "public", RequireTLS: true}},
+		{{Name: "public", AuthPlugin: "dialog"}},
+	} {
+		if _, err := NewServer(Config{ListenerProfiles: profiles}); err == nil {
+			t.Fatalf("expected an error for listener profiles %+v", profiles)
+		}
+	}
+}
+
+func TestListenerProfileTLSAndAuth(t *testing.T) {
+	cert, caPEM := newTestCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	srv := newTestServer(t, Config{
+		ListenerProfiles: []ListenerProfile{
+			{Name: "internal"},
+			{Name: "public", TLS: &tls.Config{Certificates: []tls.Certificate{cert}}, RequireTLS: true, AuthPlugin: cachingSHA2Plugin},
+		},
+	})
+	connect := func(listener string, tlsConfig *tls.Config) (*serverGreeting, error) {
+		t.Helper()
+		client, server := net.Pipe()
+		defer client.Close()
+		go srv.HandleOn(server, listener)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, g, err := clientHandshakeTLS(client, "app", "password", "", tlsConfig, false)
+		return g, err
+	}
+
+	internal, err := connect("internal", nil)
+	if err != nil {
+		t.Fatalf("plaintext client on the internal listener: %v", err)
+	}
+	if internal.Capabilities&capSSL != 0 || internal.AuthPlugin != nativePasswordPlugin {
+		t.Fatalf("internal listener offered %s with %s", capabilityString(internal.Capabilities), internal.AuthPlugin)
+	}
+	public, err := connect("public", &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("TLS client on the public listener: %v", err)
+	}
+	if public.Capabilities&capSSL == 0 || public.AuthPlugin != cachingSHA2Plugin {
+		t.Fatalf("public listener offered %s with %s", capabilityString(public.Capabilities), public.AuthPlugin)
+	}
+	var sqlErr *SQLError
+	if _, err := connect("public", nil); !errors.As(err, &sqlErr) || sqlErr.Code != 1045 {
+		t.Fatalf("plaintext client on the public listener: got %v, want error 1045", err)
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// longDataChunk is parameter data a client sent with COM_STMT_SEND_LONG_DATA.
+type longDataChunk struct {
+	param uint16
+	data  []byte
+}
+
+// maxLongDataChunk is the most parameter data sent to a backend in one
+// COM_STMT_SEND_LONG_DATA packet, after the command, statement id and
+// parameter index.
+const maxLongDataChunk = maxPacketChunk - 7
+
+// sendLongData handles COM_STMT_SEND_LONG_DATA, which has no response. The
+// data is buffered on the statement until it executes rather than forwarded
+// at once, so it survives the statement being prepared again on another
+// backend connection. Errors are reported by the next execute, as MySQL
+// does.
+func (c *Connection) sendLongData(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+	stmt, ok := c.stmts[binary.LittleEndian.Uint32(data)]
+	if !ok || stmt.longDataErr != nil {
+		return
+	}
+	size := stmt.longDataSize + int64(len(data)-6)
+	if max := c.server.cfg.MaxLongDataBytes; max > 0 && size > max {
+		c.logger.WithField("stmt_id", stmt.ID).WithField("limit", max).Warn("prepared statement long data exceeds the limit")
+		stmt.clearLongData()
+		stmt.longDataErr = &SQLError{Code: 1153, SQLState: "08S01", Message: fmt.Sprintf("Got a packet bigger than the proxy's limit of %d bytes of long data per statement", max)}
+		return
+	}
+	stmt.longData = append(stmt.longData, longDataChunk{
+		param: binary.LittleEndian.Uint16(data[4:]),
+		data:  append([]byte(nil), data[6:]...),
+	})
+	stmt.longDataSize = size
+}
+
+// flushLongData sends the statement's buffered long data to bc, where it is
+// prepared, ahead of its execution.
+func (stmt *PreparedStatement) flushLongData(bc *BackendConn) error {
+	defer stmt.clearLongData()
+	for _, chunk := range stmt.longData {
+		data := chunk.data
+		for first := true; first || len(data) > 0; first = false {
+			n := min(len(data), maxLongDataChunk)
+			payload := binary.LittleEndian.AppendUint32([]byte{COM_STMT_SEND_LONG_DATA}, stmt.backendID)
+			payload = binary.LittleEndian.AppendUint16(payload, chunk.param)
+			if err := bc.writePacket(0, append(payload, data[:n]...)); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// clearLongData discards the statement's buffered long data and any error
+// from buffering it.
+func (stmt *PreparedStatement) clearLongData() {
+	stmt.longData, stmt.longDataSize, stmt.longDataErr = nil, 0, nil
+}
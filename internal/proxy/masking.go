@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
+// MaskingRule masks the values of relayed result columns whose name matches
+// Column, for every user except the exempt ones.
+type MaskingRule struct {
+	// Column is a SQL LIKE pattern, such as %ssn%, matched
+	// case-insensitively against both the column's alias and its name in
+	// the table, so an alias cannot be used to see the raw values.
+	Column string
+	// KeepLast is the number of trailing characters left visible; the rest
+	// are replaced with '*'. Values no longer than KeepLast are masked
+	// entirely.
+	KeepLast int
+	// Exempt lists the users who see the values unmasked.
+	Exempt []string
+}
+
+type maskingRule struct {
+	column   *regexp.Regexp
+	keepLast int
+	exempt   map[string]bool
+}
+
+func compileMaskingRules(rules []MaskingRule) []maskingRule {
+	compiled := make([]maskingRule, len(rules))
+	for i, r := range rules {
+		exempt := make(map[string]bool, len(r.Exempt))
+		for _, u := range r.Exempt {
+			exempt[u] = true
+		}
+		compiled[i] = maskingRule{column: likePattern(r.Column), keepLast: r.KeepLast, exempt: exempt}
+	}
+	return compiled
+}
+
+// maskRewriter returns the transformer masking result sets relayed to user,
+// or nil if no rule applies to them.
+func (s *Server) maskRewriter(user string) RowTransformer {
+	var rules []maskingRule
+	for _, r := range s.masking {
+		if !r.exempt[user] {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return rowRewriter(func(columns []ColumnDef, row [][]byte) [][]byte {
+		for i, col := range columns {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			for _, r := range rules {
+				if r.column.MatchString(col.Name) || r.column.MatchString(col.OrgName) {
+					row[i] = maskValue(row[i], r.keepLast)
+					break
+				}
+			}
+		}
+		return row
+	})
+}
+
+// maskValue replaces all but the last keep characters of v with '*'.
+func maskValue(v []byte, keep int) []byte {
+	n := utf8.RuneCount(v)
+	if n <= keep {
+		keep = 0
+	}
+	out := make([]byte, 0, len(v))
+	for i := 0; i < n-keep; i++ {
+		out = append(out, '*')
+		_, size := utf8.DecodeRune(v)
+		v = v[size:]
+	}
+	return append(out, v...)
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMaskingRules(t *testing.T) {
+	customers := &ResultSet{
+		Columns: []ColumnDef{{Name: "name"}, {Name: "customer_ssn"}, {Name: "card", OrgName: "credit_card"}},
+		Rows:    [][]string{{"Ann", "123-45-6789", "4111111111111111"}, {"Bob", "12", "ünï"}},
+	}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeTestResultSet(conn, customers)
+	})
+	srv := newTestServer(t, Config{
+		Backends: []BackendConfig{fb.config()},
+		MaskingRules: []MaskingRule{
+			{Column: "%ssn%", KeepLast: 4, Exempt: []string{"admin"}},
+			{Column: "%CREDIT\\_CARD%", KeepLast: 4, Exempt: []string{"admin"}},
+		},
+	})
+
+	query := func(user string) [][]string {
+		client := dialProxyAs(t, srv, user)
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT * FROM customers"...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		_, rows := readTestResultSet(t, client)
+		return rows
+	}
+
+	want := [][]string{{"Ann", "*******6789", "************1111"}, {"Bob", "**", "***"}}
+	if rows := query("analyst"); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("restricted user got %q, want %q", rows, want)
+	}
+	if rows := query("admin"); !reflect.DeepEqual(rows, customers.Rows) {
+		t.Fatalf("exempt user got %q, want the raw values", rows)
+	}
+}
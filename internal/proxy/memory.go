@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// ErrPacketMemoryExhausted is returned when a client packet does not fit in
+// the shared packet buffer budget.
+var ErrPacketMemoryExhausted = errors.New("packet buffer memory exhausted")
+
+// MemoryBudget caps the bytes held in client packet buffers across all
+// connections. A nil budget is unlimited.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &MemoryBudget{limit: limit}
+}
+
+// TryAcquire reserves n bytes, reporting false without blocking if that
+// would exceed the limit.
+func (b *MemoryBudget) TryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if used+n > b.limit {
+			metrics.PacketBufferRejections.Inc()
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			metrics.PacketBufferBytes.Add(float64(n))
+			return true
+		}
+	}
+}
+
+// Release returns n previously acquired bytes.
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.used.Add(-n)
+	metrics.PacketBufferBytes.Sub(float64(n))
+}
+
+// Used reports the bytes currently reserved.
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.used.Load()
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(100)
+	if !b.TryAcquire(60) {
+		t.Fatalf("first acquire should fit")
+	}
+	if b.TryAcquire(50) {
+		t.Fatalf("acquire beyond the limit should fail")
+	}
+	b.Release(60)
+	if !b.TryAcquire(100) {
+		t.Fatalf("acquire after release should fit")
+	}
+	if b.Used() != 100 {
+		t.Fatalf("used: got %d", b.Used())
+	}
+
+	var unlimited *MemoryBudget
+	if !unlimited.TryAcquire(1 << 30) {
+		t.Fatalf("nil budget should be unlimited")
+	}
+}
+
+func TestPacketMemoryExhaustedReturnsError(t *testing.T) {
+	srv := newTestServer(t, Config{MaxPacketMemory: 32})
+	client := dialProxy(t, srv)
+	rejections := testutil.ToFloat64(metrics.PacketBufferRejections)
+
+	big := "SELECT '" + strings.Repeat("x", 64) + "'"
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, big...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	pkt := mustReadPacket(t, client)
+	sqlErr, err := ParseErrPacket(pkt.Payload)
+	if err != nil || sqlErr.Code != 1040 {
+		t.Fatalf("expected ERR 1040, got %x", pkt.Payload)
+	}
+	if got := testutil.ToFloat64(metrics.PacketBufferRejections) - rejections; got != 1 {
+		t.Fatalf("expected one rejection, got %v", got)
+	}
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("small query should still succeed, got %x", pkt.Payload)
+	}
+	if used := srv.packetMemory.Used(); used != 0 {
+		t.Fatalf("packet memory not released: %d", used)
+	}
+}
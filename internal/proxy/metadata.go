@@ -0,0 +1,21 @@
+package proxy
+
+// resultsetMetadataFull follows the column count sent to clients that
+// negotiated CLIENT_OPTIONAL_RESULTSET_METADATA: column definitions are
+// always sent for result sets built by the proxy.
+const resultsetMetadataFull = 1
+
+// optionalMetadata reports whether the client negotiated
+// CLIENT_OPTIONAL_RESULTSET_METADATA.
+func (c *Connection) optionalMetadata() bool {
+	return c.capabilities&capOptionalMetadata != 0
+}
+
+// withMetadataFlag adds the metadata flag to the column count of a locally
+// built result set when the client expects one.
+func (c *Connection) withMetadataFlag(packets [][]byte) [][]byte {
+	if c.optionalMetadata() && len(packets) > 0 {
+		packets[0] = append(packets[0], resultsetMetadataFull)
+	}
+	return packets
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// writeMetadataNoneResultSet writes a two-column result set the way a
+// backend does with resultset_metadata=NONE: the column count and its
+// metadata flag, the EOF that would end the column definitions, then the
+// rows.
+func writeMetadataNoneResultSet(conn net.Conn, rows [][]string) {
+	seq := uint8(1)
+	write := func(p []byte) {
+		WritePacket(conn, seq, p)
+		seq++
+	}
+	write([]byte{2, 0})
+	write(NewEOFPacket(0))
+	for _, row := range rows {
+		var p []byte
+		for _, v := range row {
+			p = AppendLengthEncodedString(p, v)
+		}
+		write(p)
+	}
+	write(NewEOFPacket(0))
+}
+
+func TestResultSetWithoutMetadataRelayed(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		if string(payload[1:]) == "DO 1" {
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			return
+		}
+		writeMetadataNoneResultSet(conn, [][]string{{"1", "alice"}, {"2", "bob"}})
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT id, name FROM users"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if p := mustReadPacket(t, client).Payload; !bytes.Equal(p, []byte{2, 0}) {
+		t.Fatalf("column count = %x, want 0200", p)
+	}
+	if p := mustReadPacket(t, client).Payload; !isEOFPacket(p) {
+		t.Fatalf("expected EOF in place of column definitions, got %x", p)
+	}
+	var rows [][]string
+	for {
+		p := mustReadPacket(t, client).Payload
+		if isEOFPacket(p) {
+			break
+		}
+		row, err := parseTextRow(p, 2)
+		if err != nil {
+			t.Fatalf("row %x: %v", p, err)
+		}
+		rows = append(rows, []string{string(row[0]), string(row[1])})
+	}
+	if len(rows) != 2 || rows[1][1] != "bob" {
+		t.Fatalf("rows = %q", rows)
+	}
+
+	// The connection is still in step with the backend.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if p := mustReadPacket(t, client).Payload; p[0] != 0x00 {
+		t.Fatalf("next query: got %x", p)
+	}
+}
+
+func TestResultSetWithoutMetadataRefusedWhenMasking(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeMetadataNoneResultSet(conn, [][]string{{"1", "4111111111111111"}})
+	})
+	srv := newTestServer(t, Config{
+		Backends:     []BackendConfig{fb.config()},
+		MaskingRules: []MaskingRule{{Column: "card%"}},
+	})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT id, card FROM payments"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	sqlErr, err := ParseErrPacket(mustReadPacket(t, client).Payload)
+	if err != nil || sqlErr.Code != 1235 {
+		t.Fatalf("expected error 1235, got %v %v", sqlErr, err)
+	}
+}
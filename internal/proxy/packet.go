@@ -2,20 +2,68 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
-) 
+
+	"github.com/sirupsen/logrus"
+)
 
 var (
 	ErrInvalidPacket    = errors.New("invalid packet")
 	ErrInvalidHandshake = errors.New("invalid handshake")
 	ErrAuthFailed       = errors.New("authentication failed")
+	// ErrProtocolMismatch is returned for a client that only speaks the
+	// pre-4.1 protocol.
+	ErrProtocolMismatch = errors.New("client does not support protocol 4.1")
+	// ErrTLSUnavailable is returned when a client asks to switch to TLS
+	// while no TLS configuration is set for it.
+	ErrTLSUnavailable = errors.New("client requested TLS, which is not enabled")
+	// ErrTLSRequired is returned for a client that did not switch to TLS
+	// when the proxy requires it.
+	ErrTLSRequired = errors.New("client did not use TLS, which is required")
 )
 
+// Capability flags exchanged in the handshake.
+const (
+	capClientLongPassword uint32 = 0x00000001
+	capFoundRows          uint32 = 0x00000002
+	capLongFlag           uint32 = 0x00000004
+	capConnectWithDB      uint32 = 0x00000008
+	capProtocol41         uint32 = 0x00000200
+	capCompress           uint32 = 0x00000020
+	capSSL                uint32 = 0x00000800
+	capTransactions       uint32 = 0x00002000
+	capSecureConnection   uint32 = 0x00008000
+	capMultiStatements    uint32 = 0x00010000
+	capMultiResults       uint32 = 0x00020000
+	capPluginAuth         uint32 = 0x00080000
+	capSessionTrack       uint32 = 0x00800000
+	capDeprecateEOF       uint32 = 0x01000000
+	capOptionalMetadata   uint32 = 0x02000000
+	capQueryAttributes    uint32 = 0x08000000
+)
+
+// SQLError is an error reported by a MySQL server in an ERR packet.
+type SQLError struct {
+	Code     uint16
+	SQLState string
+	Message  string
+}
+
+func (e *SQLError) Error() string {
+	return fmt.Sprintf("ERROR %d (%s): %s", e.Code, e.SQLState, e.Message)
+}
+
+// Packet encodes the error as an ERR packet payload.
+func (e *SQLError) Packet() []byte {
+	return NewErrPacket(e.Code, e.SQLState, e.Message)
+}
+
 type Packet struct {
 	Length   uint32
 	Sequence uint8
@@ -43,6 +91,93 @@ func ReadPacket(r io.Reader) (*Packet, error) {
 	return &Packet{Length: length, Sequence: sequence, Payload: payload}, nil
 }
 
+// maxPacketChunk is the largest payload of a single packet. A payload of
+// this length is continued in the next packet.
+const maxPacketChunk = 0xFFFFFF
+
+// maxReassembledPacket bounds a payload reassembled from several packets,
+// matching the largest max_allowed_packet MySQL accepts.
+const maxReassembledPacket = 1 << 30
+
+// ErrPacketFraming is returned for a client packet that is not framed as the
+// protocol requires: a continuation chunk out of sequence, a command that
+// does not start at sequence 0, or a reassembled payload beyond 1GB. Such
+// framing could smuggle data past the proxy as a separate command.
+var ErrPacketFraming = errors.New("malformed packet framing")
+
+// ReadPacketBudget reads a packet like ReadPacket, charging its payload to
+// budget. A payload split over several packets is reassembled, and its
+// chunks must be in sequence. The caller must release len(Payload) bytes
+// once done with it. If the budget is exhausted the payload is discarded
+// unread and the packet is returned without it, together with
+// ErrPacketMemoryExhausted.
+func ReadPacketBudget(r io.Reader, budget *MemoryBudget) (*Packet, error) {
+	return readPacketBudget(r, budget, false)
+}
+
+// readCommandPacket reads the packet starting a client command like
+// ReadPacketBudget. The command must start at sequence 0: anything else
+// continues a previous packet that was not max-length.
+func readCommandPacket(r io.Reader, budget *MemoryBudget) (*Packet, error) {
+	return readPacketBudget(r, budget, true)
+}
+
+// ReadFullMessage reads a payload that may be split over several packets,
+// reassembling it like ReadPacketBudget without charging it to a budget.
+// The packet's Sequence is that of its last chunk.
+func ReadFullMessage(r io.Reader) (*Packet, error) {
+	return readPacketBudget(r, nil, false)
+}
+
+func readPacketBudget(r io.Reader, budget *MemoryBudget, command bool) (*Packet, error) {
+	header := make([]byte, 4)
+	pkt := &Packet{}
+	exhausted := false
+	fail := func(err error) (*Packet, error) {
+		budget.Release(int64(len(pkt.Payload)))
+		return nil, err
+	}
+	for chunk := 0; ; chunk++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return fail(fmt.Errorf("read header: %w", err))
+		}
+		length := uint32(header[0]) | (uint32(header[1]) << 8) | (uint32(header[2]) << 16)
+		switch {
+		case chunk == 0 && command && header[3] != 0:
+			return fail(fmt.Errorf("%w: command starts at sequence %d", ErrPacketFraming, header[3]))
+		case chunk > 0 && header[3] != pkt.Sequence+1:
+			return fail(fmt.Errorf("%w: continuation has sequence %d after %d", ErrPacketFraming, header[3], pkt.Sequence))
+		case pkt.Length+length > maxReassembledPacket:
+			return fail(fmt.Errorf("%w: payload exceeds %d bytes", ErrPacketFraming, maxReassembledPacket))
+		}
+		pkt.Length += length
+		pkt.Sequence = header[3]
+
+		if length > 0 && !exhausted && !budget.TryAcquire(int64(length)) {
+			budget.Release(int64(len(pkt.Payload)))
+			pkt.Payload, exhausted = nil, true
+		}
+		if exhausted {
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return nil, fmt.Errorf("discard payload: %w", err)
+			}
+		} else if length > 0 {
+			n := len(pkt.Payload)
+			pkt.Payload = append(pkt.Payload, make([]byte, length)...)
+			if _, err := io.ReadFull(r, pkt.Payload[n:]); err != nil {
+				return fail(fmt.Errorf("read payload: %w", err))
+			}
+		}
+		if length < maxPacketChunk {
+			break
+		}
+	}
+	if exhausted {
+		return pkt, ErrPacketMemoryExhausted
+	}
+	return pkt, nil
+}
+
 func WritePacket(w io.Writer, sequence uint8, payload []byte) error {
 	if len(payload) > 0xFFFFFF {
 		return fmt.Errorf("payload too large: %d", len(payload))
@@ -58,123 +193,213 @@ func WritePacket(w io.Writer, sequence uint8, payload []byte) error {
 	return err
 }
 
-func SendHandshake(w io.Writer) ([]byte, error) {
-	const (
-		capClientLongPassword uint32 = 0x00000001
-		capFoundRows          uint32 = 0x00000002
-		capLongFlag           uint32 = 0x00000004
-		capConnectWithDB      uint32 = 0x00000008
-		capProtocol41         uint32 = 0x00000200
-		capTransactions       uint32 = 0x00002000
-		capSecureConnection   uint32 = 0x00008000
-		capPluginAuth         uint32 = 0x00080000
-	)
+// WriteLargePacket writes payload in as many packets as it needs, numbered
+// from sequence: chunks of maxPacketChunk bytes are each continued in the
+// next packet, so a payload that is a multiple of maxPacketChunk long ends
+// with an empty one. It returns the sequence number after the last packet.
+func WriteLargePacket(w io.Writer, sequence uint8, payload []byte) (uint8, error) {
+	for {
+		n := min(len(payload), maxPacketChunk)
+		if err := WritePacket(w, sequence, payload[:n]); err != nil {
+			return sequence, err
+		}
+		sequence++
+		payload = payload[n:]
+		if n < maxPacketChunk {
+			return sequence, nil
+		}
+	}
+}
+
+// SendHandshake writes the initial server greeting for connection connID and
+// returns the 20-byte auth scramble the client must answer.
+func SendHandshake(w io.Writer, connID uint32) ([]byte, error) {
+	return sendHandshake(w, connID, defaultServerVersion, serverCapabilities, nativePasswordPlugin)
+}
+
+// defaultServerVersion is the server version advertised to clients unless
+// configured otherwise.
+const defaultServerVersion = "metal-db-proxy-1.0"
 
-	capabilities := capClientLongPassword | capFoundRows | capLongFlag | capConnectWithDB | capProtocol41 | capTransactions | capSecureConnection | capPluginAuth
+// serverCapabilities are advertised to clients. CLIENT_SSL is added by
+// Server.capabilities when Config.TLS is set, and for listeners whose
+// ListenerProfile sets TLS; a client that asks for it otherwise gets an
+// error from rejectSSLRequest.
+const serverCapabilities = capClientLongPassword | capFoundRows | capLongFlag | capConnectWithDB | capProtocol41 | capTransactions | capSecureConnection | capMultiStatements | capMultiResults | capPluginAuth | capOptionalMetadata
+
+func sendHandshake(w io.Writer, connID uint32, version string, capabilities uint32, plugin string) ([]byte, error) {
+	scramble, err := newScramble(20)
+	if err != nil {
+		return nil, fmt.Errorf("generate scramble: %w", err)
+	}
+	scramblePart1 := scramble[:8]
+	scramblePart2 := scramble[8:]
 
 	var buf bytes.Buffer
 	buf.WriteByte(10)
-	buf.WriteString("metal-db-proxy-1.0")
+	buf.WriteString(version)
 	buf.WriteByte(0)
-	connID := make([]byte, 4)
-	rand.Read(connID)
-	buf.Write(connID)
-	scramblePart1 := make([]byte, 8)
-	rand.Read(scramblePart1)
+	binary.Write(&buf, binary.LittleEndian, connID)
 	buf.Write(scramblePart1)
 	buf.WriteByte(0x00)
 	binary.Write(&buf, binary.LittleEndian, uint16(capabilities))
-	buf.WriteByte(0x21)
+	buf.WriteByte(byte(CollationUTF8MB3GeneralCI))
 	binary.Write(&buf, binary.LittleEndian, uint16(0x0002))
 	binary.Write(&buf, binary.LittleEndian, uint16(capabilities>>16))
 	buf.WriteByte(21) // 8 + 13
 	buf.Write(make([]byte, 10))
-	scramblePart2 := make([]byte, 12)
-	rand.Read(scramblePart2)
 	buf.Write(scramblePart2)
 	buf.WriteByte(0)
-	buf.WriteString("mysql_native_password")
+	buf.WriteString(plugin)
 	buf.WriteByte(0)
 
 	if err := WritePacket(w, 0, buf.Bytes()); err != nil {
 		return nil, err
 	}
 
-	scramble := make([]byte, 20)
-	copy(scramble[:8], scramblePart1)
-	copy(scramble[8:], scramblePart2[:12])
 	return scramble, nil
 }
 
-func HandleHandshake(r io.Reader, w io.Writer, scramble []byte, sequence uint8) error {
-	pkt, err := ReadPacket(r)
-	if err != nil {
-		return fmt.Errorf("read handshake: %w", err)
+// newScramble returns n bytes of auth challenge from crypto/rand. Like the
+// MySQL server, bytes are folded into the 7-bit range and NUL and '$' are
+// avoided so clients that treat the scramble as a C string read all of it.
+func newScramble(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
 	}
+	for i := range b {
+		b[i] &= 0x7F
+		if b[i] == 0 || b[i] == '$' {
+			b[i]++
+		}
+	}
+	return b, nil
+}
+
+// HandshakeResponse holds the fields of the client's handshake response the
+// proxy acts on.
+type HandshakeResponse struct {
+	Capabilities uint32
+	Username     string
+	Database     string
+	// Collation is the collation the client asked for, which sets its
+	// character set.
+	Collation uint16
+	// AuthPlugin is the authentication method the client's auth response
+	// was computed with, if it named one.
+	AuthPlugin string
+}
+
+// HandleHandshake reads a client's handshake response and authenticates it
+// against the default password. sequence is the sequence number of the
+// packet before the response: the greeting, or the client's SSLRequest
+// after a TLS upgrade.
+func HandleHandshake(r io.Reader, w io.Writer, scramble []byte, sequence uint8) (*HandshakeResponse, error) {
+	ex := &authExchange{r: r, w: w, seq: sequence + 1}
+	return authenticate(ex, scramble, defaultAuth, false, logrus.NewEntry(logrus.StandardLogger()))
+}
 
-	return handleClientHandshakePacket(pkt.Payload, w, scramble, pkt.Sequence)
+// isSSLRequest reports whether a client handshake payload is an SSLRequest:
+// the fixed part of a handshake response alone, with CLIENT_SSL set.
+func isSSLRequest(payload []byte) bool {
+	return len(payload) == 32 && binary.LittleEndian.Uint32(payload)&capSSL != 0
 }
 
-func handleClientHandshakePacket(payload []byte, w io.Writer, scramble []byte, sequence uint8) error {
+// rejectSSLRequest answers an SSLRequest with an error instead of leaving
+// the client waiting for a TLS handshake that never comes.
+func rejectSSLRequest(w io.Writer, sequence uint8) error {
+	errPkt := NewErrPacket(1043, "08S01", "SSL connection error: TLS is not enabled on metal-db-proxy")
+	if err := WritePacket(w, sequence, errPkt); err != nil {
+		return err
+	}
+	return ErrTLSUnavailable
+}
+
+// parseHandshakeResponse decodes a HandshakeResponse41 packet, returning
+// the auth response separately. Malformed responses fail with
+// ErrInvalidHandshake, pre-4.1 ones with ErrProtocolMismatch.
+func parseHandshakeResponse(payload []byte) (*HandshakeResponse, []byte, error) {
+	// Pre-4.1 responses start with 2 bytes of capability flags.
+	if len(payload) >= 2 && uint32(binary.LittleEndian.Uint16(payload))&capProtocol41 == 0 {
+		return nil, nil, ErrProtocolMismatch
+	}
 	if len(payload) < 32 {
-		return ErrInvalidHandshake
+		return nil, nil, ErrInvalidHandshake
 	}
 
-	_ = binary.LittleEndian.Uint32(payload[4:8])
+	resp := &HandshakeResponse{Capabilities: binary.LittleEndian.Uint32(payload[0:4]), Collation: uint16(payload[8])}
 
-	pos := 36
+	pos := 32
 
 	username, n, err := ReadNullTerminatedString(payload[pos:])
 	if err != nil {
-		return fmt.Errorf("parse username: %w", err)
+		return nil, nil, fmt.Errorf("%w: username: %v", ErrInvalidHandshake, err)
 	}
+	resp.Username = username
 	pos += n
 
 	authLen, authSize, err := ReadLengthEncodedInt(payload[pos:])
 	if err != nil {
-		return fmt.Errorf("parse auth len: %w", err)
+		return nil, nil, fmt.Errorf("%w: auth response length: %v", ErrInvalidHandshake, err)
 	}
 	pos += authSize
 
 	if pos+int(authLen) > len(payload) {
-		return ErrInvalidPacket
+		return nil, nil, fmt.Errorf("%w: truncated auth response", ErrInvalidHandshake)
 	}
 	authResp := payload[pos : pos+int(authLen)]
+	pos += int(authLen)
 
-	if !verifyMySQLNativePassword(string(authResp), "password", scramble) {
-		errPkt := NewErrPacket(1045, "28000", "Access denied for user '"+username+"'")
-		return WritePacket(w, sequence+1, errPkt)
+	if resp.Capabilities&capConnectWithDB != 0 && pos < len(payload) {
+		db, n, err := ReadNullTerminatedString(payload[pos:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: database: %v", ErrInvalidHandshake, err)
+		}
+		resp.Database = db
+		pos += n
 	}
+	if resp.Capabilities&capPluginAuth != 0 && pos < len(payload) {
+		// Some clients leave the plugin name, last in the packet,
+		// unterminated.
+		plugin, _, err := ReadNullTerminatedString(payload[pos:])
+		if err != nil {
+			plugin = string(payload[pos:])
+		}
+		resp.AuthPlugin = plugin
+	}
+	return resp, authResp, nil
+}
 
-	okPkt := NewOKPacket(0, 0, 0)
-	return WritePacket(w, sequence+1, okPkt)
+// nativePasswordHash returns the hash mysql_native_password stores for
+// password, SHA1(SHA1(password)).
+func nativePasswordHash(password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	return stage2[:]
 }
 
-func verifyMySQLNativePassword(clientResp, password string, scramble []byte) bool {
+// verifyMySQLNativePassword checks a client's mysql_native_password
+// response, SHA1(password) XOR SHA1(scramble + stage2), against the stored
+// stage2 hash: unmasking the response must give a stage1 hashing to
+// stage2.
+func verifyMySQLNativePassword(clientResp string, stage2, scramble []byte) bool {
 	resp := []byte(clientResp)
-	if len(resp) != 20 || len(scramble) < 20 {
+	if len(resp) != sha1.Size || len(stage2) != sha1.Size || len(scramble) < 20 {
 		return false
 	}
 
-	h1 := sha1.New()
-	h1.Write([]byte(password))
-	stage1 := h1.Sum(nil)
-
-	h2 := sha1.New()
-	h2.Write(stage1)
-	stage2 := h2.Sum(nil)
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2)
+	mask := h.Sum(nil)
 
-	h3 := sha1.New()
-	h3.Write(scramble)
-	h3.Write(stage2)
-	candidate := h3.Sum(nil)
-
-	for i := 0; i < 20; i++ {
-		if resp[i] != (candidate[i] ^ stage1[i]) {
-			return false
-		}
+	stage1 := make([]byte, sha1.Size)
+	for i := range stage1 {
+		stage1[i] = resp[i] ^ mask[i]
 	}
-	return true
+	candidate := sha1.Sum(stage1)
+	return subtle.ConstantTimeCompare(candidate[:], stage2) == 1
 }
 
 func ReadNullTerminatedString(data []byte) (string, int, error) {
@@ -238,6 +463,38 @@ func NewOKPacket(affectedRows, lastInsertID uint64, status uint16) []byte {
 	return payload
 }
 
+// OKPacket is a decoded OK packet.
+type OKPacket struct {
+	AffectedRows uint64
+	LastInsertID uint64
+	Status       uint16
+	Warnings     uint16
+}
+
+// ParseOKPacket decodes an OK packet payload, including one sent with the
+// EOF header in place of an EOF packet.
+func ParseOKPacket(payload []byte) (*OKPacket, error) {
+	if len(payload) == 0 || payload[0] != 0x00 && payload[0] != 0xFE {
+		return nil, ErrInvalidPacket
+	}
+	ok := &OKPacket{}
+	pos := 1
+	for _, v := range []*uint64{&ok.AffectedRows, &ok.LastInsertID} {
+		n, size, err := ReadLengthEncodedInt(payload[pos:])
+		if err != nil {
+			return nil, err
+		}
+		*v = n
+		pos += size
+	}
+	if len(payload) < pos+4 {
+		return nil, ErrInvalidPacket
+	}
+	ok.Status = binary.LittleEndian.Uint16(payload[pos:])
+	ok.Warnings = binary.LittleEndian.Uint16(payload[pos+2:])
+	return ok, nil
+}
+
 func NewErrPacket(code uint16, sqlState, message string) []byte {
 	payload := make([]byte, 0, 64)
 	payload = append(payload, 0xFF)                      // error header
@@ -248,6 +505,21 @@ func NewErrPacket(code uint16, sqlState, message string) []byte {
 	return payload
 }
 
+// ParseErrPacket decodes an ERR packet payload.
+func ParseErrPacket(payload []byte) (*SQLError, error) {
+	if len(payload) < 3 || payload[0] != 0xFF {
+		return nil, ErrInvalidPacket
+	}
+	e := &SQLError{Code: binary.LittleEndian.Uint16(payload[1:3])}
+	rest := payload[3:]
+	if len(rest) >= 6 && rest[0] == '#' {
+		e.SQLState = string(rest[1:6])
+		rest = rest[6:]
+	}
+	e.Message = string(rest)
+	return e, nil
+}
+
 func lengthEncode(n uint64) ([]byte, error) {
 	if n < 251 {
 		return []byte{byte(n)}, nil
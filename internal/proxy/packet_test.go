@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"testing"
 )
 
@@ -68,6 +69,24 @@ func TestOKPacketFormat(t *testing.T) {
 	}
 }
 
+func TestParseOKPacket(t *testing.T) {
+	p := NewOKPacket(3, 70000, serverStatusInTrans)
+	binary.LittleEndian.PutUint16(p[len(p)-2:], 2) // warnings
+	ok, err := ParseOKPacket(p)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := OKPacket{AffectedRows: 3, LastInsertID: 70000, Status: serverStatusInTrans, Warnings: 2}
+	if *ok != want {
+		t.Fatalf("parsed %+v, want %+v", *ok, want)
+	}
+	for _, bad := range [][]byte{nil, {0xFF, 0, 0}, p[:len(p)-3]} {
+		if _, err := ParseOKPacket(bad); err == nil {
+			t.Fatalf("parsed malformed OK packet %x", bad)
+		}
+	}
+}
+
 func TestErrPacketFormat(t *testing.T) {
 	p := NewErrPacket(1045, "28000", "Access denied")
 	if len(p) < 9 {
@@ -102,11 +121,172 @@ func TestVerifyMySQLNativePassword(t *testing.T) {
 		resp[i] = candidate[i] ^ h1[i]
 	}
 
-	if !verifyMySQLNativePassword(string(resp), password, scramble) {
+	if !verifyMySQLNativePassword(string(resp), nativePasswordHash(password), scramble) {
 		t.Fatalf("expected password verification to succeed")
 	}
 
-	if verifyMySQLNativePassword(string(resp), "wrong", scramble) {
+	if verifyMySQLNativePassword(string(resp), nativePasswordHash("wrong"), scramble) {
 		t.Fatalf("expected password verification to fail with wrong password")
 	}
 }
+
+func TestSendHandshakeScramble(t *testing.T) {
+	var buf bytes.Buffer
+	first, err := SendHandshake(&buf, 1)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if len(first) != 20 {
+		t.Fatalf("scramble length: got %d", len(first))
+	}
+	if bytes.Equal(first, make([]byte, 20)) {
+		t.Fatalf("scramble is all zeros")
+	}
+	if bytes.IndexByte(first, 0) != -1 {
+		t.Fatalf("scramble contains NUL: %x", first)
+	}
+
+	second, err := SendHandshake(&buf, 2)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if bytes.Equal(first, second) {
+		t.Fatalf("scramble did not vary between handshakes: %x", first)
+	}
+}
+
+// The proxy has always announced collation 33, utf8mb3_general_ci, to
+// clients and asked backends for it; changing it changes the session
+// character set of every connection.
+func TestHandshakeCollation(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := sendHandshake(&buf, 1, "8.0.36", serverCapabilities, nativePasswordPlugin); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	pkt, err := ReadPacket(&buf)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	// protocol version, version string, connection id, scramble, filler
+	// and the low capability flags precede the collation.
+	if got := pkt.Payload[1+len("8.0.36")+1+4+8+1+2]; got != 33 {
+		t.Fatalf("server greeting collation %d, want 33", got)
+	}
+	header := make([]byte, 32)
+	putHandshakeHeader(header, 0)
+	if header[8] != 33 {
+		t.Fatalf("handshake response collation %d, want 33", header[8])
+	}
+}
+
+func TestNextConnectionIDUnique(t *testing.T) {
+	seen := make(map[uint32]bool)
+	for i := 0; i < 1000; i++ {
+		id := nextConnectionID()
+		if seen[id] {
+			t.Fatalf("duplicate connection id %d", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestReadPacketBudgetReassembles(t *testing.T) {
+	var buf bytes.Buffer
+	big := bytes.Repeat([]byte{'x'}, maxPacketChunk)
+	WritePacket(&buf, 0, big)
+	WritePacket(&buf, 1, []byte("tail"))
+	budget := NewMemoryBudget(0)
+	pkt, err := readCommandPacket(&buf, budget)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(pkt.Payload) != maxPacketChunk+4 || pkt.Sequence != 1 || string(pkt.Payload[maxPacketChunk:]) != "tail" {
+		t.Fatalf("reassembled %d bytes ending at sequence %d", len(pkt.Payload), pkt.Sequence)
+	}
+}
+
+func TestWriteLargePacket(t *testing.T) {
+	for _, c := range []struct {
+		length  int
+		packets int
+	}{
+		{10, 1},
+		{maxPacketChunk - 1, 1},
+		// A trailing empty packet ends a payload of exactly one chunk.
+		{maxPacketChunk, 2},
+		{maxPacketChunk + 4, 2},
+	} {
+		var buf bytes.Buffer
+		payload := bytes.Repeat([]byte{'x'}, c.length)
+		next, err := WriteLargePacket(&buf, 3, payload)
+		if err != nil {
+			t.Fatalf("%d bytes: write: %v", c.length, err)
+		}
+		if want := uint8(3 + c.packets); next != want {
+			t.Fatalf("%d bytes: next sequence %d, want %d", c.length, next, want)
+		}
+		if want := c.length + 4*c.packets; buf.Len() != want {
+			t.Fatalf("%d bytes: wrote %d bytes, want %d", c.length, buf.Len(), want)
+		}
+		pkt, err := ReadFullMessage(&buf)
+		if err != nil {
+			t.Fatalf("%d bytes: read: %v", c.length, err)
+		}
+		if !bytes.Equal(pkt.Payload, payload) || pkt.Sequence != next-1 || buf.Len() != 0 {
+			t.Fatalf("%d bytes: read back %d bytes ending at sequence %d", c.length, len(pkt.Payload), pkt.Sequence)
+		}
+	}
+}
+
+func TestPacketSequenceWraps(t *testing.T) {
+	var buf bytes.Buffer
+	payload := bytes.Repeat([]byte{'x'}, maxPacketChunk+4)
+	next, err := WriteLargePacket(&buf, 255, payload)
+	if err != nil || next != 1 {
+		t.Fatalf("write: next sequence %d, %v; want 1", next, err)
+	}
+	// The continuation of the chunk at 255 is at 0.
+	pkt, err := ReadFullMessage(&buf)
+	if err != nil || !bytes.Equal(pkt.Payload, payload) || pkt.Sequence != 0 {
+		t.Fatalf("read: %v", err)
+	}
+}
+
+func TestReadPacketBudgetRejectsBadFraming(t *testing.T) {
+	type chunk struct {
+		seq     uint8
+		payload []byte
+	}
+	big := bytes.Repeat([]byte{'x'}, maxPacketChunk)
+	cases := []struct {
+		name   string
+		chunks []chunk
+	}{
+		// A short chunk ends the payload, so what follows at the next
+		// sequence number is a smuggled continuation, not a new command.
+		{"continuation of a short chunk", []chunk{{0, []byte("\x03DO 1")}, {1, []byte("\x03DO 2")}}},
+		{"continuation out of sequence", []chunk{{0, big}, {2, []byte("tail")}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			for _, chunk := range c.chunks {
+				WritePacket(&buf, chunk.seq, chunk.payload)
+			}
+			budget := NewMemoryBudget(1 << 26)
+			var err error
+			for err == nil {
+				var pkt *Packet
+				if pkt, err = readCommandPacket(&buf, budget); err == nil {
+					budget.Release(int64(len(pkt.Payload)))
+				}
+			}
+			if !errors.Is(err, ErrPacketFraming) {
+				t.Fatalf("got %v, want a framing error", err)
+			}
+			if used := budget.Used(); used != 0 {
+				t.Fatalf("%d bytes of the budget leaked", used)
+			}
+		})
+	}
+}
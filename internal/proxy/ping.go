@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// pingResult is the canned answer to a ping query.
+var pingResult = &ResultSet{
+	Columns: []ColumnDef{{Name: "1", Type: TypeLongLong, Charset: CharsetBinary, Length: 1, Flags: 0x0081}},
+	Rows:    [][]string{{"1"}},
+}
+
+// pingQuerySet indexes queries by the form isPing compares.
+func pingQuerySet(queries []string) map[string]bool {
+	if len(queries) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(queries))
+	for _, q := range queries {
+		set[pingKey(ParseQuery(q))] = true
+	}
+	return set
+}
+
+// pingKey is the text of q with only its keywords and bare names
+// lowercased, so queries differing in the case of a literal stay apart.
+func pingKey(q *Query) string {
+	toks := make([]Token, len(q.Tokens))
+	for i, tok := range q.Tokens {
+		if tok.Kind == TokenWord {
+			tok.Text = strings.ToLower(tok.Text)
+		}
+		toks[i] = tok
+	}
+	return joinTokens(toks, false)
+}
+
+// isPing reports whether q should be answered locally with pingResult.
+func (c *Connection) isPing(q *Query) bool {
+	return !c.inTransaction && c.server.pingQueries[pingKey(q)]
+}
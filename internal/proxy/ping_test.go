@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPingQueriesAnsweredLocally(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		switch query := string(payload[1:]); query {
+		case "BEGIN":
+			WritePacket(conn, 1, NewOKPacket(0, 0, serverStatusInTrans))
+		case "COMMIT":
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+		default:
+			WritePacket(conn, 1, NewOKPacket(0, 0, serverStatusInTrans))
+		}
+	})
+	srv := newTestServer(t, Config{
+		Backends:    []BackendConfig{fb.config()},
+		PingQueries: []string{"SELECT 1"},
+	})
+	client := dialProxy(t, srv)
+
+	send := func(q string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %q: %v", q, err)
+		}
+	}
+
+	for _, q := range []string{"SELECT 1", "/* ping */ select  1;"} {
+		send(q)
+		names, rows := readTestResultSet(t, client)
+		if !reflect.DeepEqual(names, []string{"1"}) || !reflect.DeepEqual(rows, [][]string{{"1"}}) {
+			t.Fatalf("%q: got columns %q rows %q, want the canned 1", q, names, rows)
+		}
+	}
+	if n := fb.queries.Load(); n != 0 {
+		t.Fatalf("ping queries reached the backend %d times", n)
+	}
+
+	// Inside a transaction the ping must run on the backend.
+	send("BEGIN")
+	mustReadPacket(t, client)
+	send("SELECT 1")
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected the backend's answer inside a transaction, got %x", pkt.Payload)
+	}
+	if n := fb.queries.Load(); n != 2 {
+		t.Fatalf("backend saw %d queries, want 2", n)
+	}
+
+	send("COMMIT")
+	mustReadPacket(t, client)
+	send("SELECT 1")
+	readTestResultSet(t, client)
+	if n := fb.queries.Load(); n != 3 {
+		t.Fatalf("backend saw %d queries after COMMIT, want 3", n)
+	}
+}
+
+func TestPingKeyKeepsLiteralCase(t *testing.T) {
+	set := pingQuerySet([]string{"SELECT 'OK'"})
+	if !set[pingKey(ParseQuery("select  'OK'"))] {
+		t.Fatalf("keyword case changed the key")
+	}
+	if set[pingKey(ParseQuery("SELECT 'ok'"))] {
+		t.Fatalf("a literal of different case matched the ping query")
+	}
+}
+
+func TestPingQueriesDisabledByDefault(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT 1"...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	mustReadPacket(t, client)
+	if n := fb.queries.Load(); n != 1 {
+		t.Fatalf("backend saw %d queries, want 1", n)
+	}
+}
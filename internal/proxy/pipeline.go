@@ -0,0 +1,33 @@
+package proxy
+
+import "metal-db-proxy/internal/metrics"
+
+const COM_STMT_SEND_LONG_DATA = 0x18
+
+// errPipelined answers a command the client sent before the response to its
+// previous command was complete.
+var errPipelined = &SQLError{
+	Code:     1156,
+	SQLState: "08S01",
+	Message:  "Command rejected by metal-db-proxy: sent before the previous response was complete",
+}
+
+// expectsResponse reports whether the server answers cmd. Clients may send
+// the next command right after one that gets no answer.
+func expectsResponse(cmd byte) bool {
+	switch cmd {
+	case COM_QUIT, COM_STMT_CLOSE, COM_STMT_SEND_LONG_DATA:
+		return false
+	}
+	return true
+}
+
+// rejectPipelined answers a pipelined command with an error instead of
+// running it, so every command still gets exactly one response. The client
+// stays flagged while it keeps sending ahead of the responses.
+func (c *Connection) rejectPipelined(cmd byte) error {
+	metrics.PipelinedCommandsRejected.Inc()
+	c.logger.WithField("cmd", cmd).Warn("rejecting command sent before the previous response completed")
+	c.pipelined = c.reader.Buffered() > 0
+	return c.writePacket(errPipelined.Packet())
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// writeCommands sends the commands to the client side in a single write.
+func writeCommands(t *testing.T, client net.Conn, cmds ...[]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, cmd := range cmds {
+		WritePacket(&buf, 0, cmd)
+	}
+	if _, err := client.Write(buf.Bytes()); err != nil {
+		t.Fatalf("write commands: %v", err)
+	}
+}
+
+func TestPipelinedCommandsRejected(t *testing.T) {
+	client := dialProxy(t, newTestServer(t, Config{}))
+	query := append([]byte{COM_QUERY}, "DO 1"...)
+
+	writeCommands(t, client, query, query, query)
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("first command: expected OK, got %x", pkt.Payload)
+	}
+	for i := 0; i < 2; i++ {
+		pkt := mustReadPacket(t, client)
+		sqlErr, err := ParseErrPacket(pkt.Payload)
+		if err != nil || sqlErr.Code != 1156 || pkt.Sequence != 1 {
+			t.Fatalf("pipelined command %d: expected error 1156 with sequence 1, got %x", i, pkt.Payload)
+		}
+	}
+
+	// Once the client waits for responses again it is served normally, and
+	// a command following one that has no response is not pipelining.
+	writeCommands(t, client, []byte{COM_STMT_CLOSE, 1, 0, 0, 0}, query)
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected OK after the pipeline drained, got %x", pkt.Payload)
+	}
+}
+
+func TestPipelinedCommandsAllowed(t *testing.T) {
+	client := dialProxy(t, newTestServer(t, Config{AllowPipelining: true}))
+	query := append([]byte{COM_QUERY}, "DO 1"...)
+
+	writeCommands(t, client, query, query)
+	for i := 0; i < 2; i++ {
+		if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+			t.Fatalf("command %d: expected OK, got %x", i, pkt.Payload)
+		}
+	}
+}
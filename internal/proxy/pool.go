@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+const defaultMaxIdle = 4
+
+// Pool keeps idle authenticated connections to a single backend.
+type Pool struct {
+	backend *Backend
+	maxIdle int
+
+	mu   sync.Mutex
+	idle []*BackendConn
+	// inUse counts the connections handed out and not yet put back.
+	inUse atomic.Int64
+}
+
+func newPool(b *Backend, maxIdle int) *Pool {
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdle
+	}
+	return &Pool{backend: b, maxIdle: maxIdle}
+}
+
+// Get returns an idle connection or dials a new one. Idle connections past
+// the backend's MaxIdleTime, or failing the ping CheckIdle asks for, are
+// closed and skipped.
+func (p *Pool) Get(ctx context.Context) (*BackendConn, error) {
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		bc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		if p.usable(bc) {
+			p.inUse.Add(1)
+			return bc, nil
+		}
+	}
+
+	bc, err := p.backend.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.inUse.Add(1)
+	return bc, nil
+}
+
+// Put returns a connection to the pool, resetting any session state a client
+// left on it. Poisoned connections and connections beyond the idle limit are
+// closed, as are all connections to a draining backend.
+func (p *Pool) Put(bc *BackendConn) {
+	p.inUse.Add(-1)
+	if bc.dirty && !bc.Poisoned() {
+		bc.Reset()
+	}
+	if bc.Poisoned() {
+		metrics.BackendConnsDiscarded.WithLabelValues(bc.poisonReason).Inc()
+		bc.Close()
+		return
+	}
+
+	p.putIdle(bc)
+}
+
+// usable reports whether the idle connection bc may be handed out, closing
+// it if not.
+func (p *Pool) usable(bc *BackendConn) bool {
+	cfg := p.backend.cfg
+	unused := time.Since(bc.lastUsed)
+	reason := ""
+	switch {
+	case cfg.MaxIdleTime > 0 && unused > cfg.MaxIdleTime:
+		reason = "max_idle_time"
+	case cfg.CheckIdle > 0 && unused >= cfg.CheckIdle:
+		if err := bc.Ping(); err != nil {
+			logrus.WithError(err).WithField("backend", p.backend.Name()).Warn("idle backend connection failed its health check; closing it")
+			reason = "health_check"
+		} else {
+			bc.lastUsed = time.Now()
+		}
+	}
+	if reason == "" {
+		return true
+	}
+	metrics.BackendConnsDiscarded.WithLabelValues(reason).Inc()
+	bc.Close()
+	return false
+}
+
+// putIdle keeps a healthy connection as idle if there is room for it.
+func (p *Pool) putIdle(bc *BackendConn) {
+	p.mu.Lock()
+	if len(p.idle) >= p.maxIdle || p.backend.Draining() {
+		p.mu.Unlock()
+		bc.Close()
+		return
+	}
+	p.idle = append(p.idle, bc)
+	p.mu.Unlock()
+}
+
+// keepAlive pings the idle connections unused for interval, so the backend
+// does not close them for exceeding its wait_timeout, and closes those that
+// fail. They are taken out of the pool while they are pinged.
+func (p *Pool) keepAlive(interval time.Duration) {
+	now := time.Now()
+	var stale []*BackendConn
+	p.mu.Lock()
+	idle := p.idle[:0]
+	for _, bc := range p.idle {
+		if now.Sub(bc.lastUsed) >= interval {
+			stale = append(stale, bc)
+		} else {
+			idle = append(idle, bc)
+		}
+	}
+	p.idle = idle
+	p.mu.Unlock()
+
+	for _, bc := range stale {
+		if err := bc.Ping(); err != nil {
+			logrus.WithError(err).WithField("backend", p.backend.Name()).Warn("idle backend connection failed its keepalive ping; closing it")
+			metrics.BackendConnsDiscarded.WithLabelValues("keepalive").Inc()
+			bc.Close()
+			continue
+		}
+		bc.lastUsed = time.Now()
+		p.putIdle(bc)
+	}
+}
+
+// Idle reports the number of idle connections held by the pool.
+func (p *Pool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// InUse reports the number of connections borrowed from the pool.
+func (p *Pool) InUse() int { return int(p.inUse.Load()) }
+
+// Close closes every idle connection.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, bc := range idle {
+		bc.Close()
+	}
+}
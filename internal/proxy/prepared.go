@@ -0,0 +1,421 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	COM_STMT_PREPARE = 0x16
+	COM_STMT_EXECUTE = 0x17
+	COM_STMT_CLOSE   = 0x19
+	COM_STMT_RESET   = 0x1A
+)
+
+// cursorTypeMask selects the cursor type in the flags of COM_STMT_EXECUTE.
+const cursorTypeMask = 0x0F
+
+// PreparedStatement is a statement a client prepared on its connection.
+type PreparedStatement struct {
+	ID      uint32
+	Query   *Query
+	Columns []ColumnDef
+
+	// backend runs statements the proxy does not answer itself. Such a
+	// statement is prepared on conn, the held connection to backend, as
+	// backendID; conn is nil once that connection is released, and the
+	// statement is prepared again on the next one before it executes.
+	backend   *Backend
+	conn      *BackendConn
+	backendID uint32
+
+	// longData is the parameter data sent with COM_STMT_SEND_LONG_DATA
+	// since the statement last executed, totalling longDataSize bytes.
+	// longDataErr fails the next execute when that data was rejected.
+	longData     []longDataChunk
+	longDataSize int64
+	longDataErr  error
+
+	// paramTypes are the parameter types last bound by an execute. Later
+	// executes may omit them, so they are kept to expand the statement for
+	// the SQL script and to bind them again on a backend connection the
+	// statement is prepared again on. typesSent reports whether the
+	// statement's backend connection has been sent them.
+	paramTypes []uint16
+	typesSent  bool
+}
+
+// errUnsupportedPS is returned for statements the proxy cannot prepare.
+var errUnsupportedPS = &SQLError{Code: 1295, SQLState: "HY000", Message: "This command is not supported in the prepared statement protocol yet"}
+
+// localResult returns the result set of a statement the proxy answers
+// itself, or nil.
+func (s *Server) localResult(q *Query) *ResultSet {
+	if rs := s.interceptStatus(q); rs != nil {
+		return rs
+	}
+	if s.pingQueries[pingKey(q)] {
+		return pingResult
+	}
+	return nil
+}
+
+// prepare handles COM_STMT_PREPARE. Statements without parameters that the
+// proxy answers itself are prepared locally, others on the backend. At most
+// Config.MaxPreparedStatements may be prepared at a time.
+func (c *Connection) prepare(query string) error {
+	if max := c.server.cfg.MaxPreparedStatements; max > 0 && len(c.stmts) >= max {
+		return &SQLError{Code: 1461, SQLState: "42000", Message: fmt.Sprintf("Can't create more than max_prepared_stmt_count statements (current value: %d)", max)}
+	}
+	q, class := c.server.parseQuery(c.rewriteQuery(query))
+	if err := c.checkStatementRules(q); err != nil {
+		return err
+	}
+	rs := c.server.localResult(q)
+	if rs == nil {
+		return c.prepareOnBackend(q, class)
+	}
+
+	stmt := c.addStatement(&PreparedStatement{Query: q, Columns: rs.Columns})
+
+	ok := []byte{0x00}
+	ok = binary.LittleEndian.AppendUint32(ok, stmt.ID)
+	ok = binary.LittleEndian.AppendUint16(ok, uint16(len(stmt.Columns)))
+	ok = binary.LittleEndian.AppendUint16(ok, 0) // parameters
+	ok = append(ok, 0)                           // filler
+	ok = binary.LittleEndian.AppendUint16(ok, 0) // warnings
+	if c.optionalMetadata() {
+		ok = append(ok, resultsetMetadataFull)
+	}
+	if err := c.writePacket(ok); err != nil {
+		return err
+	}
+	if len(stmt.Columns) == 0 {
+		return nil
+	}
+	for _, col := range stmt.Columns {
+		if err := c.writePacket(col.packet()); err != nil {
+			return err
+		}
+	}
+	return c.writePacket(NewEOFPacket(0))
+}
+
+// addStatement registers stmt under a new id.
+func (c *Connection) addStatement(stmt *PreparedStatement) *PreparedStatement {
+	c.lastStmtID++
+	stmt.ID = c.lastStmtID
+	if c.stmts == nil {
+		c.stmts = make(map[uint32]*PreparedStatement)
+	}
+	c.stmts[stmt.ID] = stmt
+	return stmt
+}
+
+// prepareOnBackend prepares q on the backend serving the client's tenant or
+// current database and relays the backend's response with the statement id the client knows
+// it by. Binary rows bypass column masking and are encoded by column type,
+// so clients whose results are masked or retyped cannot prepare statements
+// on backends.
+func (c *Connection) prepareOnBackend(q *Query, class *queryClass) error {
+	if c.server.router == nil || c.mask != nil || c.retype != nil {
+		return errUnsupportedPS
+	}
+	if err := c.checkComplexity(q.SQL, class); err != nil {
+		return err
+	}
+	b, _, err := c.server.router.routeFor(c.tenant, c.database)
+	if err != nil && !c.pinned() {
+		return err
+	}
+	bc, err := c.acquire(b)
+	if err != nil {
+		return err
+	}
+	id, packets, err := bc.prepare(q.SQL)
+	c.dropPoisonedBackend(err)
+	if err != nil {
+		return err
+	}
+	stmt := c.addStatement(&PreparedStatement{Query: q, backend: bc.Backend(), conn: bc, backendID: id})
+
+	ok := append([]byte(nil), packets[0]...)
+	binary.LittleEndian.PutUint32(ok[1:], stmt.ID)
+	if len(ok) > 12 && !c.optionalMetadata() {
+		ok = ok[:12]
+	}
+	packets[0] = ok
+	for _, p := range packets {
+		if err := c.writePacket(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindStatement returns the held connection to the statement's backend with
+// the statement prepared on it, preparing it again if the connection it was
+// prepared on has been released.
+func (c *Connection) bindStatement(stmt *PreparedStatement) (*BackendConn, error) {
+	bc, err := c.acquire(stmt.backend)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.conn == bc {
+		return bc, nil
+	}
+	id, _, err := bc.prepare(stmt.Query.SQL)
+	c.dropPoisonedBackend(err)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.WithField("backend", bc.Backend().Name()).WithField("stmt_id", stmt.ID).Debug("prepared statement again on a new backend connection")
+	stmt.conn, stmt.backendID, stmt.typesSent = bc, id, false
+	return bc, nil
+}
+
+// unbindStatements forgets the backend statement ids of the held backend
+// connection when it is released.
+func (c *Connection) unbindStatements() {
+	for _, stmt := range c.stmts {
+		stmt.conn, stmt.backendID = nil, 0
+	}
+}
+
+// backendCommand returns the command in payload addressed to the statement
+// by its backend id.
+func backendCommand(cmd byte, data []byte, stmt *PreparedStatement) []byte {
+	payload := append([]byte{cmd}, data...)
+	binary.LittleEndian.PutUint32(payload[1:], stmt.backendID)
+	return payload
+}
+
+// prepare prepares query on the backend connection. It returns the
+// statement's id and the response to relay to the client: the
+// COM_STMT_PREPARE_OK followed by any parameter and column definitions.
+func (bc *BackendConn) prepare(query string) (uint32, [][]byte, error) {
+	bc.lastUsed = time.Now()
+	bc.dirty = true
+	if err := bc.writePacket(0, append([]byte{COM_STMT_PREPARE}, query...)); err != nil {
+		return 0, nil, err
+	}
+	pkt, err := bc.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	ok := pkt.Payload
+	switch {
+	case len(ok) > 0 && ok[0] == 0xFF:
+		sqlErr, err := ParseErrPacket(ok)
+		if err != nil {
+			bc.poison("protocol")
+			return 0, nil, err
+		}
+		return 0, nil, sqlErr
+	case len(ok) < 12 || ok[0] != 0x00:
+		bc.poison("desync")
+		return 0, nil, fmt.Errorf("%w: backend %s (thread %d) answered COM_STMT_PREPARE with %x", ErrBackendDesync, bc.backend.cfg.Name, bc.threadID, ok)
+	}
+	id := binary.LittleEndian.Uint32(ok[1:])
+	columns := int(binary.LittleEndian.Uint16(ok[5:]))
+	params := int(binary.LittleEndian.Uint16(ok[7:]))
+	if bc.optionalMetadata && len(ok) > 12 && ok[12] != resultsetMetadataFull {
+		// No definitions follow.
+		columns, params = 0, 0
+	}
+
+	packets := [][]byte{ok}
+	for _, n := range []int{params, columns} {
+		if n == 0 {
+			continue
+		}
+		// The definitions and their terminating EOF.
+		for i := 0; i <= n; i++ {
+			pkt, err := bc.readPacket()
+			if err != nil {
+				return 0, nil, err
+			}
+			if i == n && !isEOFPacket(pkt.Payload) {
+				bc.poison("desync")
+				return 0, nil, fmt.Errorf("%w: backend %s (thread %d) sent %x instead of EOF after statement definitions", ErrBackendDesync, bc.backend.cfg.Name, bc.threadID, pkt.Payload)
+			}
+			packets = append(packets, pkt.Payload)
+		}
+	}
+	return id, packets, nil
+}
+
+// paramCount is the number of parameters of the statement.
+func (stmt *PreparedStatement) paramCount() int {
+	n := 0
+	for _, tok := range stmt.Query.Tokens {
+		if tok.Kind == TokenPlaceholder {
+			n++
+		}
+	}
+	return n
+}
+
+// paramFlagOffset is the offset in a COM_STMT_EXECUTE, after the statement
+// id, flags, iteration count and null bitmap, of the new_params_bound_flag
+// for a statement with n parameters. The parameter types follow it when it
+// is 1.
+func paramFlagOffset(n int) int {
+	return 9 + (n+7)/8
+}
+
+// bindParams records the parameter types bound by a COM_STMT_EXECUTE for
+// stmt, if it binds them.
+func (stmt *PreparedStatement) bindParams(data []byte) {
+	n := stmt.paramCount()
+	flag := paramFlagOffset(n)
+	if n == 0 || len(data) < flag+1+2*n || data[flag] != 1 {
+		return
+	}
+	stmt.paramTypes = make([]uint16, n)
+	for i := range stmt.paramTypes {
+		stmt.paramTypes[i] = binary.LittleEndian.Uint16(data[flag+1+2*i:])
+	}
+}
+
+// withParamTypes returns a COM_STMT_EXECUTE for stmt that binds the
+// parameter types: data itself if it does, or else data with the types last
+// bound inserted, for a backend connection the statement was prepared
+// again on that has never been given them.
+func (stmt *PreparedStatement) withParamTypes(data []byte) []byte {
+	n := stmt.paramCount()
+	flag := paramFlagOffset(n)
+	if n == 0 || len(data) <= flag || data[flag] == 1 || len(stmt.paramTypes) != n {
+		return data
+	}
+	bound := append(append([]byte(nil), data[:flag]...), 1)
+	for _, typ := range stmt.paramTypes {
+		bound = binary.LittleEndian.AppendUint16(bound, typ)
+	}
+	return append(bound, data[flag+1:]...)
+}
+
+// statement returns the prepared statement whose id starts data.
+func (c *Connection) statement(data []byte, command string) (*PreparedStatement, error) {
+	if len(data) < 4 {
+		return nil, ErrInvalidPacket
+	}
+	id := binary.LittleEndian.Uint32(data)
+	stmt, ok := c.stmts[id]
+	if !ok {
+		return nil, &SQLError{Code: 1243, SQLState: "HY000", Message: fmt.Sprintf("Unknown prepared statement handler (%d) given to %s", id, command)}
+	}
+	return stmt, nil
+}
+
+// executeStatement handles COM_STMT_EXECUTE, answering with a binary
+// protocol result set.
+func (c *Connection) executeStatement(data []byte) error {
+	stmt, err := c.statement(data, "mysqld_stmt_execute")
+	if err != nil {
+		return err
+	}
+	if err := stmt.longDataErr; err != nil {
+		stmt.clearLongData()
+		return err
+	}
+	if stmt.backend != nil {
+		if len(data) > 4 && data[4]&cursorTypeMask != 0 {
+			// The rows of a cursor would be fetched with COM_STMT_FETCH,
+			// which the proxy does not relay.
+			return &SQLError{Code: 1295, SQLState: "HY000", Message: "Cursors are not supported by metal-db-proxy"}
+		}
+		if err := c.checkTransactionBudget(); err != nil {
+			stmt.clearLongData()
+			return err
+		}
+		stmt.bindParams(data)
+		var args []string
+		var argsErr error
+		if c.server.script != nil {
+			// Decoded before the long data is sent and dropped.
+			args, argsErr = stmt.executeArgs(data)
+		}
+		database := c.database
+		bc, err := c.bindStatement(stmt)
+		if err != nil {
+			return err
+		}
+		err = stmt.flushLongData(bc)
+		c.dropPoisonedBackend(err)
+		if err != nil {
+			return err
+		}
+		if !stmt.typesSent {
+			data = stmt.withParamTypes(data)
+			stmt.typesSent = true
+		}
+		run := func() (*ExecResult, error) { return c.relay(bc, backendCommand(COM_STMT_EXECUTE, data, stmt), nil) }
+		var res *ExecResult
+		if tables, ok := c.writtenTables(stmt.Query); ok {
+			res, err = c.forwardWrite(tables, run)
+		} else {
+			res, err = run()
+		}
+		if err == nil && res.Err == nil {
+			if argsErr != nil {
+				c.logger.WithError(argsErr).WithField("fingerprint", stmt.Query.Normalized()).Warn("statement left out of the SQL script")
+			} else {
+				c.recordScript(database, stmt.Query, args)
+			}
+		}
+		return err
+	}
+	// Statements answered locally have no parameters to send data for.
+	stmt.clearLongData()
+	rs := c.server.localResult(stmt.Query)
+	if rs == nil {
+		return errUnsupportedPS
+	}
+	packets, err := rs.BinaryPacketsFor(c.capabilities)
+	if err != nil {
+		return err
+	}
+	for _, p := range c.withMetadataFlag(packets) {
+		if err := c.writePacket(p); err != nil {
+			return err
+		}
+	}
+	c.recordScript(c.database, stmt.Query, nil)
+	return nil
+}
+
+// resetStatement handles COM_STMT_RESET.
+func (c *Connection) resetStatement(data []byte) ([]byte, error) {
+	stmt, err := c.statement(data, "mysqld_stmt_reset")
+	if err != nil {
+		return nil, err
+	}
+	stmt.clearLongData()
+	if stmt.conn == nil {
+		// Nothing is pending on a statement not prepared on a backend
+		// connection.
+		return NewOKPacket(0, 0, 0), nil
+	}
+	_, err = c.relay(stmt.conn, backendCommand(COM_STMT_RESET, data, stmt), nil)
+	return nil, err
+}
+
+// closeStatement handles COM_STMT_CLOSE, which has no response.
+func (c *Connection) closeStatement(data []byte) {
+	if len(data) < 4 {
+		return
+	}
+	id := binary.LittleEndian.Uint32(data)
+	stmt, ok := c.stmts[id]
+	if !ok {
+		return
+	}
+	delete(c.stmts, id)
+	if stmt.conn != nil {
+		// A failed write poisons the connection, which is enough.
+		stmt.conn.writePacket(0, backendCommand(COM_STMT_CLOSE, data[:4], stmt))
+		c.dropPoisonedBackend(nil)
+	}
+}
@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// stmtBackend is a fake backend that prepares statements per connection and
+// answers executes with its name, failing those of statements the
+// connection did not prepare. It records the executes and the long data
+// sent for its statements.
+type stmtBackend struct {
+	*fakeBackend
+	prepares, executes atomic.Int32
+
+	mu       sync.Mutex
+	prepared map[net.Conn]map[uint32]bool
+	lastID   uint32
+	execs    [][]byte
+	longData []byte
+}
+
+func newStmtBackend(t *testing.T, name string) *stmtBackend {
+	sb := &stmtBackend{prepared: make(map[net.Conn]map[uint32]bool)}
+	column := ColumnDef{Name: "backend"}
+	sb.fakeBackend = newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		switch payload[0] {
+		case COM_STMT_PREPARE:
+			sb.prepares.Add(1)
+			sb.mu.Lock()
+			sb.lastID++
+			id := sb.lastID
+			if sb.prepared[conn] == nil {
+				sb.prepared[conn] = make(map[uint32]bool)
+			}
+			sb.prepared[conn][id] = true
+			sb.mu.Unlock()
+			ok := binary.LittleEndian.AppendUint32([]byte{0x00}, id)
+			ok = append(ok, 1, 0, 0, 0, 0, 0, 0, resultsetMetadataFull)
+			WritePacket(conn, 1, ok)
+			WritePacket(conn, 2, column.packet())
+			WritePacket(conn, 3, NewEOFPacket(0))
+		case COM_STMT_EXECUTE:
+			sb.executes.Add(1)
+			sb.mu.Lock()
+			ok := sb.prepared[conn][binary.LittleEndian.Uint32(payload[1:])]
+			sb.execs = append(sb.execs, payload)
+			sb.mu.Unlock()
+			if !ok {
+				WritePacket(conn, 1, NewErrPacket(1243, "HY000", "Unknown prepared statement handler"))
+				return
+			}
+			rs := &ResultSet{Columns: []ColumnDef{column}, Rows: [][]string{{name}}}
+			packets, _ := rs.BinaryPackets()
+			packets[0] = append(packets[0], resultsetMetadataFull)
+			for i, p := range packets {
+				WritePacket(conn, uint8(i+1), p)
+			}
+		case COM_STMT_SEND_LONG_DATA:
+			sb.mu.Lock()
+			if sb.prepared[conn][binary.LittleEndian.Uint32(payload[1:])] {
+				sb.longData = append(sb.longData, payload[5:]...)
+			}
+			sb.mu.Unlock()
+		case COM_STMT_CLOSE:
+			sb.mu.Lock()
+			delete(sb.prepared[conn], binary.LittleEndian.Uint32(payload[1:]))
+			sb.mu.Unlock()
+		default:
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+		}
+	})
+	return sb
+}
+
+func TestPreparedStatementBackendAffinity(t *testing.T) {
+	primary := newStmtBackend(t, "primary")
+	analytics := newStmtBackend(t, "analytics")
+	primaryCfg, analyticsCfg := primary.config(), analytics.config()
+	primaryCfg.Name, analyticsCfg.Name = "primary", "analytics"
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{primaryCfg, analyticsCfg},
+		DatabaseRoutes: map[string]string{"analytics": "analytics"},
+	})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_STMT_PREPARE}, "SELECT name FROM users WHERE id = 1"...)); err != nil {
+		t.Fatalf("write prepare: %v", err)
+	}
+	ok := mustReadPacket(t, client).Payload
+	if ok[0] != 0x00 || binary.LittleEndian.Uint32(ok[1:]) != 1 {
+		t.Fatalf("expected COM_STMT_PREPARE_OK for statement 1, got %x", ok)
+	}
+	mustReadPacket(t, client) // column definition
+	mustReadPacket(t, client) // EOF
+
+	execute := func() {
+		t.Helper()
+		exec := binary.LittleEndian.AppendUint32([]byte{COM_STMT_EXECUTE}, 1)
+		exec = append(exec, 0, 1, 0, 0, 0)
+		if err := WritePacket(client, 0, exec); err != nil {
+			t.Fatalf("write execute: %v", err)
+		}
+		if p := mustReadPacket(t, client).Payload; p[0] != 1 {
+			t.Fatalf("expected a result set, got %x", p)
+		}
+		mustReadPacket(t, client) // column definition
+		mustReadPacket(t, client) // EOF
+		if row := mustReadPacket(t, client).Payload; !bytes.HasSuffix(row, []byte("primary")) {
+			t.Fatalf("execute answered by %q, want the backend that prepared it", row)
+		}
+		mustReadPacket(t, client) // EOF
+	}
+	execute()
+
+	// A query routed to another backend releases the connection the
+	// statement was prepared on; the next execute prepares it again on the
+	// backend it belongs to.
+	if err := WritePacket(client, 0, append([]byte{COM_INIT_DB}, "analytics"...)); err != nil {
+		t.Fatalf("write init db: %v", err)
+	}
+	mustReadPacket(t, client)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if p := mustReadPacket(t, client).Payload; p[0] != 0x00 {
+		t.Fatalf("query: %x", p)
+	}
+	execute()
+
+	if p, e := primary.prepares.Load(), primary.executes.Load(); p != 2 || e != 2 {
+		t.Fatalf("primary saw %d prepares and %d executes, want 2 and 2", p, e)
+	}
+	if p, e := analytics.prepares.Load(), analytics.executes.Load(); p != 0 || e != 0 {
+		t.Fatalf("analytics saw %d prepares and %d executes, want none", p, e)
+	}
+}
+
+func TestPreparedStatementRebindsParamTypes(t *testing.T) {
+	primary := newStmtBackend(t, "primary")
+	analytics := newStmtBackend(t, "analytics")
+	primaryCfg, analyticsCfg := primary.config(), analytics.config()
+	primaryCfg.Name, analyticsCfg.Name = "primary", "analytics"
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{primaryCfg, analyticsCfg},
+		DatabaseRoutes: map[string]string{"analytics": "analytics"},
+	})
+	client := dialProxy(t, srv)
+	command := func(cmd byte, data []byte) []byte {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{cmd}, data...)); err != nil {
+			t.Fatalf("write command: %v", err)
+		}
+		p := mustReadPacket(t, client).Payload
+		if p[0] == 1 {
+			for range 4 {
+				mustReadPacket(t, client) // column definition, EOF, row, EOF
+			}
+		}
+		return p
+	}
+	command(COM_STMT_PREPARE, []byte("SELECT name FROM users WHERE id = ?"))
+	mustReadPacket(t, client) // column definition
+	mustReadPacket(t, client) // EOF
+
+	value := binary.LittleEndian.AppendUint64(nil, 7)
+	execute := func(types ...byte) {
+		t.Helper()
+		exec := binary.LittleEndian.AppendUint32(nil, 1)
+		exec = append(exec, 0, 1, 0, 0, 0, 0) // flags, iteration count, null bitmap
+		if len(types) > 0 {
+			exec = append(append(exec, 1), types...)
+		} else {
+			exec = append(exec, 0)
+		}
+		if p := command(COM_STMT_EXECUTE, append(exec, value...)); p[0] != 1 {
+			t.Fatalf("expected a result set, got %x", p)
+		}
+	}
+	execute(TypeLongLong, 0)
+
+	// Once the statement's connection is released, the next execute omits
+	// the types, which the proxy binds again on the new connection.
+	command(COM_INIT_DB, []byte("analytics"))
+	command(COM_QUERY, []byte("DO 1"))
+	execute()
+
+	primary.mu.Lock()
+	defer primary.mu.Unlock()
+	if len(primary.execs) != 2 {
+		t.Fatalf("primary saw %d executes, want 2", len(primary.execs))
+	}
+	rebound := primary.execs[1][1+paramFlagOffset(1):]
+	if want := append([]byte{1, TypeLongLong, 0}, value...); !bytes.Equal(rebound, want) {
+		t.Fatalf("execute on the new connection bound %x, want %x", rebound, want)
+	}
+}
+
+func TestPreparedStatementLongData(t *testing.T) {
+	backend := newStmtBackend(t, "primary")
+	srv := newTestServer(t, Config{Backends: []BackendConfig{backend.config()}, MaxLongDataBytes: 16})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_STMT_PREPARE}, "INSERT INTO blobs (data) VALUES (?)"...)); err != nil {
+		t.Fatalf("write prepare: %v", err)
+	}
+	mustReadPacket(t, client) // COM_STMT_PREPARE_OK
+	mustReadPacket(t, client) // column definition
+	mustReadPacket(t, client) // EOF
+
+	sendLongData := func(data string) {
+		t.Helper()
+		payload := binary.LittleEndian.AppendUint32([]byte{COM_STMT_SEND_LONG_DATA}, 1)
+		payload = binary.LittleEndian.AppendUint16(payload, 0)
+		if err := WritePacket(client, 0, append(payload, data...)); err != nil {
+			t.Fatalf("write long data: %v", err)
+		}
+	}
+	execute := func() []byte {
+		t.Helper()
+		exec := binary.LittleEndian.AppendUint32([]byte{COM_STMT_EXECUTE}, 1)
+		exec = append(exec, 0, 1, 0, 0, 0)
+		if err := WritePacket(client, 0, exec); err != nil {
+			t.Fatalf("write execute: %v", err)
+		}
+		first := mustReadPacket(t, client).Payload
+		if first[0] != 0xFF {
+			mustReadPacket(t, client) // column definition
+			mustReadPacket(t, client) // EOF
+			mustReadPacket(t, client) // row
+			mustReadPacket(t, client) // EOF
+		}
+		return first
+	}
+
+	// The chunks are forwarded, in order, with the execute.
+	sendLongData("hello, ")
+	sendLongData("world")
+	if p := execute(); p[0] != 1 {
+		t.Fatalf("expected a result set, got %x", p)
+	}
+	backend.mu.Lock()
+	got := string(backend.longData)
+	backend.longData = nil
+	backend.mu.Unlock()
+	if want := "\x00\x00hello, \x00\x00world"; got != want {
+		t.Fatalf("backend received long data %q, want %q", got, want)
+	}
+
+	// Data beyond the limit fails the next execute without reaching the
+	// backend, and is discarded.
+	sendLongData("0123456789")
+	sendLongData("0123456789")
+	sqlErr, err := ParseErrPacket(execute())
+	if err != nil || sqlErr.Code != 1153 {
+		t.Fatalf("got %v, %v, want error 1153", sqlErr, err)
+	}
+	if p := execute(); p[0] != 1 {
+		t.Fatalf("expected a result set after the rejected long data, got %x", p)
+	}
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if len(backend.longData) != 0 || backend.executes.Load() != 2 {
+		t.Fatalf("backend received %q of long data in %d executes, want none in 2", backend.longData, backend.executes.Load())
+	}
+}
+
+func TestPreparedStatementParameters(t *testing.T) {
+	executed := make(chan []byte, 1)
+	param := ColumnDef{Name: "?", Type: TypeVarString}
+	column := ColumnDef{Name: "name", Type: TypeVarString}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		switch payload[0] {
+		case COM_STMT_PREPARE:
+			ok := binary.LittleEndian.AppendUint32([]byte{0x00}, 42)
+			ok = append(ok, 1, 0, 2, 0, 0, 0, 0, resultsetMetadataFull)
+			packets := [][]byte{ok, param.packet(), param.packet(), NewEOFPacket(0), column.packet(), NewEOFPacket(0)}
+			for i, p := range packets {
+				WritePacket(conn, uint8(i+1), p)
+			}
+		case COM_STMT_EXECUTE:
+			executed <- payload
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+		}
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_STMT_PREPARE}, "SELECT name FROM t WHERE a = ? AND b = ?"...)); err != nil {
+		t.Fatalf("write prepare: %v", err)
+	}
+	ok := mustReadPacket(t, client).Payload
+	if len(ok) < 12 || ok[0] != 0x00 {
+		t.Fatalf("COM_STMT_PREPARE_OK = %x", ok)
+	}
+	id := binary.LittleEndian.Uint32(ok[1:])
+	columns, params := binary.LittleEndian.Uint16(ok[5:]), binary.LittleEndian.Uint16(ok[7:])
+	if id != 1 || columns != 1 || params != 2 {
+		t.Fatalf("prepared statement %d with %d columns and %d parameters, want 1, 1 and 2", id, columns, params)
+	}
+	// The parameter definitions, then the column definitions, each ended
+	// by an EOF.
+	for i, want := range []string{"?", "?", "", "name", ""} {
+		p := mustReadPacket(t, client).Payload
+		if want == "" {
+			if !isEOFPacket(p) {
+				t.Fatalf("packet %d = %x, want EOF", i, p)
+			}
+			continue
+		}
+		if def, err := parseColumnDef(p); err != nil || def.Name != want {
+			t.Fatalf("packet %d = %+v, %v, want definition %q", i, def, err, want)
+		}
+	}
+
+	// The first parameter is NULL, the second the string "x"; the execute
+	// reaches the backend addressed to its statement id, bindings intact.
+	exec := binary.LittleEndian.AppendUint32([]byte{COM_STMT_EXECUTE}, id)
+	exec = append(exec, 0, 1, 0, 0, 0)
+	bindings := []byte{0x01, 1, TypeVarString, 0, TypeVarString, 0, 1, 'x'}
+	if err := WritePacket(client, 0, append(exec, bindings...)); err != nil {
+		t.Fatalf("write execute: %v", err)
+	}
+	if p := mustReadPacket(t, client).Payload; p[0] != 0x00 {
+		t.Fatalf("execute answered with %x, want OK", p)
+	}
+	got := <-executed
+	if backendID := binary.LittleEndian.Uint32(got[1:]); backendID != 42 || !bytes.Equal(got[10:], bindings) {
+		t.Fatalf("backend received statement %d with bindings %x, want 42 and %x", backendID, got[10:], bindings)
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errProxyCommandDenied is returned for PROXY commands from anyone but the
+// admin user.
+var errProxyCommandDenied = &SQLError{Code: 1227, SQLState: "42000", Message: "Access denied; you need the proxy admin user for this operation"}
+
+// isProxyCommand reports whether q is in the PROXY command namespace.
+func isProxyCommand(q *Query) bool {
+	return len(q.Tokens) > 0 && q.Tokens[0].IsWord("PROXY")
+}
+
+// proxyCommand runs a PROXY command, which administers the proxy itself:
+//
+//	PROXY SHOW CONNECTIONS
+//	PROXY SHOW BACKENDS
+//	PROXY KILL id
+//	PROXY DRAIN BACKEND name
+//	PROXY RESUME BACKEND name
+//	PROXY RELOAD
+//
+// Only Config.AdminUser may run them.
+func (c *Connection) proxyCommand(q *Query) ([]byte, error) {
+	c.mu.Lock()
+	user := c.username
+	c.mu.Unlock()
+	if admin := c.server.cfg.AdminUser; admin == "" || user != admin {
+		c.logger.WithField("user", user).Warn("PROXY command denied")
+		return nil, errProxyCommandDenied
+	}
+
+	toks := q.Tokens[1:]
+	var words []string
+	for _, tok := range toks {
+		words = append(words, tok.Value)
+	}
+	verb := strings.ToUpper(strings.Join(words, " "))
+	log := c.logger.WithField("user", user).WithField("command", q.Text())
+	switch {
+	case verb == "SHOW CONNECTIONS":
+		return nil, c.writeResultSet(connectionsResult(c.server.ConnectionList()))
+	case verb == "SHOW BACKENDS":
+		return nil, c.writeResultSet(backendsResult(c.server.BackendStatus()))
+	case len(toks) == 2 && toks[0].IsWord("KILL"):
+		id, err := strconv.ParseUint(words[1], 10, 32)
+		if err != nil {
+			break
+		}
+		target, ok := c.server.conns.get(uint32(id))
+		if !ok {
+			return nil, &SQLError{Code: 1094, SQLState: "HY000", Message: "Unknown thread id: " + words[1]}
+		}
+		log.Info("killing client connection")
+		target.kill()
+		return NewOKPacket(0, 0, 0), nil
+	case len(toks) >= 3 && toks[1].IsWord("BACKEND") && (toks[0].IsWord("DRAIN") || toks[0].IsWord("RESUME")):
+		// Backend names such as db-1:3306 span several tokens.
+		name := toks[2].Value
+		if len(toks) > 3 {
+			last := toks[len(toks)-1]
+			name = q.SQL[toks[2].Pos : last.Pos+len(last.Text)]
+		}
+		if err := c.server.DrainBackend(name, toks[0].IsWord("DRAIN")); err != nil {
+			return nil, &SQLError{Code: 1105, SQLState: "HY000", Message: err.Error()}
+		}
+		log.Info("backend drain state changed by PROXY command")
+		return NewOKPacket(0, 0, 0), nil
+	case verb == "RELOAD":
+		// Configuration is read once at startup.
+		return nil, &SQLError{Code: 1235, SQLState: "42000", Message: "This proxy doesn't support PROXY RELOAD; restart it to apply new configuration"}
+	}
+	return nil, &SQLError{Code: 1064, SQLState: "42000", Message: "Unknown PROXY command: " + q.Text()}
+}
+
+func connectionsResult(conns []ConnectionInfo) *ResultSet {
+	rs := &ResultSet{Columns: []ColumnDef{
+		{Name: "Id", Type: TypeLongLong, Charset: CharsetBinary, Length: 21},
+		{Name: "User"},
+		{Name: "Host"},
+		{Name: "db"},
+		{Name: "Time", Type: TypeLongLong, Charset: CharsetBinary, Length: 21},
+		{Name: "Tag"},
+	}}
+	for _, info := range conns {
+		rs.Rows = append(rs.Rows, []string{
+			strconv.FormatUint(uint64(info.ID), 10),
+			info.User,
+			info.Remote,
+			info.Database,
+			strconv.FormatInt(int64(time.Since(info.Connected).Seconds()), 10),
+			info.Tag,
+		})
+	}
+	return rs
+}
+
+func backendsResult(backends []BackendStatus) *ResultSet {
+	rs := &ResultSet{Columns: []ColumnDef{
+		{Name: "Name"},
+		{Name: "Addr"},
+		{Name: "Healthy"},
+		{Name: "Draining"},
+		{Name: "Active", Type: TypeLongLong, Charset: CharsetBinary, Length: 21},
+		{Name: "Idle", Type: TypeLongLong, Charset: CharsetBinary, Length: 21},
+	}}
+	for _, b := range backends {
+		rs.Rows = append(rs.Rows, []string{
+			b.Name,
+			b.Addr,
+			strconv.FormatBool(b.Healthy),
+			strconv.FormatBool(b.Draining),
+			strconv.Itoa(b.Active),
+			strconv.Itoa(b.Idle),
+		})
+	}
+	return rs
+}
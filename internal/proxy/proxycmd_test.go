@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProxyCommands(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	backend := fb.config()
+	backend.Name = "primary-1"
+	passwords := authFunc(func(string) (string, error) { return "password", nil })
+	srv := newTestServer(t, Config{Backends: []BackendConfig{backend}, Auth: passwords, AdminUser: "dba"})
+	admin := dialProxyAs(t, srv, "dba")
+	app := dialProxyAs(t, srv, "app")
+
+	query := func(conn net.Conn, sql string) *Packet {
+		t.Helper()
+		if err := WritePacket(conn, 0, append([]byte{COM_QUERY}, sql...)); err != nil {
+			t.Fatalf("write %q: %v", sql, err)
+		}
+		return mustReadPacket(t, conn)
+	}
+	expectErr := func(pkt *Packet, code uint16) {
+		t.Helper()
+		sqlErr, err := ParseErrPacket(pkt.Payload)
+		if err != nil || sqlErr.Code != code {
+			t.Fatalf("got %v, %v, want error %d", sqlErr, err, code)
+		}
+	}
+
+	// Only the admin user may run PROXY commands.
+	expectErr(query(app, "PROXY SHOW CONNECTIONS"), 1227)
+	expectErr(query(app, "PROXY DRAIN BACKEND primary-1"), 1227)
+	if srv.BackendStatus()[0].Draining {
+		t.Fatalf("a denied PROXY command drained the backend")
+	}
+
+	if err := WritePacket(admin, 0, append([]byte{COM_QUERY}, "proxy show connections"...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	names, rows := readTestResultSet(t, admin)
+	if len(names) != 6 || names[0] != "Id" || len(rows) != 2 || rows[0][1] != "dba" || rows[1][1] != "app" {
+		t.Fatalf("PROXY SHOW CONNECTIONS = %q %q", names, rows)
+	}
+
+	if pkt := query(admin, "PROXY DRAIN BACKEND primary-1"); pkt.Payload[0] != 0x00 {
+		t.Fatalf("PROXY DRAIN BACKEND: %x", pkt.Payload)
+	}
+	if !srv.BackendStatus()[0].Draining {
+		t.Fatalf("backend not draining")
+	}
+	expectErr(query(admin, "PROXY DRAIN BACKEND replica"), 1105)
+	expectErr(query(admin, "PROXY RELOAD"), 1235)
+	expectErr(query(admin, "PROXY FROBNICATE"), 1064)
+
+	expectErr(query(admin, "PROXY KILL 999999"), 1094)
+	if pkt := query(admin, "PROXY KILL "+rows[1][0]); pkt.Payload[0] != 0x00 {
+		t.Fatalf("PROXY KILL: %x", pkt.Payload)
+	}
+	if _, err := ReadPacket(app); err == nil {
+		t.Fatalf("killed client is still connected")
+	}
+}
+
+func TestAdminUserNeedsPasswordChecks(t *testing.T) {
+	for _, auth := range []AuthProvider{nil, StaticAuth("secret")} {
+		if _, err := NewServer(Config{Auth: auth, AdminUser: "dba"}); err == nil {
+			t.Fatalf("accepted an admin user with Auth %v, which lets anyone log in as them", auth)
+		}
+	}
+}
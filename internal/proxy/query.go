@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// StatementType classifies what a query does.
+type StatementType string
+
+const (
+	StmtOther    StatementType = "other"
+	StmtSelect   StatementType = "select"
+	StmtInsert   StatementType = "insert"
+	StmtReplace  StatementType = "replace"
+	StmtUpdate   StatementType = "update"
+	StmtDelete   StatementType = "delete"
+	StmtDDL      StatementType = "ddl"
+	StmtSet      StatementType = "set"
+	StmtUse      StatementType = "use"
+	StmtShow     StatementType = "show"
+	StmtExplain  StatementType = "explain"
+	StmtBegin    StatementType = "begin"
+	StmtCommit   StatementType = "commit"
+	StmtRollback StatementType = "rollback"
+	// StmtSavepoint is SAVEPOINT, ROLLBACK TO SAVEPOINT or RELEASE
+	// SAVEPOINT: statements inside a transaction, not boundaries of one.
+	StmtSavepoint StatementType = "savepoint"
+	StmtCall      StatementType = "call"
+)
+
+// Query is the lexical analysis of a statement shared by every feature that
+// inspects queries, so they agree on what a query is and are not fooled by
+// keywords inside literals or comments.
+type Query struct {
+	SQL string
+	// Tokens are the statement's tokens without comments or a trailing
+	// semicolon.
+	Tokens []Token
+	// Comments are the statement's comments in order of appearance.
+	Comments []Token
+	Type     StatementType
+	// Tables are the tables the statement references, as written
+	// (db.table when qualified), without duplicates.
+	Tables []string
+}
+
+// ParseQuery tokenizes and classifies sql.
+func ParseQuery(sql string) *Query {
+	q := tokenizeQuery(sql)
+	q.Type = classify(q.Tokens)
+	q.Tables = referencedTables(q.Tokens)
+	return q
+}
+
+// tokenizeQuery is ParseQuery without the classification.
+func tokenizeQuery(sql string) *Query {
+	q := &Query{SQL: sql}
+	for _, tok := range Tokenize(sql) {
+		if tok.Kind == TokenComment {
+			q.Comments = append(q.Comments, tok)
+		} else {
+			q.Tokens = append(q.Tokens, tok)
+		}
+	}
+	for len(q.Tokens) > 0 && q.Tokens[len(q.Tokens)-1].IsPunct(";") {
+		q.Tokens = q.Tokens[:len(q.Tokens)-1]
+	}
+	return q
+}
+
+// MultiStatement reports whether q is several statements separated by
+// semicolons. CREATE statements are never reported: the body of a stored
+// program contains semicolons of its own.
+func (q *Query) MultiStatement() bool {
+	if len(q.Tokens) == 0 || q.Tokens[0].IsWord("CREATE") {
+		return false
+	}
+	for _, tok := range q.Tokens {
+		if tok.IsPunct(";") {
+			return true
+		}
+	}
+	return false
+}
+
+var statementKeywords = map[string]StatementType{
+	"SELECT":    StmtSelect,
+	"TABLE":     StmtSelect,
+	"VALUES":    StmtSelect,
+	"INSERT":    StmtInsert,
+	"REPLACE":   StmtReplace,
+	"UPDATE":    StmtUpdate,
+	"DELETE":    StmtDelete,
+	"CREATE":    StmtDDL,
+	"ALTER":     StmtDDL,
+	"DROP":      StmtDDL,
+	"TRUNCATE":  StmtDDL,
+	"RENAME":    StmtDDL,
+	"SET":       StmtSet,
+	"USE":       StmtUse,
+	"SHOW":      StmtShow,
+	"BEGIN":     StmtBegin,
+	"START":     StmtBegin,
+	"COMMIT":    StmtCommit,
+	"ROLLBACK":  StmtRollback,
+	"SAVEPOINT": StmtSavepoint,
+	"RELEASE":   StmtSavepoint,
+	"CALL":      StmtCall,
+}
+
+func classify(tokens []Token) StatementType {
+	i := 0
+	for i < len(tokens) && tokens[i].IsPunct("(") {
+		i++
+	}
+	if i >= len(tokens) || tokens[i].Kind != TokenWord {
+		return StmtOther
+	}
+
+	switch kw := strings.ToUpper(tokens[i].Text); kw {
+	case "WITH":
+		// The statement kind follows the common table expressions.
+		depth := 0
+		for _, tok := range tokens[i+1:] {
+			switch {
+			case tok.IsPunct("("):
+				depth++
+			case tok.IsPunct(")"):
+				depth--
+			case depth == 0 && tok.Kind == TokenWord:
+				switch t := statementKeywords[strings.ToUpper(tok.Text)]; t {
+				case StmtSelect, StmtInsert, StmtReplace, StmtUpdate, StmtDelete:
+					return t
+				}
+			}
+		}
+		return StmtOther
+	case "EXPLAIN", "DESCRIBE", "DESC":
+		if i+1 < len(tokens) && tokens[i+1].Kind == TokenWord {
+			switch strings.ToUpper(tokens[i+1].Text) {
+			case "SELECT", "INSERT", "REPLACE", "UPDATE", "DELETE", "TABLE", "WITH", "FORMAT", "ANALYZE", "FOR":
+				return StmtExplain
+			}
+		}
+		if kw == "EXPLAIN" {
+			return StmtExplain
+		}
+		return StmtShow
+	case "START":
+		if i+1 < len(tokens) && tokens[i+1].IsWord("TRANSACTION") {
+			return StmtBegin
+		}
+		return StmtOther
+	case "ROLLBACK":
+		// ROLLBACK [WORK] TO [SAVEPOINT] sp ends no transaction.
+		for _, tok := range tokens[i+1:] {
+			if tok.IsWord("TO") {
+				return StmtSavepoint
+			}
+		}
+		return StmtRollback
+	default:
+		if t, ok := statementKeywords[kw]; ok {
+			return t
+		}
+		return StmtOther
+	}
+}
+
+// tableListEnd are the words that end a table reference list; any other
+// word directly after a table name is taken as its alias.
+var tableListEnd = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true,
+	"CROSS": true, "NATURAL": true, "STRAIGHT_JOIN": true, "OUTER": true,
+	"ON": true, "USING": true, "GROUP": true, "ORDER": true, "LIMIT": true,
+	"HAVING": true, "UNION": true, "EXCEPT": true, "INTERSECT": true,
+	"FOR": true, "LOCK": true, "SET": true, "VALUES": true, "VALUE": true,
+	"SELECT": true, "WINDOW": true, "PARTITION": true, "USE": true,
+	"IGNORE": true, "FORCE": true, "INTO": true, "FROM": true, "AS": true,
+	"WITH": true, "LIKE": true, "READ": true, "WRITE": true,
+}
+
+func referencedTables(tokens []Token) []string {
+	var tables []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			tables = append(tables, name)
+		}
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.Kind != TokenWord {
+			continue
+		}
+		switch strings.ToUpper(tok.Text) {
+		case "FROM", "JOIN", "INTO", "UPDATE", "TABLE":
+		default:
+			continue
+		}
+		// A reference list: name [[AS] alias] [, name [[AS] alias]]...
+		j := i + 1
+		for j < len(tokens) && (tokens[j].IsWord("IF") || tokens[j].IsWord("NOT") || tokens[j].IsWord("EXISTS") ||
+			tokens[j].IsWord("LOW_PRIORITY") || tokens[j].IsWord("IGNORE") || tokens[j].IsWord("ONLY")) {
+			j++
+		}
+		for {
+			name, n := tableName(tokens[j:])
+			if n == 0 {
+				break
+			}
+			add(name)
+			j += n
+			if j < len(tokens) && tokens[j].IsWord("AS") {
+				j++
+			}
+			if j < len(tokens) && (tokens[j].Kind == TokenQuotedName ||
+				(tokens[j].Kind == TokenWord && !tableListEnd[strings.ToUpper(tokens[j].Text)])) {
+				j++
+			}
+			if j >= len(tokens) || !tokens[j].IsPunct(",") {
+				break
+			}
+			j++
+		}
+		i = j - 1
+	}
+	return tables
+}
+
+// tableName reads a possibly qualified table name from the start of tokens,
+// returning it and the number of tokens consumed.
+func tableName(tokens []Token) (string, int) {
+	isName := func(i int) bool {
+		return i < len(tokens) && (tokens[i].Kind == TokenQuotedName ||
+			(tokens[i].Kind == TokenWord && !tableListEnd[strings.ToUpper(tokens[i].Text)]))
+	}
+	if !isName(0) {
+		return "", 0
+	}
+	if len(tokens) > 2 && tokens[1].IsPunct(".") && isName(2) {
+		return tokens[0].Value + "." + tokens[2].Value, 3
+	}
+	return tokens[0].Value, 1
+}
+
+// Normalized returns the statement with comments removed, literals replaced
+// by ? and whitespace collapsed, so queries of the same shape compare equal.
+func (q *Query) Normalized() string {
+	return joinTokens(q.Tokens, true)
+}
+
+// Fingerprint returns query with its comments removed, literals replaced by
+// ? and whitespace collapsed. It is safe to log where the query itself,
+// whose literals may hold sensitive values, is not.
+func Fingerprint(query string) string {
+	return tokenizeQuery(query).Normalized()
+}
+
+// Text returns the statement with comments removed and whitespace collapsed.
+func (q *Query) Text() string {
+	return joinTokens(q.Tokens, false)
+}
+
+// WithoutComments returns the statement with its comments blanked out and
+// everything else, whitespace included, as written. Optimizer hints
+// (/*+ ... */) are kept because they change how the statement executes, as
+// is the code of executable comments (/*! ... */).
+func (q *Query) WithoutComments() string {
+	var b strings.Builder
+	pos := 0
+	for _, c := range q.Comments {
+		if strings.HasPrefix(c.Text, "/*+") || c.Pos < pos {
+			continue
+		}
+		b.WriteString(q.SQL[pos:c.Pos])
+		b.WriteByte(' ')
+		pos = c.Pos + len(c.Text)
+	}
+	b.WriteString(q.SQL[pos:])
+	return b.String()
+}
+
+func joinTokens(tokens []Token, hideLiterals bool) string {
+	var b strings.Builder
+	for i, tok := range tokens {
+		text := tok.Text
+		if hideLiterals && tok.isLiteral() {
+			text = "?"
+		}
+		if i > 0 && !tok.IsPunct(",") && !tok.IsPunct(")") && !tok.IsPunct(".") &&
+			!tokens[i-1].IsPunct("(") && !tokens[i-1].IsPunct(".") {
+			b.WriteByte(' ')
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+// parseUseStatement returns the database named by a `USE db` statement.
+func parseUseStatement(query string) (string, bool) {
+	q := ParseQuery(query)
+	if q.Type != StmtUse || len(q.Tokens) != 2 {
+		return "", false
+	}
+	db := q.Tokens[1].Value
+	return db, db != ""
+}
+
+// isShowDatabases reports whether query is `SHOW DATABASES` or its
+// `SHOW SCHEMAS` synonym.
+func isShowDatabases(query string) bool {
+	toks := ParseQuery(query).Tokens
+	return len(toks) == 2 && toks[0].IsWord("SHOW") && (toks[1].IsWord("DATABASES") || toks[1].IsWord("SCHEMAS"))
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// queryClass is what the proxy derives from the shape of a query, which is
+// the same for every query with the same fingerprint.
+type queryClass struct {
+	typ    StatementType
+	tables []string
+	// complexityReason and complexityErr are the verdict of the complexity
+	// limits; both are empty when the query is within them.
+	complexityReason string
+	complexityErr    error
+}
+
+// queryCache is a bounded LRU cache of query classes by fingerprint. It is
+// safe for concurrent use. The configuration its entries depend on is fixed
+// for the life of the Server that owns it.
+type queryCache struct {
+	max int
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type queryCacheEntry struct {
+	key   string
+	class *queryClass
+}
+
+// newQueryCache returns a cache of up to size classes, or nil when size is
+// not positive.
+func newQueryCache(size int) *queryCache {
+	if size <= 0 {
+		return nil
+	}
+	return &queryCache{max: size, order: list.New(), entries: make(map[string]*list.Element, size)}
+}
+
+func (c *queryCache) get(key string) (*queryClass, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*queryCacheEntry).class, true
+}
+
+func (c *queryCache) add(key string, class *queryClass) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*queryCacheEntry).class = class
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&queryCacheEntry{key: key, class: class})
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+// parseQuery tokenizes sql and classifies it, reusing the class of an
+// earlier query with the same fingerprint when the cache is enabled.
+func (s *Server) parseQuery(sql string) (*Query, *queryClass) {
+	q := tokenizeQuery(sql)
+	var key string
+	if s.queryCache != nil {
+		key = q.Normalized()
+		if class, ok := s.queryCache.get(key); ok {
+			metrics.QueryCacheLookups.WithLabelValues("hit").Inc()
+			q.Type, q.Tables = class.typ, class.tables
+			return q, class
+		}
+		metrics.QueryCacheLookups.WithLabelValues("miss").Inc()
+	}
+	q.Type = classify(q.Tokens)
+	q.Tables = referencedTables(q.Tokens)
+	class := &queryClass{typ: q.Type, tables: q.Tables}
+	if limits := s.cfg.Complexity; limits.enabled() {
+		class.complexityReason, class.complexityErr = limits.check(q)
+	}
+	if s.queryCache != nil {
+		s.queryCache.add(key, class)
+	}
+	return q, class
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestQueryCacheHits(t *testing.T) {
+	srv := newTestServer(t, Config{
+		QueryCacheSize: 8,
+		Complexity:     ComplexityLimits{MaxJoins: 1},
+	})
+	hits := metrics.QueryCacheLookups.WithLabelValues("hit")
+	misses := metrics.QueryCacheLookups.WithLabelValues("miss")
+	hitsBefore, missesBefore := testutil.ToFloat64(hits), testutil.ToFloat64(misses)
+
+	q, class := srv.parseQuery("SELECT name FROM users WHERE id = 1")
+	if q.Type != StmtSelect || len(q.Tables) != 1 || class.complexityErr != nil {
+		t.Fatalf("first parse: %+v %+v", q, class)
+	}
+	q, cached := srv.parseQuery("SELECT name FROM users WHERE id = 2")
+	if cached != class || q.Type != StmtSelect || q.Tables[0] != "users" {
+		t.Fatalf("same shape was classified again: %+v", q)
+	}
+	for _, sql := range []string{
+		"SELECT * FROM a JOIN b ON a.id = b.id JOIN c ON b.id = c.id WHERE a.x = 1",
+		"SELECT * FROM a JOIN b ON a.id = b.id JOIN c ON b.id = c.id WHERE a.x = 2",
+	} {
+		_, class := srv.parseQuery(sql)
+		if class.complexityReason != "joins" {
+			t.Fatalf("cached verdict lost: %+v", class)
+		}
+	}
+	if got := testutil.ToFloat64(hits) - hitsBefore; got != 2 {
+		t.Fatalf("hits = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(misses) - missesBefore; got != 2 {
+		t.Fatalf("misses = %v, want 2", got)
+	}
+}
+
+func TestQueryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newQueryCache(2)
+	a, b, d := &queryClass{typ: StmtSelect}, &queryClass{typ: StmtInsert}, &queryClass{typ: StmtDelete}
+	c.add("a", a)
+	c.add("b", b)
+	c.get("a")
+	c.add("d", d)
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("least recently used entry was kept")
+	}
+	if got, ok := c.get("a"); !ok || got != a {
+		t.Fatalf("recently used entry was evicted")
+	}
+	if got, ok := c.get("d"); !ok || got != d {
+		t.Fatalf("newest entry missing")
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// QueryLogConfig enables the query log: one JSON object per client query,
+// written to a rotating file separate from the operational log.
+type QueryLogConfig struct {
+	// Path is the file the log is written to.
+	Path string
+	// MaxSize is the size in bytes at which the file is rotated. Zero
+	// disables rotation.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept. Zero keeps them all.
+	MaxBackups int
+	// MaxAge removes rotated files older than this. Zero disables
+	// age-based removal.
+	MaxAge time.Duration
+}
+
+// QueryLogEntry is one line of the query log.
+type QueryLogEntry struct {
+	Time         time.Time `json:"ts"`
+	ConnectionID uint32    `json:"conn_id"`
+	User         string    `json:"user"`
+	Database     string    `json:"db"`
+	// Fingerprint is the query with its literals replaced by ?.
+	Fingerprint string  `json:"fingerprint"`
+	DurationMS  float64 `json:"duration_ms"`
+	// Rows is the number of rows returned, or affected by a statement
+	// without a result set.
+	Rows uint64 `json:"rows"`
+	// LastInsertID, Warnings and Status are reported by the backend's OK
+	// packet for statements without a result set.
+	LastInsertID uint64 `json:"last_insert_id,omitempty"`
+	Warnings     uint16 `json:"warnings,omitempty"`
+	Status       uint16 `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+	// Tags are the query's sqlcommenter tags.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Backend is the backend the query was sent to, if any, and Route why
+	// it was chosen: hint, tenant, database, default, drain_failover,
+	// transaction for a client held on the backend its transaction began
+	// on, or dedicated for a client with a backend connection of its own.
+	Backend string `json:"backend,omitempty"`
+	Route   string `json:"route,omitempty"`
+}
+
+// QueryLog writes QueryLogEntry values as JSON Lines.
+type QueryLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewQueryLog opens the file in cfg for appending.
+func NewQueryLog(cfg QueryLogConfig) (*QueryLog, error) {
+	f := &RotatingFile{
+		Path:       cfg.Path,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+	}
+	if err := f.open(); err != nil {
+		return nil, fmt.Errorf("open query log: %w", err)
+	}
+	return &QueryLog{w: f}, nil
+}
+
+// Log appends e. Each entry is written with a single Write so rotation
+// never splits a line.
+func (l *QueryLog) Log(e QueryLogEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying file.
+func (l *QueryLog) Close() error {
+	return l.w.Close()
+}
+
+// logQuery records a query that started at start in the query log.
+func (c *Connection) logQuery(q *Query, start time.Time, err error) {
+	if c.server.queryLog == nil {
+		return
+	}
+	e := QueryLogEntry{
+		Time:         start,
+		ConnectionID: c.id,
+		User:         c.username,
+		Database:     c.database,
+		Fingerprint:  q.Normalized(),
+		Tags:         q.Tags(),
+		DurationMS:   float64(time.Since(start).Microseconds()) / 1000,
+		Backend:      c.route.backend,
+		Route:        c.route.reason,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if c.result != nil {
+		e.Rows = c.result.Rows
+		if !c.result.ResultSet {
+			e.LastInsertID = c.result.LastInsertID
+			e.Warnings = c.result.Warnings
+			e.Status = c.result.Status
+		}
+	}
+	if lerr := c.server.queryLog.Log(e); lerr != nil {
+		c.logger.WithError(lerr).Warn("failed to write query log")
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestQueryLogEntries(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(3, 0, 0))
+	})
+	path := filepath.Join(t.TempDir(), "queries.log")
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, QueryLog: &QueryLogConfig{Path: path}})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "UPDATE t SET a = 5 WHERE b = 'x' /*controller='orders',action='update'*/"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	mustReadPacket(t, client)
+
+	// The entry is written once the response has been relayed.
+	var data []byte
+	for deadline := time.Now().Add(time.Second); len(data) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(path)
+	}
+	var e QueryLogEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatalf("decode %q: %v", data, err)
+	}
+	if e.Fingerprint != "UPDATE t SET a = ? WHERE b = ?" || e.Rows != 3 || e.User != "root" || e.ConnectionID == 0 || e.Error != "" ||
+		e.Tags["controller"] != "orders" || e.Tags["action"] != "update" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
+
+func TestQueryLogCountsRelayedRows(t *testing.T) {
+	rs := &ResultSet{Columns: []ColumnDef{{Name: "id"}}}
+	for i := 0; i < 7; i++ {
+		rs.Rows = append(rs.Rows, []string{strconv.Itoa(i)})
+	}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeTestResultSet(conn, rs)
+	})
+	path := filepath.Join(t.TempDir(), "queries.log")
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, QueryLog: &QueryLogConfig{Path: path}})
+	count, sum := resultRowsHistogram(t)
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT id FROM t"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if _, rows := readTestResultSet(t, client); len(rows) != 7 {
+		t.Fatalf("client got %d rows, want 7", len(rows))
+	}
+
+	var data []byte
+	for deadline := time.Now().Add(time.Second); len(data) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(path)
+	}
+	var e QueryLogEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatalf("decode %q: %v", data, err)
+	}
+	if e.Rows != 7 {
+		t.Fatalf("logged %d rows, want 7", e.Rows)
+	}
+	if c, s := resultRowsHistogram(t); c-count != 1 || s-sum != 7 {
+		t.Fatalf("histogram observed %d result sets totalling %v rows, want 1 and 7", c-count, s-sum)
+	}
+}
+
+func TestQueryLogRecordsOKPacket(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		// SERVER_STATUS_AUTOCOMMIT and one warning.
+		ok := NewOKPacket(4, 1042, 0x0002)
+		binary.LittleEndian.PutUint16(ok[len(ok)-2:], 1)
+		WritePacket(conn, 1, ok)
+	})
+	path := filepath.Join(t.TempDir(), "queries.log")
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, QueryLog: &QueryLogConfig{Path: path}})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "INSERT INTO t VALUES (1), (2), (3), (4)"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected OK, got %x", pkt.Payload)
+	}
+
+	var data []byte
+	for deadline := time.Now().Add(time.Second); len(data) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(path)
+	}
+	var e QueryLogEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatalf("decode %q: %v", data, err)
+	}
+	if e.Rows != 4 || e.LastInsertID != 1042 || e.Warnings != 1 || e.Status != 0x0002 {
+		t.Fatalf("logged rows %d, last insert id %d, warnings %d, status %#x", e.Rows, e.LastInsertID, e.Warnings, e.Status)
+	}
+}
+
+func resultRowsHistogram(t *testing.T) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.ResultRows.Write(&m); err != nil {
+		t.Fatalf("read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestQueryLogRecordsRoute(t *testing.T) {
+	handler := func(conn net.Conn, payload []byte) {
+		status := uint16(0)
+		if strings.HasPrefix(string(payload[1:]), "BEGIN") {
+			status = serverStatusInTrans
+		}
+		WritePacket(conn, 1, NewOKPacket(0, 0, status))
+	}
+	primary, analytics := newFakeBackend(t, handler), newFakeBackend(t, handler)
+	primaryCfg, analyticsCfg := primary.config(), analytics.config()
+	primaryCfg.Name, analyticsCfg.Name = "primary", "analytics"
+	path := filepath.Join(t.TempDir(), "queries.log")
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{primaryCfg, analyticsCfg},
+		DatabaseRoutes: map[string]string{"reports": "analytics"},
+		QueryLog:       &QueryLogConfig{Path: path},
+	})
+
+	client := dialProxy(t, srv)
+	queries := []string{
+		"UPDATE t SET a = 1",
+		"SELECT /*+ backend=analytics */ 1",
+		"USE reports",
+		"SELECT 2",
+		"USE shop",
+		"BEGIN",
+		"SELECT /*+ backend=analytics */ 3",
+	}
+	for _, q := range queries {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		mustReadPacket(t, client)
+	}
+
+	var lines []string
+	for deadline := time.Now().Add(time.Second); len(lines) < len(queries) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := os.ReadFile(path)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	want := [][2]string{
+		{"primary", "default"},
+		{"analytics", "hint"},
+		{"analytics", "database"},
+		{"analytics", "database"},
+		{"primary", "default"},
+		{"primary", "default"},
+		{"primary", "transaction"},
+	}
+	if len(lines) != len(queries) {
+		t.Fatalf("logged %d queries, want %d", len(lines), len(queries))
+	}
+	for i, line := range lines {
+		var e QueryLogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		if got := [2]string{e.Backend, e.Route}; got != want[i] {
+			t.Fatalf("%s: logged backend %q route %q, want %q", queries[i], e.Backend, e.Route, want[i])
+		}
+	}
+}
+
+func TestRotatingFileRotatesAtSize(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &RotatingFile{
+		Path:       filepath.Join(dir, "queries.log"),
+		MaxSize:    100,
+		MaxBackups: 2,
+		now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+	}
+	defer f.Close()
+
+	line := strings.Repeat("x", 29) + "\n"
+	for i := 0; i < 10; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	// Three lines fit in 100 bytes, so ten lines rotate three times; only
+	// the two newest backups are kept.
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Fatalf("expected the log and 2 backups, got %d files", len(entries))
+	}
+	for _, e := range entries {
+		info, _ := e.Info()
+		want := int64(3 * len(line))
+		if e.Name() == "queries.log" {
+			want = int64(len(line))
+		}
+		if info.Size() != want {
+			t.Fatalf("%s is %d bytes, want %d", e.Name(), info.Size(), want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "queries-2024-01-01T00-00-01.000.log")); !os.IsNotExist(err) {
+		t.Fatalf("oldest backup was not pruned")
+	}
+}
+
+func TestRotatingFilePrunesByAge(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &RotatingFile{
+		Path:    filepath.Join(dir, "queries.log"),
+		MaxSize: 10,
+		MaxAge:  time.Hour,
+		now:     func() time.Time { return now },
+	}
+	defer f.Close()
+
+	for i := 0; i < 4; i++ {
+		f.Write([]byte("0123456789"))
+		now = now.Add(45 * time.Minute)
+	}
+	var backups []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() != "queries.log" {
+			backups = append(backups, e.Name())
+		}
+	}
+	if len(backups) != 2 || backups[0] != "queries-2024-01-01T01-30-00.000.log" {
+		t.Fatalf("expected only the backups younger than an hour, got %v", backups)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnectionInfo is a snapshot of a client connection as reported by
+// SHOW PROCESSLIST and the admin API.
+type ConnectionInfo struct {
+	ID        uint32
+	User      string
+	Database  string
+	Remote    string
+	Connected time.Time
+	// Tag is the label the client gave its connection with the
+	// Config.TagVariable proxy variable.
+	Tag string
+}
+
+// connRegistry tracks the live client connections of a server. It is safe
+// for concurrent use.
+type connRegistry struct {
+	mu    sync.RWMutex
+	conns map[uint32]*Connection
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint32]*Connection)}
+}
+
+func (r *connRegistry) add(c *Connection) {
+	r.mu.Lock()
+	r.conns[c.id] = c
+	r.mu.Unlock()
+}
+
+// remove deregisters c. It reports whether c was registered, so only the
+// first of several calls for a connection has an effect.
+func (r *connRegistry) remove(c *Connection) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns[c.id] != c {
+		return false
+	}
+	delete(r.conns, c.id)
+	return true
+}
+
+func (r *connRegistry) get(id uint32) (*Connection, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.conns[id]
+	return c, ok
+}
+
+func (r *connRegistry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.conns)
+}
+
+// snapshot returns the registered connections ordered by id.
+func (r *connRegistry) snapshot() []ConnectionInfo {
+	r.mu.RLock()
+	infos := make([]ConnectionInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		infos = append(infos, c.Info())
+	}
+	r.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestConnRegistryConcurrent(t *testing.T) {
+	srv := newTestServer(t, Config{})
+	r := srv.conns
+
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				a, b := net.Pipe()
+				c := NewConnection(srv, a)
+				r.add(c)
+				if got, ok := r.get(c.id); !ok || got != c {
+					t.Errorf("connection %d not registered", c.id)
+				}
+				r.snapshot()
+				if !r.remove(c) {
+					t.Errorf("first remove of %d failed", c.id)
+				}
+				if r.remove(c) {
+					t.Errorf("connection %d deregistered twice", c.id)
+				}
+				a.Close()
+				b.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := r.len(); n != 0 {
+		t.Fatalf("%d connections leaked in the registry", n)
+	}
+}
+
+// panicConn panics on the first write, standing in for a bug in a
+// connection's command handling.
+type panicConn struct{ net.Conn }
+
+func (panicConn) Write([]byte) (int, error) { panic("write") }
+
+func TestConnectionsDeregisterOnEveryExit(t *testing.T) {
+	srv := newTestServer(t, Config{})
+	opened := testutil.ToFloat64(metrics.ConnectionsOpened)
+	active := testutil.ToFloat64(metrics.ActiveConnections)
+	quits := testutil.ToFloat64(metrics.Commands.WithLabelValues("quit"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 60; i++ {
+		client, server := net.Pipe()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 3 {
+			case 0: // disconnects before the handshake completes
+				client.Close()
+				srv.Handle(server)
+			case 1: // panics while handling the connection
+				defer client.Close()
+				srv.Handle(panicConn{server})
+			case 2: // authenticates, then quits
+				go func() {
+					client.SetDeadline(time.Now().Add(5 * time.Second))
+					if _, err := clientHandshake(client, "root", "password", ""); err == nil {
+						WritePacket(client, 0, []byte{COM_QUIT})
+					}
+					client.Close()
+				}()
+				srv.Handle(server)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := srv.Connections(); n != 0 {
+		t.Fatalf("%d connections still registered: %+v", n, srv.ConnectionList())
+	}
+	if got := testutil.ToFloat64(metrics.ConnectionsOpened) - opened; got != 60 {
+		t.Fatalf("opened connections rose by %v, want 60", got)
+	}
+	// Connections of earlier tests may still be closing.
+	if got := testutil.ToFloat64(metrics.ActiveConnections); got > active {
+		t.Fatalf("active connections rose from %v to %v", active, got)
+	}
+	if got := testutil.ToFloat64(metrics.Commands.WithLabelValues("quit")) - quits; got != 20 {
+		t.Fatalf("quit commands rose by %v, want 20", got)
+	}
+}
+
+func TestConnectionListReportsAuthenticatedUser(t *testing.T) {
+	srv := newTestServer(t, Config{})
+	dialProxy(t, srv)
+
+	// The proxy records the user just after sending the auth OK.
+	deadline := time.Now().Add(time.Second)
+	for {
+		list := srv.ConnectionList()
+		if len(list) == 1 && list[0].User == "root" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ConnectionList() = %+v", list)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// maxColumns is the most columns a MySQL result set can have.
+const maxColumns = 4096
+
+// localInfileHeader starts the request a backend sends for the file of a
+// LOAD DATA LOCAL INFILE statement.
+const localInfileHeader = 0xFB
+
+// responsePacket is the kind of packet expected next in a relayed response.
+type responsePacket int
+
+const (
+	expectHeader responsePacket = iota // OK, ERR, LOCAL INFILE or column count
+	expectColumnDef
+	expectColumnsEOF
+	expectRow
+)
+
+// columnDefPrefix starts every column definition: the length-encoded
+// catalog, which is always "def".
+var columnDefPrefix = []byte{3, 'd', 'e', 'f'}
+
+// checkResponsePacket returns a description of payload if it cannot be the
+// packet expected next, or nil. An ERR packet is accepted anywhere.
+func checkResponsePacket(expect responsePacket, payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("an empty packet")
+	}
+	if payload[0] == 0xFF {
+		return nil
+	}
+	switch expect {
+	case expectHeader:
+		switch payload[0] {
+		case 0x00, localInfileHeader:
+			return nil
+		case 0xFE:
+			return unexpectedPacket("response header", payload)
+		}
+		columns, _, err := ReadLengthEncodedInt(payload)
+		if err != nil || columns == 0 || columns > maxColumns {
+			return unexpectedPacket("response header", payload)
+		}
+	case expectColumnDef:
+		if !bytes.HasPrefix(payload, columnDefPrefix) {
+			return unexpectedPacket("column definition", payload)
+		}
+	case expectColumnsEOF:
+		if !isEOFPacket(payload) {
+			return unexpectedPacket("EOF after column definitions", payload)
+		}
+	}
+	return nil
+}
+
+func unexpectedPacket(want string, payload []byte) error {
+	if len(payload) > 16 {
+		payload = payload[:16]
+	}
+	return fmt.Errorf("%x where a %s was expected", payload, want)
+}
+
+// errLocalInfile is returned for LOAD DATA LOCAL INFILE, whose file the
+// proxy does not relay.
+var errLocalInfile = &SQLError{Code: 1148, SQLState: "42000", Message: "LOAD DATA LOCAL INFILE is not supported by metal-db-proxy"}
+
+// declineLocalInfile answers a backend's request for a LOCAL INFILE file
+// with an empty one and consumes the statement's result, leaving the
+// connection ready for the next command.
+func (bc *BackendConn) declineLocalInfile(sequence uint8) error {
+	if err := bc.writePacket(sequence+1, nil); err != nil {
+		bc.poison("protocol")
+		return err
+	}
+	if _, err := bc.readPacket(); err != nil {
+		bc.poison("protocol")
+		return err
+	}
+	return errLocalInfile
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Hot restart hands the listening sockets to a new process using the
+// systemd socket-activation convention: the sockets are file descriptors 3
+// onwards, LISTEN_FDS is set to their number and LISTEN_FDNAMES to their
+// names, separated by colons. The old process then stops accepting and
+// drains its connections while the new one accepts on the same sockets, so
+// no connection attempt is refused during an upgrade.
+//
+// LISTEN_PID cannot be set by the parent because the child's pid is only
+// known after it starts, so a missing LISTEN_PID is accepted. Inheritance
+// needs file descriptor passing across exec, which Windows does not support.
+
+// listenFDsStart is the first inherited file descriptor.
+const listenFDsStart = 3
+
+// NamedListener is a listener handed to a new process under a name, so the
+// new process can tell several apart.
+type NamedListener struct {
+	Name string
+	net.Listener
+}
+
+// InheritedListeners returns the listeners passed by a parent process or by
+// systemd socket activation, in the order they were passed, or nil if there
+// are none. The activation variables are removed so they do not leak into
+// further children.
+func InheritedListeners() ([]NamedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return inheritedListeners(os.Getenv, listenFDsStart)
+}
+
+func inheritedListeners(getenv func(string) string, fd uintptr) ([]NamedListener, error) {
+	n, _ := strconv.Atoi(getenv("LISTEN_FDS"))
+	if n < 1 {
+		return nil, nil
+	}
+	if pid := getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	lns := make([]NamedListener, 0, n)
+	for i := range n {
+		f := os.NewFile(fd+uintptr(i), "listener")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		lns = append(lns, NamedListener{Name: name, Listener: ln})
+	}
+	return lns, nil
+}
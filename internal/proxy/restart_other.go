@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import (
+	"errors"
+	"os"
+)
+
+// RestartSignal is nil: hot restart is not supported on this platform.
+var RestartSignal os.Signal
+
+func Restart(lns []NamedListener) (*os.Process, error) {
+	return nil, errors.New("hot restart is not supported on this platform")
+}
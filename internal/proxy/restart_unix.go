@@ -0,0 +1,66 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// RestartSignal triggers a hot restart.
+var RestartSignal os.Signal = syscall.SIGUSR2
+
+// Restart starts a new instance of the running binary, with the same
+// arguments, that inherits lns. The caller should then stop accepting on
+// them and drain its connections; closing them does not affect the new
+// process, nor remove the file of a Unix socket.
+func Restart(lns []NamedListener) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return restartProcess(lns, path, os.Args, os.Environ())
+}
+
+func restartProcess(lns []NamedListener, path string, args, env []string) (*os.Process, error) {
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+	names := make([]string, len(lns))
+	for i, ln := range lns {
+		if strings.Contains(ln.Name, ":") {
+			return nil, fmt.Errorf("cannot hand off listener %q: names may not contain ':'", ln.Name)
+		}
+		fl, ok := ln.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("cannot hand off a %T", ln.Listener)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names[i] = ln.Name
+	}
+	child, err := os.StartProcess(path, args, &os.ProcAttr{
+		Env:   append(env, "LISTEN_FDS="+strconv.Itoa(len(lns)), "LISTEN_FDNAMES="+strings.Join(names, ":")),
+		Files: files,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ln := range lns {
+		if ul, ok := ln.Listener.(*net.UnixListener); ok {
+			// The socket file now belongs to the new process.
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return child, nil
+}
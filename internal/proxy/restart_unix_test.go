@@ -0,0 +1,85 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestHotRestartChild is the restarted process in TestHotRestart: it serves
+// one connection on each inherited listener, answering with its name.
+func TestHotRestartChild(t *testing.T) {
+	if os.Getenv("METAL_RESTART_CHILD") != "1" {
+		t.Skip("only runs as the child of TestHotRestart")
+	}
+	lns, err := InheritedListeners()
+	if err != nil || len(lns) != 2 {
+		os.Exit(2)
+	}
+	for _, ln := range lns {
+		conn, err := ln.Accept()
+		if err != nil {
+			os.Exit(3)
+		}
+		conn.Write([]byte(ln.Name + "\n"))
+		conn.Close()
+	}
+	os.Exit(0)
+}
+
+func TestHotRestart(t *testing.T) {
+	ln, err := Listen(t.Context(), "127.0.0.1:0", ListenConfig{})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	unix, err := Listen(t.Context(), "unix:"+path, ListenConfig{})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	lns := []NamedListener{{Name: "metal", Listener: ln}, {Name: "internal", Listener: unix}}
+	child, err := restartProcess(lns, os.Args[0], []string{os.Args[0], "-test.run=^TestHotRestartChild$"},
+		append(os.Environ(), "METAL_RESTART_CHILD=1"))
+	if err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	// The old process stops accepting; the sockets, and the Unix socket's
+	// file, stay open in the child.
+	ln.Close()
+	unix.Close()
+
+	for _, c := range []struct{ network, addr, name string }{{"tcp", addr, "metal"}, {"unix", path, "internal"}} {
+		conn, err := net.DialTimeout(c.network, c.addr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("dial %s after handoff: %v", c.addr, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || line != c.name+"\n" {
+			t.Fatalf("expected the child to answer on %s, got %q, %v", c.name, line, err)
+		}
+	}
+	state, err := child.Wait()
+	if err != nil || !state.Success() {
+		t.Fatalf("child exited with %v, %v", state, err)
+	}
+}
+
+func TestInheritedListenerWithoutActivation(t *testing.T) {
+	ln, err := inheritedListeners(func(string) string { return "" }, listenFDsStart)
+	if ln != nil || err != nil {
+		t.Fatalf("expected no listener without LISTEN_FDS, got %v, %v", ln, err)
+	}
+	other := map[string]string{"LISTEN_FDS": "1", "LISTEN_PID": "1"}
+	if ln, _ := inheritedListeners(func(k string) string { return other[k] }, listenFDsStart); ln != nil {
+		t.Fatalf("a listener meant for another pid was taken")
+	}
+}
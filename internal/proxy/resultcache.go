@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// ResultCacheConfig configures the cache of SELECT result sets. Entries are
+// served until TTL passes or a statement run through the proxy writes to a
+// table they read. Writes made other than through the proxy, and writes to
+// the tables under a view, are only caught by TTL.
+type ResultCacheConfig struct {
+	// MaxBytes bounds the memory held by cached entries; the least recently
+	// used are evicted to make room. It must be positive.
+	MaxBytes int64
+	// TTL is how long an entry is served after it was cached. It must be
+	// positive.
+	TTL time.Duration
+	// CompressAbove is the size in bytes above which an entry is stored
+	// zstd compressed, when that makes it smaller. Zero stores every entry
+	// as relayed.
+	CompressAbove int
+}
+
+// resultCache is a bounded LRU cache of the packets relayed for a query,
+// keyed by everything that shapes them. It is safe for concurrent use.
+type resultCache struct {
+	cfg ResultCacheConfig
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+	size    int64
+	// byTable indexes the keys of entries by the tables they read.
+	byTable map[string]map[string]bool
+	// generation counts invalidations, so a result read before one is not
+	// cached after it.
+	generation uint64
+}
+
+type resultCacheEntry struct {
+	key string
+	// data holds the relayed packets, each preceded by its length as a
+	// little-endian uint32, zstd compressed when compressed is set.
+	data       []byte
+	compressed bool
+	tables     []string
+	rows       uint64
+	status     uint16
+	expires    time.Time
+}
+
+func (e *resultCacheEntry) size() int64 { return int64(len(e.key) + len(e.data)) }
+
+func (e *resultCacheEntry) encoding() string {
+	if e.compressed {
+		return "zstd"
+	}
+	return "none"
+}
+
+// newResultCache returns a cache configured by cfg, or nil when cfg is nil.
+func newResultCache(cfg *ResultCacheConfig) *resultCache {
+	if cfg == nil {
+		return nil
+	}
+	return &resultCache{cfg: *cfg, order: list.New(), entries: make(map[string]*list.Element), byTable: make(map[string]map[string]bool)}
+}
+
+// zstd encoders and decoders are safe for concurrent EncodeAll and
+// DecodeAll calls.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// currentGeneration is the generation to pass to add for a result about to
+// be read.
+func (c *resultCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *resultCache) get(key string, now time.Time) (*resultCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*resultCacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry, true
+}
+
+// add caches the packets relayed for key, which read tables, compressing
+// them above the configured threshold. An entry larger than the whole cache
+// is dropped, as is one read before an invalidation since generation.
+func (c *resultCache) add(key string, tables []string, packets []byte, rows uint64, status uint16, generation uint64, now time.Time) {
+	entry := &resultCacheEntry{key: key, tables: tables, data: packets, rows: rows, status: status, expires: now.Add(c.cfg.TTL)}
+	if c.cfg.CompressAbove > 0 && len(packets) > c.cfg.CompressAbove {
+		if z := zstdEncoder.EncodeAll(packets, nil); len(z) < len(packets) {
+			entry.data, entry.compressed = z, true
+		}
+	}
+	if entry.size() > c.cfg.MaxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += entry.size()
+	for _, table := range tables {
+		if c.byTable[table] == nil {
+			c.byTable[table] = make(map[string]bool)
+		}
+		c.byTable[table][key] = true
+	}
+	metrics.ResultCacheBytes.WithLabelValues(entry.encoding()).Add(float64(entry.size()))
+	for c.size > c.cfg.MaxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry; c.mu must be held.
+func (c *resultCache) remove(e *list.Element) {
+	entry := e.Value.(*resultCacheEntry)
+	c.order.Remove(e)
+	delete(c.entries, entry.key)
+	for _, table := range entry.tables {
+		delete(c.byTable[table], entry.key)
+		if len(c.byTable[table]) == 0 {
+			delete(c.byTable, table)
+		}
+	}
+	c.size -= entry.size()
+	metrics.ResultCacheBytes.WithLabelValues(entry.encoding()).Sub(float64(entry.size()))
+}
+
+// invalidate drops the entries that read any of tables, or every entry when
+// tables is empty.
+func (c *resultCache) invalidate(tables []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if len(tables) == 0 {
+		for c.order.Len() > 0 {
+			c.remove(c.order.Back())
+		}
+		return
+	}
+	for _, table := range tables {
+		for key := range c.byTable[table] {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// packets returns the entry's relayed packets, decompressing them if needed.
+func (e *resultCacheEntry) packets() ([][]byte, error) {
+	data := e.data
+	if e.compressed {
+		var err error
+		if data, err = zstdDecoder.DecodeAll(data, nil); err != nil {
+			return nil, fmt.Errorf("cached result: %w", err)
+		}
+	}
+	var packets [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 || int(binary.LittleEndian.Uint32(data)) > len(data)-4 {
+			return nil, fmt.Errorf("cached result: truncated packet")
+		}
+		n := binary.LittleEndian.Uint32(data)
+		packets = append(packets, data[4:4+n])
+		data = data[4+n:]
+	}
+	return packets, nil
+}
+
+// resultCapture copies the packets relayed to a client, up to max bytes.
+type resultCapture struct {
+	max      int64
+	buf      []byte
+	overflow bool
+}
+
+// wrap returns forward with every packet it is given also captured.
+func (rc *resultCapture) wrap(forward func([]byte) error) func([]byte) error {
+	return func(p []byte) error {
+		if !rc.overflow {
+			if int64(len(rc.buf)+4+len(p)) > rc.max {
+				rc.overflow, rc.buf = true, nil
+			} else {
+				rc.buf = binary.LittleEndian.AppendUint32(rc.buf, uint32(len(p)))
+				rc.buf = append(rc.buf, p...)
+			}
+		}
+		return forward(p)
+	}
+}
+
+// uncacheableWords are the words that make a SELECT's result depend on more
+// than its text and the data: locking reads, SELECT ... INTO and functions
+// whose value changes from call to call or with the session.
+var uncacheableWords = map[string]bool{
+	"INTO": true, "FOR": true, "LOCK": true,
+	"NOW": true, "CURRENT_TIMESTAMP": true, "CURRENT_DATE": true, "CURRENT_TIME": true,
+	"SYSDATE": true, "UNIX_TIMESTAMP": true, "UTC_TIMESTAMP": true, "CURDATE": true, "CURTIME": true,
+	"RAND": true, "UUID": true, "UUID_SHORT": true, "SLEEP": true, "GET_LOCK": true,
+	"CONNECTION_ID": true, "LAST_INSERT_ID": true, "FOUND_ROWS": true, "ROW_COUNT": true,
+	"USER": true, "CURRENT_USER": true, "SESSION_USER": true, "SYSTEM_USER": true, "DATABASE": true,
+}
+
+// cacheableResult reports whether the result of q may be served from the
+// result cache: a single SELECT that reads no variables and calls nothing in
+// uncacheableWords.
+func cacheableResult(q *Query) bool {
+	if q.Type != StmtSelect || q.MultiStatement() {
+		return false
+	}
+	for _, tok := range q.Tokens {
+		if tok.Kind == TokenVariable || tok.Kind == TokenWord && uncacheableWords[strings.ToUpper(tok.Text)] {
+			return false
+		}
+	}
+	return true
+}
+
+// resultCacheKey is what the packets relayed for query depend on besides
+// the data: the user's masking and column rules, the database, the
+// negotiated capabilities and charset, and the hinted backend.
+func (c *Connection) resultCacheKey(query string) string {
+	hinted := ""
+	if c.hinted != nil {
+		hinted = c.hinted.Name()
+	}
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00%s\x00%s", c.username, c.database, c.capabilities, c.charset, hinted, query)
+}
+
+// cacheTables are q's tables as the result cache indexes them: lowercased
+// and qualified with the current database when they name none.
+func (c *Connection) cacheTables(q *Query) []string {
+	tables := make([]string, 0, len(q.Tables))
+	for _, t := range q.Tables {
+		if !strings.Contains(t, ".") {
+			t = c.database + "." + t
+		}
+		tables = append(tables, strings.ToLower(t))
+	}
+	return tables
+}
+
+// readOnlyTypes are the statements that leave cached results valid.
+var readOnlyTypes = map[StatementType]bool{
+	StmtSelect: true, StmtShow: true, StmtExplain: true, StmtSet: true, StmtUse: true,
+	StmtBegin: true, StmtCommit: true, StmtRollback: true, StmtSavepoint: true,
+}
+
+// writtenTables returns the tables q may change, as the result cache
+// indexes them or nil when they are unknown, and whether it may change any.
+func (c *Connection) writtenTables(q *Query) ([]string, bool) {
+	if c.server.resultCache == nil || readOnlyTypes[q.Type] && !q.MultiStatement() {
+		return nil, false
+	}
+	if q.Type == StmtCall || q.Type == StmtOther {
+		return nil, true
+	}
+	return c.cacheTables(q), true
+}
+
+// forwardWrite runs a statement that may change tables, dropping their
+// cached results, or every one when tables is nil, before it runs and
+// again just before its response reaches the client. Tables written inside
+// a transaction are dropped once more when it ends, as other clients may
+// have cached the rows they saw before the commit.
+func (c *Connection) forwardWrite(tables []string, run func() (*ExecResult, error)) (*ExecResult, error) {
+	cache := c.server.resultCache
+	cache.invalidate(tables)
+	c.beforeReply = func() { cache.invalidate(tables) }
+	defer func() { c.beforeReply = nil }()
+	res, err := run()
+	if c.inTransaction {
+		for _, t := range tables {
+			if !slices.Contains(c.txWrites, t) {
+				c.txWrites = append(c.txWrites, t)
+			}
+		}
+		c.txWroteAll = c.txWroteAll || tables == nil
+	}
+	return res, err
+}
+
+// replyInvalidation returns what to drop from the result cache just before
+// the response to the command being executed is relayed: what forwardWrite
+// asked for and, inside a transaction that wrote, its tables, as the
+// command may commit it. It is nil when there is nothing to drop.
+func (c *Connection) replyInvalidation() func() {
+	before := c.beforeReply
+	c.beforeReply = nil
+	if !c.inTransaction || len(c.txWrites) == 0 && !c.txWroteAll {
+		return before
+	}
+	tables := c.txWrites
+	if c.txWroteAll {
+		tables = nil
+	}
+	cache := c.server.resultCache
+	return func() {
+		if before != nil {
+			before()
+		}
+		cache.invalidate(tables)
+	}
+}
+
+// endTransactionWrites drops the cached results of the tables written in
+// the transaction that just ended.
+func (c *Connection) endTransactionWrites() {
+	if c.txWroteAll || len(c.txWrites) > 0 {
+		tables := c.txWrites
+		if c.txWroteAll {
+			tables = nil
+		}
+		c.server.resultCache.invalidate(tables)
+	}
+	c.txWrites, c.txWroteAll = nil, false
+}
+
+// forwardCached is forward for a text query whose result set may be served
+// from, or stored in, the server's result cache.
+func (c *Connection) forwardCached(q *Query, payload []byte) (*ExecResult, error) {
+	cache := c.server.resultCache
+	if cache == nil || c.inTransaction || c.session.len() > 0 || !cacheableResult(q) {
+		if tables, ok := c.writtenTables(q); ok {
+			return c.forwardWrite(tables, func() (*ExecResult, error) { return c.forward(payload) })
+		}
+		return c.forward(payload)
+	}
+	key := c.resultCacheKey(string(payload[1:]))
+	if entry, ok := cache.get(key, time.Now()); ok {
+		packets, err := entry.packets()
+		if err == nil {
+			metrics.ResultCacheLookups.WithLabelValues("hit").Inc()
+			for _, p := range packets {
+				if err := c.writePacket(p); err != nil {
+					return nil, err
+				}
+			}
+			c.result = &ExecResult{ResultSet: true, Rows: entry.rows, Status: entry.status}
+			return c.result, nil
+		}
+		c.logger.WithError(err).Warn("discarding unreadable cached result")
+	}
+	metrics.ResultCacheLookups.WithLabelValues("miss").Inc()
+	generation := cache.currentGeneration()
+	c.capture = &resultCapture{max: cache.cfg.MaxBytes}
+	defer func() { c.capture = nil }()
+	res, err := c.forward(payload)
+	if err == nil && res.ResultSet && res.Err == nil && !res.InTransaction() && !c.capture.overflow {
+		cache.add(key, c.cacheTables(q), c.capture.buf, res.Rows, res.Status, generation, time.Now())
+	}
+	return res, err
+}
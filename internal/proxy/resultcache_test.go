@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestResultCacheCompressesLargeEntries(t *testing.T) {
+	rs := &ResultSet{Columns: []ColumnDef{{Name: "payload"}}}
+	for i := 0; i < 200; i++ {
+		rs.Rows = append(rs.Rows, []string{strings.Repeat("x", 100)})
+	}
+	var queries atomic.Int32
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		if payload[0] == COM_QUERY && strings.HasPrefix(string(payload[1:]), "SELECT payload") {
+			queries.Add(1)
+		}
+		writeTestResultSet(conn, rs)
+	})
+	srv := newTestServer(t, Config{
+		Backends:    []BackendConfig{fb.config()},
+		ResultCache: &ResultCacheConfig{MaxBytes: 1 << 20, TTL: time.Minute, CompressAbove: 1024},
+	})
+	compressed := metrics.ResultCacheBytes.WithLabelValues("zstd")
+	hits := metrics.ResultCacheLookups.WithLabelValues("hit")
+	compressedBefore, hitsBefore := testutil.ToFloat64(compressed), testutil.ToFloat64(hits)
+
+	client := dialProxy(t, srv)
+	for i := 0; i < 2; i++ {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT payload FROM exports"...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		_, rows := readTestResultSet(t, client)
+		if len(rows) != 200 || rows[199][0] != strings.Repeat("x", 100) {
+			t.Fatalf("query %d: got %d rows, want 200 intact", i, len(rows))
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("backend ran the query %d times, want 1", n)
+	}
+	if got := testutil.ToFloat64(hits) - hitsBefore; got != 1 {
+		t.Fatalf("cache hits = %v, want 1", got)
+	}
+	stored := testutil.ToFloat64(compressed) - compressedBefore
+	if stored <= 0 || stored >= 200*100 {
+		t.Fatalf("compressed cache bytes = %v, want a compressed entry", stored)
+	}
+}
+
+func TestResultCacheInvalidatedByWrites(t *testing.T) {
+	var selects atomic.Int32
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		query := string(payload[1:])
+		switch {
+		case query == "SELECT n FROM counters":
+			selects.Add(1)
+			writeTestResultSet(conn, &ResultSet{Columns: []ColumnDef{{Name: "n"}}, Rows: [][]string{{"1"}}})
+		case query == "BEGIN" || strings.HasPrefix(query, "UPDATE"):
+			WritePacket(conn, 1, NewOKPacket(1, 0, serverStatusInTrans))
+		default:
+			WritePacket(conn, 1, NewOKPacket(1, 0, 0))
+		}
+	})
+	srv := newTestServer(t, Config{
+		Backends:    []BackendConfig{fb.config()},
+		ResultCache: &ResultCacheConfig{MaxBytes: 1 << 20, TTL: time.Minute},
+	})
+	client, other := dialProxyAs(t, srv, "app"), dialProxyAs(t, srv, "app")
+	sendOn := func(conn net.Conn, q string) {
+		t.Helper()
+		if err := WritePacket(conn, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %q: %v", q, err)
+		}
+		if strings.HasPrefix(q, "SELECT") {
+			readTestResultSet(t, conn)
+		} else {
+			mustReadPacket(t, conn)
+		}
+	}
+	send := func(q string) {
+		t.Helper()
+		sendOn(client, q)
+	}
+	// selected runs the cached query on conn and checks how many times the
+	// backend has run it so far.
+	selected := func(conn net.Conn, want int32) {
+		t.Helper()
+		sendOn(conn, "SELECT n FROM counters")
+		if n := selects.Load(); n != want {
+			t.Fatalf("backend ran the query %d times, want %d", n, want)
+		}
+	}
+
+	// The entry is added once the result is relayed, so before the
+	// client's next query.
+	selected(client, 1)
+	selected(client, 1)
+	selected(other, 1)
+	send("INSERT INTO audit VALUES (1)")
+	selected(client, 1)
+	send("INSERT INTO counters VALUES (2)")
+	selected(client, 2)
+
+	// Rows another client reads while a transaction writes them are
+	// dropped again at COMMIT, when the write becomes visible.
+	send("BEGIN")
+	send("UPDATE counters SET n = 3")
+	selected(other, 3)
+	send("COMMIT")
+	selected(other, 4)
+
+	// Statements whose tables are unknown drop everything.
+	send("CALL refresh_counters()")
+	selected(other, 5)
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// ErrResultTooLarge is returned when a response relayed from a backend
+// exceeds the client's byte limit. The rest of it is discarded together with
+// the backend connection.
+var ErrResultTooLarge = errors.New("result set too large")
+
+// resultLimit returns the most bytes of a single response relayed to the
+// client, or zero for no limit.
+func (c *Connection) resultLimit() int64 {
+	c.mu.Lock()
+	user := c.username
+	c.mu.Unlock()
+	if limit, ok := c.server.cfg.UserMaxResultBytes[user]; ok {
+		return limit
+	}
+	return c.server.cfg.MaxResultBytes
+}
+
+// limitForward wraps forward to fail with ErrResultTooLarge, without
+// forwarding, once packets totalling more than limit bytes were passed to it.
+func limitForward(forward func([]byte) error, limit int64) func([]byte) error {
+	if limit <= 0 {
+		return forward
+	}
+	var relayed int64
+	return func(p []byte) error {
+		relayed += int64(len(p))
+		if relayed > limit {
+			metrics.ResultLimitExceeded.Inc()
+			return fmt.Errorf("%w: more than %d bytes", ErrResultTooLarge, limit)
+		}
+		return forward(p)
+	}
+}
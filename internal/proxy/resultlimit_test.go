@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestResultByteLimit(t *testing.T) {
+	rs := &ResultSet{Columns: []ColumnDef{{Name: "payload"}}}
+	for i := 0; i < 100; i++ {
+		rs.Rows = append(rs.Rows, []string{strings.Repeat("x", 100)})
+	}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeTestResultSet(conn, rs)
+	})
+	const limit = 2000
+	srv := newTestServer(t, Config{
+		Backends:           []BackendConfig{fb.config()},
+		MaxResultBytes:     limit,
+		UserMaxResultBytes: map[string]int64{"bulk": 0},
+	})
+	discarded := metrics.BackendConnsDiscarded.WithLabelValues("result_limit")
+	before := testutil.ToFloat64(discarded)
+
+	client := dialProxy(t, srv)
+	// cutOff queries the rows and checks the response stops at the limit.
+	cutOff := func() {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT payload FROM exports"...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		relayed := 0
+		for {
+			pkt := mustReadPacket(t, client)
+			if pkt.Payload[0] == 0xFF {
+				sqlErr, err := ParseErrPacket(pkt.Payload)
+				if err != nil || sqlErr.Code != 1105 {
+					t.Fatalf("got %v, %v, want error 1105", sqlErr, err)
+				}
+				break
+			}
+			if isEOFPacket(pkt.Payload) && relayed > 100 {
+				t.Fatalf("the whole result set was relayed")
+			}
+			relayed += len(pkt.Payload)
+		}
+		if relayed > limit {
+			t.Fatalf("relayed %d bytes, beyond the %d byte limit", relayed, limit)
+		}
+	}
+	cutOff()
+	if got := testutil.ToFloat64(discarded) - before; got != 1 {
+		t.Fatalf("backend connections discarded for the limit: %v, want 1", got)
+	}
+
+	// Users exempt from the limit get everything, and the client that hit
+	// it stays connected.
+	bulk := dialProxyAs(t, srv, "bulk")
+	if err := WritePacket(bulk, 0, append([]byte{COM_QUERY}, "SELECT payload FROM exports"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if _, rows := readTestResultSet(t, bulk); len(rows) != 100 {
+		t.Fatalf("exempt user got %d rows, want 100", len(rows))
+	}
+	cutOff()
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Column types used in column definitions.
+const (
+	TypeLongLong  byte = 0x08
+	TypeVarString byte = 0xFD
+)
+
+// Character sets used in column definitions, identified by collation id.
+// CharsetUTF8MB4 is id 33, utf8mb3_general_ci, which the proxy has always
+// sent for text columns and in handshakes.
+const (
+	CharsetUTF8MB4 = CollationUTF8MB3GeneralCI
+	CharsetBinary  = CollationBinary
+)
+
+// ColumnDef describes one column of a text-protocol result set.
+type ColumnDef struct {
+	Schema   string
+	Table    string
+	OrgTable string
+	Name     string
+	OrgName  string
+	Type     byte
+	Charset  uint16
+	Length   uint32
+	Flags    uint16
+	Decimals byte
+
+	// transcodeFrom is the character set the values of a relayed column
+	// are converted from, when it differs from the client's.
+	transcodeFrom string
+}
+
+// ResultSet is a complete result set built by the proxy itself rather than
+// relayed from a backend.
+type ResultSet struct {
+	Columns []ColumnDef
+	Rows    [][]string
+}
+
+// Packets encodes the result set as the sequence of packet payloads sent to
+// the client: column count, column definitions, EOF, rows and a final EOF.
+func (rs *ResultSet) Packets() [][]byte {
+	return rs.PacketsFor(0)
+}
+
+// PacketsFor is Packets framed for a client that negotiated caps. With
+// CLIENT_DEPRECATE_EOF the EOF after the column definitions is left out and
+// the rows end with an OK packet carrying the EOF header.
+func (rs *ResultSet) PacketsFor(caps uint32) [][]byte {
+	packets := rs.headerPackets(caps)
+	for _, row := range rs.Rows {
+		var p []byte
+		for _, v := range row {
+			p = AppendLengthEncodedString(p, v)
+		}
+		packets = append(packets, p)
+	}
+	return append(packets, resultSetEnd(caps))
+}
+
+// WriteResultSet writes rs as Packets encodes it, numbered from seq, and
+// returns the sequence number after its last packet.
+func WriteResultSet(w io.Writer, seq uint8, rs *ResultSet) (uint8, error) {
+	for _, p := range rs.Packets() {
+		var err error
+		if seq, err = WriteLargePacket(w, seq, p); err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// headerPackets returns the column count, column definitions and, unless
+// caps include CLIENT_DEPRECATE_EOF, EOF that precede the rows in both
+// protocols.
+func (rs *ResultSet) headerPackets(caps uint32) [][]byte {
+	packets := make([][]byte, 0, len(rs.Columns)+len(rs.Rows)+3)
+	count, _ := lengthEncode(uint64(len(rs.Columns)))
+	packets = append(packets, count)
+	for _, col := range rs.Columns {
+		packets = append(packets, col.packet())
+	}
+	if caps&capDeprecateEOF != 0 {
+		return packets
+	}
+	return append(packets, NewEOFPacket(0))
+}
+
+// resultSetEnd returns the packet ending the rows of a result set: EOF, or
+// with CLIENT_DEPRECATE_EOF an OK packet with the EOF header.
+func resultSetEnd(caps uint32) []byte {
+	if caps&capDeprecateEOF == 0 {
+		return NewEOFPacket(0)
+	}
+	p := NewOKPacket(0, 0, 0)
+	p[0] = 0xFE
+	return p
+}
+
+func (col ColumnDef) packet() []byte {
+	charset, typ, length := col.Charset, col.Type, col.Length
+	if typ == 0 {
+		typ = TypeVarString
+	}
+	if charset == 0 {
+		charset = CharsetUTF8MB4
+	}
+	if length == 0 {
+		length = 255
+	}
+
+	orgName := col.OrgName
+	if orgName == "" {
+		orgName = col.Name
+	}
+
+	p := AppendLengthEncodedString(nil, "def")
+	p = AppendLengthEncodedString(p, col.Schema)
+	p = AppendLengthEncodedString(p, col.Table)
+	p = AppendLengthEncodedString(p, col.OrgTable)
+	p = AppendLengthEncodedString(p, col.Name)
+	p = AppendLengthEncodedString(p, orgName)
+	p = append(p, 0x0C)
+	p = binary.LittleEndian.AppendUint16(p, charset)
+	p = binary.LittleEndian.AppendUint32(p, length)
+	p = append(p, typ)
+	p = binary.LittleEndian.AppendUint16(p, col.Flags)
+	p = append(p, col.Decimals)
+	p = append(p, 0, 0) // filler
+	return p
+}
+
+// parseColumnDef decodes a Protocol::ColumnDefinition41 packet.
+func parseColumnDef(payload []byte) (ColumnDef, error) {
+	var col ColumnDef
+	pos := 0
+	fields := []*string{nil, &col.Schema, &col.Table, &col.OrgTable, &col.Name, &col.OrgName}
+	for _, f := range fields {
+		v, n, err := readLengthEncodedBytes(payload[pos:])
+		if err != nil {
+			return col, err
+		}
+		if f != nil {
+			*f = string(v)
+		}
+		pos += n
+	}
+	// Length of the fixed-size fields, always 0x0C.
+	_, n, err := ReadLengthEncodedInt(payload[pos:])
+	if err != nil {
+		return col, err
+	}
+	pos += n
+	if len(payload) < pos+10 {
+		return col, ErrInvalidPacket
+	}
+	col.Charset = binary.LittleEndian.Uint16(payload[pos:])
+	col.Length = binary.LittleEndian.Uint32(payload[pos+2:])
+	col.Type = payload[pos+6]
+	col.Flags = binary.LittleEndian.Uint16(payload[pos+7:])
+	col.Decimals = payload[pos+9]
+	return col, nil
+}
+
+// parseTextRow splits a text-protocol row into its column values. NULL
+// values are returned as nil.
+func parseTextRow(payload []byte, columns int) ([][]byte, error) {
+	row := make([][]byte, 0, columns)
+	pos := 0
+	for i := 0; i < columns; i++ {
+		if pos >= len(payload) {
+			return nil, ErrInvalidPacket
+		}
+		if payload[pos] == 0xFB {
+			row = append(row, nil)
+			pos++
+			continue
+		}
+		v, n, err := readLengthEncodedBytes(payload[pos:])
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, v)
+		pos += n
+	}
+	return row, nil
+}
+
+// encodeTextRow is the inverse of parseTextRow.
+func encodeTextRow(row [][]byte) []byte {
+	var p []byte
+	for _, v := range row {
+		if v == nil {
+			p = append(p, 0xFB)
+			continue
+		}
+		n, _ := lengthEncode(uint64(len(v)))
+		p = append(p, n...)
+		p = append(p, v...)
+	}
+	return p
+}
+
+// ErrNullValue is returned by ReadLengthEncodedString for the NULL marker
+// 0xFB, which takes one byte.
+var ErrNullValue = errors.New("NULL value")
+
+// ReadLengthEncodedString reads a string prefixed with its length as a
+// length-encoded integer and returns it with the number of bytes read.
+func ReadLengthEncodedString(data []byte) (string, int, error) {
+	if len(data) > 0 && data[0] == 0xFB {
+		return "", 1, ErrNullValue
+	}
+	b, n, err := readLengthEncodedBytes(data)
+	return string(b), n, err
+}
+
+func readLengthEncodedBytes(data []byte) ([]byte, int, error) {
+	n, size, err := ReadLengthEncodedInt(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	end := size + int(n)
+	if n > uint64(len(data)) || end > len(data) {
+		return nil, 0, ErrInvalidPacket
+	}
+	return data[size:end:end], end, nil
+}
+
+// NewEOFPacket builds an EOF packet with no warnings.
+func NewEOFPacket(status uint16) []byte {
+	p := []byte{0xFE, 0, 0}
+	return binary.LittleEndian.AppendUint16(p, status)
+}
+
+// AppendLengthEncodedString appends s to buf prefixed with its length as a
+// length-encoded integer.
+func AppendLengthEncodedString(buf []byte, s string) []byte {
+	n, _ := lengthEncode(uint64(len(s)))
+	buf = append(buf, n...)
+	return append(buf, s...)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteResultSet(t *testing.T) {
+	rs := &ResultSet{
+		Columns: []ColumnDef{{Name: "id", Type: TypeLongLong, Charset: CharsetBinary}, {Name: "name"}},
+		Rows:    [][]string{{"1", "ada"}, {"2", ""}},
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan uint8, 1)
+	go func() {
+		next, err := WriteResultSet(server, 1, rs)
+		if err != nil {
+			t.Errorf("write: %v", err)
+		}
+		done <- next
+	}()
+
+	if pkt := mustReadPacket(t, client); pkt.Sequence != 1 || string(pkt.Payload) != "\x02" {
+		t.Fatalf("got column count %d %x", pkt.Sequence, pkt.Payload)
+	}
+	for _, want := range rs.Columns {
+		col, err := parseColumnDef(mustReadPacket(t, client).Payload)
+		if err != nil {
+			t.Fatalf("column definition: %v", err)
+		}
+		if want.Type == 0 {
+			want.Type, want.Charset = TypeVarString, CharsetUTF8MB4
+		}
+		if col.Name != want.Name || col.Type != want.Type || col.Charset != want.Charset {
+			t.Fatalf("got column %+v, want %+v", col, want)
+		}
+	}
+	if pkt := mustReadPacket(t, client); !isEOFPacket(pkt.Payload) {
+		t.Fatalf("expected EOF after column definitions, got %x", pkt.Payload)
+	}
+	var rows [][]string
+	for {
+		pkt := mustReadPacket(t, client)
+		if isEOFPacket(pkt.Payload) {
+			break
+		}
+		values, err := parseTextRow(pkt.Payload, len(rs.Columns))
+		if err != nil {
+			t.Fatalf("row: %v", err)
+		}
+		rows = append(rows, []string{string(values[0]), string(values[1])})
+	}
+	if !reflect.DeepEqual(rows, rs.Rows) {
+		t.Fatalf("got rows %q, want %q", rows, rs.Rows)
+	}
+	// Column count, two definitions, EOF, two rows and EOF.
+	if next := <-done; next != 8 {
+		t.Fatalf("next sequence %d, want 8", next)
+	}
+}
+
+func TestLengthEncodedString(t *testing.T) {
+	for _, c := range []struct {
+		length, prefix int
+	}{
+		{0, 1},
+		{10, 1},
+		{250, 1},
+		{251, 3},
+		{1<<16 - 1, 3},
+		{70000, 4},
+	} {
+		s := strings.Repeat("x", c.length)
+		buf := AppendLengthEncodedString([]byte("head"), s)
+		if len(buf) != 4+c.prefix+c.length {
+			t.Fatalf("%d bytes: encoded to %d bytes, want %d", c.length, len(buf)-4, c.prefix+c.length)
+		}
+		got, n, err := ReadLengthEncodedString(append(buf[4:], "tail"...))
+		if err != nil || got != s || n != c.prefix+c.length {
+			t.Fatalf("%d bytes: read back %d bytes of %d, %v", c.length, len(got), n, err)
+		}
+	}
+
+	if _, n, err := ReadLengthEncodedString([]byte{0xFB, 'x'}); !errors.Is(err, ErrNullValue) || n != 1 {
+		t.Fatalf("NULL: got %d, %v", n, err)
+	}
+	if _, _, err := ReadLengthEncodedString([]byte{5, 'x'}); !errors.Is(err, ErrInvalidPacket) {
+		t.Fatalf("truncated string: got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// setReusePort enables SO_REUSEPORT on the socket. On Linux (3.9+) the
+// kernel load-balances incoming connections across every socket bound to
+// the port by processes of the same user. On the BSDs and macOS the option
+// only permits the shared bind; connections are not spread evenly.
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
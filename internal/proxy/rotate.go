@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat stamps rotated files; it sorts chronologically and is
+// safe in file names.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is an append-only file that is renamed aside once it reaches
+// MaxSize bytes. Rotated backups are named after the file with the rotation
+// time inserted before the extension, e.g. queries-2006-01-02T15-04-05.000.log.
+type RotatingFile struct {
+	// Path is the file written to.
+	Path string
+	// MaxSize is the size in bytes that triggers rotation. Zero disables
+	// rotation.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept. Zero keeps them all.
+	MaxBackups int
+	// MaxAge removes rotated files older than this. Zero keeps them
+	// regardless of age.
+	MaxAge time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	now  func() time.Time // for tests
+}
+
+// Write appends p, rotating first if p would take the file past MaxSize.
+// A single write is never split across files.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if err := os.Rename(f.Path, f.backupName(f.timeNow())); err != nil {
+		return fmt.Errorf("rotate %s: %w", f.Path, err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.prune()
+}
+
+func (f *RotatingFile) timeNow() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+// backupName is the name the file is rotated to at t.
+func (f *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(f.Path)
+	return strings.TrimSuffix(f.Path, ext) + "-" + t.UTC().Format(backupTimeFormat) + ext
+}
+
+// backups lists the rotated files, newest first.
+func (f *RotatingFile) backups() ([]string, error) {
+	ext := filepath.Ext(f.Path)
+	prefix := filepath.Base(strings.TrimSuffix(f.Path, ext)) + "-"
+	dir := filepath.Dir(f.Path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ext)); err == nil {
+			names = append(names, filepath.Join(dir, name))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// prune removes the backups beyond MaxBackups or older than MaxAge.
+func (f *RotatingFile) prune() error {
+	if f.MaxBackups == 0 && f.MaxAge == 0 {
+		return nil
+	}
+	names, err := f.backups()
+	if err != nil {
+		return err
+	}
+	cutoff := f.timeNow().Add(-f.MaxAge)
+	for i, name := range names {
+		expired := f.MaxAge > 0 && name < f.backupName(cutoff)
+		if (f.MaxBackups > 0 && i >= f.MaxBackups) || expired {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
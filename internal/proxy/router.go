@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrBackendDraining is returned for a query whose backend is draining when
+// no other backend holds its data.
+var ErrBackendDraining = errors.New("backend is draining and no other backend serves the query")
+
+// Router picks the backend a client's commands are sent to.
+type Router struct {
+	backends  []*Backend
+	byName    map[string]*Backend
+	databases map[string]*Backend
+	tenants   map[string]*Backend
+	// routed are the backends that serve routed databases or tenants, as
+	// the target of a route or, for databases, as their default database.
+	// They hold only that data, so unrouted databases never fail over to
+	// them.
+	routed map[*Backend]bool
+}
+
+// NewRouter builds a router over backends. The first backend is the default;
+// routes maps database names to the name of the backend that serves them.
+func NewRouter(backends []*Backend, routes map[string]string) (*Router, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("router needs at least one backend")
+	}
+	r := &Router{
+		backends:  backends,
+		byName:    make(map[string]*Backend, len(backends)),
+		databases: make(map[string]*Backend, len(routes)),
+		routed:    make(map[*Backend]bool),
+	}
+	for _, b := range backends {
+		if _, dup := r.byName[b.Name()]; dup {
+			return nil, fmt.Errorf("duplicate backend name %q", b.Name())
+		}
+		r.byName[b.Name()] = b
+	}
+	for db, name := range routes {
+		b, ok := r.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("route for database %q: unknown backend %q", db, name)
+		}
+		r.databases[db] = b
+		r.routed[b] = true
+	}
+	for _, b := range backends {
+		if _, ok := r.databases[b.cfg.Database]; ok {
+			r.routed[b] = true
+		}
+	}
+	return r, nil
+}
+
+// routeTenants routes the tenants in routes to the named backends.
+func (r *Router) routeTenants(routes map[string]string) error {
+	r.tenants = make(map[string]*Backend, len(routes))
+	for tenant, name := range routes {
+		b, ok := r.byName[name]
+		if !ok {
+			return fmt.Errorf("route for tenant %q: unknown backend %q", tenant, name)
+		}
+		r.tenants[tenant] = b
+		r.routed[b] = true
+	}
+	return nil
+}
+
+// Route returns the backend serving database. A draining backend is passed
+// over for the first one, in configuration order, that holds the same
+// databases and is not draining; without one the draining backend is
+// returned.
+func (r *Router) Route(database string) *Backend {
+	b, _, _ := r.route(database)
+	return b
+}
+
+// route is Route also returning why the backend was chosen: database for a
+// routed database, default for the default backend, or drain_failover when
+// the backend that would have been chosen is draining. A routed database
+// fails over only to a backend whose default database it is, an unrouted
+// one only to a backend that serves no routed database; the error reports a
+// draining backend with no such replacement.
+func (r *Router) route(database string) (*Backend, string, error) {
+	if b, ok := r.databases[database]; ok {
+		return r.available(b, "database", func(alt *Backend) bool {
+			return alt.cfg.Database == database
+		})
+	}
+	return r.available(r.backends[0], "default", func(alt *Backend) bool {
+		return !r.routed[alt]
+	})
+}
+
+// routeFor is route for a client of tenant, which is served by the backend
+// its tenant is routed to, if any, with the reason tenant. A tenant's
+// backend holds that tenant's data alone and never fails over.
+func (r *Router) routeFor(tenant, database string) (*Backend, string, error) {
+	if r.tenantRouted(tenant) {
+		return r.available(r.tenants[tenant], "tenant", func(*Backend) bool { return false })
+	}
+	return r.route(database)
+}
+
+// tenantRouted reports whether tenant is routed to a backend of its own.
+func (r *Router) tenantRouted(tenant string) bool {
+	_, ok := r.tenants[tenant]
+	return ok && tenant != ""
+}
+
+// available returns b, chosen for reason, unless it is draining, in which
+// case it returns the first backend that is not draining and that serves
+// accepts. Failing over to any other backend would send the query to one
+// that does not hold its data, so without one ErrBackendDraining is
+// returned along with b.
+func (r *Router) available(b *Backend, reason string, serves func(*Backend) bool) (*Backend, string, error) {
+	if !b.Draining() {
+		return b, reason, nil
+	}
+	for _, alt := range r.backends {
+		if alt != b && !alt.Draining() && serves(alt) {
+			return alt, "drain_failover", nil
+		}
+	}
+	return b, reason, fmt.Errorf("%w: %s", ErrBackendDraining, b.Name())
+}
+
+// Drain stops routing queries to the named backend, or resumes routing to
+// it when draining is false. Queries in flight on the backend finish; its
+// connections are closed as clients release them.
+func (r *Router) Drain(name string, draining bool) error {
+	b, ok := r.byName[name]
+	if !ok {
+		return fmt.Errorf("unknown backend %q", name)
+	}
+	b.setDraining(draining)
+	return nil
+}
+
+// Named returns the backend called name.
+func (r *Router) Named(name string) (*Backend, bool) {
+	b, ok := r.byName[name]
+	return b, ok
+}
+
+// RoutesByDatabase reports whether any per-database routes are configured.
+func (r *Router) RoutesByDatabase() bool {
+	return len(r.databases) > 0
+}
+
+// Databases returns the sorted union of routed databases and the default
+// databases of each backend.
+func (r *Router) Databases() []string {
+	seen := make(map[string]bool)
+	for db := range r.databases {
+		seen[db] = true
+	}
+	for _, b := range r.backends {
+		if b.cfg.Database != "" {
+			seen[b.cfg.Database] = true
+		}
+	}
+	dbs := make([]string, 0, len(seen))
+	for db := range seen {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+// Backends returns every configured backend, default first.
+func (r *Router) Backends() []*Backend {
+	return r.backends
+}
@@ -0,0 +1,416 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestShowDatabasesAcrossRoutes(t *testing.T) {
+	okHandler := func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	}
+	sales := newFakeBackend(t, okHandler)
+	hr := newFakeBackend(t, okHandler)
+
+	salesCfg, hrCfg := sales.config(), hr.config()
+	salesCfg.Name, hrCfg.Name = "sales-cluster", "hr-cluster"
+	salesCfg.Database = "app"
+	srv := newTestServer(t, Config{
+		Backends: []BackendConfig{salesCfg, hrCfg},
+		DatabaseRoutes: map[string]string{
+			"orders":   "sales-cluster",
+			"invoices": "sales-cluster",
+			"payroll":  "hr-cluster",
+		},
+	})
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "show databases;"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+
+	var rows []string
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 1 {
+		t.Fatalf("expected one column, got %x", pkt.Payload)
+	}
+	mustReadPacket(t, client) // column definition
+	if pkt := mustReadPacket(t, client); !isEOFPacket(pkt.Payload) {
+		t.Fatalf("expected EOF after column definitions, got %x", pkt.Payload)
+	}
+	for {
+		pkt := mustReadPacket(t, client)
+		if isEOFPacket(pkt.Payload) {
+			break
+		}
+		name, _, err := ReadLengthEncodedString(pkt.Payload)
+		if err != nil {
+			t.Fatalf("decode row: %v", err)
+		}
+		rows = append(rows, name)
+	}
+
+	want := []string{"app", "invoices", "orders", "payroll"}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got databases %v, want %v", rows, want)
+	}
+	if sales.queries.Load()+hr.queries.Load() != 0 {
+		t.Fatalf("SHOW DATABASES should not reach a backend")
+	}
+}
+
+func TestUseDatabaseRoutesToBackend(t *testing.T) {
+	okHandler := func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	}
+	defaultBackend := newFakeBackend(t, okHandler)
+	hr := newFakeBackend(t, okHandler)
+	hrCfg := hr.config()
+	hrCfg.Name = "hr-cluster"
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{defaultBackend.config(), hrCfg},
+		DatabaseRoutes: map[string]string{"payroll": "hr-cluster"},
+	})
+
+	client := dialProxy(t, srv)
+	for _, q := range []string{"USE `payroll`", "SELECT * FROM salaries"} {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+			t.Fatalf("%s: expected OK, got %x", q, pkt.Payload)
+		}
+	}
+	if n := hr.queries.Load(); n != 1 {
+		t.Fatalf("expected query on hr backend, got %d", n)
+	}
+	if n := defaultBackend.queries.Load(); n != 0 {
+		t.Fatalf("default backend should not be used, saw %d queries", n)
+	}
+}
+
+func TestDefaultDatabaseAppliedOnConnect(t *testing.T) {
+	initDB := make(chan string, 4)
+	handler := func(conn net.Conn, payload []byte) {
+		if payload[0] == COM_INIT_DB {
+			initDB <- string(payload[1:])
+		}
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	}
+	defaultBackend := newFakeBackend(t, handler)
+	analytics := newFakeBackend(t, handler)
+	analyticsCfg := analytics.config()
+	analyticsCfg.Name = "analytics-cluster"
+	srv := newTestServer(t, Config{
+		Backends:         []BackendConfig{defaultBackend.config(), analyticsCfg},
+		DatabaseRoutes:   map[string]string{"warehouse": "analytics-cluster"},
+		DefaultDatabases: map[string]string{"reporting": "warehouse"},
+	})
+
+	client := dialProxyAs(t, srv, "reporting")
+	if db := <-initDB; db != "warehouse" {
+		t.Fatalf("backend was switched to %q, want warehouse", db)
+	}
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT * FROM facts"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	mustReadPacket(t, client)
+	if n := analytics.queries.Load(); n != 1 {
+		t.Fatalf("analytics backend saw %d queries, want 1", n)
+	}
+	for _, info := range srv.ConnectionList() {
+		if info.User == "reporting" && info.Database != "warehouse" {
+			t.Fatalf("connection database = %q, want warehouse", info.Database)
+		}
+	}
+
+	// Users without a default connect without a database.
+	dialProxyAs(t, srv, "root")
+	select {
+	case db := <-initDB:
+		t.Fatalf("database %q selected for a user without a default", db)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTransactionPinsBackendThroughSavepoints(t *testing.T) {
+	// txHandler reports an open transaction from BEGIN until COMMIT or a
+	// full ROLLBACK, like a real server's status flags.
+	txHandler := func() func(conn net.Conn, payload []byte) {
+		var status uint16
+		return func(conn net.Conn, payload []byte) {
+			if payload[0] == COM_QUERY {
+				switch ParseQuery(string(payload[1:])).Type {
+				case StmtBegin:
+					status = serverStatusInTrans
+				case StmtCommit, StmtRollback:
+					status = 0
+				}
+			}
+			WritePacket(conn, 1, NewOKPacket(0, 0, status))
+		}
+	}
+	defaultBackend := newFakeBackend(t, txHandler())
+	hr := newFakeBackend(t, txHandler())
+	hrCfg := hr.config()
+	hrCfg.Name = "hr-cluster"
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{defaultBackend.config(), hrCfg},
+		DatabaseRoutes: map[string]string{"payroll": "hr-cluster"},
+	})
+
+	client := dialProxy(t, srv)
+	run := func(q string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+			t.Fatalf("%s: expected OK, got %x", q, pkt.Payload)
+		}
+	}
+	for _, q := range []string{
+		"BEGIN",
+		"SAVEPOINT sp1",
+		"ROLLBACK TO SAVEPOINT sp1",
+		"RELEASE SAVEPOINT sp1",
+		// Switching to a database routed elsewhere must not move the open
+		// transaction off its backend.
+		"USE payroll",
+		"UPDATE salaries SET amount = 1",
+	} {
+		run(q)
+	}
+	if n := hr.queries.Load(); n != 0 {
+		t.Fatalf("transaction left its backend: hr saw %d queries", n)
+	}
+	if n := defaultBackend.queries.Load(); n != 5 {
+		t.Fatalf("default backend saw %d queries, want 5", n)
+	}
+
+	run("COMMIT")
+	run("SELECT * FROM salaries")
+	if n := hr.queries.Load(); n != 1 {
+		t.Fatalf("after COMMIT the query should reach hr, saw %d queries", n)
+	}
+}
+
+func mustReadPacket(t *testing.T, conn net.Conn) *Packet {
+	t.Helper()
+	pkt, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("read packet: %v", err)
+	}
+	return pkt
+}
+
+func TestBackendHint(t *testing.T) {
+	cases := map[string]string{
+		"SELECT 1":                          "",
+		"SELECT /*+ backend=analytics */ 1": "analytics",
+		"SELECT /*+ MAX_EXECUTION_TIME(10) BACKEND=olap */ 1": "olap",
+		"SELECT /* backend=analytics */ 1":                    "",
+		"SELECT 1 /*+ backend= */":                            "",
+	}
+	for query, want := range cases {
+		if got := backendHint(ParseQuery(query)); got != want {
+			t.Fatalf("backendHint(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestBackendHintRoutesQuery(t *testing.T) {
+	okHandler := func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	}
+	primary := newFakeBackend(t, okHandler)
+	analytics := newFakeBackend(t, okHandler)
+	analyticsCfg := analytics.config()
+	analyticsCfg.Name = "analytics-cluster"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	down := BackendConfig{Name: "down", Addr: ln.Addr().String(), DialTimeout: 100 * time.Millisecond}
+	ln.Close()
+
+	srv := newTestServer(t, Config{Backends: []BackendConfig{primary.config(), analyticsCfg, down}})
+	client := dialProxy(t, srv)
+	query := func(q string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %q: %v", q, err)
+		}
+		if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+			t.Fatalf("%q: got %x", q, pkt.Payload)
+		}
+	}
+
+	query("SELECT /*+ backend=analytics-cluster */ COUNT(*) FROM events")
+	if n := analytics.queries.Load(); n != 1 {
+		t.Fatalf("analytics backend saw %d queries, want 1", n)
+	}
+	query("SELECT 1")
+	query("SELECT /*+ backend=nonexistent */ 1")
+	query("SELECT /*+ backend=down */ 1")
+	if n := primary.queries.Load(); n != 3 {
+		t.Fatalf("primary backend saw %d queries, want 3", n)
+	}
+	if n := analytics.queries.Load(); n != 1 {
+		t.Fatalf("analytics backend saw %d queries, want 1", n)
+	}
+}
+
+func TestDrainingBackendReceivesNoNewQueries(t *testing.T) {
+	okHandler := func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	}
+	primary := newFakeBackend(t, okHandler)
+	standby := newFakeBackend(t, okHandler)
+	primaryCfg, standbyCfg := primary.config(), standby.config()
+	primaryCfg.Name, standbyCfg.Name = "primary", "standby"
+	srv := newTestServer(t, Config{Backends: []BackendConfig{primaryCfg, standbyCfg}})
+	admin := srv.AdminHandler()
+
+	client := dialProxy(t, srv)
+	query := func() {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+			t.Fatalf("query: got %x", pkt.Payload)
+		}
+	}
+	request := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	query()
+	if rec := request(http.MethodPost, "/backends/primary/drain"); rec.Code != http.StatusNoContent {
+		t.Fatalf("drain: got %d %s", rec.Code, rec.Body)
+	}
+	query()
+	query()
+	if p, s := primary.queries.Load(), standby.queries.Load(); p != 1 || s != 2 {
+		t.Fatalf("queries after drain: primary %d standby %d, want 1 and 2", p, s)
+	}
+
+	var status []BackendStatus
+	if err := json.Unmarshal(request(http.MethodGet, "/backends").Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if len(status) != 2 || !status[0].Draining || status[0].Active != 0 || status[0].Idle != 0 || status[1].Draining {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if rec := request(http.MethodDelete, "/backends/primary/drain"); rec.Code != http.StatusNoContent {
+		t.Fatalf("undrain: got %d", rec.Code)
+	}
+	query()
+	if n := primary.queries.Load(); n != 2 {
+		t.Fatalf("primary saw %d queries after undrain, want 2", n)
+	}
+	if rec := request(http.MethodPost, "/backends/nonexistent/drain"); rec.Code != http.StatusNotFound {
+		t.Fatalf("drain unknown backend: got %d", rec.Code)
+	}
+}
+
+func TestDrainingBackendFailsOverOnlyToItsData(t *testing.T) {
+	okHandler := func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	}
+	primary := newFakeBackend(t, okHandler)
+	orders := newFakeBackend(t, okHandler)
+	replica := newFakeBackend(t, okHandler)
+	primaryCfg, ordersCfg, replicaCfg := primary.config(), orders.config(), replica.config()
+	primaryCfg.Name, ordersCfg.Name, replicaCfg.Name = "primary", "orders", "orders-replica"
+	replicaCfg.Database = "orders"
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{primaryCfg, ordersCfg, replicaCfg},
+		DatabaseRoutes: map[string]string{"orders": "orders"},
+	})
+	command := func(client net.Conn, cmd byte, arg string) []byte {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{cmd}, arg...)); err != nil {
+			t.Fatalf("write command: %v", err)
+		}
+		return mustReadPacket(t, client).Payload
+	}
+	wantDraining := func(p []byte) {
+		t.Helper()
+		sqlErr, err := ParseErrPacket(p)
+		if err != nil || sqlErr.Code != 1053 {
+			t.Fatalf("got %v, %v, want error 1053", sqlErr, err)
+		}
+	}
+
+	client := dialProxy(t, srv)
+	if p := command(client, COM_INIT_DB, "orders"); p[0] != 0x00 {
+		t.Fatalf("use orders: got %x", p)
+	}
+	// The replica configured for the database takes over its queries.
+	srv.router.Drain("orders", true)
+	if p := command(client, COM_QUERY, "DO 1"); p[0] != 0x00 {
+		t.Fatalf("query: got %x", p)
+	}
+	if o, r := orders.queries.Load(), replica.queries.Load(); o != 0 || r != 1 {
+		t.Fatalf("orders backend saw %d queries, replica %d, want 0 and 1", o, r)
+	}
+	// Without it the query fails rather than reach the primary.
+	srv.router.Drain("orders-replica", true)
+	wantDraining(command(client, COM_QUERY, "DO 1"))
+
+	// Unrouted databases never fail over to backends of routed ones.
+	srv.router.Drain("primary", true)
+	wantDraining(command(dialProxy(t, srv), COM_QUERY, "DO 1"))
+	if n := primary.queries.Load() + orders.queries.Load() + replica.queries.Load(); n != 1 {
+		t.Fatalf("backends saw %d queries, want 1", n)
+	}
+}
+
+func TestStripCommentsKeepsHints(t *testing.T) {
+	received := make(chan string, 1)
+	analytics := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		received <- string(payload[1:])
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	primary := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	analyticsCfg := analytics.config()
+	analyticsCfg.Name = "analytics"
+	srv := newTestServer(t, Config{
+		Backends:      []BackendConfig{primary.config(), analyticsCfg},
+		StripComments: true,
+		MetricTags:    []string{"source"},
+	})
+	tagged := metrics.QueriesByTag.WithLabelValues("source", "report")
+	before := testutil.ToFloat64(tagged)
+
+	client := dialProxy(t, srv)
+	query := "SELECT /*+ backend=analytics */ a -- why\nFROM t WHERE b = '/* kept */' /*source='report'*/"
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, query...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	mustReadPacket(t, client)
+
+	want := "SELECT /*+ backend=analytics */ a  \nFROM t WHERE b = '/* kept */'  "
+	if got := <-received; got != want {
+		t.Fatalf("backend received %q, want %q", got, want)
+	}
+	if n := testutil.ToFloat64(tagged) - before; n != 1 {
+		t.Fatalf("tag counted %v times, want 1", n)
+	}
+}
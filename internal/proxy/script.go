@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Temporal and NULL parameter types, decoded when prepared statements are
+// expanded for the SQL script.
+const (
+	TypeNull      byte = 0x06
+	TypeTimestamp byte = 0x07
+	TypeDate      byte = 0x0A
+	TypeTime      byte = 0x0B
+	TypeDateTime  byte = 0x0C
+)
+
+// scriptDelimiters are tried in turn for statements that contain semicolons
+// of their own, such as CREATE PROCEDURE bodies.
+var scriptDelimiters = []string{"$$", "//", ";;"}
+
+// scriptWriter writes the statements clients execute successfully as a SQL
+// script that replays them, switching databases with USE as they did.
+type scriptWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	// database is the database the script has selected so far.
+	database string
+}
+
+// newScriptWriter appends the script to the file at path, or writes it to
+// standard output when path is "-".
+func newScriptWriter(path string) (*scriptWriter, error) {
+	if path == "-" {
+		return &scriptWriter{w: nopWriteCloser{os.Stdout}}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open SQL script: %w", err)
+	}
+	return &scriptWriter{w: f}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// record appends the statement q ran in database, with its placeholders
+// replaced by args. after is the client's database once it ran, which
+// differs when the statement itself was a USE.
+func (s *scriptWriter) record(database, after string, q *Query, args []string) error {
+	if len(q.Tokens) == 0 {
+		return nil
+	}
+	stmt, compound := scriptStatement(q, args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	if database != "" && database != s.database {
+		fmt.Fprintf(&b, "USE %s;\n", quoteIdentifier(database))
+	}
+	if !compound {
+		b.WriteString(stmt + ";\n")
+	} else {
+		delim := scriptDelimiters[0]
+		for _, d := range scriptDelimiters {
+			if !strings.Contains(stmt, d) {
+				delim = d
+				break
+			}
+		}
+		fmt.Fprintf(&b, "DELIMITER %s\n%s%s\nDELIMITER ;\n", delim, stmt, delim)
+	}
+	s.database = after
+	_, err := io.WriteString(s.w, b.String())
+	return err
+}
+
+func (s *scriptWriter) Close() error { return s.w.Close() }
+
+// recordScript appends q, run in database with args for its placeholders,
+// to the SQL script if one is written.
+func (c *Connection) recordScript(database string, q *Query, args []string) {
+	if c.server.script == nil {
+		return
+	}
+	if err := c.server.script.record(database, c.database, q, args); err != nil {
+		c.logger.WithError(err).Warn("failed to write SQL script")
+	}
+}
+
+// scriptStatement returns the text of q from its first token to its last,
+// without surrounding comments or the trailing semicolon, with the i-th
+// placeholder replaced by args[i]. compound reports whether it contains
+// semicolons, and so needs a delimiter of its own.
+func scriptStatement(q *Query, args []string) (stmt string, compound bool) {
+	first, last := q.Tokens[0], q.Tokens[len(q.Tokens)-1]
+	var b strings.Builder
+	pos, arg := first.Pos, 0
+	for _, tok := range q.Tokens {
+		switch {
+		case tok.Kind == TokenPunct && tok.Text == ";":
+			compound = true
+		case tok.Kind == TokenPlaceholder && arg < len(args):
+			b.WriteString(q.SQL[pos:tok.Pos])
+			b.WriteString(args[arg])
+			pos = tok.Pos + len(tok.Text)
+			arg++
+		}
+	}
+	b.WriteString(q.SQL[pos : last.Pos+len(last.Text)])
+	return b.String(), compound
+}
+
+// quoteIdentifier quotes name with backquotes.
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// quoteString quotes s as a SQL string literal.
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case 0x1A:
+			b.WriteString(`\Z`)
+		case '\'', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// errScriptParams is returned when the parameters of an execute cannot be
+// decoded for the script.
+var errScriptParams = errors.New("malformed statement parameters")
+
+// executeArgs decodes the parameters of a COM_STMT_EXECUTE for stmt as SQL
+// literals, with the types recorded by bindParams; data sent with
+// COM_STMT_SEND_LONG_DATA stands in for its parameter.
+func (stmt *PreparedStatement) executeArgs(data []byte) ([]string, error) {
+	n := stmt.paramCount()
+	if n == 0 {
+		return nil, nil
+	}
+	flag := paramFlagOffset(n)
+	if len(data) <= flag || len(stmt.paramTypes) != n {
+		return nil, errScriptParams
+	}
+	nulls := data[9:flag]
+	pos := flag + 1
+	if data[flag] == 1 {
+		pos += 2 * n
+	}
+
+	long := make(map[uint16][]byte)
+	for _, chunk := range stmt.longData {
+		long[chunk.param] = append(long[chunk.param], chunk.data...)
+	}
+	args := make([]string, n)
+	for i, typ := range stmt.paramTypes {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			args[i] = "NULL"
+			continue
+		}
+		if v, ok := long[uint16(i)]; ok {
+			args[i] = quoteString(string(v))
+			continue
+		}
+		if pos > len(data) {
+			return nil, errScriptParams
+		}
+		arg, size, err := paramLiteral(byte(typ), typ&0x8000 != 0, data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		args[i] = arg
+		pos += size
+	}
+	return args, nil
+}
+
+// paramLiteral decodes a binary protocol parameter value of type typ from
+// the start of data as a SQL literal, returning the bytes it took.
+func paramLiteral(typ byte, unsigned bool, data []byte) (string, int, error) {
+	fixed := func(size int) (uint64, error) {
+		if len(data) < size {
+			return 0, errScriptParams
+		}
+		var b [8]byte
+		copy(b[:], data[:size])
+		return binary.LittleEndian.Uint64(b[:]), nil
+	}
+	integer := func(size int) (string, int, error) {
+		v, err := fixed(size)
+		if err != nil {
+			return "", 0, err
+		}
+		if unsigned {
+			return strconv.FormatUint(v, 10), size, nil
+		}
+		shift := 64 - 8*size
+		return strconv.FormatInt(int64(v<<shift)>>shift, 10), size, nil
+	}
+	switch typ {
+	case TypeNull:
+		return "NULL", 0, nil
+	case TypeTiny:
+		return integer(1)
+	case TypeShort, TypeYear:
+		return integer(2)
+	case TypeLong, TypeInt24:
+		return integer(4)
+	case TypeLongLong:
+		return integer(8)
+	case TypeFloat:
+		v, err := fixed(4)
+		if err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32), 4, nil
+	case TypeDouble:
+		v, err := fixed(8)
+		if err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64), 8, nil
+	case TypeDate, TypeDateTime, TypeTimestamp, TypeTime:
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			return "", 0, errScriptParams
+		}
+		return quoteString(temporalLiteral(typ, data[1:1+data[0]])), 1 + int(data[0]), nil
+	}
+	v, size, err := readLengthEncodedBytes(data)
+	if err != nil {
+		return "", 0, errScriptParams
+	}
+	return quoteString(string(v)), size, nil
+}
+
+// temporalLiteral formats the binary protocol encoding b of a date, datetime
+// or time value.
+func temporalLiteral(typ byte, b []byte) string {
+	if typ == TypeTime {
+		if len(b) < 8 {
+			return "00:00:00"
+		}
+		sign := ""
+		if b[0] == 1 {
+			sign = "-"
+		}
+		hours := binary.LittleEndian.Uint32(b[1:])*24 + uint32(b[5])
+		s := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, b[6], b[7])
+		if len(b) >= 12 {
+			s += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(b[8:]))
+		}
+		return s
+	}
+	if len(b) < 4 {
+		return "0000-00-00"
+	}
+	s := fmt.Sprintf("%04d-%02d-%02d", binary.LittleEndian.Uint16(b), b[2], b[3])
+	if len(b) >= 7 {
+		s += fmt.Sprintf(" %02d:%02d:%02d", b[4], b[5], b[6])
+	}
+	if len(b) >= 11 {
+		s += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(b[7:]))
+	}
+	return s
+}
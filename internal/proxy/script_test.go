@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLScript(t *testing.T) {
+	backend := newStmtBackend(t, "primary")
+	path := filepath.Join(t.TempDir(), "session.sql")
+	srv := newTestServer(t, Config{Backends: []BackendConfig{backend.config()}, Script: path})
+	client := dialProxy(t, srv)
+
+	command := func(cmd byte, arg string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{cmd}, arg...)); err != nil {
+			t.Fatalf("write %q: %v", arg, err)
+		}
+		if p := mustReadPacket(t, client).Payload; p[0] != 0x00 {
+			t.Fatalf("%q: expected OK, got %x", arg, p)
+		}
+	}
+	command(COM_INIT_DB, "shop")
+	command(COM_QUERY, "CREATE TABLE t (id BIGINT, name TEXT, at DATETIME, note TEXT) -- trailing comment")
+	command(COM_QUERY, "/* leading */ INSERT INTO t (id, name) VALUES (1, 'it''s');")
+	command(COM_QUERY, "CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END")
+	command(COM_QUERY, "USE archive")
+
+	if err := WritePacket(client, 0, append([]byte{COM_STMT_PREPARE}, "INSERT INTO t VALUES (?, ?, ?, ?)"...)); err != nil {
+		t.Fatalf("write prepare: %v", err)
+	}
+	mustReadPacket(t, client) // COM_STMT_PREPARE_OK
+	mustReadPacket(t, client) // column definition
+	mustReadPacket(t, client) // EOF
+	execute := func(params ...byte) {
+		t.Helper()
+		exec := binary.LittleEndian.AppendUint32([]byte{COM_STMT_EXECUTE}, 1)
+		exec = append(exec, 0, 1, 0, 0, 0)
+		if err := WritePacket(client, 0, append(exec, params...)); err != nil {
+			t.Fatalf("write execute: %v", err)
+		}
+		for range 5 { // result set header, column, EOF, row, EOF
+			mustReadPacket(t, client)
+		}
+	}
+	// The fourth parameter is NULL. The first execute binds the types:
+	// BIGINT, VAR_STRING, DATETIME and NULL; the second reuses them.
+	minus7 := binary.LittleEndian.AppendUint64(nil, uint64(1<<64-7))
+	execute(append(append([]byte{0x08, 1, 0x08, 0, 0xFD, 0, 0x0C, 0, 0x06, 0}, minus7...),
+		4, 'a', '\'', 'b', '\n',
+		7, 0xEA, 0x07, 10, 17, 9, 30, 0)...)
+	execute(append(binary.LittleEndian.AppendUint64([]byte{0x08, 0}, 8),
+		1, 'c',
+		4, 0xEA, 0x07, 1, 2)...)
+
+	want := "USE `shop`;\n" +
+		"CREATE TABLE t (id BIGINT, name TEXT, at DATETIME, note TEXT);\n" +
+		"INSERT INTO t (id, name) VALUES (1, 'it''s');\n" +
+		"DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END$$\nDELIMITER ;\n" +
+		"USE archive;\n" +
+		"INSERT INTO t VALUES (-7, 'a\\'b\\n', '2026-10-17 09:30:00', NULL);\n" +
+		"INSERT INTO t VALUES (8, 'c', '2026-01-02', NULL);\n"
+	var got string
+	for deadline := time.Now().Add(time.Second); got != want && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := os.ReadFile(path)
+		got = string(data)
+	}
+	if got != want {
+		t.Fatalf("script:\n%s\nwant:\n%s", got, want)
+	}
+}
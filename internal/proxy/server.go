@@ -0,0 +1,587 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultHealthCheckInterval = 5 * time.Second
+
+// Config holds the proxy settings shared by every client connection.
+type Config struct {
+	// Backends are the upstream MySQL servers queries are forwarded to; the
+	// first one is the default. When empty the proxy answers every query
+	// itself.
+	Backends []BackendConfig
+	// DatabaseRoutes maps database names to the name of the backend serving
+	// them.
+	DatabaseRoutes map[string]string
+	// TenantRoutes maps tenants to the name of the backend serving them,
+	// ahead of DatabaseRoutes.
+	TenantRoutes map[string]string
+
+	// TenantPattern derives each client's tenant from its user name: the
+	// submatch named tenant, or else the first, such as ^([^.]+)\. for
+	// acme.reports. Clients whose name does not match have no tenant.
+	// RequireTenant rejects their commands.
+	TenantPattern string
+	RequireTenant bool
+	// QueryRewriter, when set, may rewrite each query a client runs or
+	// prepares before the proxy classifies it.
+	QueryRewriter func(session SessionContext, query string) string
+
+	// DefaultDatabases maps user names to the database selected for them
+	// when they connect without naming one.
+	DefaultDatabases map[string]string
+
+	// HealthCheckInterval is how often backends are pinged.
+	HealthCheckInterval time.Duration
+
+	// MaxSessionVariables bounds the SET statements tracked per client for
+	// replay on a new backend connection.
+	MaxSessionVariables int
+
+	// MaxPacketMemory caps the bytes held in client packet buffers across
+	// all connections. Zero means unlimited.
+	MaxPacketMemory int64
+
+	// ExplainRewrites are applied to EXPLAIN result sets relayed from
+	// backends.
+	ExplainRewrites []ExplainRewrite
+
+	// KeepAlive configures TCP keepalive probes on client connections. They
+	// keep firewalls and load balancers from reaping a client connection
+	// that is silent while a long query runs on a backend.
+	KeepAlive net.KeepAliveConfig
+
+	// SocketBuffers sizes the kernel buffers of accepted client
+	// connections.
+	SocketBuffers SocketBuffers
+
+	// Complexity rejects queries that exceed heuristic limits before they
+	// are forwarded. The zero value disables every check.
+	Complexity ComplexityLimits
+
+	// HandshakeTimeout bounds the time from accepting a client to completing
+	// its authentication; slower clients are disconnected. Zero means no
+	// limit.
+	HandshakeTimeout time.Duration
+	// IdleTimeout disconnects clients that send no command for this long,
+	// as MySQL's wait_timeout does. The proxy reports it as wait_timeout
+	// and interactive_timeout, so client pools can retire connections
+	// first. Zero means no limit, and the backend's values are reported.
+	IdleTimeout time.Duration
+
+	// SessionVariables are system variables reported to clients as set,
+	// through session state tracking in the OK packet that completes their
+	// authentication, so they need not query them after connecting. Clients
+	// that do not negotiate CLIENT_SESSION_TRACK are not told.
+	SessionVariables map[string]string
+
+	// ServerVersion is the server version advertised to clients in the
+	// handshake. Defaults to the proxy's own version.
+	ServerVersion string
+	// ProbeBackendVersion advertises the default backend's version instead,
+	// with a "-metal" suffix, once a health check has reached the backend, so clients
+	// enable the features of the server they really talk to. ServerVersion
+	// is advertised until then.
+	ProbeBackendVersion bool
+
+	// Auth checks client credentials. Every user name is accepted with the
+	// password "password" when nil.
+	Auth AuthProvider
+	// AdminUser may run PROXY commands, such as PROXY SHOW CONNECTIONS, to
+	// administer the proxy over the MySQL protocol. Nobody may when empty.
+	// It needs an Auth provider other than StaticAuth, or TransparentAuth.
+	AdminUser string
+	// AuthFailOpen lets clients in without a password check when Auth
+	// fails to look them up. By default they are denied. AdminUser is
+	// always denied.
+	AuthFailOpen bool
+	// AuthPlugin is the authentication method offered to clients:
+	// mysql_native_password, the default, or caching_sha2_password.
+	// Clients may always authenticate with mysql_native_password. It is
+	// not used in transparent mode.
+	AuthPlugin string
+	// AuthRSAKey is the key clients encrypt their password with to
+	// authenticate with caching_sha2_password over an unencrypted
+	// connection. One is generated at startup when nil.
+	AuthRSAKey *rsa.PrivateKey
+	// TagVariable names the proxy variable clients label their connection
+	// with, as in SET @@proxy_tag = 'reporting-job-42'. The statement is
+	// answered by the proxy and the label shown by PROXY SHOW CONNECTIONS
+	// and in the connection's logs. Empty disables it.
+	TagVariable string
+
+	// TransparentAuth authenticates clients against the default backend
+	// with their own credentials instead of at the proxy: the backend's
+	// greeting and the auth exchange are relayed, and each client keeps the
+	// backend connection it authenticated. Requires a plaintext default
+	// backend.
+	TransparentAuth bool
+
+	// PingQueries are validation queries, such as "SELECT 1", that the proxy
+	// answers itself with a single `1` row instead of forwarding them, unless
+	// the client is inside a transaction. Matching ignores case, comments and
+	// whitespace. Empty disables the short-circuit.
+	PingQueries []string
+
+	// Compression advertises CLIENT_COMPRESS so clients may use the zlib
+	// compressed protocol. It is not offered in transparent mode.
+	Compression bool
+	// TLS, when set, advertises CLIENT_SSL and upgrades clients that send
+	// an SSLRequest to TLS with this configuration. It is not offered in
+	// transparent mode. ApplyTLSPolicy restricts its versions and cipher
+	// suites as BackendTLSConfig does for backends.
+	TLS *tls.Config
+	// RequireTLS denies clients that do not switch to TLS before
+	// authenticating. It needs TLS and cannot be combined with
+	// TransparentAuth.
+	RequireTLS bool
+
+	// CapabilityOverrides withhold capabilities from clients by source
+	// address.
+	CapabilityOverrides []CapabilityOverride
+
+	// ListenerProfiles set the greeting and authentication of clients by the
+	// listener that accepted them.
+	ListenerProfiles []ListenerProfile
+
+	// LoadShedding rejects new connections while the proxy is overloaded.
+	LoadShedding LoadShedding
+
+	// ConnectionRateLimit closes new connections arriving faster than
+	// allowed, before the handshake.
+	ConnectionRateLimit ConnectionRateLimit
+
+	// ReconnectJitter spreads out reconnecting clients after an outage. Off
+	// by default.
+	ReconnectJitter ReconnectJitter
+
+	// AllowPipelining executes commands a client sends before the response
+	// to its previous command is complete, in order. By default they are
+	// rejected with an error, one per command, so the client cannot desync.
+	AllowPipelining bool
+
+	// QueryCacheSize is the number of query fingerprints whose
+	// classification is cached, so queries of a common shape are not
+	// classified again. Zero disables the cache.
+	QueryCacheSize int
+
+	// ResultCache caches the result sets of plain SELECT queries; nil
+	// disables it.
+	ResultCache *ResultCacheConfig
+
+	// MaxResultBytes bounds the bytes of a single response relayed from a
+	// backend to a client; a larger one is cut off with an error. Zero means
+	// no limit. UserMaxResultBytes overrides it by user name, where zero
+	// lifts the limit.
+	MaxResultBytes     int64
+	UserMaxResultBytes map[string]int64
+
+	// MaxTransactionTime bounds how long a client's transaction may stay
+	// open across all its statements. The first statement after the
+	// budget runs out rolls the transaction back and fails instead. Zero
+	// means no limit. UserMaxTransactionTime overrides it by user name,
+	// where zero lifts the limit.
+	MaxTransactionTime     time.Duration
+	UserMaxTransactionTime map[string]time.Duration
+
+	// StatementRules refuse queries by statement type with MySQL's 1142
+	// error. UserStatementRules replace them for the users they name, where
+	// empty rules permit everything.
+	StatementRules     StatementRules
+	UserStatementRules map[string]StatementRules
+
+	// DeadlockRetries replays a client's transaction up to this many times
+	// when a statement fails with a deadlock (1213) or lock wait timeout
+	// (1205), before the error reaches the client. Only transactions of
+	// text queries totalling at most ReplayBufferBytes are buffered for
+	// replay; zero means no limit. Zero retries disables replay.
+	DeadlockRetries   int
+	ReplayBufferBytes int64
+
+	// MaxPreparedStatements bounds the statements a client may have
+	// prepared at once; further prepares fail until it closes some. Zero
+	// means no limit.
+	MaxPreparedStatements int
+	// MaxLongDataBytes bounds the parameter data a client may send with
+	// COM_STMT_SEND_LONG_DATA for one statement execution. Zero means no
+	// limit.
+	MaxLongDataBytes int64
+
+	// MaskingRules mask sensitive columns in result sets relayed from
+	// backends.
+	MaskingRules []MaskingRule
+
+	// ColumnTypeRules change the column types advertised in result sets
+	// relayed from backends.
+	ColumnTypeRules []ColumnTypeRule
+	// CharsetMismatch selects what happens to relayed text columns in a
+	// character set other than the client's; empty skips the comparison.
+	CharsetMismatch CharsetMismatchMode
+
+	// StandaloneResponses are the OK packets returned for matching queries
+	// when no backend is configured. Queries matching none get an empty OK.
+	StandaloneResponses []StandaloneResponse
+	// StandaloneSchema are the tables reported by queries of the
+	// information_schema TABLES and COLUMNS views when no backend is
+	// configured.
+	StandaloneSchema []SchemaTable
+	// StandaloneSelect answers SELECT and SHOW statements matching no
+	// StandaloneResponses when no backend is configured.
+	StandaloneSelect StandaloneSelect
+
+	// StripComments removes comments from queries before they are forwarded
+	// to a backend, after the proxy has read its own hints and sqlcommenter
+	// tags from them. By default queries are forwarded verbatim.
+	StripComments bool
+
+	// MetricTags are the sqlcommenter tags, such as controller or action,
+	// by which queries are counted. The distinct values counted per tag are
+	// bounded.
+	MetricTags []string
+
+	// TracerProvider records a span for every client query when set. It is
+	// usually an OpenTelemetry SDK provider exporting over OTLP.
+	TracerProvider trace.TracerProvider
+
+	// QueryLog writes every client query to a JSON Lines file when set.
+	QueryLog *QueryLogConfig
+
+	// Script, when set, is a file to which every statement clients run
+	// successfully is appended as a replayable SQL script, or "-" for
+	// standard output. Prepared statements are written with their
+	// parameters in place.
+	Script string
+}
+
+// Server owns the state shared between client connections.
+type Server struct {
+	cfg          Config
+	router       *Router
+	packetMemory *MemoryBudget
+	pingQueries  map[string]bool
+	queryLog     *QueryLog
+	script       *scriptWriter
+	masking      []maskingRule
+	columnTypes  []columnTypeRule
+	tracer       trace.Tracer
+	tags         *tagCounter
+	capOverrides []capabilityOverride
+	listeners    map[string]listenerProfile
+	tenantRE     *regexp.Regexp
+	queryCache   *queryCache
+	resultCache  *resultCache
+	sha2Cache    sha2Cache
+	authRSA      *authRSAKey
+
+	started     time.Time
+	conns       *connRegistry
+	connRate    connRate
+	connLimiter *connLimiter
+	// inFlight is the number of client commands being executed.
+	inFlight atomic.Int64
+
+	sockBufLogged sync.Once
+}
+
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.HealthCheckInterval == 0 {
+		cfg.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if err := cfg.SocketBuffers.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.ReconnectJitter.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.ConnectionRateLimit.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.CharsetMismatch.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.StandaloneSelect.validate(); err != nil {
+		return nil, err
+	}
+	authRSA, err := authRSAKeyFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RequireTLS && (cfg.TLS == nil || cfg.TransparentAuth) {
+		return nil, errors.New("RequireTLS needs TLS and is not supported with TransparentAuth")
+	}
+	if _, static := cfg.Auth.(StaticAuth); cfg.AdminUser != "" && !cfg.TransparentAuth && (cfg.Auth == nil || static) {
+		// StaticAuth lets anyone log in under the admin's name.
+		return nil, errors.New("AdminUser needs an Auth provider that checks each user's password")
+	}
+	if rc := cfg.ResultCache; rc != nil && (rc.MaxBytes <= 0 || rc.TTL <= 0 || rc.CompressAbove < 0) {
+		return nil, errors.New("ResultCache needs a positive MaxBytes and TTL")
+	}
+	if err := cfg.StatementRules.validate(); err != nil {
+		return nil, err
+	}
+	for user, rules := range cfg.UserStatementRules {
+		if err := rules.validate(); err != nil {
+			return nil, fmt.Errorf("statement rules of user %s: %w", user, err)
+		}
+	}
+	capOverrides, err := compileCapabilityOverrides(cfg.CapabilityOverrides)
+	if err != nil {
+		return nil, err
+	}
+	columnTypes, err := compileColumnTypeRules(cfg.ColumnTypeRules)
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := compileListenerProfiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tenantPattern, err := compileTenantPattern(cfg.TenantPattern)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		cfg:          cfg,
+		packetMemory: NewMemoryBudget(cfg.MaxPacketMemory),
+		pingQueries:  pingQuerySet(cfg.PingQueries),
+		masking:      compileMaskingRules(cfg.MaskingRules),
+		columnTypes:  columnTypes,
+		tags:         newTagCounter(cfg.MetricTags),
+		capOverrides: capOverrides,
+		listeners:    listeners,
+		tenantRE:     tenantPattern,
+		queryCache:   newQueryCache(cfg.QueryCacheSize),
+		resultCache:  newResultCache(cfg.ResultCache),
+		authRSA:      authRSA,
+		started:      time.Now(),
+		conns:        newConnRegistry(),
+		connLimiter:  newConnLimiter(cfg.ConnectionRateLimit),
+	}
+	if len(cfg.Backends) > 0 {
+		backends := make([]*Backend, len(cfg.Backends))
+		for i, bc := range cfg.Backends {
+			if err := bc.SocketBuffers.validate(); err != nil {
+				return nil, fmt.Errorf("backend %s: %w", bc.Addr, err)
+			}
+			backends[i] = NewBackend(bc)
+			if _, err := backends[i].clientTLS(); err != nil {
+				return nil, fmt.Errorf("backend %s: %w", backends[i].Name(), err)
+			}
+		}
+		router, err := NewRouter(backends, cfg.DatabaseRoutes)
+		if err != nil {
+			return nil, err
+		}
+		if err := router.routeTenants(cfg.TenantRoutes); err != nil {
+			return nil, err
+		}
+		if cfg.TransparentAuth && router.Route("").cfg.TLS != nil {
+			return nil, fmt.Errorf("transparent authentication cannot be relayed over TLS to backend %s", router.Route("").Name())
+		}
+		s.router = router
+	}
+	if cfg.TracerProvider != nil {
+		s.tracer = cfg.TracerProvider.Tracer(tracerName)
+	}
+	if cfg.QueryLog != nil {
+		ql, err := NewQueryLog(*cfg.QueryLog)
+		if err != nil {
+			return nil, err
+		}
+		s.queryLog = ql
+	}
+	if cfg.Script != "" {
+		sw, err := newScriptWriter(cfg.Script)
+		if err != nil {
+			return nil, err
+		}
+		s.script = sw
+	}
+	return s, nil
+}
+
+// Run health-checks the backends, and keeps their idle connections alive,
+// until ctx is cancelled.
+func (s *Server) Run(ctx context.Context) {
+	if s.router == nil {
+		return
+	}
+	for _, b := range s.router.Backends() {
+		if b.cfg.KeepAliveInterval > 0 {
+			go b.keepIdleAlive(ctx)
+		}
+	}
+	ticker := time.NewTicker(s.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.checkBackends(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkBackends(ctx context.Context) {
+	if s.router == nil {
+		return
+	}
+	for _, b := range s.router.Backends() {
+		if err := b.Check(ctx); err != nil {
+			logrus.WithError(err).WithField("backend", b.Name()).Warn("backend health check failed")
+		}
+	}
+}
+
+// Ready reports whether the proxy can serve queries: either it runs without
+// backends or at least one backend is healthy. Until then new connections
+// are refused.
+func (s *Server) Ready() bool {
+	if s.router == nil {
+		return true
+	}
+	for _, b := range s.router.Backends() {
+		if b.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle serves a single client connection until it disconnects.
+func (s *Server) Handle(conn net.Conn) {
+	s.HandleOn(conn, "")
+}
+
+// HandleOn is Handle for a connection accepted on the listener whose
+// ListenerProfile is called listener; "" is the default listener.
+func (s *Server) HandleOn(conn net.Conn, listener string) {
+	if s.cfg.KeepAlive.Enable {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			if err := tcp.SetKeepAliveConfig(s.cfg.KeepAlive); err != nil {
+				logrus.WithError(err).WithField("remote", conn.RemoteAddr().String()).Warn("failed to enable TCP keepalive")
+			}
+		}
+	}
+	c := NewConnection(s, conn)
+	if listener != "" {
+		profile, ok := s.listeners[listener]
+		if !ok {
+			c.logger.WithField("listener", listener).Warn("connection accepted on a listener without a profile")
+		}
+		c.profile = profile
+		c.logger = c.logger.WithField("listener", listener)
+	}
+	s.cfg.SocketBuffers.apply(conn, c.logger, &s.sockBufLogged)
+	c.Handle()
+}
+
+// capabilities are the capability flags advertised to clients.
+func (s *Server) capabilities() uint32 {
+	caps := uint32(serverCapabilities)
+	if s.cfg.Compression && !s.cfg.TransparentAuth {
+		caps |= capCompress
+	}
+	if s.cfg.TLS != nil && !s.cfg.TransparentAuth {
+		caps |= capSSL
+	}
+	if len(s.cfg.SessionVariables) > 0 && !s.cfg.TransparentAuth {
+		caps |= capSessionTrack
+	}
+	return caps
+}
+
+// serverVersion is the server version advertised to clients.
+func (s *Server) serverVersion() string {
+	if s.cfg.ProbeBackendVersion && s.router != nil {
+		if v := s.router.Route("").Version(); v != "" {
+			return v + "-metal"
+		}
+	}
+	if s.cfg.ServerVersion != "" {
+		return s.cfg.ServerVersion
+	}
+	return defaultServerVersion
+}
+
+// BackendStatus describes a backend for the admin API.
+type BackendStatus struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining"`
+	// Active is the number of pooled connections borrowed by clients.
+	Active int `json:"active"`
+	Idle   int `json:"idle"`
+}
+
+// BackendStatus returns the status of every backend, default first.
+func (s *Server) BackendStatus() []BackendStatus {
+	if s.router == nil {
+		return []BackendStatus{}
+	}
+	status := make([]BackendStatus, 0, len(s.router.Backends()))
+	for _, b := range s.router.Backends() {
+		status = append(status, BackendStatus{
+			Name:     b.Name(),
+			Addr:     b.Addr(),
+			Healthy:  b.Healthy(),
+			Draining: b.Draining(),
+			Active:   b.Pool().InUse(),
+			Idle:     b.Pool().Idle(),
+		})
+	}
+	return status
+}
+
+// DrainBackend starts or stops draining the named backend.
+func (s *Server) DrainBackend(name string, draining bool) error {
+	if s.router == nil {
+		return fmt.Errorf("unknown backend %q", name)
+	}
+	if err := s.router.Drain(name, draining); err != nil {
+		return err
+	}
+	logrus.WithField("backend", name).WithField("draining", draining).Info("backend drain state changed")
+	return nil
+}
+
+// Uptime reports how long the server has existed.
+func (s *Server) Uptime() time.Duration { return time.Since(s.started) }
+
+// Connections reports the number of client connections being served.
+func (s *Server) Connections() int64 { return int64(s.conns.len()) }
+
+// ConnectionList returns a snapshot of the client connections ordered by id.
+func (s *Server) ConnectionList() []ConnectionInfo { return s.conns.snapshot() }
+
+// Close releases the pooled backend connections.
+func (s *Server) Close() {
+	if s.queryLog != nil {
+		s.queryLog.Close()
+	}
+	if s.script != nil {
+		s.script.Close()
+	}
+	if s.router == nil {
+		return
+	}
+	for _, b := range s.router.Backends() {
+		b.Pool().Close()
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestClientKeepAliveApplied(t *testing.T) {
+	srv := newTestServer(t, Config{KeepAlive: net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     42 * time.Second,
+		Interval: 7 * time.Second,
+		Count:    3,
+	}})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		srv.Handle(conn)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientHandshake(client, "root", "password", ""); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	raw, err := (<-accepted).(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("syscall conn: %v", err)
+	}
+	var enabled, idle int
+	raw.Control(func(fd uintptr) {
+		enabled, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		idle, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+	})
+	if enabled != 1 || idle != 42 {
+		t.Fatalf("keepalive not applied: enabled=%d idle=%d", enabled, idle)
+	}
+}
+
+func TestSocketBuffersApplied(t *testing.T) {
+	bufs := SocketBuffers{Send: 64 << 10, Receive: 128 << 10}
+	srv := newTestServer(t, Config{SocketBuffers: bufs})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		srv.Handle(conn)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientHandshake(client, "root", "password", ""); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	// Linux doubles the requested sizes to account for bookkeeping.
+	snd, rcv, err := socketBufferSizes((<-accepted).(*net.TCPConn))
+	if err != nil || snd != 2*bufs.Send || rcv != 2*bufs.Receive {
+		t.Fatalf("client socket buffers: snd=%d rcv=%d err=%v", snd, rcv, err)
+	}
+
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {})
+	cfg := fb.config()
+	cfg.SocketBuffers = bufs
+	bc, err := NewBackend(cfg).dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial backend: %v", err)
+	}
+	defer bc.Close()
+	snd, rcv, err = socketBufferSizes(bc.conn.(*net.TCPConn))
+	if err != nil || snd != 2*bufs.Send || rcv != 2*bufs.Receive {
+		t.Fatalf("backend socket buffers: snd=%d rcv=%d err=%v", snd, rcv, err)
+	}
+}
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestNotReadyRejectsConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // nothing listens on addr any more
+
+	srv := newTestServer(t, Config{Backends: []BackendConfig{{
+		Addr:        addr,
+		DialTimeout: 100 * time.Millisecond,
+	}}})
+	if srv.Ready() {
+		t.Fatalf("server should not be ready with an unreachable backend")
+	}
+
+	rec := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz: got %d, want 503", rec.Code)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.Handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pkt := mustReadPacket(t, client)
+	sqlErr, err := ParseErrPacket(pkt.Payload)
+	if err != nil {
+		t.Fatalf("expected ERR instead of greeting, got %x", pkt.Payload)
+	}
+	if sqlErr.Code != 1053 || sqlErr.SQLState != "08S01" || pkt.Sequence != 0 {
+		t.Fatalf("unexpected error: seq=%d %v", pkt.Sequence, sqlErr)
+	}
+}
+
+func TestHandshakeTimeoutClosesStalledClient(t *testing.T) {
+	srv := newTestServer(t, Config{HandshakeTimeout: 100 * time.Millisecond})
+	before := testutil.ToFloat64(metrics.HandshakeTimeouts)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		srv.Handle(server)
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	mustReadPacket(t, client)
+
+	// Dribble the first bytes of a handshake response, then stall.
+	if _, err := client.Write([]byte{0x40, 0x00}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stalled handshake was not timed out")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("connection still open after handshake timeout")
+	}
+	if got := testutil.ToFloat64(metrics.HandshakeTimeouts) - before; got != 1 {
+		t.Fatalf("handshake timeouts: got %v, want 1", got)
+	}
+
+	// Clients that authenticate in time keep their connection past it.
+	conn := dialProxy(t, srv)
+	time.Sleep(200 * time.Millisecond)
+	if err := WritePacket(conn, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, conn); pkt.Payload[0] != 0x00 {
+		t.Fatalf("query after handshake timeout elapsed: got %x", pkt.Payload)
+	}
+}
+
+func TestSSLRequestRejected(t *testing.T) {
+	srv := newTestServer(t, Config{})
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.Handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	greeting, err := parseServerGreeting(mustReadPacket(t, client).Payload)
+	if err != nil {
+		t.Fatalf("parse greeting: %v", err)
+	}
+	if greeting.Capabilities&capSSL != 0 {
+		t.Fatalf("greeting advertises CLIENT_SSL without TLS configured")
+	}
+
+	// A client with ssl-mode=PREFERRED may ask for TLS regardless.
+	req := make([]byte, 32)
+	putHandshakeHeader(req, capProtocol41|capSecureConnection|capSSL)
+	if err := WritePacket(client, 1, req); err != nil {
+		t.Fatalf("write SSL request: %v", err)
+	}
+	pkt := mustReadPacket(t, client)
+	sqlErr, err := ParseErrPacket(pkt.Payload)
+	if err != nil || sqlErr.Code != 1043 || pkt.Sequence != 2 {
+		t.Fatalf("expected error 1043 with sequence 2, got seq=%d %x", pkt.Sequence, pkt.Payload)
+	}
+	if _, err := ReadPacket(client); err == nil {
+		t.Fatalf("connection left open after the rejected SSL request")
+	}
+}
+
+func TestReadyWithHealthyBackend(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	if !srv.Ready() {
+		t.Fatalf("server should be ready once the backend answers COM_PING")
+	}
+
+	rec := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/readyz: got %d, want 200", rec.Code)
+	}
+}
+
+func TestAdvertisedVersionProbedFromBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	fb := &fakeBackend{ln: ln, version: "8.0.36"}
+	go fb.serve()
+
+	advertised := func(cfg Config) string {
+		t.Helper()
+		srv := newTestServer(t, cfg)
+		client, server := net.Pipe()
+		defer client.Close()
+		go srv.Handle(server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		g, err := parseServerGreeting(mustReadPacket(t, client).Payload)
+		if err != nil {
+			t.Fatalf("parse greeting: %v", err)
+		}
+		return g.ServerVersion
+	}
+	if v := advertised(Config{Backends: []BackendConfig{fb.config()}, ProbeBackendVersion: true}); v != "8.0.36-metal" {
+		t.Fatalf("advertised %q, want 8.0.36-metal", v)
+	}
+	if v := advertised(Config{Backends: []BackendConfig{fb.config()}, ServerVersion: "5.7.0"}); v != "5.7.0" {
+		t.Fatalf("advertised %q without probing, want the configured 5.7.0", v)
+	}
+
+	// An unreachable backend leaves the configured version in place.
+	down := BackendConfig{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond}
+	srv := newTestServer(t, Config{Backends: []BackendConfig{down}, ServerVersion: "5.7.0", ProbeBackendVersion: true})
+	if v := srv.serverVersion(); v != "5.7.0" {
+		t.Fatalf("advertised %q after a failed probe, want 5.7.0", v)
+	}
+}
+
+func TestLongRunningQueryDetected(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		time.Sleep(100 * time.Millisecond)
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{
+		Backends:  []BackendConfig{fb.config()},
+		KeepAlive: net.KeepAliveConfig{Enable: true, Idle: 10 * time.Millisecond},
+	})
+	client := dialProxy(t, srv)
+	before := testutil.ToFloat64(metrics.LongRunningQueries)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT SLEEP(0.1)"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected OK, got %x", pkt.Payload)
+	}
+	if got := testutil.ToFloat64(metrics.LongRunningQueries) - before; got != 1 {
+		t.Fatalf("expected one long-running query, got %v", got)
+	}
+}
+
+func TestClientDisconnectKillsQuery(t *testing.T) {
+	kills := make(chan string, 1)
+	killed := make(chan struct{})
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		query := string(payload[1:])
+		switch {
+		case strings.HasPrefix(query, "KILL QUERY "):
+			kills <- query
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			close(killed)
+		case query == "SELECT SLEEP(60)":
+			select {
+			case <-killed:
+				WritePacket(conn, 1, NewErrPacket(1317, "70100", "Query execution was interrupted"))
+			case <-time.After(5 * time.Second):
+				WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+			}
+		}
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	discarded := metrics.BackendConnsDiscarded.WithLabelValues("client")
+	before := testutil.ToFloat64(discarded)
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT SLEEP(60)"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	for fb.queries.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client.Close()
+
+	select {
+	case q := <-kills:
+		// The health check's pooled connection, thread 1, ran the query.
+		if q != "KILL QUERY 1" {
+			t.Fatalf("killed the wrong thread: %q", q)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("query was not killed after the client disconnected")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for testutil.ToFloat64(discarded)-before < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend connection of the disconnected client was not discarded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSocketBufferValidation(t *testing.T) {
+	if _, err := NewServer(Config{SocketBuffers: SocketBuffers{Send: -1}}); err == nil {
+		t.Fatalf("expected an error for a negative send buffer")
+	}
+	backend := BackendConfig{Addr: "127.0.0.1:1", SocketBuffers: SocketBuffers{Receive: 1 << 40}}
+	if _, err := NewServer(Config{Backends: []BackendConfig{backend}}); err == nil {
+		t.Fatalf("expected an error for an oversized backend receive buffer")
+	}
+}
+
+func TestQueriesCountedByStatementType(t *testing.T) {
+	client := dialProxy(t, newTestServer(t, Config{}))
+	cases := []struct {
+		query string
+		typ   StatementType
+	}{
+		{"SELECT * FROM t", StmtSelect},
+		{"insert into t values (1)", StmtInsert},
+		{"UPDATE t SET a = 1", StmtUpdate},
+		{"/* app */ DELETE FROM t", StmtDelete},
+		{"CREATE TABLE t (id INT)", StmtDDL},
+		{"USE shop", StmtUse},
+		{"DO SLEEP(1)", StmtOther},
+	}
+	for _, c := range cases {
+		counter := metrics.QueriesByType.WithLabelValues(string(c.typ))
+		before := testutil.ToFloat64(counter)
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, c.query...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		mustReadPacket(t, client)
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Fatalf("%s: %s counter rose by %v, want 1", c.query, c.typ, got)
+		}
+	}
+}
+
+func TestEmptyQuery(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	client := dialProxy(t, srv)
+	for _, query := range []string{"", "  \n", "/* nothing */", ";", "-- done\n;"} {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, query...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		sqlErr, err := ParseErrPacket(mustReadPacket(t, client).Payload)
+		if err != nil || sqlErr.Code != 1065 {
+			t.Fatalf("%q: got %v, %v, want error 1065", query, sqlErr, err)
+		}
+	}
+	if fb.queries.Load() != 0 {
+		t.Fatalf("backend received %d empty queries", fb.queries.Load())
+	}
+}
+
+func TestPing(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+
+	c := &Connection{server: srv}
+	resp, err := c.handleCommand([]byte{COM_PING})
+	if err != nil {
+		t.Fatalf("handle COM_PING: %v", err)
+	}
+	if len(resp) == 0 || resp[0] != 0x00 {
+		t.Fatalf("COM_PING answered with % x, want an OK packet", resp)
+	}
+
+	client := dialProxy(t, srv)
+	before := fb.pings.Load()
+	for i := 0; i < 2; i++ {
+		if err := WritePacket(client, 0, []byte{COM_PING}); err != nil {
+			t.Fatalf("write ping: %v", err)
+		}
+		pkt := mustReadPacket(t, client)
+		if pkt.Sequence != 1 || len(pkt.Payload) == 0 || pkt.Payload[0] != 0x00 {
+			t.Fatalf("ping %d answered with sequence %d, payload % x", i, pkt.Sequence, pkt.Payload)
+		}
+	}
+	if got := fb.pings.Load() - before; got != 0 {
+		t.Fatalf("backend received %d pings, want none", got)
+	}
+}
+
+func TestKillGracePeriod(t *testing.T) {
+	abandoned := make(chan struct{})
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		query := string(payload[1:])
+		switch {
+		case strings.HasPrefix(query, "KILL QUERY "):
+			WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+		case query == "SELECT SLEEP(60)":
+			// Ignore the kill: answer nothing until the proxy gives up.
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := ReadPacket(conn); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				close(abandoned)
+			}
+		}
+	})
+	cfg := fb.config()
+	cfg.KillGracePeriod = 100 * time.Millisecond
+	srv := newTestServer(t, Config{Backends: []BackendConfig{cfg}})
+	discarded := metrics.BackendConnsDiscarded.WithLabelValues("kill_timeout")
+	before, beforeKills := testutil.ToFloat64(discarded), testutil.ToFloat64(metrics.BackendKillTimeouts)
+
+	client := dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT SLEEP(60)"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	for fb.queries.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client.Close()
+
+	select {
+	case <-abandoned:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("backend connection was not closed after the grace period")
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for testutil.ToFloat64(discarded)-before < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned backend connection was not discarded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(metrics.BackendKillTimeouts) - beforeKills; got != 1 {
+		t.Fatalf("expected one kill timeout, got %v", got)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultMaxSessionVariables = 64
+
+// sessionState records the SET statements a client has run so they can be
+// replayed when its backend connection is replaced. Statements are keyed by
+// the variable they assign; a later SET of the same variable supersedes the
+// earlier one.
+type sessionState struct {
+	max   int
+	keys  []string
+	stmts map[string]string
+}
+
+func newSessionState(max int) *sessionState {
+	if max <= 0 {
+		max = defaultMaxSessionVariables
+	}
+	return &sessionState{max: max, stmts: make(map[string]string)}
+}
+
+// check returns an error if recording a statement for key would exceed the
+// tracking limit.
+func (s *sessionState) check(key string) error {
+	if _, ok := s.stmts[key]; ok || len(s.keys) < s.max {
+		return nil
+	}
+	return &SQLError{
+		Code:     1105,
+		SQLState: "HY000",
+		Message:  fmt.Sprintf("metal-db-proxy tracks at most %d session variables per connection", s.max),
+	}
+}
+
+func (s *sessionState) record(key, stmt string) {
+	if _, ok := s.stmts[key]; ok {
+		for i, k := range s.keys {
+			if k == key {
+				s.keys = append(s.keys[:i], s.keys[i+1:]...)
+				break
+			}
+		}
+	}
+	s.keys = append(s.keys, key)
+	s.stmts[key] = stmt
+}
+
+func (s *sessionState) len() int { return len(s.keys) }
+
+// replay runs every recorded statement, oldest first, on bc.
+func (s *sessionState) replay(bc *BackendConn) error {
+	for _, key := range s.keys {
+		if err := bc.Query(s.stmts[key]); err != nil {
+			return fmt.Errorf("restore session variable %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// sessionSetKey returns the key under which a session-scoped SET statement is
+// tracked. Global assignments and SET TRANSACTION, which only affects the
+// next transaction, are not session state and are not tracked.
+func sessionSetKey(query string) (string, bool) {
+	q := ParseQuery(query)
+	toks := q.Tokens
+	if q.Type != StmtSet || len(toks) < 2 {
+		return "", false
+	}
+	rest := toks[1:]
+
+	first := rest[0]
+	for _, w := range []string{"GLOBAL", "PERSIST", "PERSIST_ONLY", "TRANSACTION"} {
+		if first.IsWord(w) {
+			return "", false
+		}
+	}
+	if first.Kind == TokenVariable {
+		lower := strings.ToLower(first.Text)
+		for _, prefix := range []string{"@@global.", "@@persist.", "@@persist_only."} {
+			if strings.HasPrefix(lower, prefix) {
+				return "", false
+			}
+		}
+	}
+	if first.IsWord("NAMES") || first.IsWord("CHARSET") || (first.IsWord("CHARACTER") && len(rest) > 1 && rest[1].IsWord("SET")) {
+		return "names", true
+	}
+	if hasTopLevelComma(rest) {
+		last := rest[len(rest)-1]
+		return strings.ToLower(q.SQL[first.Pos : last.Pos+len(last.Text)]), true
+	}
+
+	if first.IsWord("SESSION") || first.IsWord("LOCAL") {
+		if len(rest) < 2 {
+			return "", false
+		}
+		first = rest[1]
+	}
+	switch first.Kind {
+	case TokenVariable:
+		name := strings.ToLower(first.Text)
+		for _, prefix := range []string{"@@session.", "@@local.", "@@"} {
+			if strings.HasPrefix(name, prefix) {
+				name = name[len(prefix):]
+				break
+			}
+		}
+		return strings.Trim(name, "`"), name != ""
+	case TokenWord, TokenQuotedName:
+		return strings.ToLower(first.Value), true
+	}
+	return "", false
+}
+
+// hasTopLevelComma reports whether tokens contain a comma outside
+// parentheses, i.e. assign more than one variable.
+func hasTopLevelComma(tokens []Token) bool {
+	depth := 0
+	for _, tok := range tokens {
+		switch {
+		case tok.IsPunct("("):
+			depth++
+		case tok.IsPunct(")"):
+			depth--
+		case tok.IsPunct(",") && depth == 0:
+			return true
+		}
+	}
+	return false
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
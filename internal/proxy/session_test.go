@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSessionSetKey(t *testing.T) {
+	cases := []struct {
+		query string
+		key   string
+		ok    bool
+	}{
+		{"SET @x = 1", "@x", true},
+		{"set @X:=1;", "@x", true},
+		{"SET SESSION sql_mode = 'ANSI'", "sql_mode", true},
+		{"SET @@session.sql_mode='ANSI'", "sql_mode", true},
+		{"SET @@autocommit = 0", "autocommit", true},
+		{"SET NAMES utf8mb4", "names", true},
+		{"SET CHARACTER SET latin1", "names", true},
+		{"SET @a = 1, @b = 'x,y'", "@a = 1, @b = 'x,y'", true},
+		{"SET @a = 'x,y'", "@a", true},
+		{"SET GLOBAL max_connections = 10", "", false},
+		{"SET @@global.max_connections = 10", "", false},
+		{"SET TRANSACTION ISOLATION LEVEL READ COMMITTED", "", false},
+		{"SELECT 1", "", false},
+		{"SETTINGS", "", false},
+	}
+	for _, c := range cases {
+		key, ok := sessionSetKey(c.query)
+		if key != c.key || ok != c.ok {
+			t.Errorf("sessionSetKey(%q) = %q, %v; want %q, %v", c.query, key, ok, c.key, c.ok)
+		}
+	}
+}
+
+func TestSessionStateLimit(t *testing.T) {
+	s := newSessionState(2)
+	s.record("@a", "SET @a = 1")
+	s.record("@b", "SET @b = 1")
+	if err := s.check("@a"); err != nil {
+		t.Fatalf("re-setting a tracked variable should be allowed: %v", err)
+	}
+	if err := s.check("@c"); err == nil {
+		t.Fatalf("expected error beyond the tracking limit")
+	}
+}
+
+func TestSessionReplayedAfterBackendReconnect(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[net.Conn][]string)
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		query := string(payload[1:])
+		mu.Lock()
+		received[conn] = append(received[conn], query)
+		mu.Unlock()
+		if query == "DROP CONNECTION" {
+			conn.Close()
+			return
+		}
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	client := dialProxy(t, srv)
+
+	query := func(q string) *Packet {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %q: %v", q, err)
+		}
+		return mustReadPacket(t, client)
+	}
+
+	query("SET @x = 1")
+	query("SET SESSION sql_mode = 'ANSI'")
+	query("SET @x = 2")
+	if pkt := query("DROP CONNECTION"); pkt.Payload[0] != 0xFF {
+		t.Fatalf("expected ERR after losing the backend, got %x", pkt.Payload)
+	}
+	if pkt := query("SELECT @x"); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected OK after reconnect, got %x", pkt.Payload)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var fresh []string
+	for _, queries := range received {
+		if queries[len(queries)-1] == "SELECT @x" {
+			fresh = queries
+		}
+	}
+	want := []string{"SET SESSION sql_mode = 'ANSI'", "SET @x = 2", "SELECT @x"}
+	if !reflect.DeepEqual(fresh, want) {
+		t.Fatalf("new backend connection got %q, want %q", fresh, want)
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// serverSessionStateChanged flags an OK packet that carries session
+	// state changes.
+	serverSessionStateChanged uint16 = 0x4000
+	// sessionTrackSystemVariables is the session state change type of a
+	// system variable set to a new value.
+	sessionTrackSystemVariables byte = 0x00
+)
+
+// sessionStateOK builds the OK packet completing a client's authentication.
+// A client that negotiated CLIENT_SESSION_TRACK is told of the configured
+// session variables as session state changes.
+func (c *Connection) sessionStateOK(resp *HandshakeResponse) []byte {
+	if resp.Capabilities&c.offered&capSessionTrack == 0 {
+		return NewOKPacket(0, 0, 0)
+	}
+	vars := c.server.cfg.SessionVariables
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var state []byte
+	for _, name := range names {
+		change := AppendLengthEncodedString(nil, name)
+		change = AppendLengthEncodedString(change, vars[name])
+		state = append(state, sessionTrackSystemVariables)
+		state = AppendLengthEncodedString(state, string(change))
+	}
+
+	ok := []byte{0x00, 0, 0} // no affected rows or insert id
+	ok = binary.LittleEndian.AppendUint16(ok, serverSessionStateChanged)
+	ok = binary.LittleEndian.AppendUint16(ok, 0) // warnings
+	ok = AppendLengthEncodedString(ok, "")       // info
+	return AppendLengthEncodedString(ok, string(state))
+}
+
+// trackedOKInfo re-encodes the info of an OK packet from a backend that did
+// not negotiate CLIENT_SESSION_TRACK for a client that did: the info, such
+// as "Rows matched: 1  Changed: 1  Warnings: 0", then becomes a
+// length-encoded string.
+func trackedOKInfo(payload []byte) []byte {
+	pos := 1
+	for range 2 {
+		_, n, err := ReadLengthEncodedInt(payload[pos:])
+		if err != nil {
+			return payload
+		}
+		pos += n
+	}
+	pos += 4 // status and warnings
+	if pos >= len(payload) {
+		return payload
+	}
+	out := append([]byte(nil), payload[:pos]...)
+	return AppendLengthEncodedString(out, string(payload[pos:]))
+}
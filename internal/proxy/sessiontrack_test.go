@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionStateOK(t *testing.T) {
+	info := "Rows matched: 1  Changed: 1  Warnings: 0"
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, append(NewOKPacket(1, 0, 0), info...))
+	})
+	srv := newTestServer(t, Config{
+		Backends:         []BackendConfig{fb.config()},
+		SessionVariables: map[string]string{"time_zone": "+00:00", "sql_mode": "STRICT_ALL_TABLES"},
+	})
+
+	client, server := net.Pipe()
+	go srv.Handle(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	pkt := mustReadPacket(t, client)
+	greeting, err := parseServerGreeting(pkt.Payload)
+	if err != nil {
+		t.Fatalf("parse greeting: %v", err)
+	}
+	if greeting.Capabilities&capSessionTrack == 0 {
+		t.Fatalf("session tracking not offered: %s", capabilityString(greeting.Capabilities))
+	}
+	auth := nativePasswordAuth(greeting.Scramble, "password")
+	resp := make([]byte, 32)
+	putHandshakeHeader(resp, capProtocol41|capSecureConnection|capPluginAuth|capSessionTrack)
+	resp = append(resp, "app\x00"...)
+	resp = append(append(resp, byte(len(auth))), auth...)
+	resp = append(resp, "mysql_native_password\x00"...)
+	if err := WritePacket(client, 1, resp); err != nil {
+		t.Fatalf("write handshake response: %v", err)
+	}
+
+	ok := mustReadPacket(t, client).Payload
+	if ok[0] != 0x00 || binary.LittleEndian.Uint16(ok[3:])&serverSessionStateChanged == 0 {
+		t.Fatalf("expected an OK with session state, got %x", ok)
+	}
+	// next splits a length-encoded string from the front of b.
+	next := func(b *[]byte) string {
+		t.Helper()
+		s, n, err := ReadLengthEncodedString(*b)
+		if err != nil {
+			t.Fatalf("malformed OK packet %x: %v", ok, err)
+		}
+		*b = (*b)[n:]
+		return s
+	}
+	rest := ok[7:]
+	if s := next(&rest); s != "" {
+		t.Fatalf("got info %q", s)
+	}
+	state := []byte(next(&rest))
+	var got [][2]string
+	for len(state) > 0 {
+		if state[0] != sessionTrackSystemVariables {
+			t.Fatalf("unexpected session state change type %d", state[0])
+		}
+		state = state[1:]
+		change := []byte(next(&state))
+		name := next(&change)
+		got = append(got, [2]string{name, next(&change)})
+	}
+	want := [][2]string{{"sql_mode", "STRICT_ALL_TABLES"}, {"time_zone", "+00:00"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got session variables %q, want %q", got, want)
+	}
+
+	// The info of relayed OK packets is length-encoded for the client.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "UPDATE t SET a = 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	ok = mustReadPacket(t, client).Payload
+	rest = ok[7:]
+	if s := next(&rest); s != info || len(rest) != 0 {
+		t.Fatalf("got OK %q, want info %q length-encoded", ok, info)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// LoadShedding rejects new clients before authentication while the proxy is
+// overloaded, so the work of connected clients can complete. Zero limits
+// are disabled.
+type LoadShedding struct {
+	// MaxConnections is the number of client connections above which new
+	// ones are rejected.
+	MaxConnections int
+	// MaxInFlightQueries is the number of commands being executed for
+	// clients above which new connections are rejected.
+	MaxInFlightQueries int
+}
+
+// overloaded reports why the server should shed a new connection, or ""
+// if it should not. The connection asking is already counted.
+func (s *Server) overloaded() string {
+	l := s.cfg.LoadShedding
+	reason := ""
+	switch {
+	case l.MaxConnections > 0 && s.conns.len() > l.MaxConnections:
+		reason = fmt.Sprintf("%d connections", s.conns.len())
+	case l.MaxInFlightQueries > 0 && int(s.inFlight.Load()) > l.MaxInFlightQueries:
+		reason = fmt.Sprintf("%d queries in flight", s.inFlight.Load())
+	}
+	if reason != "" {
+		metrics.Shedding.Set(1)
+	} else {
+		metrics.Shedding.Set(0)
+	}
+	return reason
+}
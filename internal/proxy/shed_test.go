@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestLoadSheddingRejectsOverConnectionLimit(t *testing.T) {
+	srv := newTestServer(t, Config{LoadShedding: LoadShedding{MaxConnections: 1}})
+	before := testutil.ToFloat64(metrics.ConnectionsShed)
+
+	first := dialProxy(t, srv)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.Handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pkt := mustReadPacket(t, client)
+	sqlErr, err := ParseErrPacket(pkt.Payload)
+	if err != nil {
+		t.Fatalf("expected ERR instead of greeting, got %x", pkt.Payload)
+	}
+	if sqlErr.Code != 1040 || sqlErr.SQLState != "08004" || pkt.Sequence != 0 {
+		t.Fatalf("unexpected error: seq=%d %v", pkt.Sequence, sqlErr)
+	}
+	if got := testutil.ToFloat64(metrics.ConnectionsShed) - before; got != 1 {
+		t.Fatalf("connections shed: got %v, want 1", got)
+	}
+	if testutil.ToFloat64(metrics.Shedding) != 1 {
+		t.Fatalf("shedding gauge not set")
+	}
+
+	// The connected client is unaffected.
+	if err := WritePacket(first, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, first); pkt.Payload[0] != 0x00 {
+		t.Fatalf("query: got %x", pkt.Payload)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Connections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialProxy(t, srv)
+	if testutil.ToFloat64(metrics.Shedding) != 0 {
+		t.Fatalf("shedding gauge not cleared")
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxSocketBuffer bounds configured socket buffer sizes; the kernel caps
+// them further (net.core.wmem_max and rmem_max on Linux).
+const maxSocketBuffer = 256 << 20
+
+// SocketBuffers sets SO_SNDBUF and SO_RCVBUF on TCP connections. Zero
+// leaves the operating system default, which autotunes on Linux; setting a
+// size disables autotuning for that direction.
+type SocketBuffers struct {
+	Send    int
+	Receive int
+}
+
+func (b SocketBuffers) validate() error {
+	for _, v := range []struct {
+		name string
+		size int
+	}{{"send", b.Send}, {"receive", b.Receive}} {
+		if v.size < 0 || v.size > maxSocketBuffer {
+			return fmt.Errorf("socket %s buffer must be between 0 and %d bytes, got %d", v.name, maxSocketBuffer, v.size)
+		}
+	}
+	return nil
+}
+
+// apply sets the buffer sizes on conn if it is a TCP connection and logs
+// the sizes the kernel actually granted: at info level the first time once
+// is run, at debug level afterwards.
+func (b SocketBuffers) apply(conn net.Conn, logger *logrus.Entry, once *sync.Once) {
+	if b.Send == 0 && b.Receive == 0 {
+		return
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if b.Send > 0 {
+		if err := tcp.SetWriteBuffer(b.Send); err != nil {
+			logger.WithError(err).Warn("failed to set socket send buffer")
+		}
+	}
+	if b.Receive > 0 {
+		if err := tcp.SetReadBuffer(b.Receive); err != nil {
+			logger.WithError(err).Warn("failed to set socket receive buffer")
+		}
+	}
+	snd, rcv, err := socketBufferSizes(tcp)
+	if err != nil {
+		logger.WithError(err).Debug("cannot read effective socket buffer sizes")
+		return
+	}
+	entry := logger.WithFields(logrus.Fields{"sndbuf": snd, "rcvbuf": rcv})
+	logged := false
+	once.Do(func() {
+		entry.Info("socket buffers set")
+		logged = true
+	})
+	if !logged {
+		entry.Debug("socket buffers set")
+	}
+}
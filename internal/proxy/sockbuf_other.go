@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func socketBufferSizes(conn *net.TCPConn) (snd, rcv int, err error) {
+	return 0, 0, errors.New("reading socket buffer sizes is not supported on this platform")
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketBufferSizes reads back SO_SNDBUF and SO_RCVBUF. Linux reports twice
+// the requested size, the extra half being kernel bookkeeping overhead.
+func socketBufferSizes(conn *net.TCPConn) (snd, rcv int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		snd, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		if sockErr == nil {
+			rcv, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return snd, rcv, sockErr
+}
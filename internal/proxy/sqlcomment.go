@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// Tags returns the sqlcommenter tags of the query's trailing comment, such
+// as /*controller='users',action='index'*/, with keys and values
+// URL-decoded. It returns nil if the query has no such comment.
+func (q *Query) Tags() map[string]string {
+	if len(q.Comments) == 0 {
+		return nil
+	}
+	last := q.Comments[len(q.Comments)-1]
+	if len(q.Tokens) > 0 && q.Tokens[len(q.Tokens)-1].Pos > last.Pos {
+		return nil
+	}
+	return parseSQLComment(last.Text)
+}
+
+// parseSQLComment parses a /* */ comment made only of key='value' pairs
+// separated by commas. Anything else yields nil.
+func parseSQLComment(text string) map[string]string {
+	body, ok := strings.CutPrefix(text, "/*")
+	if !ok {
+		return nil
+	}
+	body = strings.TrimSpace(strings.TrimSuffix(body, "*/"))
+	tags := make(map[string]string)
+	for body != "" {
+		key, rest, ok := strings.Cut(body, "=")
+		rest = strings.TrimLeft(rest, " ")
+		if !ok || !strings.HasPrefix(rest, "'") {
+			return nil
+		}
+		// The value runs to the next quote not escaped with a backslash.
+		end := 1
+		for end < len(rest) && (rest[end] != '\'' || rest[end-1] == '\\') {
+			end++
+		}
+		if end == len(rest) {
+			return nil
+		}
+		k, kerr := url.QueryUnescape(strings.TrimSpace(key))
+		v, verr := url.QueryUnescape(strings.ReplaceAll(rest[1:end], `\'`, `'`))
+		if kerr != nil || verr != nil || k == "" {
+			return nil
+		}
+		tags[k] = v
+		body = strings.TrimSpace(rest[end+1:])
+		if body != "" {
+			if body[0] != ',' {
+				return nil
+			}
+			body = strings.TrimSpace(body[1:])
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// maxTagValues bounds the distinct values counted per tag; later values are
+// counted as "other".
+const maxTagValues = 100
+
+// tagCounter counts queries by the values of a fixed set of sqlcommenter
+// tags, keeping the metric's cardinality bounded.
+type tagCounter struct {
+	mu     sync.Mutex
+	values map[string]map[string]bool
+}
+
+func newTagCounter(keys []string) *tagCounter {
+	if len(keys) == 0 {
+		return nil
+	}
+	tc := &tagCounter{values: make(map[string]map[string]bool, len(keys))}
+	for _, k := range keys {
+		tc.values[k] = make(map[string]bool)
+	}
+	return tc
+}
+
+func (tc *tagCounter) count(tags map[string]string) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for key, seen := range tc.values {
+		v, ok := tags[key]
+		if !ok {
+			continue
+		}
+		if !seen[v] {
+			if len(seen) >= maxTagValues {
+				v = "other"
+			} else {
+				seen[v] = true
+			}
+		}
+		metrics.QueriesByTag.WithLabelValues(key, v).Inc()
+	}
+}
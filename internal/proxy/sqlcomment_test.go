@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+func TestQueryTags(t *testing.T) {
+	cases := []struct {
+		sql  string
+		tags map[string]string
+	}{
+		{
+			"SELECT * FROM users /*action='index',controller='users',framework='rails%3Av7.1',route='%2Fusers%2F%3Aid'*/",
+			map[string]string{"action": "index", "controller": "users", "framework": "rails:v7.1", "route": "/users/:id"},
+		},
+		{"SELECT 1 /* action = 'it\\'s', db_driver='go' */;", map[string]string{"action": "it's", "db_driver": "go"}},
+		// Only the trailing comment is a sqlcommenter comment.
+		{"SELECT /*action='index'*/ 1", nil},
+		{"SELECT 1 /* just a note */", nil},
+		{"SELECT 1 /*action='unterminated*/", nil},
+		{"SELECT 1 -- action='index'", nil},
+	}
+	for _, c := range cases {
+		if got := ParseQuery(c.sql).Tags(); !reflect.DeepEqual(got, c.tags) {
+			t.Errorf("Tags(%q) = %v, want %v", c.sql, got, c.tags)
+		}
+	}
+}
+
+func TestTagCounterBounded(t *testing.T) {
+	tc := newTagCounter([]string{"route"})
+	other := metrics.QueriesByTag.WithLabelValues("route", "other")
+	before := testutil.ToFloat64(other)
+	series := testutil.CollectAndCount(metrics.QueriesByTag, "metal_queries_by_tag_total")
+	for i := 0; i < maxTagValues+5; i++ {
+		tc.count(map[string]string{"route": fmt.Sprintf("/users/%d", i), "user_id": "42"})
+	}
+	if got := testutil.ToFloat64(other) - before; got != 5 {
+		t.Fatalf("values beyond the bound counted %v times as other, want 5", got)
+	}
+	// Other tests may have counted tags of their own before.
+	if n := testutil.CollectAndCount(metrics.QueriesByTag, "metal_queries_by_tag_total") - series; n > maxTagValues+1 {
+		t.Fatalf("tag metric gained %d series", n)
+	}
+}
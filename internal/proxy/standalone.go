@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// StandaloneResponse is a canned OK returned for matching queries when the
+// proxy runs without a backend, so client test suites can exercise their
+// handling of affected rows and insert ids.
+type StandaloneResponse struct {
+	// Match selects the queries answered with this response.
+	Match *regexp.Regexp
+	// AffectedRows and LastInsertID are reported in the OK packet.
+	AffectedRows uint64
+	LastInsertID uint64
+}
+
+// StandaloneSelect answers SELECT and SHOW statements that match no
+// StandaloneResponses when the proxy runs without a backend. Clients
+// expecting rows are often confused by an OK. The zero value still answers
+// them with an empty OK.
+type StandaloneSelect struct {
+	// Columns, when set, answer with an empty result set of these columns.
+	// Types are those ColumnTypeRule understands, with an optional length
+	// such as varchar(255); an empty type is VARCHAR.
+	Columns []SchemaColumn
+	// Error, when set, answers with this error instead.
+	Error *SQLError
+}
+
+func (s StandaloneSelect) validate() error {
+	for _, col := range s.Columns {
+		if _, err := col.columnDef(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnDef describes col in a result set.
+func (col SchemaColumn) columnDef() (ColumnDef, error) {
+	name, _, _ := strings.Cut(col.Type, "(")
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "" {
+		name = "VARCHAR"
+	}
+	typ, ok := columnTypes[name]
+	if !ok {
+		return ColumnDef{}, fmt.Errorf("standalone column %s: unknown type %q", col.Name, col.Type)
+	}
+	def := ColumnDef{Name: col.Name, Type: typ}
+	if !textTypes[name] {
+		def.Charset = CharsetBinary
+	}
+	if col.NotNull {
+		def.Flags = 0x0001 // NOT_NULL_FLAG
+	}
+	return def, nil
+}
+
+// standaloneAnswer answers q without a backend: with the first configured
+// response that matches, the StandaloneSelect answer for SELECT and SHOW
+// statements, or an empty OK.
+func (c *Connection) standaloneAnswer(q *Query) ([]byte, error) {
+	for _, r := range c.server.cfg.StandaloneResponses {
+		if r.Match.MatchString(q.SQL) {
+			return NewOKPacket(r.AffectedRows, r.LastInsertID, 0), nil
+		}
+	}
+	sel := c.server.cfg.StandaloneSelect
+	if q.Type == StmtSelect || q.Type == StmtShow {
+		switch {
+		case sel.Error != nil:
+			return nil, sel.Error
+		case len(sel.Columns) > 0:
+			rs := &ResultSet{}
+			for _, col := range sel.Columns {
+				def, _ := col.columnDef()
+				rs.Columns = append(rs.Columns, def)
+			}
+			return nil, c.writeResultSet(rs)
+		}
+	}
+	return NewOKPacket(0, 0, 0), nil
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestStandaloneResponses(t *testing.T) {
+	srv := newTestServer(t, Config{StandaloneResponses: []StandaloneResponse{
+		{Match: regexp.MustCompile(`(?i)^INSERT INTO users\b`), AffectedRows: 1, LastInsertID: 42},
+		{Match: regexp.MustCompile(`(?i)^DELETE\b`), AffectedRows: 7},
+	}})
+	client := dialProxy(t, srv)
+
+	cases := []struct {
+		query          string
+		affected, last uint64
+	}{
+		{"INSERT INTO users (name) VALUES ('ann')", 1, 42},
+		{"delete from users", 7, 0},
+		{"UPDATE users SET name = 'bob'", 0, 0},
+	}
+	for _, c := range cases {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, c.query...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		pkt := mustReadPacket(t, client)
+		if pkt.Payload[0] != 0x00 {
+			t.Fatalf("%s: expected OK, got %x", c.query, pkt.Payload)
+		}
+		affected, n, _ := ReadLengthEncodedInt(pkt.Payload[1:])
+		last, _, _ := ReadLengthEncodedInt(pkt.Payload[1+n:])
+		if affected != c.affected || last != c.last {
+			t.Fatalf("%s: got affected=%d insert id=%d, want %d and %d", c.query, affected, last, c.affected, c.last)
+		}
+	}
+}
+
+func TestStandaloneInformationSchema(t *testing.T) {
+	srv := newTestServer(t, Config{StandaloneSchema: []SchemaTable{
+		{Database: "app", Name: "users", Columns: []SchemaColumn{
+			{Name: "id", Type: "bigint", NotNull: true},
+			{Name: "email", Type: "varchar(255)"},
+		}},
+		{Database: "app", Name: "orders", Columns: []SchemaColumn{{Name: "id", Type: "bigint", NotNull: true}}},
+		{Database: "audit", Name: "events"},
+	}})
+	client := dialProxy(t, srv)
+
+	cases := []struct {
+		query string
+		names []string
+		rows  [][]string
+	}{
+		{
+			"SELECT TABLE_NAME, table_type FROM information_schema.TABLES WHERE TABLE_SCHEMA = 'app' ORDER BY TABLE_NAME",
+			[]string{"TABLE_NAME", "table_type"},
+			[][]string{{"orders", "BASE TABLE"}, {"users", "BASE TABLE"}},
+		},
+		{
+			"select t.table_schema AS db, t.table_name name from INFORMATION_SCHEMA.tables t where t.table_schema in ('audit', 'missing')",
+			[]string{"db", "name"},
+			[][]string{{"audit", "events"}},
+		},
+		{
+			"SELECT COLUMN_NAME, ORDINAL_POSITION, IS_NULLABLE, DATA_TYPE, COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = 'app' AND TABLE_NAME = 'users' ORDER BY ORDINAL_POSITION DESC",
+			[]string{"COLUMN_NAME", "ORDINAL_POSITION", "IS_NULLABLE", "DATA_TYPE", "COLUMN_TYPE"},
+			[][]string{{"email", "2", "YES", "varchar", "varchar(255)"}, {"id", "1", "NO", "bigint", "bigint"}},
+		},
+		{
+			"SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()",
+			[]string{"TABLE_NAME"},
+			nil,
+		},
+	}
+	for _, c := range cases {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, c.query...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		names, rows := readTestResultSet(t, client)
+		if !reflect.DeepEqual(names, c.names) || !reflect.DeepEqual(rows, c.rows) {
+			t.Fatalf("%s:\ngot  %q %q\nwant %q %q", c.query, names, rows, c.names, c.rows)
+		}
+	}
+
+	// Shapes the proxy does not understand keep the plain OK.
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT COUNT(*) FROM information_schema.TABLES"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected OK, got %x", pkt.Payload)
+	}
+}
+
+func TestStandaloneSelect(t *testing.T) {
+	srv := newTestServer(t, Config{
+		StandaloneResponses: []StandaloneResponse{{Match: regexp.MustCompile(`(?i)^SELECT 1$`), AffectedRows: 1}},
+		StandaloneSelect: StandaloneSelect{Columns: []SchemaColumn{
+			{Name: "id", Type: "bigint", NotNull: true},
+			{Name: "name", Type: "varchar(255)"},
+		}},
+	})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SELECT id, name FROM users"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	pkt := mustReadPacket(t, client)
+	if count, _, _ := ReadLengthEncodedInt(pkt.Payload); count != 2 {
+		t.Fatalf("expected 2 columns, got %x", pkt.Payload)
+	}
+	id, err := parseColumnDef(mustReadPacket(t, client).Payload)
+	if err != nil {
+		t.Fatalf("parse column: %v", err)
+	}
+	if id.Name != "id" || id.Type != TypeLongLong || id.Flags&0x0001 == 0 {
+		t.Fatalf("got id column %+v", id)
+	}
+	name, err := parseColumnDef(mustReadPacket(t, client).Payload)
+	if err != nil {
+		t.Fatalf("parse column: %v", err)
+	}
+	if name.Name != "name" || name.Type != TypeVarString {
+		t.Fatalf("got name column %+v", name)
+	}
+	if pkt := mustReadPacket(t, client); !isEOFPacket(pkt.Payload) {
+		t.Fatalf("expected EOF after columns, got %x", pkt.Payload)
+	}
+	if pkt := mustReadPacket(t, client); !isEOFPacket(pkt.Payload) {
+		t.Fatalf("expected EOF with no rows, got %x", pkt.Payload)
+	}
+
+	// Configured responses and writes keep their OK.
+	for _, query := range []string{"SELECT 1", "UPDATE users SET name = 'bob'"} {
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, query...)); err != nil {
+			t.Fatalf("write query: %v", err)
+		}
+		if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+			t.Fatalf("%s: expected OK, got %x", query, pkt.Payload)
+		}
+	}
+
+	srv = newTestServer(t, Config{StandaloneSelect: StandaloneSelect{Error: &SQLError{Code: 1105, SQLState: "HY000", Message: "not mocked"}}})
+	client = dialProxy(t, srv)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SHOW TABLES"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0xFF || !bytes.Contains(pkt.Payload, []byte("not mocked")) {
+		t.Fatalf("expected the configured error, got %x", pkt.Payload)
+	}
+
+	if _, err := NewServer(Config{StandaloneSelect: StandaloneSelect{Columns: []SchemaColumn{{Name: "x", Type: "widget"}}}}); err == nil {
+		t.Fatalf("expected an unknown column type to be rejected")
+	}
+}
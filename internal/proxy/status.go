@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"metal-db-proxy/internal/buildinfo"
+)
+
+// proxyVariable returns the value of a read-only @@metal_* variable that the
+// proxy answers itself, or of a system variable the proxy enforces in its
+// stead.
+func (s *Server) proxyVariable(name string) (string, bool) {
+	info := buildinfo.Get()
+	name = strings.ToLower(name)
+	vars := s.proxySystemVariables()
+	if scope, rest, ok := strings.Cut(name, "."); ok && (scope == "global" || scope == "session" || scope == "local") {
+		v, ok := vars[rest]
+		return v, ok
+	}
+	if v, ok := vars[name]; ok {
+		return v, true
+	}
+	switch name {
+	case "metal_version":
+		return info.Version, true
+	case "metal_commit":
+		return info.Commit, true
+	case "metal_uptime":
+		return strconv.FormatInt(int64(s.Uptime().Seconds()), 10), true
+	case "metal_connections":
+		return strconv.FormatInt(s.Connections(), 10), true
+	}
+	return "", false
+}
+
+// proxySystemVariables are the MySQL system variables whose values come from
+// the proxy's configuration rather than the backend: the timeouts the proxy
+// enforces itself.
+func (s *Server) proxySystemVariables() map[string]string {
+	t := s.cfg.IdleTimeout
+	if t <= 0 {
+		return nil
+	}
+	secs := strconv.FormatInt(max(int64(t/time.Second), 1), 10)
+	return map[string]string{"wait_timeout": secs, "interactive_timeout": secs}
+}
+
+// proxyStatus lists the status variables the proxy reports for itself, in
+// SHOW STATUS order.
+func (s *Server) proxyStatus() [][]string {
+	info := buildinfo.Get()
+	return [][]string{
+		{"Metal_commit", info.Commit},
+		{"Metal_connections", strconv.FormatInt(s.Connections(), 10)},
+		{"Metal_version", info.Version},
+		{"Uptime", strconv.FormatInt(int64(s.Uptime().Seconds()), 10)},
+	}
+}
+
+// interceptStatus answers queries about the proxy itself without a backend:
+// a SELECT of only @@metal_* variables, and SHOW STATUS LIKE patterns without
+// a % wildcard that match the proxy's own status variables. It returns nil
+// for other queries.
+func (s *Server) interceptStatus(q *Query) *ResultSet {
+	switch q.Type {
+	case StmtSelect:
+		return s.selectProxyVariables(q.Tokens)
+	case StmtShow:
+		if rs := s.showProxyStatus(q.Tokens); rs != nil {
+			return rs
+		}
+		return s.showProxyVariables(q.Tokens)
+	}
+	return nil
+}
+
+func (s *Server) selectProxyVariables(toks []Token) *ResultSet {
+	if len(toks) < 2 || !toks[0].IsWord("SELECT") {
+		return nil
+	}
+	rs := &ResultSet{Rows: [][]string{nil}}
+	for i := 1; i < len(toks); i++ {
+		tok := toks[i]
+		if tok.Kind != TokenVariable || !strings.HasPrefix(tok.Text, "@@") {
+			return nil
+		}
+		value, ok := s.proxyVariable(strings.TrimPrefix(tok.Text, "@@"))
+		if !ok {
+			return nil
+		}
+		name := tok.Text
+		if i+2 < len(toks) && toks[i+1].IsWord("AS") {
+			name = toks[i+2].Value
+			i += 2
+		}
+		rs.Columns = append(rs.Columns, ColumnDef{Name: name})
+		rs.Rows[0] = append(rs.Rows[0], value)
+		if i+1 < len(toks) {
+			if !toks[i+1].IsPunct(",") {
+				return nil
+			}
+			i++
+		}
+	}
+	return rs
+}
+
+// showProxyStatus answers SHOW STATUS LIKE patterns that match the proxy's
+// own status variables. Patterns with a % wildcard may match status of the
+// backend too, and are left to forwardStatus unless there is no backend.
+func (s *Server) showProxyStatus(toks []Token) *ResultSet {
+	pattern, ok := showStatusPattern(toks)
+	if !ok || s.router != nil && strings.Contains(pattern, "%") {
+		return nil
+	}
+	rs := &ResultSet{Columns: []ColumnDef{{Name: "Variable_name"}, {Name: "Value"}}, Rows: s.proxyStatusLike(pattern)}
+	if len(rs.Rows) == 0 {
+		return nil
+	}
+	return rs
+}
+
+// showStatusPattern returns the pattern of SHOW [GLOBAL|SESSION] STATUS
+// LIKE 'pattern'.
+func showStatusPattern(toks []Token) (string, bool) {
+	if len(toks) > 0 && toks[0].IsWord("SHOW") {
+		toks = toks[1:]
+	}
+	if len(toks) > 0 && (toks[0].IsWord("GLOBAL") || toks[0].IsWord("SESSION")) {
+		toks = toks[1:]
+	}
+	if len(toks) != 3 || !toks[0].IsWord("STATUS") || !toks[1].IsWord("LIKE") || toks[2].Kind != TokenString {
+		return "", false
+	}
+	return toks[2].Value, true
+}
+
+// proxyStatusLike returns the proxy's status variables matching the LIKE
+// pattern.
+func (s *Server) proxyStatusLike(pattern string) [][]string {
+	like := likePattern(pattern)
+	var rows [][]string
+	for _, row := range s.proxyStatus() {
+		if like.MatchString(row[0]) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// forwardStatus runs SHOW STATUS LIKE on the backend and relays its rows
+// with the proxy's own status variables matching pattern merged in, in name
+// order. The proxy's value replaces the backend's for a variable both
+// report, such as Uptime.
+func (c *Connection) forwardStatus(payload []byte, pattern string) error {
+	bc, err := c.acquireBackend()
+	if err != nil {
+		return err
+	}
+	var backendRows [][]string
+	collect := rowRewriter(func(_ []ColumnDef, row [][]byte) [][]byte {
+		if len(row) == 2 {
+			backendRows = append(backendRows, []string{string(row[0]), string(row[1])})
+		}
+		return row
+	})
+	res, err := bc.execute(payload, func([]byte) error { return nil }, newRowPipeline(collect), c.capabilities)
+	c.dropPoisonedBackend(err)
+	if err != nil {
+		return err
+	}
+	if res.Err != nil {
+		return res.Err
+	}
+
+	rows := c.server.proxyStatusLike(pattern)
+	own := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		own[strings.ToLower(row[0])] = true
+	}
+	for _, row := range backendRows {
+		if !own[strings.ToLower(row[0])] {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return strings.ToLower(rows[i][0]) < strings.ToLower(rows[j][0]) })
+	return c.writeResultSet(&ResultSet{Columns: []ColumnDef{{Name: "Variable_name"}, {Name: "Value"}}, Rows: rows})
+}
+
+// showProxyVariables answers SHOW VARIABLES LIKE for the proxy's system
+// variables. Patterns with a % wildcard may match variables of the backend
+// too, and are left to it.
+func (s *Server) showProxyVariables(toks []Token) *ResultSet {
+	if len(toks) > 0 && toks[0].IsWord("SHOW") {
+		toks = toks[1:]
+	}
+	if len(toks) > 0 && (toks[0].IsWord("GLOBAL") || toks[0].IsWord("SESSION")) {
+		toks = toks[1:]
+	}
+	if len(toks) != 3 || !toks[0].IsWord("VARIABLES") || !toks[1].IsWord("LIKE") || toks[2].Kind != TokenString ||
+		strings.Contains(toks[2].Value, "%") {
+		return nil
+	}
+	like := likePattern(toks[2].Value)
+
+	rs := &ResultSet{Columns: []ColumnDef{{Name: "Variable_name"}, {Name: "Value"}}}
+	vars := s.proxySystemVariables()
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if like.MatchString(name) {
+			rs.Rows = append(rs.Rows, []string{name, vars[name]})
+		}
+	}
+	if len(rs.Rows) == 0 {
+		return nil
+	}
+	return rs
+}
+
+// likePattern compiles a SQL LIKE pattern into a case-insensitive regexp.
+func likePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; {
+		case ch == '%':
+			b.WriteString(".*")
+		case ch == '_':
+			b.WriteString(".")
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
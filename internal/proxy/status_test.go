@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"metal-db-proxy/internal/buildinfo"
+)
+
+func TestSelectProxyVersion(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	client := dialProxy(t, srv)
+
+	query := func(q string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %q: %v", q, err)
+		}
+	}
+
+	query("SELECT @@metal_version, @@metal_commit AS commit")
+	names, rows := readTestResultSet(t, client)
+	info := buildinfo.Get()
+	if !reflect.DeepEqual(names, []string{"@@metal_version", "commit"}) {
+		t.Fatalf("columns = %q", names)
+	}
+	if !reflect.DeepEqual(rows, [][]string{{info.Version, info.Commit}}) {
+		t.Fatalf("rows = %q, want version %q commit %q", rows, info.Version, info.Commit)
+	}
+
+	query("SHOW STATUS LIKE 'uptime'")
+	names, rows = readTestResultSet(t, client)
+	if len(rows) != 1 || rows[0][0] != "Uptime" || len(names) != 2 {
+		t.Fatalf("SHOW STATUS LIKE 'uptime' = %q %q", names, rows)
+	}
+
+	if n := fb.queries.Load(); n != 0 {
+		t.Fatalf("proxy status queries reached the backend %d times", n)
+	}
+
+	// Status the proxy does not own still comes from the backend.
+	query("SHOW STATUS LIKE 'Innodb%'")
+	readTestResultSet(t, client)
+	query("SELECT @@version")
+	mustReadPacket(t, client)
+	if n := fb.queries.Load(); n != 2 {
+		t.Fatalf("backend saw %d queries, want 2", n)
+	}
+}
+
+func TestShowStatusMergesBackendStatus(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		writeTestResultSet(conn, &ResultSet{
+			Columns: []ColumnDef{{Name: "Variable_name"}, {Name: "Value"}},
+			Rows:    [][]string{{"Aborted_clients", "3"}, {"Threads_connected", "7"}, {"Uptime", "999999"}},
+		})
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}})
+	client := dialProxy(t, srv)
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "SHOW GLOBAL STATUS LIKE '%'"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	_, rows := readTestResultSet(t, client)
+	var names []string
+	for _, row := range rows {
+		names = append(names, row[0])
+		if row[0] == "Uptime" && row[1] == "999999" {
+			t.Fatalf("backend uptime was relayed instead of the proxy's")
+		}
+	}
+	want := []string{"Aborted_clients", "Metal_commit", "Metal_connections", "Metal_version", "Threads_connected", "Uptime"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("status variables %q, want %q", names, want)
+	}
+	if n := fb.queries.Load(); n != 1 {
+		t.Fatalf("backend saw %d queries, want 1", n)
+	}
+}
+
+func TestIdleTimeoutVariables(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, IdleTimeout: 90 * time.Second})
+	client := dialProxy(t, srv)
+
+	query := func(q string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %q: %v", q, err)
+		}
+	}
+
+	query("SELECT @@wait_timeout, @@session.interactive_timeout")
+	names, rows := readTestResultSet(t, client)
+	if !reflect.DeepEqual(names, []string{"@@wait_timeout", "@@session.interactive_timeout"}) || !reflect.DeepEqual(rows, [][]string{{"90", "90"}}) {
+		t.Fatalf("got %q %q", names, rows)
+	}
+	query("SHOW GLOBAL VARIABLES LIKE 'wait_timeout'")
+	names, rows = readTestResultSet(t, client)
+	if len(names) != 2 || !reflect.DeepEqual(rows, [][]string{{"wait_timeout", "90"}}) {
+		t.Fatalf("SHOW VARIABLES LIKE 'wait_timeout' = %q %q", names, rows)
+	}
+	if n := fb.queries.Load(); n != 0 {
+		t.Fatalf("timeout queries reached the backend %d times", n)
+	}
+
+	// Patterns that may match the backend's other variables go to it.
+	query("SHOW VARIABLES LIKE '%timeout'")
+	mustReadPacket(t, client)
+	if n := fb.queries.Load(); n != 1 {
+		t.Fatalf("backend saw %d queries, want 1", n)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := newTestServer(t, Config{IdleTimeout: 100 * time.Millisecond})
+	client := dialProxy(t, srv)
+
+	pkt := mustReadPacket(t, client)
+	if pkt.Payload[0] != 0xFF || binary.LittleEndian.Uint16(pkt.Payload[1:]) != 4031 {
+		t.Fatalf("expected the inactivity error, got %x", pkt.Payload)
+	}
+	if _, err := ReadPacket(client); err == nil {
+		t.Fatalf("expected the idle connection to be closed")
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import "strings"
+
+// tagAssignment reports whether q sets the Config.TagVariable proxy
+// variable, as in SET @@proxy_tag = 'reporting-job-42', returning the tag it
+// assigns. NULL, DEFAULT and the empty string clear the tag. Statements
+// setting other variables alongside it are left to the backend.
+func (s *Server) tagAssignment(q *Query) (string, bool) {
+	name := s.cfg.TagVariable
+	toks := q.Tokens
+	if n := len(toks); n > 0 && toks[n-1].IsPunct(";") {
+		toks = toks[:n-1]
+	}
+	if name == "" || len(toks) != 4 || !toks[0].IsWord("SET") || toks[1].Kind != TokenVariable {
+		return "", false
+	}
+	variable := strings.ToLower(toks[1].Text)
+	for _, prefix := range []string{"@@session.", "@@local.", "@@"} {
+		if strings.HasPrefix(variable, prefix) {
+			variable = variable[len(prefix):]
+			break
+		}
+	}
+	if variable != strings.ToLower(name) || !toks[2].IsPunct("=") && !toks[2].IsPunct(":=") {
+		return "", false
+	}
+	switch value := toks[3]; {
+	case value.isLiteral():
+		return value.Value, true
+	case value.IsWord("NULL"), value.IsWord("DEFAULT"):
+		return "", true
+	}
+	return "", false
+}
+
+// setTag labels the connection with tag in the registry and its logs.
+func (c *Connection) setTag(tag string) {
+	c.mu.Lock()
+	c.tag = tag
+	c.mu.Unlock()
+	c.logger = c.logger.WithField("tag", tag)
+	c.logger.Info("connection tagged")
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnectionTag(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, TagVariable: "proxy_tag"})
+	client := dialProxy(t, srv)
+
+	query := func(q string) {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %s: %v", q, err)
+		}
+		if p := mustReadPacket(t, client).Payload; p[0] != 0x00 {
+			t.Fatalf("%s: expected OK, got %x", q, p)
+		}
+	}
+	tag := func() string {
+		t.Helper()
+		conns := srv.ConnectionList()
+		if len(conns) != 1 {
+			t.Fatalf("%d connections registered", len(conns))
+		}
+		return conns[0].Tag
+	}
+
+	query("SET @@proxy_tag = 'reporting-job-42'")
+	if got := tag(); got != "reporting-job-42" {
+		t.Fatalf("tag = %q", got)
+	}
+	query("set @@SESSION.Proxy_Tag := \"nightly\";")
+	if got := tag(); got != "nightly" {
+		t.Fatalf("tag = %q", got)
+	}
+	query("SET @@proxy_tag = NULL")
+	if got := tag(); got != "" {
+		t.Fatalf("tag = %q after clearing it", got)
+	}
+	if n := fb.queries.Load(); n != 0 {
+		t.Fatalf("backend received %d tag assignments", n)
+	}
+
+	// Other variables, alone or alongside the tag, are the backend's.
+	query("SET @@proxy_tag = 'a', @@autocommit = 1")
+	query("SET @@sql_mode = 'ANSI'")
+	if n := fb.queries.Load(); n != 2 || tag() != "" {
+		t.Fatalf("backend received %d queries, tag %q", n, tag())
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// SessionContext describes the client session a query runs in, for hooks
+// such as Config.QueryRewriter.
+type SessionContext struct {
+	User     string
+	Database string
+	// Tenant is derived from the user name by Config.TenantPattern; it is
+	// empty for clients without one.
+	Tenant string
+}
+
+// errNoTenant is returned for commands from a client without a tenant when
+// Config.RequireTenant is set.
+var errNoTenant = &SQLError{Code: 1227, SQLState: "42000", Message: "Access denied; no tenant context is established for this connection"}
+
+// compileTenantPattern compiles Config.TenantPattern, which must have a
+// submatch for the tenant.
+func compileTenantPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("tenant pattern: %w", err)
+	}
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("tenant pattern %q has no group capturing the tenant", pattern)
+	}
+	return re, nil
+}
+
+// tenantOf returns the tenant of user: the submatch named tenant, or else
+// the first one, of the tenant pattern.
+func (s *Server) tenantOf(user string) string {
+	if s.tenantRE == nil {
+		return ""
+	}
+	m := s.tenantRE.FindStringSubmatch(user)
+	if m == nil {
+		return ""
+	}
+	if i := s.tenantRE.SubexpIndex("tenant"); i > 0 {
+		return m[i]
+	}
+	return m[1]
+}
+
+// sessionContext returns the context the client's next query runs in.
+func (c *Connection) sessionContext() SessionContext {
+	return SessionContext{User: c.username, Database: c.database, Tenant: c.tenant}
+}
+
+// checkTenant rejects the command of a client without a tenant when one is
+// required.
+func (c *Connection) checkTenant() error {
+	if c.server.cfg.RequireTenant && c.tenant == "" {
+		return errNoTenant
+	}
+	return nil
+}
+
+// rewriteQuery applies Config.QueryRewriter to a query from the client.
+func (c *Connection) rewriteQuery(query string) string {
+	if c.server.cfg.QueryRewriter == nil {
+		return query
+	}
+	return c.server.cfg.QueryRewriter(c.sessionContext(), query)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestTenantContext(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	var sessions []SessionContext
+	shared := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	acme := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		mu.Lock()
+		received = append(received, string(payload[1:]))
+		mu.Unlock()
+		if payload[0] == COM_STMT_PREPARE {
+			WritePacket(conn, 1, []byte{0x00, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	sharedCfg, acmeCfg := shared.config(), acme.config()
+	sharedCfg.Name, acmeCfg.Name = "shared", "acme-db"
+	srv := newTestServer(t, Config{
+		Backends:      []BackendConfig{sharedCfg, acmeCfg},
+		TenantRoutes:  map[string]string{"acme": "acme-db"},
+		TenantPattern: `^(?P<tenant>[^.]+)\.`,
+		RequireTenant: true,
+		QueryRewriter: func(s SessionContext, query string) string {
+			mu.Lock()
+			sessions = append(sessions, s)
+			mu.Unlock()
+			return query + " /* tenant=" + s.Tenant + " */"
+		},
+	})
+
+	client := dialProxyAs(t, srv, "acme.reports")
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DELETE FROM orders"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if p := mustReadPacket(t, client).Payload; p[0] != 0x00 {
+		t.Fatalf("expected OK, got %x", p)
+	}
+	mu.Lock()
+	if len(sessions) != 1 || sessions[0] != (SessionContext{User: "acme.reports", Tenant: "acme"}) {
+		t.Fatalf("rewriter saw sessions %+v", sessions)
+	}
+	if len(received) != 1 || received[0] != "DELETE FROM orders /* tenant=acme */" {
+		t.Fatalf("tenant backend received %q", received)
+	}
+	mu.Unlock()
+
+	// The tenant's backend serves its hinted queries and prepared
+	// statements, and queries fail rather than leave it while it drains.
+	for _, cmd := range [][]byte{
+		append([]byte{COM_QUERY}, "SELECT /*+ backend=shared */ 1"...),
+		append([]byte{COM_STMT_PREPARE}, "SELECT ?"...),
+	} {
+		if err := WritePacket(client, 0, cmd); err != nil {
+			t.Fatalf("write command: %v", err)
+		}
+		if p := mustReadPacket(t, client).Payload; p[0] != 0x00 {
+			t.Fatalf("expected OK, got %x", p)
+		}
+	}
+	srv.router.Drain("acme-db", true)
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if sqlErr, err := ParseErrPacket(mustReadPacket(t, client).Payload); err != nil || sqlErr.Code != 1053 {
+		t.Fatalf("query while the tenant's backend drains: got %v, %v, want error 1053", sqlErr, err)
+	}
+	mu.Lock()
+	if len(received) != 3 || received[2] != "SELECT ? /* tenant=acme */" {
+		t.Fatalf("tenant backend received %q", received)
+	}
+	mu.Unlock()
+	if shared.queries.Load() != 0 {
+		t.Fatalf("a tenant's query reached the shared backend")
+	}
+	srv.router.Drain("acme-db", false)
+
+	// A user name without a tenant establishes no context.
+	mu.Lock()
+	rewritten := len(sessions)
+	mu.Unlock()
+	client = dialProxyAs(t, srv, "root")
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DELETE FROM orders"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	sqlErr, err := ParseErrPacket(mustReadPacket(t, client).Payload)
+	if err != nil || sqlErr.Code != 1227 {
+		t.Fatalf("got %v, %v, want error 1227", sqlErr, err)
+	}
+	if shared.queries.Load() != 0 || len(sessions) != rewritten {
+		t.Fatalf("query without a tenant reached the rewriter or a backend")
+	}
+
+	if _, err := NewServer(Config{TenantPattern: `^[^.]+\.`}); err == nil {
+		t.Fatalf("accepted a tenant pattern without a group")
+	}
+}
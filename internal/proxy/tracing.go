@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the proxy's instrumentation in exported spans.
+const tracerName = "metal-db-proxy"
+
+// startSpan starts the span of a client query, or returns nil when tracing
+// is off. A trace context the application put in a sqlcommenter comment,
+// such as /*traceparent='00-...-01'*/, becomes the span's parent so the
+// query joins the application's trace.
+func (c *Connection) startSpan(q *Query) trace.Span {
+	if c.server.tracer == nil {
+		return nil
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier(q.Tags()))
+	name := strings.ToUpper(string(q.Type))
+	_, span := c.server.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.statement", q.Normalized()),
+			attribute.String("db.name", c.database),
+			attribute.String("db.user", c.username),
+		))
+	return span
+}
+
+// endSpan finishes a span from startSpan.
+func (c *Connection) endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if c.backend != nil {
+		span.SetAttributes(attribute.String("server.address", c.backend.Backend().Addr()))
+	}
+	if c.result != nil {
+		span.SetAttributes(attribute.Int64("db.rows", int64(c.result.Rows)))
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
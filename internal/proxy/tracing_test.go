@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestQuerySpans(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(2, 0, 0))
+	})
+	rec := tracetest.NewSpanRecorder()
+	srv := newTestServer(t, Config{
+		Backends:       []BackendConfig{fb.config()},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)),
+	})
+	client := dialProxy(t, srv)
+
+	query := "UPDATE t SET a = 1 WHERE id = 7 /*traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'*/"
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, query...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	mustReadPacket(t, client)
+
+	var spans []sdktrace.ReadOnlySpan
+	for deadline := time.Now().Add(time.Second); len(spans) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		spans = rec.Ended()
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "UPDATE" {
+		t.Fatalf("span name %q", span.Name())
+	}
+	if got := span.Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("span not joined to the application's trace: parent trace %s", got)
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["db.statement"].AsString() != "UPDATE t SET a = ? WHERE id = ?" ||
+		attrs["server.address"].AsString() != fb.config().Addr ||
+		attrs["db.rows"].AsInt64() != 2 {
+		t.Fatalf("unexpected attributes %v", span.Attributes())
+	}
+}
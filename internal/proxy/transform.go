@@ -0,0 +1,94 @@
+package proxy
+
+// RowTransformer rewrites a result set relayed from a backend as it streams
+// to the client: each column definition and each row is transformed as it
+// is read and forwarded before the next is read, so results are never
+// buffered and a slow client holds back the backend.
+type RowTransformer interface {
+	// TransformColumn may change a column definition in place, reporting
+	// whether it did.
+	TransformColumn(col *ColumnDef) bool
+	// TransformRow rewrites the values of one text-protocol row, whose
+	// column definitions are as TransformColumn left them. NULL values are
+	// nil.
+	TransformRow(columns []ColumnDef, row [][]byte) [][]byte
+}
+
+// rowRewriter rewrites the values of one relayed text-protocol row. NULL
+// values are nil.
+type rowRewriter func(columns []ColumnDef, row [][]byte) [][]byte
+
+func (f rowRewriter) TransformColumn(*ColumnDef) bool { return false }
+
+func (f rowRewriter) TransformRow(columns []ColumnDef, row [][]byte) [][]byte {
+	return f(columns, row)
+}
+
+// columnRewriter changes a relayed column definition in place, reporting
+// whether it did.
+type columnRewriter func(col *ColumnDef) bool
+
+func (f columnRewriter) TransformColumn(col *ColumnDef) bool { return f(col) }
+
+func (f columnRewriter) TransformRow(_ []ColumnDef, row [][]byte) [][]byte { return row }
+
+// rowPipeline applies its stages in order to every column definition and
+// row of a relayed result set.
+type rowPipeline struct {
+	stages []RowTransformer
+	// rows is set when a stage may rewrite rows. Pipelines of columnRewriters
+	// alone leave rows as the backend sent them, so they can relay binary
+	// rows and result sets without column definitions.
+	rows bool
+}
+
+// newRowPipeline returns the pipeline of stages, skipping those that are
+// nil.
+func newRowPipeline(stages ...RowTransformer) *rowPipeline {
+	p := &rowPipeline{}
+	for _, t := range stages {
+		p.then(t)
+	}
+	return p
+}
+
+// then appends t to the pipeline, unless it is nil.
+func (p *rowPipeline) then(t RowTransformer) {
+	switch t := t.(type) {
+	case nil:
+		return
+	case columnRewriter:
+	case *rowPipeline:
+		p.rows = p.rows || t.rows
+	default:
+		p.rows = true
+	}
+	p.stages = append(p.stages, t)
+}
+
+// empty reports whether p transforms nothing; it may be nil.
+func (p *rowPipeline) empty() bool {
+	return p == nil || len(p.stages) == 0
+}
+
+// rewritesRows reports whether p may rewrite rows; it may be nil.
+func (p *rowPipeline) rewritesRows() bool {
+	return p != nil && p.rows
+}
+
+func (p *rowPipeline) TransformColumn(col *ColumnDef) bool {
+	changed := false
+	for _, t := range p.stages {
+		if t.TransformColumn(col) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (p *rowPipeline) TransformRow(columns []ColumnDef, row [][]byte) [][]byte {
+	for _, t := range p.stages {
+		row = t.TransformRow(columns, row)
+	}
+	return row
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRowPipeline(t *testing.T) {
+	// The backend sends the second row only once the first has reached the
+	// client, which it cannot if the relay buffers the result set.
+	relayed := make(chan struct{})
+	rs := &ResultSet{
+		Columns: []ColumnDef{{Name: "id", Type: TypeLongLong}, {Name: "email"}},
+		Rows:    [][]string{{"1", "ann@example.com"}, {"2", "bob@example.com"}},
+	}
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		packets := rs.Packets()
+		for i, p := range packets {
+			if i == len(packets)-2 {
+				select {
+				case <-relayed:
+				case <-time.After(5 * time.Second):
+					conn.Close()
+					return
+				}
+			}
+			WritePacket(conn, uint8(i+1), p)
+		}
+	})
+	bc, err := NewBackend(fb.config()).dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer bc.Close()
+
+	retype := columnRewriter(func(col *ColumnDef) bool {
+		if col.Type != TypeLongLong {
+			return false
+		}
+		col.Type = TypeLong
+		return true
+	})
+	mask := rowRewriter(func(columns []ColumnDef, row [][]byte) [][]byte {
+		row[1] = bytes.Repeat([]byte("*"), len(row[1]))
+		return row
+	})
+	tag := rowRewriter(func(columns []ColumnDef, row [][]byte) [][]byte {
+		// Runs after mask, on the masked value, and sees the new type.
+		if columns[0].Type == TypeLong {
+			row[1] = append(row[1][:3], "@"+string(row[0])...)
+		}
+		return row
+	})
+	p := newRowPipeline(retype, nil, newRowPipeline(mask, tag))
+	if !p.rewritesRows() {
+		t.Fatalf("expected the pipeline to rewrite rows")
+	}
+
+	var types []byte
+	var rows [][]string
+	forward := func(pkt []byte) error {
+		switch {
+		case len(types) < len(rs.Columns) && pkt[0] == 0x03:
+			col, err := parseColumnDef(pkt)
+			if err != nil {
+				return err
+			}
+			types = append(types, col.Type)
+		case len(types) == len(rs.Columns) && !isEOFPacket(pkt):
+			row, err := parseTextRow(pkt, len(rs.Columns))
+			if err != nil {
+				return err
+			}
+			rows = append(rows, []string{string(row[0]), string(row[1])})
+			if len(rows) == 1 {
+				close(relayed)
+			}
+		}
+		return nil
+	}
+	res, err := bc.execute(append([]byte{COM_QUERY}, "SELECT id, email FROM users"...), forward, p, 0)
+	if err != nil || res.Err != nil {
+		t.Fatalf("execute: %v %v", err, res)
+	}
+	if want := []byte{TypeLong, TypeVarString}; !bytes.Equal(types, want) {
+		t.Fatalf("got column types %v, want %v", types, want)
+	}
+	if want := [][]string{{"1", "***@1"}, {"2", "***@2"}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got rows %q, want %q", rows, want)
+	}
+}
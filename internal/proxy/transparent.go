@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// transparentCapabilities are cleared from a relayed backend greeting: the
+// proxy must be able to read the client's traffic, which rules out TLS and
+// compression, and relays result sets in the EOF-terminated format.
+const transparentCapabilities = capSSL | capCompress | capDeprecateEOF | capQueryAttributes
+
+// transparentHandshake authenticates the client directly against the default
+// backend instead of the proxy. The backend's greeting, scramble included,
+// is relayed to the client and the authentication exchange is relayed back
+// until the backend accepts or rejects the client. On success the
+// authenticated connection is held as the client's dedicated backend.
+func (c *Connection) transparentHandshake() (*HandshakeResponse, error) {
+	b := c.server.router.Route("")
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.DialTimeout)
+	defer cancel()
+	conn, err := b.dialTCP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hs, threadID, err := relayAuth(c.conn, conn, b.cfg.DialTimeout, transparentCapabilities|c.server.withheldCapabilities(c.conn.RemoteAddr()))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.backend = &BackendConn{
+		backend:   b,
+		conn:      conn,
+		threadID:  threadID,
+		database:  hs.Database,
+		lastUsed:  time.Now(),
+		dedicated: true,
+		// The client negotiated its capabilities with the backend itself.
+		optionalMetadata: hs.Capabilities&capOptionalMetadata != 0,
+		sessionTrack:     hs.Capabilities&capSessionTrack != 0,
+	}
+	return hs, nil
+}
+
+// relayAuth relays a connection handshake between client and backend,
+// with the capabilities in withheld cleared from the greeting, returning the
+// client's handshake response and the backend thread id.
+func relayAuth(client, backend net.Conn, greetingTimeout time.Duration, withheld uint32) (*HandshakeResponse, uint32, error) {
+	backend.SetReadDeadline(time.Now().Add(greetingTimeout))
+	pkt, err := ReadPacket(backend)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read backend greeting: %w", err)
+	}
+	backend.SetReadDeadline(time.Time{})
+	greeting, err := parseServerGreeting(pkt.Payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	payload, err := maskGreetingCapabilities(pkt.Payload, withheld)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := WritePacket(client, pkt.Sequence, payload); err != nil {
+		return nil, 0, err
+	}
+
+	pkt, err = ReadPacket(client)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read handshake: %w", err)
+	}
+	if isSSLRequest(pkt.Payload) {
+		return nil, 0, rejectSSLRequest(client, pkt.Sequence+1)
+	}
+	hs, _, err := parseHandshakeResponse(pkt.Payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := WritePacket(backend, pkt.Sequence, pkt.Payload); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		pkt, err := ReadPacket(backend)
+		if err != nil {
+			return nil, 0, fmt.Errorf("read auth result: %w", err)
+		}
+		if len(pkt.Payload) == 0 {
+			return nil, 0, ErrInvalidPacket
+		}
+		if err := WritePacket(client, pkt.Sequence, pkt.Payload); err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case pkt.Payload[0] == 0x00:
+			return hs, greeting.ConnectionID, nil
+		case pkt.Payload[0] == 0xFF:
+			return nil, 0, ErrAuthFailed
+		case len(pkt.Payload) == 2 && pkt.Payload[0] == 0x01 && pkt.Payload[1] == 0x03:
+			// caching_sha2_password fast auth succeeded; the OK follows.
+			continue
+		}
+		// An auth switch or more auth data: the client answers next.
+		reply, err := ReadPacket(client)
+		if err != nil {
+			return nil, 0, fmt.Errorf("read auth response: %w", err)
+		}
+		if err := WritePacket(backend, reply.Sequence, reply.Payload); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// maskGreetingCapabilities returns a copy of a HandshakeV10 payload with the
+// capability bits in mask cleared.
+func maskGreetingCapabilities(payload []byte, mask uint32) ([]byte, error) {
+	_, n, err := ReadNullTerminatedString(payload[1:])
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	low := 1 + n + 4 + 8 + 1 // version, thread id, scramble part 1, filler
+	if len(payload) < low+2 {
+		return nil, ErrInvalidHandshake
+	}
+	out := append([]byte(nil), payload...)
+	caps := binary.LittleEndian.Uint16(out[low:]) &^ uint16(mask)
+	binary.LittleEndian.PutUint16(out[low:], caps)
+
+	high := low + 2 + 1 + 2 // charset, status flags
+	if len(out) >= high+2 {
+		caps := binary.LittleEndian.Uint16(out[high:]) &^ uint16(mask>>16)
+		binary.LittleEndian.PutUint16(out[high:], caps)
+	}
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransparentAuthRelaysBackendHandshake(t *testing.T) {
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		WritePacket(conn, 1, NewOKPacket(0, 0, 0))
+	})
+	srv := newTestServer(t, Config{Backends: []BackendConfig{fb.config()}, TransparentAuth: true})
+
+	connect := func(password string) (net.Conn, *serverGreeting, error) {
+		client, server := net.Pipe()
+		go srv.Handle(server)
+		t.Cleanup(func() { client.Close() })
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		greeting, err := clientHandshake(client, "app", password, "")
+		return client, greeting, err
+	}
+
+	client, greeting, err := connect("password")
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	// The greeting is the backend's own: its thread id is the fake's count
+	// of accepted connections (the health check's, then the client's).
+	if greeting.ConnectionID != 2 || fb.accepted.Load() != 2 {
+		t.Fatalf("greeting thread id %d, backend accepted %d; want the backend's greeting", greeting.ConnectionID, fb.accepted.Load())
+	}
+	if greeting.Capabilities&transparentCapabilities != 0 {
+		t.Fatalf("relayed greeting advertises unsupported capabilities %#x", greeting.Capabilities)
+	}
+
+	if err := WritePacket(client, 0, append([]byte{COM_QUERY}, "DO 1"...)); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	if pkt := mustReadPacket(t, client); pkt.Payload[0] != 0x00 {
+		t.Fatalf("expected OK, got %x", pkt.Payload)
+	}
+	if fb.accepted.Load() != 2 {
+		t.Fatalf("query used a new backend connection instead of the authenticated one")
+	}
+
+	// The dedicated connection is closed, not pooled, when the client leaves.
+	WritePacket(client, 0, []byte{COM_QUIT})
+	time.Sleep(50 * time.Millisecond)
+	if idle := srv.router.Route("").Pool().Idle(); idle != 1 {
+		t.Fatalf("pool holds %d idle connections, want only the health check's", idle)
+	}
+
+	_, _, err = connect("wrong")
+	var sqlErr *SQLError
+	if !errors.As(err, &sqlErr) || sqlErr.Code != 1045 {
+		t.Fatalf("expected the backend's access denied error, got %v", err)
+	}
+}
+
+func TestTransparentAuthRejectsBackendTLS(t *testing.T) {
+	cfg := BackendConfig{Addr: "127.0.0.1:1", TLS: &BackendTLSConfig{Verify: TLSSkipVerify}}
+	if _, err := NewServer(Config{Backends: []BackendConfig{cfg}, TransparentAuth: true}); err == nil {
+		t.Fatalf("expected transparent auth over a TLS backend to be refused")
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"metal-db-proxy/internal/metrics"
+)
+
+// transactionBudget returns the longest a transaction of the client may stay
+// open, or zero for no limit.
+func (c *Connection) transactionBudget() time.Duration {
+	c.mu.Lock()
+	user := c.username
+	c.mu.Unlock()
+	if budget, ok := c.server.cfg.UserMaxTransactionTime[user]; ok {
+		return budget
+	}
+	return c.server.cfg.MaxTransactionTime
+}
+
+// checkTransactionBudget is called before each statement. Once the client's
+// open transaction has outlived its budget, it is rolled back, the backend
+// connection released and an error returned in place of the statement.
+// Dedicated connections cannot be replaced, so they are kept unless the
+// rollback failed.
+func (c *Connection) checkTransactionBudget() error {
+	if !c.inTransaction || c.backend == nil {
+		return nil
+	}
+	budget := c.transactionBudget()
+	elapsed := time.Since(c.txStarted)
+	if budget <= 0 || elapsed <= budget {
+		return nil
+	}
+	metrics.TransactionsAborted.Inc()
+	log := c.logger.WithField("backend", c.backend.Backend().Name()).WithField("elapsed", elapsed.Round(time.Millisecond)).WithField("budget", budget)
+	if err := c.backend.Query("ROLLBACK"); err != nil {
+		// The connection is closed rather than pooled in an open
+		// transaction.
+		log.WithError(err).Warn("failed to roll back transaction over its time budget")
+		c.backend.poison("rollback_failed")
+	} else {
+		log.Warn("rolled back transaction over its time budget")
+	}
+	c.endTransaction()
+	if !c.backend.dedicated || c.backend.Poisoned() {
+		c.releaseBackend()
+	}
+	return &SQLError{Code: 1205, SQLState: "HY000", Message: fmt.Sprintf("Transaction exceeded its time budget of %s and was rolled back; try restarting transaction", budget)}
+}
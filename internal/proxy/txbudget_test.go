@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransactionBudget(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	fb := newFakeBackend(t, func(conn net.Conn, payload []byte) {
+		query := string(payload[1:])
+		mu.Lock()
+		received = append(received, query)
+		mu.Unlock()
+		status := serverStatusInTrans
+		if query == "COMMIT" || query == "ROLLBACK" {
+			status = 0
+		}
+		WritePacket(conn, 1, NewOKPacket(0, 0, status))
+	})
+	srv := newTestServer(t, Config{
+		Backends:               []BackendConfig{fb.config()},
+		UserMaxTransactionTime: map[string]time.Duration{"app": 50 * time.Millisecond},
+	})
+
+	query := func(client net.Conn, q string) *SQLError {
+		t.Helper()
+		if err := WritePacket(client, 0, append([]byte{COM_QUERY}, q...)); err != nil {
+			t.Fatalf("write %s: %v", q, err)
+		}
+		pkt := mustReadPacket(t, client)
+		if pkt.Payload[0] != 0xFF {
+			return nil
+		}
+		sqlErr, err := ParseErrPacket(pkt.Payload)
+		if err != nil {
+			t.Fatalf("parse ERR: %v", err)
+		}
+		return sqlErr
+	}
+
+	for _, user := range []string{"app", "batch"} {
+		client := dialProxyAs(t, srv, user)
+		query(client, "BEGIN")
+		query(client, "UPDATE t SET x = 1")
+		time.Sleep(100 * time.Millisecond)
+		sqlErr := query(client, "UPDATE t SET x = 2")
+		if user == "batch" {
+			// No budget applies to this user.
+			if sqlErr != nil {
+				t.Fatalf("transaction of %s aborted: %v", user, sqlErr)
+			}
+			query(client, "COMMIT")
+			continue
+		}
+		if sqlErr == nil || sqlErr.Code != 1205 || !strings.Contains(sqlErr.Message, "rolled back") {
+			t.Fatalf("statement over the budget: got %v, want error 1205", sqlErr)
+		}
+		if sqlErr := query(client, "SELECT 1"); sqlErr != nil {
+			t.Fatalf("statement after the abort failed: %v", sqlErr)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"BEGIN", "UPDATE t SET x = 1", "ROLLBACK", "SELECT 1",
+		"BEGIN", "UPDATE t SET x = 1", "UPDATE t SET x = 2", "COMMIT",
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Fatalf("backend received %q, want %q", received, want)
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// UserFile is an AuthProvider for the users listed in a file, one
+// user:hash line each. The hash is the hex mysql_native_password hash of
+// the user's password, SHA1(SHA1(password)), optionally prefixed with '*'
+// as in MySQL's mysql.user table, so no plaintext password is kept. Blank
+// lines and lines starting with # are ignored.
+type UserFile map[string][]byte
+
+// LoadUserFile reads a users file.
+func LoadUserFile(path string) (UserFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := UserFile{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// User names may contain colons; hashes do not.
+		i := strings.LastIndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		hash, err := hex.DecodeString(strings.TrimPrefix(text[i+1:], "*"))
+		if err != nil || len(hash) != 20 {
+			return nil, fmt.Errorf("%s:%d: hash of user %s is not 40 hex digits", path, line, text[:i])
+		}
+		users[text[:i]] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (f UserFile) PasswordHash(ctx context.Context, user string) ([]byte, error) {
+	hash, ok := f[user]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return hash, nil
+}